@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"p83.nl/go/ekster/pkg/admin"
+	"p83.nl/go/ekster/pkg/client"
+)
+
+// performAdminCommands runs the "ek admin" commands against the admin API of
+// the server of the Microsub endpoint
+func performAdminCommands(c *client.Client, commands []string) {
+	if len(commands) == 0 {
+		usageFatal()
+	}
+
+	endpoint, err := c.MicrosubEndpoint.Parse("/admin/")
+	if err != nil {
+		log.Fatal(err)
+	}
+	ac := &admin.Client{Endpoint: endpoint, Token: c.Token}
+
+	args := url.Values{}
+	arg := func(i int, name string) {
+		if len(commands) > i {
+			args.Set(name, commands[i])
+		}
+	}
+
+	switch commands[0] {
+	case "refresh":
+		if len(commands) < 2 {
+			usageFatal()
+		}
+		user := ""
+		if len(commands) > 2 {
+			user = commands[2]
+		}
+		res, err := ac.RefreshFeed(commands[1], user)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		for _, feed := range res.Feeds {
+			if feed.Error != "" {
+				fmt.Printf("%-20s %-20s error: %s\n", feed.User, feed.Channel, feed.Error)
+			} else {
+				fmt.Printf("%-20s %-20s refreshed\n", feed.User, feed.Channel)
+			}
+		}
+	case "resubscribe":
+		arg(1, "url")
+		startAdminJob(ac, "websub/resubscribe", args)
+	case "rebuild-unread":
+		arg(1, "user")
+		arg(2, "channel")
+		startAdminJob(ac, "unread/rebuild", args)
+	case "clear-cache":
+		startAdminJob(ac, "cache/clear", nil)
+	case "reindex":
+		startAdminJob(ac, "feeds/reindex", nil)
+	case "jobs":
+		jobs, err := ac.Jobs()
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		for _, job := range jobs {
+			showJob(job)
+		}
+	case "job":
+		if len(commands) != 2 {
+			usageFatal()
+		}
+		job, err := ac.Job(commands[1])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		showJob(job)
+	case "cancel":
+		if len(commands) != 2 {
+			usageFatal()
+		}
+		job, err := ac.CancelJob(commands[1])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		fmt.Printf("Job %s cancelled\n", job.ID)
+	default:
+		usageFatal()
+	}
+}
+
+// startAdminJob starts a job and shows its progress until it's finished
+func startAdminJob(ac *admin.Client, path string, args url.Values) {
+	job, err := ac.StartJob(path, args)
+	if err != nil {
+		log.Fatalf("An error occurred: %s\n", err)
+	}
+	fmt.Printf("Job %s started\n", job.ID)
+
+	job, err = ac.Wait(job.ID, time.Second, func(job admin.Job) {
+		if !job.IsFinished() && job.Total > 0 {
+			fmt.Printf("%d/%d\n", job.Done, job.Total)
+		}
+	})
+	if err != nil {
+		log.Fatalf("An error occurred: %s\n", err)
+	}
+	showJob(job)
+	if job.Status != admin.JobDone {
+		os.Exit(1)
+	}
+}
+
+func showJob(job admin.Job) {
+	progress := fmt.Sprint(job.Done)
+	if job.Total > 0 {
+		progress = fmt.Sprintf("%d/%d", job.Done, job.Total)
+	}
+	result := job.Message
+	if job.Error != "" {
+		result = job.Error
+	}
+	fmt.Printf("%-5s %-15s %-10s %-10s %s %s\n", job.ID, job.Type, job.Status, progress, job.Started.Local().Format(time.RFC3339), result)
+}
+
+func usageFatal() {
+	flag.Usage()
+	os.Exit(2)
+}
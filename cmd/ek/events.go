@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+// formatEvent returns a line that describes the event
+func formatEvent(msg sse.Message) string {
+	var s string
+	switch e := msg.Object.(type) {
+	case microsub.ChannelEvent:
+		s = fmt.Sprintf("%s %s %q", msg.Event, e.Channel.UID, e.Channel.Name)
+	case microsub.ChannelDeletedEvent:
+		s = fmt.Sprintf("%s %s", msg.Event, e.UID)
+	case microsub.ChannelsOrderEvent:
+		s = fmt.Sprintf("%s %s", msg.Event, strings.Join(e.Channels, " "))
+	case microsub.NewItemEvent:
+		title := e.Item.Name
+		if title == "" {
+			title = e.Item.URL
+		}
+		if title == "" {
+			title = e.Item.ID
+		}
+		s = fmt.Sprintf("%s in %s: %s", msg.Event, e.Channel, title)
+	case microsub.Channel:
+		s = fmt.Sprintf("%s %s: %d unread", msg.Event, e.UID, e.Unread.UnreadCount)
+	case microsub.ItemsEvent:
+		s = fmt.Sprintf("%s in %s: %s", msg.Event, e.Channel, strings.Join(e.Entries, " "))
+	case microsub.FollowEvent:
+		s = fmt.Sprintf("%s %s in %s", msg.Event, e.Feed.URL, e.Channel)
+	case microsub.SettingsEvent:
+		s = fmt.Sprintf("%s of %s", msg.Event, e.Channel)
+	default:
+		s = fmt.Sprintf("%s %s", msg.Event, msg.Data)
+	}
+	if msg.ID != 0 {
+		s = fmt.Sprintf("%d %s", msg.ID, s)
+	}
+	return s
+}
+
+func showEvent(msg sse.Message) {
+	fmt.Printf("%s %s\n", time.Now().Format("15:04:05"), formatEvent(msg))
+}
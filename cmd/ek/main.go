@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/gilliek/go-opml/opml"
@@ -146,12 +147,26 @@ Commands:
 
 	unfollow UID URL             unfollow URL on channel UID
 
+	events                       show the changes on the server as they happen
+
 	export opml                  export feeds as OPML
 	import opml FILENAME         import OPML feeds
 
 	export json                  export feeds as json
 	import json FILENAME         import json feeds
 
+Admin commands, these need the admin scope of the primary user:
+
+	admin connect URL                    get a token with the admin scope
+	admin refresh URL [USER]             fetch the feed at URL now
+	admin resubscribe [URL]              renew the WebSub subscriptions
+	admin rebuild-unread [USER [UID]]    count the unread items again
+	admin clear-cache                    remove the cached pages
+	admin reindex                        rebuild the index of WebSub feeds
+	admin jobs                           list the admin jobs
+	admin job ID                         show the admin job ID
+	admin cancel ID                      cancel the admin job ID
+
 Global arguments:
 
 `)
@@ -160,61 +175,87 @@ Global arguments:
 
 	configDir := fmt.Sprintf("%s/.config/microsub", os.Getenv("HOME"))
 
-	if len(os.Args) == 3 && os.Args[1] == "connect" {
-		err := os.MkdirAll(configDir, os.FileMode(0770))
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		f, err := os.Create(fmt.Sprintf("%s/client.json", configDir))
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer f.Close()
+	args := flag.Args()
 
-		me, err := url.Parse(os.Args[2])
-		if err != nil {
-			log.Fatal(err)
-		}
+	if len(args) == 2 && args[0] == "connect" {
+		connect(args[1], "read follow mute block channels", fmt.Sprintf("%s/client.json", configDir))
+		return
+	}
 
-		endpoints, err := indieauth.GetEndpoints(me)
-		if err != nil {
-			log.Fatal(err)
-		}
+	// The admin scope is only requested for the admin commands, and kept
+	// in a separate file
+	if len(args) == 3 && args[0] == "admin" && args[1] == "connect" {
+		connect(args[2], "admin", fmt.Sprintf("%s/admin.json", configDir))
+		return
+	}
 
-		clientID := "https://p83.nl/microsub-client"
-		scope := "read follow mute block channels"
+	authFile := "client.json"
+	if len(args) > 0 && args[0] == "admin" {
+		authFile = "admin.json"
+	}
 
-		token, err := indieauth.Authorize(me, endpoints, clientID, scope)
-		if err != nil {
-			log.Fatal(err)
-		}
+	var c client.Client
+	err := loadAuth(&c, fmt.Sprintf("%s/%s", configDir, authFile))
+	if os.IsNotExist(err) && authFile == "admin.json" {
+		log.Fatal("Use ek admin connect URL first, to get a token with the admin scope")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		enc := json.NewEncoder(f)
-		err = enc.Encode(token)
-		if err != nil {
-			log.Fatal(err)
-		}
+	err = loadEndpoints(&c, c.Me, fmt.Sprintf("%s/endpoints.json", configDir))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		log.Println("Authorization successful")
+	c.Logging = *verbose
 
+	if len(args) > 0 && args[0] == "admin" {
+		performAdminCommands(&c, args[1:])
 		return
 	}
 
-	var c client.Client
-	err := loadAuth(&c, fmt.Sprintf("%s/client.json", configDir))
+	performCommands(&c, args)
+}
+
+// connect asks the authorization endpoint of meURL for a token with scope,
+// and saves the token in filename
+func connect(meURL, scope, filename string) {
+	err := os.MkdirAll(filepath.Dir(filename), os.FileMode(0770))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = loadEndpoints(&c, c.Me, fmt.Sprintf("%s/endpoints.json", configDir))
+	me, err := url.Parse(meURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	c.Logging = *verbose
+	endpoints, err := indieauth.GetEndpoints(me)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clientID := "https://p83.nl/microsub-client"
+
+	token, err := indieauth.Authorize(me, endpoints, clientID, scope)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(token)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	performCommands(&c, flag.Args())
+	log.Println("Authorization successful")
 }
 
 func performCommands(sub microsub.Microsub, commands []string) {
@@ -376,7 +417,7 @@ func performCommands(sub microsub.Microsub, commands []string) {
 			log.Fatalf("could not start event listener: %+v", err)
 		}
 		for msg := range c {
-			log.Printf("%s: %s", msg.Event, msg.Data)
+			showEvent(msg)
 		}
 	}
 }
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"p83.nl/go/ekster/pkg/admin"
+	"p83.nl/go/ekster/pkg/auth"
+	"p83.nl/go/ekster/pkg/logging"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/server"
+)
+
+// adminHandler serves the admin API on /admin/. See package admin for the endpoints.
+type adminHandler struct {
+	users       *userBackends
+	hub         *hubIncomingBackend
+	jobs        *jobRunner
+	pool        *redis.Pool
+	authEnabled bool
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.authEnabled && !h.authorize(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/admin/")
+	values := r.URL.Query()
+
+	if path == "jobs" {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, h.jobs.list())
+		return
+	}
+
+	if strings.HasPrefix(path, "jobs/") {
+		id := strings.TrimPrefix(path, "jobs/")
+		var job admin.Job
+		var ok bool
+		switch r.Method {
+		case http.MethodGet:
+			job, ok = h.jobs.get(id)
+		case http.MethodDelete:
+			job, ok = h.jobs.cancel(id)
+		default:
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		if !ok {
+			server.WriteError(w, microsub.NotFoundError("unknown job %s", id))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, job)
+		return
+	}
+
+	var operations = map[string]func(w http.ResponseWriter, r *http.Request, values url.Values){
+		"feeds/refresh":      h.refreshFeed,
+		"feeds/reindex":      h.reindexFeeds,
+		"websub/resubscribe": h.resubscribe,
+		"unread/rebuild":     h.rebuildUnread,
+		"cache/clear":        h.clearCache,
+	}
+
+	op, ok := operations[path]
+	if !ok {
+		server.WriteError(w, microsub.NotFoundError("unknown admin operation %s", path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+	op(w, r, values)
+}
+
+// authorize checks that the request has a token of the primary user with
+// the admin scope
+func (h *adminHandler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	logger := logging.FromContext(r.Context())
+	b := h.users.primary.backend
+
+	var token auth.TokenResponse
+	authorized, err := b.AuthTokenAccepted(r.Header.Get("Authorization"), &token)
+	if err != nil {
+		logger.Warnf("token not accepted: %v", err)
+	}
+	if !authorized {
+		server.WriteError(w, microsub.UnauthorizedError("can't validate token"))
+		return false
+	}
+
+	if !sameUser(token.Me, b.Me) {
+		logger.Warn("admin API used by other user", "me", token.Me)
+		server.WriteError(w, microsub.ForbiddenError("only %s can use the admin API", b.Me))
+		return false
+	}
+
+	if !hasScope(token.Scope, ScopeAdmin) {
+		logger.Warnf("Token with scope %q is missing scope %q", token.Scope, ScopeAdmin)
+		writeInsufficientScope(w, ScopeAdmin)
+		return false
+	}
+
+	return true
+}
+
+// selectUsers returns the user with id, or all users when id is empty
+func (h *adminHandler) selectUsers(id string) ([]*userBackend, error) {
+	if id == "" {
+		return h.users.all(), nil
+	}
+	user, ok := h.users.get(id)
+	if !ok {
+		return nil, microsub.NotFoundError("unknown user %s", id)
+	}
+	return []*userBackend{user}, nil
+}
+
+// startJob starts fn as a job and responds with the job
+func (h *adminHandler) startJob(w http.ResponseWriter, typ string, fn func(ctx context.Context, p *jobProgress) error) {
+	job, err := h.jobs.start(typ, fn)
+	if err != nil {
+		server.WriteError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/admin/jobs/"+job.ID)
+	writeAdminJSON(w, http.StatusAccepted, job)
+}
+
+// refreshFeed fetches a feed now for all channels that follow it. It's fast
+// enough to run in the request.
+func (h *adminHandler) refreshFeed(w http.ResponseWriter, r *http.Request, values url.Values) {
+	feedURL := values.Get("url")
+	if feedURL == "" {
+		server.WriteError(w, microsub.InvalidRequestError("missing url"))
+		return
+	}
+	users, err := h.selectUsers(values.Get("user"))
+	if err != nil {
+		server.WriteError(w, err)
+		return
+	}
+
+	res := admin.RefreshResult{URL: feedURL, Feeds: []admin.RefreshedFeed{}}
+	for _, user := range users {
+		for uid, urls := range user.backend.getFeeds() {
+			for _, u := range urls {
+				if u != feedURL {
+					continue
+				}
+				feed := admin.RefreshedFeed{User: user.id, Channel: uid}
+				if err := refreshFeed(r.Context(), user.backend, uid, feedURL); err != nil {
+					feed.Error = err.Error()
+				}
+				res.Feeds = append(res.Feeds, feed)
+			}
+		}
+	}
+
+	if len(res.Feeds) == 0 {
+		server.WriteError(w, microsub.NotFoundError("no channel follows %s", feedURL))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, res)
+}
+
+// refreshFeed fetches feedURL and adds the new items to channel
+func refreshFeed(ctx context.Context, b *memoryBackend, channel, feedURL string) error {
+	resp, err := b.Fetch3(ctx, channel, feedURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("HTTP Status is %d", resp.StatusCode)
+	}
+	return b.ProcessContent(channel, feedURL, resp.Header.Get("Content-Type"), resp.Body)
+}
+
+// resubscribe renews the WebSub subscriptions, or only the one of url
+func (h *adminHandler) resubscribe(w http.ResponseWriter, r *http.Request, values url.Values) {
+	feedURL := values.Get("url")
+
+	h.startJob(w, "resubscribe", func(ctx context.Context, p *jobProgress) error {
+		feeds, err := h.hub.Feeds()
+		if err != nil {
+			return err
+		}
+		var selected []Feed
+		for _, feed := range feeds {
+			if feedURL == "" || feed.URL == feedURL {
+				selected = append(selected, feed)
+			}
+		}
+		p.total(len(selected))
+
+		failed := 0
+		for _, feed := range selected {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if feed.Callback == "" {
+				feed.Callback = fmt.Sprintf("%s/incoming/%d", h.hub.baseURL, feed.ID)
+			}
+			varWebsub.Add("resubscribe", 1)
+			if err := h.hub.Subscribe(&feed); err != nil {
+				logging.FromContext(ctx).Warn("resubscribe failed", "url", feed.URL, "hub", feed.Hub, "err", err)
+				varWebsub.Add("errors", 1)
+				failed++
+			}
+			p.step(1)
+		}
+
+		p.message("renewed %d subscriptions, %d failed", len(selected)-failed, failed)
+		return nil
+	})
+}
+
+// rebuildUnread counts the unread items of the channels again
+func (h *adminHandler) rebuildUnread(w http.ResponseWriter, r *http.Request, values url.Values) {
+	users, err := h.selectUsers(values.Get("user"))
+	if err != nil {
+		server.WriteError(w, err)
+		return
+	}
+
+	type userChannel struct {
+		backend *memoryBackend
+		uid     string
+	}
+	var channels []userChannel
+	channel := values.Get("channel")
+	for _, user := range users {
+		b := user.backend
+		b.lock.RLock()
+		for uid := range b.Channels {
+			if channel == "" || uid == channel {
+				channels = append(channels, userChannel{b, uid})
+			}
+		}
+		b.lock.RUnlock()
+	}
+	if channel != "" && len(channels) == 0 {
+		server.WriteError(w, microsub.NotFoundError("unknown channel %s", channel))
+		return
+	}
+
+	h.startJob(w, "rebuild-unread", func(ctx context.Context, p *jobProgress) error {
+		p.total(len(channels))
+		for _, c := range channels {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := c.backend.updateChannelUnreadCount(c.uid); err != nil {
+				return fmt.Errorf("channel %s of %s: %v", c.uid, c.backend.Me, err)
+			}
+			p.step(1)
+		}
+		p.message("counted the unread items of %d channels", len(channels))
+		return nil
+	})
+}
+
+// clearCache removes the pages in the http_cache:* keys
+func (h *adminHandler) clearCache(w http.ResponseWriter, r *http.Request, values url.Values) {
+	h.startJob(w, "clear-cache", func(ctx context.Context, p *jobProgress) error {
+		conn, err := h.pool.GetContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		removed := 0
+		cursor := 0
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "http_cache:*", "COUNT", 500))
+			if err != nil {
+				return err
+			}
+			var keys []string
+			if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				n, err := redis.Int(conn.Do("DEL", redis.Args{}.AddFlat(keys)...))
+				if err != nil {
+					return err
+				}
+				removed += n
+				p.step(len(keys))
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+
+		p.message("removed %d cached pages", removed)
+		return nil
+	})
+}
+
+// feedKey identifies a followed feed in the WebSub index
+type feedKey struct {
+	user, channel, url string
+}
+
+// reindexFeeds makes the feed:* records match the feeds that are followed.
+// Records are created for followed feeds without one, records of feeds that
+// are not followed anymore and duplicates are removed.
+func (h *adminHandler) reindexFeeds(w http.ResponseWriter, r *http.Request, values url.Values) {
+	h.startJob(w, "reindex", func(ctx context.Context, p *jobProgress) error {
+		conn, err := h.pool.GetContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		records, err := feedRecords(conn)
+		if err != nil {
+			return err
+		}
+
+		followed := make(map[feedKey]*memoryBackend)
+		for _, user := range h.users.all() {
+			for uid, urls := range user.backend.getFeeds() {
+				for _, u := range urls {
+					followed[feedKey{user.id, uid, u}] = user.backend
+				}
+			}
+		}
+		p.total(len(records) + len(followed))
+
+		indexed := make(map[feedKey]bool)
+		removed := 0
+		for _, feed := range records {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			me := feed.Me
+			if me == "" {
+				me = h.users.primary.backend.Me
+			}
+			var id string
+			if user, ok := h.users.lookup(me); ok {
+				id = user.id
+			}
+			key := feedKey{id, feed.Channel, feed.URL}
+			if _, ok := followed[key]; ok && !indexed[key] {
+				indexed[key] = true
+			} else {
+				if _, err := conn.Do("DEL", fmt.Sprintf("feed:%d", feed.ID)); err != nil {
+					return err
+				}
+				removed++
+			}
+			p.step(1)
+		}
+
+		created := 0
+		for key, backend := range followed {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !indexed[key] {
+				// An error means that the feed has no WebSub hub, the record is created anyway
+				if _, err := backend.CreateFeed(key.url, key.channel); err != nil {
+					logging.FromContext(ctx).Debug("feed without hub", "url", key.url, "err", err)
+				}
+				created++
+			}
+			p.step(1)
+		}
+
+		p.message("created %d and removed %d feed records", created, removed)
+		return nil
+	})
+}
+
+// feedRecords returns all feed:* records, with or without a hub, ordered by id
+func feedRecords(conn redis.Conn) ([]Feed, error) {
+	keys, err := redis.Strings(conn.Do("KEYS", "feed:*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, key := range keys {
+		id, err := strconv.ParseInt(strings.TrimPrefix(key, "feed:"), 10, 64)
+		if err != nil {
+			// e.g. feed:next_id
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var feeds []Feed
+	for _, id := range ids {
+		values, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("feed:%d", id)))
+		if err != nil {
+			return nil, err
+		}
+		var feed Feed
+		if err := redis.ScanStruct(values, &feed); err != nil {
+			return nil, err
+		}
+		feed.ID = id
+		feeds = append(feeds, feed)
+	}
+	return feeds, nil
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	server.WriteError(w, microsub.InvalidRequestError("method %s is not allowed", r.Method))
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("could not write admin response: %v", err)
+	}
+}
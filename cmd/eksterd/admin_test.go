@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/admin"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func newTestAdminHandler(t *testing.T, authEnabled bool) (*adminHandler, func()) {
+	users, cleanup := newTestUsers(t)
+	r, stop := startTestRunner()
+	h := &adminHandler{
+		users:       users,
+		hub:         &hubIncomingBackend{users: users, pool: users.pool},
+		jobs:        r,
+		pool:        users.pool,
+		authEnabled: authEnabled,
+	}
+	return h, func() {
+		stop()
+		cleanup()
+	}
+}
+
+func TestAdminHandler_Unauthorized(t *testing.T) {
+	h, cleanup := newTestAdminHandler(t, true)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/admin/cache/clear", nil)
+	r.Header.Set("Authorization", "Bearer invalid")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+	assert.Empty(t, h.jobs.list())
+}
+
+func TestAdminHandler_Routes(t *testing.T) {
+	h, cleanup := newTestAdminHandler(t, false)
+	defer cleanup()
+
+	tests := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/admin/unknown", 404},
+		{"GET", "/admin/cache/clear", 400},
+		{"POST", "/admin/jobs", 400},
+		{"GET", "/admin/jobs/1", 404},
+		{"POST", "/admin/feeds/refresh", 400},
+		{"POST", "/admin/feeds/refresh?url=https://example.org/feed", 404},
+		{"POST", "/admin/feeds/refresh?url=https://example.org/feed&user=unknown", 404},
+		{"POST", "/admin/unread/rebuild?channel=unknown", 404},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		assert.Equal(t, test.code, w.Code, "%s %s", test.method, test.path)
+
+		var merr microsub.Error
+		if assert.NoError(t, json.NewDecoder(w.Body).Decode(&merr)) {
+			assert.NotEmpty(t, merr.Code)
+		}
+	}
+}
+
+func TestAdminHandler_Jobs(t *testing.T) {
+	h, cleanup := newTestAdminHandler(t, false)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/cache/clear", nil))
+	assert.Equal(t, 202, w.Code)
+	assert.Equal(t, "/admin/jobs/1", w.Header().Get("Location"))
+
+	var job admin.Job
+	if assert.NoError(t, json.NewDecoder(w.Body).Decode(&job)) {
+		assert.Equal(t, "1", job.ID)
+		assert.Equal(t, "clear-cache", job.Type)
+	}
+
+	// Redis is not available, so the job fails
+	job = waitForJob(t, h.jobs, "1")
+	assert.Equal(t, admin.JobFailed, job.Status)
+	assert.Equal(t, "no redis", job.Error)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/jobs/1", nil))
+	assert.Equal(t, 200, w.Code)
+	job = admin.Job{}
+	if assert.NoError(t, json.NewDecoder(w.Body).Decode(&job)) {
+		assert.Equal(t, admin.JobFailed, job.Status)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/admin/unread/rebuild?channel=home", nil))
+	assert.Equal(t, 202, w.Code)
+	job = waitForJob(t, h.jobs, "2")
+	assert.Equal(t, "rebuild-unread", job.Type)
+	assert.Equal(t, 1, job.Total)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/jobs", nil))
+	assert.Equal(t, 200, w.Code)
+	var jobs []admin.Job
+	if assert.NoError(t, json.NewDecoder(w.Body).Decode(&jobs)) && assert.Len(t, jobs, 2) {
+		assert.Equal(t, "2", jobs[0].ID)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/jobs/2", nil))
+	assert.Equal(t, 200, w.Code)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
 	"strings"
@@ -27,12 +26,14 @@ func cachedCheckAuthToken(conn redis.Conn, header string, tokenEndpoint string,
 
 	authorized, err := getCachedValue(conn, key, r)
 	if err != nil {
-		log.Printf("could not get cached auth token value: %v", err)
+		logger.Errorf("could not get cached auth token value: %v", err)
 	}
 
 	if authorized {
+		metricAuthCache.With("hit").Inc()
 		return true, nil
 	}
+	metricAuthCache.With("miss").Inc()
 
 	authorized, err = checkAuthToken(header, tokenEndpoint, r)
 	if err != nil {
@@ -42,7 +43,7 @@ func cachedCheckAuthToken(conn redis.Conn, header string, tokenEndpoint string,
 	if authorized {
 		err = setCachedTokenResponseValue(conn, key, r)
 		if err != nil {
-			log.Printf("could not set cached token response value: %v", err)
+			logger.Errorf("could not set cached token response value: %v", err)
 		}
 
 		return true, nil
@@ -65,7 +66,7 @@ func checkAuthToken(header string, tokenEndpoint string, token *auth.TokenRespon
 	defer func() {
 		err := res.Body.Close()
 		if err != nil {
-			log.Printf("could not close http response body: %v", err)
+			logger.Errorf("could not close http response body: %v", err)
 		}
 	}()
 
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"p83.nl/go/ekster/pkg/cron"
+	"p83.nl/go/ekster/pkg/logging"
+	"p83.nl/go/ekster/pkg/sse"
+	"p83.nl/go/ekster/pkg/timeline"
+	"p83.nl/go/ekster/pkg/webpush"
+)
+
+// Config contains the settings of eksterd. The settings are read from a YAML
+// file, environment variables and flags, in that order.
+type Config struct {
+	Port      int    `yaml:"port"`
+	Auth      bool   `yaml:"auth"`
+	Headless  bool   `yaml:"headless"`
+	Redis     string `yaml:"redis"`
+	BaseURL   string `yaml:"baseurl"`
+	Templates string `yaml:"templates"`
+	// TemplatesReload parses the templates again when a file in Templates changes
+	TemplatesReload bool   `yaml:"templates_reload"`
+	MediaDir        string `yaml:"media_dir"`
+	// MediaPruneInterval is the time between two removals of unused media
+	MediaPruneInterval time.Duration `yaml:"media_prune_interval"`
+	Store              string        `yaml:"store"`
+	UsersDir           string        `yaml:"users_dir"`
+	Users              []string      `yaml:"users"`
+	Metrics            bool          `yaml:"metrics"`
+	// MetricsToken is the bearer token that is needed for /metrics
+	MetricsToken string `yaml:"metrics_token"`
+
+	// ShutdownTimeout is the time the server waits for requests and workers to stop
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Log      LogConfig      `yaml:"log"`
+	Fetch    FetchConfig    `yaml:"fetch"`
+	WebSub   WebSubConfig   `yaml:"websub"`
+	Timeline TimelineConfig `yaml:"timeline"`
+	Events   EventsConfig   `yaml:"events"`
+	Webhooks WebhooksConfig `yaml:"webhooks"`
+	SMTP     SMTPConfig     `yaml:"smtp"`
+	Digests  DigestsConfig  `yaml:"digests"`
+	WebPush  WebPushConfig  `yaml:"webpush"`
+	Sessions SessionsConfig `yaml:"sessions"`
+}
+
+// LogConfig contains the settings for logging
+type LogConfig struct {
+	// Level is the minimum level of messages that are logged: debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is the format of the messages: text or json
+	Format string `yaml:"format"`
+}
+
+// FetchConfig contains the settings for fetching feeds
+type FetchConfig struct {
+	// Interval is the time between two updates of all feeds
+	Interval time.Duration `yaml:"interval"`
+	// CacheTTL is the time a fetched page is cached
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// WebSubConfig contains the settings for WebSub subscriptions
+type WebSubConfig struct {
+	// Lease is the time we ask the hub to keep the subscription
+	Lease time.Duration `yaml:"lease"`
+	// ResubscribeInterval is the time between two checks for subscriptions that need to be renewed
+	ResubscribeInterval time.Duration `yaml:"resubscribe_interval"`
+}
+
+// TimelineConfig contains the settings for timelines
+type TimelineConfig struct {
+	// PageSize is the number of items in one page of a timeline
+	PageSize int `yaml:"page_size"`
+	// StreamMaxLength is the number of items kept in a "stream" timeline
+	StreamMaxLength int `yaml:"stream_max_length"`
+}
+
+// EventsConfig contains the settings for the event streams
+type EventsConfig struct {
+	// LogSize is the number of events that are kept for clients that reconnect
+	LogSize int `yaml:"log_size"`
+	// QueueSize is the number of events that are queued for a client
+	QueueSize int `yaml:"queue_size"`
+	// SlowClient is what happens when the queue of a client is full:
+	// evict, drop-newest or drop-oldest
+	SlowClient string `yaml:"slow_client"`
+}
+
+// WebhooksConfig contains the settings for the delivery of webhooks
+type WebhooksConfig struct {
+	// MaxAttempts is the number of deliveries before a webhook is moved to
+	// the dead letters
+	MaxAttempts int `yaml:"max_attempts"`
+	// Timeout is the time a delivery can take
+	Timeout time.Duration `yaml:"timeout"`
+	// Workers is the number of deliveries that are sent at the same time
+	Workers int `yaml:"workers"`
+}
+
+// SMTPConfig contains the settings of the mail server that sends the digests
+type SMTPConfig struct {
+	// Addr is the host:port of the mail server, digests are only sent when it's set
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// From is the sender of the digests
+	From string `yaml:"from"`
+}
+
+// DigestsConfig contains the settings for the email digests of channels
+type DigestsConfig struct {
+	// Schedule is used for digests without a schedule of their own
+	Schedule string `yaml:"schedule"`
+	// MaxItems is the number of items in one digest
+	MaxItems int `yaml:"max_items"`
+}
+
+// WebPushConfig contains the settings for Web Push notifications
+type WebPushConfig struct {
+	// VAPIDKey is the private key that signs the messages, base64url encoded.
+	// Without it, a key is created and kept in Redis.
+	VAPIDKey string `yaml:"vapid_key"`
+	// Subject is a mailto: or https: url for the push services, the baseurl
+	// is used when it's empty
+	Subject string `yaml:"subject"`
+	// Throttle is the minimum time between two notifications for a channel
+	// on one device
+	Throttle time.Duration `yaml:"throttle"`
+	// TTL is the time a push service keeps a notification for a device that
+	// is offline
+	TTL time.Duration `yaml:"ttl"`
+	// Workers is the number of notifications that are sent at the same time
+	Workers int `yaml:"workers"`
+}
+
+// SessionsConfig contains the settings for the sessions of the web interface
+type SessionsConfig struct {
+	// Secret signs the session cookies. Without it, a secret is created and
+	// kept in Redis.
+	Secret string `yaml:"secret"`
+	// Lifetime is the time a session stays logged in
+	Lifetime time.Duration `yaml:"lifetime"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:     80,
+		Auth:     true,
+		Redis:    "redis:6379",
+		MediaDir: "./media",
+		Store:    "ekster.json",
+		UsersDir: "./users",
+		Metrics:  false,
+
+		MediaPruneInterval: time.Hour,
+
+		ShutdownTimeout: 30 * time.Second,
+
+		Log: LogConfig{
+			Level:  "info",
+			Format: string(logging.FormatText),
+		},
+		Fetch: FetchConfig{
+			Interval: 10 * time.Minute,
+			CacheTTL: time.Hour,
+		},
+		WebSub: WebSubConfig{
+			Lease:               24 * time.Hour,
+			ResubscribeInterval: 10 * time.Minute,
+		},
+		Timeline: TimelineConfig{
+			PageSize:        timeline.DefaultOptions.PageSize,
+			StreamMaxLength: timeline.DefaultOptions.StreamMaxLength,
+		},
+		Events: EventsConfig{
+			LogSize:    sse.DefaultLogSize,
+			QueueSize:  sse.DefaultOptions.QueueSize,
+			SlowClient: sse.DefaultOptions.Policy.String(),
+		},
+		Webhooks: WebhooksConfig{
+			MaxAttempts: 6,
+			Timeout:     10 * time.Second,
+			Workers:     4,
+		},
+		Digests: DigestsConfig{
+			Schedule: "0 7 * * *",
+			MaxItems: 50,
+		},
+		WebPush: WebPushConfig{
+			Throttle: 5 * time.Minute,
+			TTL:      24 * time.Hour,
+			Workers:  4,
+		},
+		Sessions: SessionsConfig{
+			Lifetime: 30 * 24 * time.Hour,
+		},
+	}
+}
+
+var runningConfig atomic.Value
+
+// currentConfig returns the config of the running server. It changes when
+// the config is reloaded, so don't keep the result around.
+func currentConfig() Config {
+	if cfg, ok := runningConfig.Load().(Config); ok {
+		return cfg
+	}
+	return defaultConfig()
+}
+
+func setCurrentConfig(cfg Config) {
+	runningConfig.Store(cfg)
+	timeline.SetOptions(timeline.Options{
+		PageSize:        cfg.Timeline.PageSize,
+		StreamMaxLength: cfg.Timeline.StreamMaxLength,
+	})
+	if level, err := logging.ParseLevel(cfg.Log.Level); err == nil {
+		logger.SetLevel(level)
+	}
+	logger.SetFormat(logging.Format(cfg.Log.Format))
+}
+
+// appOptions returns the options for NewApp
+func (cfg Config) appOptions() AppOptions {
+	return AppOptions{
+		Port:           cfg.Port,
+		AuthEnabled:    cfg.Auth,
+		Headless:       cfg.Headless,
+		RedisServer:    cfg.Redis,
+		BaseURL:        cfg.BaseURL,
+		TemplateDir:    cfg.Templates,
+		TemplateReload: cfg.TemplatesReload,
+		MediaDir:       cfg.MediaDir,
+		StoreFile:      cfg.Store,
+		UsersDir:       cfg.UsersDir,
+		Users:          cfg.Users,
+		Metrics:        cfg.Metrics,
+	}
+}
+
+// configSetting connects a setting with its environment variable and flag
+type configSetting struct {
+	env   string
+	flag  string
+	usage string
+	field func(cfg *Config) interface{}
+}
+
+var configSettings = []configSetting{
+	{"EKSTER_PORT", "port", "port for serving api", func(c *Config) interface{} { return &c.Port }},
+	{"EKSTER_AUTH", "auth", "use auth", func(c *Config) interface{} { return &c.Auth }},
+	{"EKSTER_HEADLESS", "headless", "disable frontend", func(c *Config) interface{} { return &c.Headless }},
+	{"EKSTER_REDIS", "redis", "redis server", func(c *Config) interface{} { return &c.Redis }},
+	{"EKSTER_BASEURL", "baseurl", "http server baseurl", func(c *Config) interface{} { return &c.BaseURL }},
+	{"EKSTER_TEMPLATES", "templates", "directory with templates that replace the compiled in templates", func(c *Config) interface{} { return &c.Templates }},
+	{"EKSTER_TEMPLATES_RELOAD", "templates-reload", "parse the templates again when they change", func(c *Config) interface{} { return &c.TemplatesReload }},
+	{"EKSTER_MEDIA_DIR", "media", "directory for files uploaded to the media endpoint", func(c *Config) interface{} { return &c.MediaDir }},
+	{"EKSTER_MEDIA_PRUNE_INTERVAL", "media-prune-interval", "time between removals of unused media", func(c *Config) interface{} { return &c.MediaPruneInterval }},
+	{"EKSTER_STORE", "store", "file where channels, feeds and settings are saved", func(c *Config) interface{} { return &c.Store }},
+	{"EKSTER_USERS_DIR", "users-dir", "directory for the backends of other users", func(c *Config) interface{} { return &c.UsersDir }},
+	{"EKSTER_USERS", "users", "comma separated urls of other users that can sign in, or * for everyone", func(c *Config) interface{} { return &c.Users }},
+	{"EKSTER_METRICS", "metrics", "serve Prometheus metrics on /metrics", func(c *Config) interface{} { return &c.Metrics }},
+	{"EKSTER_METRICS_TOKEN", "metrics-token", "bearer token that is needed for /metrics", func(c *Config) interface{} { return &c.MetricsToken }},
+	{"EKSTER_SHUTDOWN_TIMEOUT", "shutdown-timeout", "time to wait for requests and workers to stop", func(c *Config) interface{} { return &c.ShutdownTimeout }},
+	{"EKSTER_LOG_LEVEL", "log-level", "minimum level of logged messages: debug, info, warn or error", func(c *Config) interface{} { return &c.Log.Level }},
+	{"EKSTER_LOG_FORMAT", "log-format", "format of logged messages: text or json", func(c *Config) interface{} { return &c.Log.Format }},
+	{"EKSTER_FETCH_INTERVAL", "fetch-interval", "time between updates of all feeds", func(c *Config) interface{} { return &c.Fetch.Interval }},
+	{"EKSTER_CACHE_TTL", "cache-ttl", "time fetched pages are cached", func(c *Config) interface{} { return &c.Fetch.CacheTTL }},
+	{"EKSTER_WEBSUB_LEASE", "websub-lease", "lease time of WebSub subscriptions", func(c *Config) interface{} { return &c.WebSub.Lease }},
+	{"EKSTER_WEBSUB_RESUBSCRIBE_INTERVAL", "websub-resubscribe-interval", "time between checks for WebSub subscriptions to renew", func(c *Config) interface{} { return &c.WebSub.ResubscribeInterval }},
+	{"EKSTER_PAGE_SIZE", "page-size", "number of items in a page of a timeline", func(c *Config) interface{} { return &c.Timeline.PageSize }},
+	{"EKSTER_STREAM_MAX_LENGTH", "stream-max-length", "number of items kept in a stream timeline", func(c *Config) interface{} { return &c.Timeline.StreamMaxLength }},
+	{"EKSTER_EVENTS_LOG_SIZE", "events-log-size", "number of events kept for clients of the event stream that reconnect", func(c *Config) interface{} { return &c.Events.LogSize }},
+	{"EKSTER_EVENTS_QUEUE_SIZE", "events-queue-size", "number of events queued for a client of the event stream", func(c *Config) interface{} { return &c.Events.QueueSize }},
+	{"EKSTER_EVENTS_SLOW_CLIENT", "events-slow-client", "what happens when the queue of a client is full: evict, drop-newest or drop-oldest", func(c *Config) interface{} { return &c.Events.SlowClient }},
+	{"EKSTER_WEBHOOKS_MAX_ATTEMPTS", "webhooks-max-attempts", "number of deliveries of a webhook before it's a dead letter", func(c *Config) interface{} { return &c.Webhooks.MaxAttempts }},
+	{"EKSTER_WEBHOOKS_TIMEOUT", "webhooks-timeout", "time a delivery of a webhook can take", func(c *Config) interface{} { return &c.Webhooks.Timeout }},
+	{"EKSTER_WEBHOOKS_WORKERS", "webhooks-workers", "number of webhook deliveries that are sent at the same time", func(c *Config) interface{} { return &c.Webhooks.Workers }},
+	{"EKSTER_SMTP_ADDR", "smtp-addr", "host:port of the mail server for digests", func(c *Config) interface{} { return &c.SMTP.Addr }},
+	{"EKSTER_SMTP_USERNAME", "smtp-username", "username for the mail server", func(c *Config) interface{} { return &c.SMTP.Username }},
+	{"EKSTER_SMTP_PASSWORD", "smtp-password", "password for the mail server", func(c *Config) interface{} { return &c.SMTP.Password }},
+	{"EKSTER_SMTP_FROM", "smtp-from", "sender address of digests", func(c *Config) interface{} { return &c.SMTP.From }},
+	{"EKSTER_DIGESTS_SCHEDULE", "digests-schedule", "default cron-like schedule of digests", func(c *Config) interface{} { return &c.Digests.Schedule }},
+	{"EKSTER_DIGESTS_MAX_ITEMS", "digests-max-items", "number of items in one digest", func(c *Config) interface{} { return &c.Digests.MaxItems }},
+	{"EKSTER_WEBPUSH_VAPID_KEY", "webpush-vapid-key", "private VAPID key for Web Push, base64url encoded", func(c *Config) interface{} { return &c.WebPush.VAPIDKey }},
+	{"EKSTER_WEBPUSH_SUBJECT", "webpush-subject", "mailto: or https: contact url for push services", func(c *Config) interface{} { return &c.WebPush.Subject }},
+	{"EKSTER_WEBPUSH_THROTTLE", "webpush-throttle", "minimum time between notifications for a channel on a device", func(c *Config) interface{} { return &c.WebPush.Throttle }},
+	{"EKSTER_WEBPUSH_TTL", "webpush-ttl", "time push services keep notifications for offline devices", func(c *Config) interface{} { return &c.WebPush.TTL }},
+	{"EKSTER_WEBPUSH_WORKERS", "webpush-workers", "number of push notifications that are sent at the same time", func(c *Config) interface{} { return &c.WebPush.Workers }},
+	{"EKSTER_SESSIONS_SECRET", "sessions-secret", "secret that signs the session cookies", func(c *Config) interface{} { return &c.Sessions.Secret }},
+	{"EKSTER_SESSIONS_LIFETIME", "sessions-lifetime", "time a session of the web interface stays logged in", func(c *Config) interface{} { return &c.Sessions.Lifetime }},
+}
+
+// setConfigValue parses s and sets the value of the setting
+func setConfigValue(field interface{}, s string) error {
+	switch v := field.(type) {
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*v = n
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*v = b
+	case *string:
+		*v = s
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*v = append(*v, item)
+			}
+		}
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*v = d
+	default:
+		return fmt.Errorf("unsupported type %T", field)
+	}
+	return nil
+}
+
+// configFlag is a flag.Value for a setting
+type configFlag struct {
+	field interface{}
+}
+
+func (f configFlag) String() string {
+	if f.field == nil {
+		return ""
+	}
+	switch v := f.field.(type) {
+	case *[]string:
+		return strings.Join(*v, ",")
+	default:
+		return fmt.Sprint(reflect.ValueOf(v).Elem().Interface())
+	}
+}
+
+func (f configFlag) Set(s string) error {
+	return setConfigValue(f.field, s)
+}
+
+func (f configFlag) IsBoolFlag() bool {
+	_, ok := f.field.(*bool)
+	return ok
+}
+
+// defineConfigFlags adds the flags for the settings to fs. The values of the
+// flags are kept in flags, and are applied by loadConfig.
+func defineConfigFlags(fs *flag.FlagSet, flags *Config) {
+	*flags = defaultConfig()
+	for _, s := range configSettings {
+		fs.Var(configFlag{s.field(flags)}, s.flag, s.usage)
+	}
+}
+
+// loadConfig reads the config from filename (when it's not empty), and applies
+// the environment variables and the flags that are set in fs.
+func loadConfig(filename string, lookupEnv func(string) (string, bool), fs *flag.FlagSet, flags *Config) (Config, error) {
+	cfg := defaultConfig()
+
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return cfg, err
+		}
+		err = yaml.UnmarshalStrict(data, &cfg)
+		if err != nil {
+			return cfg, errors.Wrapf(err, "could not read %s", filename)
+		}
+	}
+
+	for _, s := range configSettings {
+		if value, ok := lookupEnv(s.env); ok {
+			err := setConfigValue(s.field(&cfg), value)
+			if err != nil {
+				return cfg, errors.Wrapf(err, "invalid value for %s", s.env)
+			}
+		}
+	}
+
+	if fs != nil {
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		for _, s := range configSettings {
+			if set[s.flag] {
+				reflect.ValueOf(s.field(&cfg)).Elem().Set(reflect.ValueOf(s.field(flags)).Elem())
+			}
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+// validate returns an error that lists all problems in the config
+func (cfg Config) validate() error {
+	var problems []string
+
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is not a valid port", cfg.Port))
+	}
+	if cfg.Redis == "" {
+		problems = append(problems, "redis is missing, use redis, EKSTER_REDIS or -redis")
+	}
+	if cfg.BaseURL == "" {
+		problems = append(problems, "baseurl is missing, please set with external url, use baseurl, EKSTER_BASEURL or -baseurl")
+	} else if u, err := url.Parse(cfg.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("baseurl %q is not a http(s) url", cfg.BaseURL))
+	}
+	if cfg.Templates != "" {
+		if info, err := os.Stat(cfg.Templates); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("templates %q is not a directory", cfg.Templates))
+		}
+	}
+	if cfg.MediaPruneInterval < time.Minute {
+		problems = append(problems, "media_prune_interval should be at least 1m")
+	}
+	if cfg.Store == "" {
+		problems = append(problems, "store is missing")
+	}
+	if s := cfg.MetricsToken; s != "" && len(s) < 16 {
+		problems = append(problems, "metrics_token should be at least 16 characters")
+	}
+	if cfg.ShutdownTimeout < time.Second {
+		problems = append(problems, "shutdown_timeout should be at least 1s")
+	}
+	if _, err := logging.ParseLevel(cfg.Log.Level); err != nil {
+		problems = append(problems, "log.level should be debug, info, warn or error")
+	}
+	if f := logging.Format(cfg.Log.Format); f != logging.FormatText && f != logging.FormatJSON {
+		problems = append(problems, "log.format should be text or json")
+	}
+	if cfg.Fetch.Interval < time.Minute {
+		problems = append(problems, "fetch.interval should be at least 1m")
+	}
+	if cfg.Fetch.CacheTTL < time.Second {
+		problems = append(problems, "fetch.cache_ttl should be at least 1s")
+	}
+	if cfg.WebSub.Lease < time.Minute {
+		problems = append(problems, "websub.lease should be at least 1m")
+	}
+	if cfg.WebSub.ResubscribeInterval < time.Minute {
+		problems = append(problems, "websub.resubscribe_interval should be at least 1m")
+	}
+	if cfg.Timeline.PageSize < 1 || cfg.Timeline.PageSize > 1000 {
+		problems = append(problems, "timeline.page_size should be between 1 and 1000")
+	}
+	if cfg.Timeline.StreamMaxLength < cfg.Timeline.PageSize {
+		problems = append(problems, "timeline.stream_max_length should be at least timeline.page_size")
+	}
+	if cfg.Events.LogSize < 1 {
+		problems = append(problems, "events.log_size should be at least 1")
+	}
+	if cfg.Events.QueueSize < 1 {
+		problems = append(problems, "events.queue_size should be at least 1")
+	}
+	if _, err := sse.ParsePolicy(cfg.Events.SlowClient); err != nil {
+		problems = append(problems, "events.slow_client should be evict, drop-newest or drop-oldest")
+	}
+	if cfg.Webhooks.MaxAttempts < 1 {
+		problems = append(problems, "webhooks.max_attempts should be at least 1")
+	}
+	if cfg.Webhooks.Timeout < time.Second {
+		problems = append(problems, "webhooks.timeout should be at least 1s")
+	}
+	if cfg.Webhooks.Workers < 1 || cfg.Webhooks.Workers > 100 {
+		problems = append(problems, "webhooks.workers should be between 1 and 100")
+	}
+	if cfg.SMTP.Addr != "" {
+		if _, _, err := net.SplitHostPort(cfg.SMTP.Addr); err != nil {
+			problems = append(problems, fmt.Sprintf("smtp.addr %q should be host:port", cfg.SMTP.Addr))
+		}
+		if _, err := mail.ParseAddress(cfg.SMTP.From); err != nil {
+			problems = append(problems, "smtp.from should be an email address when smtp.addr is set")
+		}
+	}
+	if _, err := cron.Parse(cfg.Digests.Schedule); err != nil {
+		problems = append(problems, fmt.Sprintf("digests.schedule: %v", err))
+	}
+	if cfg.Digests.MaxItems < 1 || cfg.Digests.MaxItems > 1000 {
+		problems = append(problems, "digests.max_items should be between 1 and 1000")
+	}
+	if cfg.WebPush.VAPIDKey != "" {
+		if _, err := webpush.ParseKey(cfg.WebPush.VAPIDKey); err != nil {
+			problems = append(problems, fmt.Sprintf("webpush.vapid_key: %v", err))
+		}
+	}
+	if s := cfg.WebPush.Subject; s != "" && !strings.HasPrefix(s, "mailto:") && !strings.HasPrefix(s, "https://") {
+		problems = append(problems, "webpush.subject should start with mailto: or https://")
+	}
+	if cfg.WebPush.Throttle < 0 {
+		problems = append(problems, "webpush.throttle should not be negative")
+	}
+	if cfg.WebPush.TTL < 0 {
+		problems = append(problems, "webpush.ttl should not be negative")
+	}
+	if cfg.WebPush.Workers < 1 || cfg.WebPush.Workers > 100 {
+		problems = append(problems, "webpush.workers should be between 1 and 100")
+	}
+	if s := cfg.Sessions.Secret; s != "" && len(s) < 32 {
+		problems = append(problems, "sessions.secret should be at least 32 characters")
+	}
+	if cfg.Sessions.Lifetime < time.Minute {
+		problems = append(problems, "sessions.lifetime should be at least 1m")
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// reloadConfig applies the settings of cfg that can be changed while the
+// server is running. Changes to the other settings are logged, they need a
+// restart.
+func reloadConfig(running, cfg Config) Config {
+	reloaded := cfg
+
+	// These settings are used when the server starts
+	reloaded.Port = running.Port
+	reloaded.Auth = running.Auth
+	reloaded.Headless = running.Headless
+	reloaded.Redis = running.Redis
+	reloaded.BaseURL = running.BaseURL
+	reloaded.Templates = running.Templates
+	reloaded.TemplatesReload = running.TemplatesReload
+	reloaded.MediaDir = running.MediaDir
+	reloaded.Store = running.Store
+	reloaded.UsersDir = running.UsersDir
+	reloaded.Metrics = running.Metrics
+	reloaded.Webhooks.Workers = running.Webhooks.Workers
+	if cfg.Webhooks.Workers != running.Webhooks.Workers {
+		logger.Warnf("Config setting webhooks.workers was changed, restart eksterd to use it")
+	}
+	reloaded.WebPush.Workers = running.WebPush.Workers
+	if cfg.WebPush.Workers != running.WebPush.Workers {
+		logger.Warnf("Config setting webpush.workers was changed, restart eksterd to use it")
+	}
+
+	runningValue := reflect.ValueOf(running)
+	cfgValue := reflect.ValueOf(cfg)
+	for i := 0; i < cfgValue.NumField(); i++ {
+		if !reflect.DeepEqual(runningValue.Field(i).Interface(), cfgValue.Field(i).Interface()) &&
+			reflect.DeepEqual(runningValue.Field(i).Interface(), reflect.ValueOf(reloaded).Field(i).Interface()) {
+			logger.Warnf("Config setting %s was changed, restart eksterd to use it", cfgValue.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+
+	return reloaded
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestConfig(t *testing.T, dir, content string) string {
+	filename := filepath.Join(dir, "eksterd.yml")
+	err := ioutil.WriteFile(filename, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func noEnv(string) (string, bool) {
+	return "", false
+}
+
+func TestLoadConfig_File(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	filename := writeTestConfig(t, dir, `
+port: 8090
+baseurl: https://microsub.example.com
+users:
+  - https://alice.example.org/
+fetch:
+  interval: 15m
+timeline:
+  page_size: 50
+`)
+
+	cfg, err := loadConfig(filename, noEnv, nil, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 8090, cfg.Port)
+		assert.Equal(t, "https://microsub.example.com", cfg.BaseURL)
+		assert.Equal(t, []string{"https://alice.example.org/"}, cfg.Users)
+		assert.Equal(t, 15*time.Minute, cfg.Fetch.Interval)
+		assert.Equal(t, 50, cfg.Timeline.PageSize)
+
+		// Defaults are used for the missing settings
+		assert.Equal(t, time.Hour, cfg.Fetch.CacheTTL)
+		assert.Equal(t, 24*time.Hour, cfg.WebSub.Lease)
+		assert.Equal(t, 250, cfg.Timeline.StreamMaxLength)
+		assert.Equal(t, "ekster.json", cfg.Store)
+	}
+}
+
+func TestLoadConfig_UnknownSetting(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	filename := writeTestConfig(t, dir, "baseurl: https://microsub.example.com\npage_size: 10\n")
+
+	_, err := loadConfig(filename, noEnv, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	filename := writeTestConfig(t, dir, `
+port: 8090
+redis: redis.example.com:6379
+baseurl: https://microsub.example.com
+fetch:
+  interval: 15m
+`)
+
+	env := map[string]string{
+		"EKSTER_PORT":           "8091",
+		"EKSTER_FETCH_INTERVAL": "20m",
+		"EKSTER_USERS":          "https://alice.example.org/, *",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	var flags Config
+	fs := flag.NewFlagSet("eksterd", flag.ContinueOnError)
+	defineConfigFlags(fs, &flags)
+	assert.NoError(t, fs.Parse([]string{"-port", "8092", "-auth=false"}))
+
+	cfg, err := loadConfig(filename, lookupEnv, fs, &flags)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 8092, cfg.Port)
+		assert.False(t, cfg.Auth)
+		assert.Equal(t, 20*time.Minute, cfg.Fetch.Interval)
+		assert.Equal(t, []string{"https://alice.example.org/", "*"}, cfg.Users)
+		assert.Equal(t, "redis.example.com:6379", cfg.Redis)
+	}
+}
+
+func TestLoadConfig_InvalidEnv(t *testing.T) {
+	lookupEnv := func(key string) (string, bool) {
+		if key == "EKSTER_PAGE_SIZE" {
+			return "many", true
+		}
+		return "", false
+	}
+	_, err := loadConfig("", lookupEnv, nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "EKSTER_PAGE_SIZE")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BaseURL = "https://microsub.example.com"
+	assert.NoError(t, cfg.validate())
+
+	cfg.BaseURL = "microsub.example.com"
+	cfg.Port = 0
+	cfg.Fetch.Interval = time.Second
+	cfg.Timeline.PageSize = 300
+	cfg.Log.Level = "verbose"
+	cfg.Log.Format = "xml"
+	cfg.Events.SlowClient = "block"
+	cfg.Webhooks.MaxAttempts = 0
+	cfg.Webhooks.Workers = 0
+	cfg.WebPush.Workers = 200
+	cfg.SMTP.Addr = "mail.example.com:25"
+	cfg.Digests.Schedule = "every day"
+	cfg.WebPush.Subject = "admin@example.com"
+	cfg.Templates = "./missing-templates"
+	cfg.Sessions.Secret = "short"
+	cfg.MediaPruneInterval = time.Second
+	err := cfg.validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "baseurl")
+		assert.Contains(t, err.Error(), "port")
+		assert.Contains(t, err.Error(), "fetch.interval")
+		assert.Contains(t, err.Error(), "timeline.stream_max_length")
+		assert.Contains(t, err.Error(), "log.level")
+		assert.Contains(t, err.Error(), "log.format")
+		assert.Contains(t, err.Error(), "events.slow_client")
+		assert.Contains(t, err.Error(), "webhooks.max_attempts")
+		assert.Contains(t, err.Error(), "webhooks.workers")
+		assert.Contains(t, err.Error(), "webpush.workers")
+		assert.Contains(t, err.Error(), "smtp.from")
+		assert.Contains(t, err.Error(), "digests.schedule")
+		assert.Contains(t, err.Error(), "webpush.subject")
+		assert.Contains(t, err.Error(), "missing-templates")
+		assert.Contains(t, err.Error(), "sessions.secret")
+		assert.Contains(t, err.Error(), "media_prune_interval")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	running := defaultConfig()
+	running.BaseURL = "https://microsub.example.com"
+
+	cfg := running
+	cfg.Port = 8090
+	cfg.Redis = "redis.example.com:6379"
+	cfg.Users = []string{"*"}
+	cfg.Fetch.Interval = 30 * time.Minute
+	cfg.Timeline.PageSize = 40
+	cfg.Log.Level = "debug"
+	cfg.Webhooks.Workers = 8
+	cfg.WebPush.Workers = 8
+	cfg.Webhooks.MaxAttempts = 3
+
+	reloaded := reloadConfig(running, cfg)
+	assert.Equal(t, running.Port, reloaded.Port)
+	assert.Equal(t, running.Redis, reloaded.Redis)
+	assert.Equal(t, []string{"*"}, reloaded.Users)
+	assert.Equal(t, 30*time.Minute, reloaded.Fetch.Interval)
+	assert.Equal(t, 40, reloaded.Timeline.PageSize)
+	assert.Equal(t, "debug", reloaded.Log.Level)
+	assert.Equal(t, running.Webhooks.Workers, reloaded.Webhooks.Workers)
+	assert.Equal(t, running.WebPush.Workers, reloaded.WebPush.Workers)
+	assert.Equal(t, 3, reloaded.Webhooks.MaxAttempts)
+}
+
+func TestCheckConfig(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := defaultConfig()
+	cfg.BaseURL = "https://microsub.example.com"
+	assert.Equal(t, 0, checkConfig(&buf, cfg, cfg.validate()))
+	assert.Contains(t, buf.String(), "baseurl: https://microsub.example.com")
+	assert.Contains(t, buf.String(), "Config is valid")
+
+	buf.Reset()
+	cfg.BaseURL = ""
+	assert.Equal(t, 1, checkConfig(&buf, cfg, cfg.validate()))
+	assert.Contains(t, buf.String(), "Config is not valid")
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"p83.nl/go/ekster/pkg/cron"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/timeline"
+)
+
+// digest sends the unread items of a channel by email
+type digest struct {
+	To string `json:"to"`
+	// Schedule is a cron-like schedule, without it digests.schedule is used
+	Schedule string `json:"schedule,omitempty"`
+	// MarkRead marks the items read after the digest is sent
+	MarkRead bool      `json:"mark_read,omitempty"`
+	Created  time.Time `json:"created"`
+	// Confirmed is set when the link in the confirmation email is opened,
+	// digests are only sent to confirmed addresses
+	Confirmed bool `json:"confirmed,omitempty"`
+	// Token is the secret of the confirmation link
+	Token string `json:"token,omitempty"`
+}
+
+// digestItem is an item as it's shown in a digest
+type digestItem struct {
+	Title     string
+	Author    string
+	Published string
+	Text      string
+	URL       string
+}
+
+// digestData is passed to the digest templates
+type digestData struct {
+	Channel string
+	Items   []digestItem
+}
+
+// digestTextTemplate and digestHTMLTemplate render a digest. The HTML is
+// rendered with html/template, because the items come from other sites.
+var (
+	digestTextTemplate = template.Must(template.New("digest").Parse(`{{ len .Items }} unread items in {{ .Channel }}
+{{ range .Items }}
+{{ .Title }}
+{{ if .Author }}by {{ .Author }}{{ if .Published }}, {{ end }}{{ end }}{{ .Published }}
+{{ if .Text }}{{ .Text }}
+{{ end }}{{ if .URL }}{{ .URL }}
+{{ end }}{{ end }}`))
+
+	digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; max-width: 40em">
+<h1 style="font-size: 1.3em">{{ len .Items }} unread items in {{ .Channel }}</h1>
+{{ range .Items }}
+<div style="margin-bottom: 1.5em">
+<h2 style="font-size: 1.1em; margin-bottom: 0.2em">{{ if .URL }}<a href="{{ .URL }}">{{ .Title }}</a>{{ else }}{{ .Title }}{{ end }}</h2>
+<small style="color: #777">{{ if .Author }}by {{ .Author }}{{ if .Published }}, {{ end }}{{ end }}{{ .Published }}</small>
+{{ if .Text }}<p>{{ .Text }}</p>{{ end }}
+</div>
+{{ end }}
+</body>
+</html>
+`))
+)
+
+// digestBackend sends the digests of all users
+type digestBackend struct {
+	users *userBackends
+	pool  *redis.Pool
+	// send delivers a message, it's sendMail when the server runs
+	send func(cfg SMTPConfig, to string, msg []byte) error
+}
+
+// setDigest sends a digest of channel to the address in d. A new address
+// has to be confirmed before digests are sent to it, the returned digest
+// contains the token of the confirmation link.
+func (b *memoryBackend) setDigest(channel string, d digest) (digest, error) {
+	if !b.channelExists(channel) {
+		return digest{}, microsub.NotFoundError("channel %s does not exist", channel)
+	}
+	to, err := mail.ParseAddress(d.To)
+	if err != nil {
+		return digest{}, microsub.InvalidRequestError("%s is not an email address", d.To)
+	}
+	d.To = to.Address
+	if d.Schedule != "" {
+		if _, err := cron.Parse(d.Schedule); err != nil {
+			return digest{}, microsub.InvalidRequestError("invalid schedule: %v", err)
+		}
+	}
+	if d.Created.IsZero() {
+		d.Created = time.Now()
+	}
+
+	b.lock.Lock()
+	if b.Digests == nil {
+		b.Digests = make(map[string]digest)
+	}
+	// Only the stored digest says if the address is confirmed
+	old, ok := b.Digests[channel]
+	if ok && strings.EqualFold(old.To, d.To) {
+		d.Confirmed, d.Token = old.Confirmed, old.Token
+	} else {
+		d.Confirmed, d.Token = false, ""
+	}
+	if !d.Confirmed && d.Token == "" {
+		d.Token = randomHex(16)
+	}
+	b.Digests[channel] = d
+	b.lock.Unlock()
+
+	return d, b.save()
+}
+
+// confirmDigest confirms the address of the digest of channel, when token is
+// the token of its confirmation link
+func (b *memoryBackend) confirmDigest(channel, token string) error {
+	b.lock.Lock()
+	d, ok := b.Digests[channel]
+	if !ok || d.Token == "" || subtle.ConstantTimeCompare([]byte(d.Token), []byte(token)) != 1 {
+		b.lock.Unlock()
+		return microsub.NotFoundError("confirmation link is not valid")
+	}
+	d.Confirmed, d.Token = true, ""
+	b.Digests[channel] = d
+	b.lock.Unlock()
+
+	return b.save()
+}
+
+// removeDigest stops the digest of channel
+func (b *memoryBackend) removeDigest(channel string) error {
+	b.lock.Lock()
+	delete(b.Digests, channel)
+	b.lock.Unlock()
+
+	return b.save()
+}
+
+// digest returns the digest of channel
+func (b *memoryBackend) digest(channel string) (digest, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	d, ok := b.Digests[channel]
+	return d, ok
+}
+
+// digests returns the digests of all channels
+func (b *memoryBackend) digests() map[string]digest {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	digests := make(map[string]digest, len(b.Digests))
+	for k, v := range b.Digests {
+		digests[k] = v
+	}
+	return digests
+}
+
+// channelName returns the name of channel, or the uid when it doesn't exist
+func (b *memoryBackend) channelName(uid string) string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if c, ok := b.Channels[uid]; ok && c.Name != "" {
+		return c.Name
+	}
+	if uid == "notifications" {
+		return "Notifications"
+	}
+	return uid
+}
+
+// nextDigest returns the time of the digest after last
+func nextDigest(d digest, defaultSchedule string, last time.Time) (time.Time, error) {
+	spec := d.Schedule
+	if spec == "" {
+		spec = defaultSchedule
+	}
+	s, err := cron.Parse(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if last.IsZero() {
+		last = d.Created
+	}
+	return s.Next(last.In(time.Local)), nil
+}
+
+// run checks every minute which digests should be sent, until ctx is
+// cancelled
+func (db *digestBackend) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		db.sendDue(ctx, time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendDue sends the digests that were scheduled before now. A digest that
+// could not be sent is not sent again until its next time, the unread items
+// are then part of the next digest.
+func (db *digestBackend) sendDue(ctx context.Context, now time.Time) {
+	cfg := currentConfig()
+	if cfg.SMTP.Addr == "" {
+		return
+	}
+
+	for _, user := range db.users.all() {
+		for channel, d := range user.backend.digests() {
+			if ctx.Err() != nil {
+				return
+			}
+			if !d.Confirmed {
+				continue
+			}
+
+			key := user.backend.prefix + "digest:" + channel + ":last_sent"
+			last, err := db.lastSent(key)
+			if err != nil {
+				logger.Errorf("could not read last digest of %s for %s: %v", channel, user.id, err)
+				continue
+			}
+			next, err := nextDigest(d, cfg.Digests.Schedule, last)
+			if err != nil {
+				logger.Errorf("invalid schedule of digest %s for %s: %v", channel, user.id, err)
+				continue
+			}
+			if next.IsZero() || next.After(now) {
+				continue
+			}
+
+			if err := db.setLastSent(key, now); err != nil {
+				logger.Errorf("could not save last digest of %s for %s: %v", channel, user.id, err)
+				continue
+			}
+
+			n, err := db.sendDigest(user.backend, channel, d, cfg)
+			if err != nil {
+				metricDigests.With("error").Inc()
+				logger.Errorf("could not send digest of %s for %s: %v", channel, user.id, err)
+				continue
+			}
+			if n > 0 {
+				metricDigests.With("ok").Inc()
+				logger.Infof("sent digest of %s with %d items for %s", channel, n, user.id)
+			}
+		}
+	}
+}
+
+func (db *digestBackend) lastSent(key string) (time.Time, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	sec, err := redis.Int64(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+func (db *digestBackend) setLastSent(key string, t time.Time) error {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", key, t.Unix())
+	return err
+}
+
+// sendDigest sends the unread items of channel, and returns the number of
+// items that were sent. Nothing is sent when there are no unread items.
+func (db *digestBackend) sendDigest(b *memoryBackend, channel string, d digest, cfg Config) (int, error) {
+	items, err := unreadItems(b.getTimeline(channel), cfg.Digests.MaxItems)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read timeline")
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	msg, err := digestMessage(cfg.SMTP.From, d.To, b.channelName(channel), items, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	err = db.send(cfg.SMTP, d.To, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	if d.MarkRead {
+		var uids []string
+		for _, item := range items {
+			uids = append(uids, item.ID)
+		}
+		err = b.MarkRead(channel, uids)
+		if err != nil {
+			return len(items), errors.Wrap(err, "could not mark digest items read")
+		}
+	}
+
+	return len(items), nil
+}
+
+// unreadItems returns at most max unread items of tl
+func unreadItems(tl timeline.Backend, max int) ([]microsub.Item, error) {
+	var items []microsub.Item
+	seen := make(map[string]bool)
+
+	after := ""
+	for len(items) < max {
+		page, err := tl.Items("", after)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if item.Read || seen[item.ID] {
+				continue
+			}
+			seen[item.ID] = true
+			items = append(items, item)
+			if len(items) == max {
+				break
+			}
+		}
+		if len(page.Items) == 0 || page.Paging.After == "" || page.Paging.After == after {
+			break
+		}
+		after = page.Paging.After
+	}
+
+	return items, nil
+}
+
+// newDigestItem returns the parts of item that are shown in a digest
+func newDigestItem(item microsub.Item) digestItem {
+	di := digestItem{
+		Title:     item.Name,
+		Published: item.Published,
+		URL:       item.URL,
+		Text:      item.Summary,
+	}
+	if t, err := time.Parse(time.RFC3339, item.Published); err == nil {
+		di.Published = t.Format("2 Jan 2006 15:04")
+	}
+	if item.Author != nil {
+		di.Author = item.Author.Name
+	}
+	if di.Text == "" && item.Content != nil {
+		di.Text = item.Content.Text
+	}
+	di.Text = shorten(strings.Join(strings.Fields(di.Text), " "), 300)
+	if di.Title == "" || di.Title == di.Text {
+		di.Title = shorten(di.Text, 80)
+		di.Text = ""
+	}
+	if di.Title == "" {
+		di.Title = "Untitled"
+	}
+	return di
+}
+
+// shorten cuts s at a word boundary before n runes
+func shorten(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	cut := string(r[:n])
+	if i := strings.LastIndexByte(cut, ' '); i > n/2 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// digestMessage returns an email with a plain text and a HTML version of the
+// items
+func digestMessage(from, to, channel string, items []microsub.Item, now time.Time) ([]byte, error) {
+	data := digestData{Channel: channel}
+	for _, item := range items {
+		data.Items = append(data.Items, newDigestItem(item))
+	}
+
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := digestHTMLTemplate.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	subject := fmt.Sprintf("%d unread items in %s", len(items), channel)
+	if len(items) == 1 {
+		subject = fmt.Sprintf("1 unread item in %s", channel)
+	}
+
+	var msg bytes.Buffer
+	writeHeader := func(name, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+	writeHeader("From", from)
+	writeHeader("To", to)
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", subject))
+	writeHeader("Date", now.Format(time.RFC1123Z))
+	writeHeader("Message-ID", "<"+strconv.FormatInt(now.UnixNano(), 36)+"."+randomHex(8)+"@ekster>")
+	writeHeader("MIME-Version", "1.0")
+	writeHeader("Content-Type", "multipart/alternative; boundary="+w.Boundary())
+	msg.WriteString("\r\n")
+	_, err := io.Copy(&msg, &body)
+	return msg.Bytes(), err
+}
+
+// sendConfirmation sends the confirmation link of the digest of channel to
+// its address. Nothing is sent when no mail server is configured.
+func (db *digestBackend) sendConfirmation(b *memoryBackend, channel string, d digest, link string) error {
+	cfg := currentConfig()
+	if cfg.SMTP.Addr == "" {
+		return nil
+	}
+	msg := digestConfirmMessage(cfg.SMTP.From, d.To, b.channelName(channel), link, time.Now())
+	return db.send(cfg.SMTP, d.To, msg)
+}
+
+// digestConfirmMessage returns an email with the link that confirms the
+// address of a digest
+func digestConfirmMessage(from, to, channel, link string, now time.Time) []byte {
+	var body bytes.Buffer
+	qw := quotedprintable.NewWriter(&body)
+	fmt.Fprintf(qw, "Someone asked to send the unread items of %s to this address.\r\n\r\n", channel)
+	fmt.Fprintf(qw, "Open this link to start the digest:\r\n\r\n%s\r\n\r\n", link)
+	fmt.Fprintf(qw, "When you didn't ask for it, you can ignore this email. Nothing is sent until the link is opened.\r\n")
+	_ = qw.Close()
+
+	var msg bytes.Buffer
+	writeHeader := func(name, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+	writeHeader("From", from)
+	writeHeader("To", to)
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", "Confirm the digest of "+channel))
+	writeHeader("Date", now.Format(time.RFC1123Z))
+	writeHeader("Message-ID", "<"+strconv.FormatInt(now.UnixNano(), 36)+"."+randomHex(8)+"@ekster>")
+	writeHeader("MIME-Version", "1.0")
+	writeHeader("Content-Type", "text/plain; charset=utf-8")
+	writeHeader("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
+
+// sendMail sends msg to the mail server from the config
+func sendMail(cfg SMTPConfig, to string, msg []byte) error {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return errors.Wrap(err, "invalid smtp.from")
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(cfg.Addr)
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+
+	return smtp.SendMail(cfg.Addr, auth, from.Address, []string{to}, msg)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// pagedTimeline returns its items in pages of two
+type pagedTimeline struct {
+	items []microsub.Item
+}
+
+func (tl *pagedTimeline) Items(before, after string) (microsub.Timeline, error) {
+	start := 0
+	for i, item := range tl.items {
+		if item.ID == after {
+			start = i + 1
+		}
+	}
+	end := start + 2
+	if end > len(tl.items) {
+		end = len(tl.items)
+	}
+	page := microsub.Timeline{Items: tl.items[start:end]}
+	if end > start {
+		page.Paging.After = tl.items[end-1].ID
+	}
+	return page, nil
+}
+
+func (tl *pagedTimeline) Count() (int, error)                      { return len(tl.items), nil }
+func (tl *pagedTimeline) AddItem(item microsub.Item) (bool, error) { return false, nil }
+func (tl *pagedTimeline) MarkRead(uids []string) error             { return nil }
+func (tl *pagedTimeline) MarkUnread(uids []string) error           { return nil }
+func (tl *pagedTimeline) RemoveItem(uid string) error              { return nil }
+func (tl *pagedTimeline) HasItem(uid string) (bool, error)         { return false, nil }
+
+// smtpStandIn accepts one message and sends it on the returned channel
+func smtpStandIn(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 1)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var msg strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					msg.WriteString(strings.TrimPrefix(line, "."))
+				}
+				messages <- msg.String()
+				reply("250 ok")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().String(), messages
+}
+
+func TestMemoryBackend_Digests(t *testing.T) {
+	backend := newMemoryBackend("https://example.com/")
+
+	_, err := backend.setDigest("missing", digest{To: "me@example.com"})
+	assert.Equal(t, microsub.ErrorNotFound, microsub.ErrorCode(err))
+	_, err = backend.setDigest("home", digest{To: "not an address"})
+	assert.Equal(t, microsub.ErrorInvalidRequest, microsub.ErrorCode(err))
+	_, err = backend.setDigest("home", digest{To: "me@example.com", Schedule: "every day"})
+	assert.Equal(t, microsub.ErrorInvalidRequest, microsub.ErrorCode(err))
+
+	// The address can't be confirmed by the form
+	set, err := backend.setDigest("home", digest{To: "Me <me@example.com>", Schedule: "@weekly", MarkRead: true, Confirmed: true})
+	assert.NoError(t, err)
+	d, ok := backend.digest("home")
+	if assert.True(t, ok) {
+		assert.Equal(t, set, d)
+		assert.Equal(t, "me@example.com", d.To)
+		assert.Equal(t, "@weekly", d.Schedule)
+		assert.True(t, d.MarkRead)
+		assert.False(t, d.Created.IsZero())
+		assert.False(t, d.Confirmed)
+		assert.Len(t, d.Token, 32)
+	}
+
+	// The digests are saved with the channels and feeds
+	assert.Equal(t, d, backend.config().Digests["home"])
+
+	assert.Equal(t, microsub.ErrorNotFound, microsub.ErrorCode(backend.confirmDigest("home", "wrong")))
+	assert.Equal(t, microsub.ErrorNotFound, microsub.ErrorCode(backend.confirmDigest("missing", d.Token)))
+	assert.NoError(t, backend.confirmDigest("home", d.Token))
+	d, _ = backend.digest("home")
+	assert.True(t, d.Confirmed)
+	assert.Empty(t, d.Token)
+	// The link only works once
+	assert.Error(t, backend.confirmDigest("home", set.Token))
+
+	// Changing the schedule keeps the address confirmed
+	d.Schedule = "@daily"
+	d, err = backend.setDigest("home", d)
+	if assert.NoError(t, err) {
+		assert.True(t, d.Confirmed)
+	}
+
+	// A new address has to be confirmed again
+	d.To = "other@example.com"
+	d, err = backend.setDigest("home", d)
+	if assert.NoError(t, err) {
+		assert.False(t, d.Confirmed)
+		assert.Len(t, d.Token, 32)
+	}
+
+	assert.NoError(t, backend.removeDigest("home"))
+	_, ok = backend.digest("home")
+	assert.False(t, ok)
+}
+
+func TestDigestBackend_SendConfirmation(t *testing.T) {
+	backend := newMemoryBackend("https://example.com/")
+	d, err := backend.setDigest("home", digest{To: "me@example.com"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var sent []string
+	db := &digestBackend{send: func(cfg SMTPConfig, to string, msg []byte) error {
+		sent = append(sent, to)
+		m, err := mail.ReadMessage(bytes.NewReader(msg))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "me@example.com", m.Header.Get("To"))
+			body, _ := ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+			assert.Contains(t, string(body), "https://ekster.example.com/digest/confirm?token="+d.Token)
+		}
+		return nil
+	}}
+
+	// Without a mail server nothing is sent
+	assert.NoError(t, db.sendConfirmation(backend, "home", d, "https://ekster.example.com/digest/confirm?token="+d.Token))
+	assert.Empty(t, sent)
+
+	cfg := defaultConfig()
+	cfg.SMTP = SMTPConfig{Addr: "mail.example.com:25", From: "ekster@example.com"}
+	setCurrentConfig(cfg)
+	defer setCurrentConfig(defaultConfig())
+	assert.NoError(t, db.sendConfirmation(backend, "home", d, "https://ekster.example.com/digest/confirm?token="+d.Token))
+	assert.Equal(t, []string{"me@example.com"}, sent)
+}
+
+func TestNextDigest(t *testing.T) {
+	created := time.Date(2018, 7, 1, 12, 0, 0, 0, time.Local)
+
+	next, err := nextDigest(digest{Created: created}, "0 7 * * *", time.Time{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Date(2018, 7, 2, 7, 0, 0, 0, time.Local), next)
+	}
+
+	next, err = nextDigest(digest{Created: created, Schedule: "0 18 * * *"}, "0 7 * * *", created.Add(7*time.Hour))
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Date(2018, 7, 2, 18, 0, 0, 0, time.Local), next)
+	}
+}
+
+func TestUnreadItems(t *testing.T) {
+	tl := &pagedTimeline{items: []microsub.Item{
+		{ID: "1"}, {ID: "2", Read: true}, {ID: "3"}, {ID: "4"}, {ID: "5"},
+	}}
+
+	items, err := unreadItems(tl, 10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []microsub.Item{{ID: "1"}, {ID: "3"}, {ID: "4"}, {ID: "5"}}, items)
+	}
+
+	items, err = unreadItems(tl, 2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []microsub.Item{{ID: "1"}, {ID: "3"}}, items)
+	}
+}
+
+func TestSendDigest(t *testing.T) {
+	addr, messages := smtpStandIn(t)
+
+	items := []microsub.Item{
+		{
+			ID:        "1",
+			Name:      "Hello <world>",
+			URL:       "https://example.com/hello",
+			Published: "2018-07-01T12:00:00Z",
+			Author:    &microsub.Card{Name: "Peter"},
+			Summary:   "A post about <script>alert(1)</script> things",
+		},
+		{ID: "2", Content: &microsub.Content{Text: "Just a note"}},
+	}
+	now := time.Date(2018, 7, 2, 7, 0, 0, 0, time.UTC)
+
+	msg, err := digestMessage("Ekster <ekster@example.com>", "me@example.com", "Home", items, now)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = sendMail(SMTPConfig{Addr: addr, From: "Ekster <ekster@example.com>"}, "me@example.com", msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var received string
+	select {
+	case received = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(received))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "me@example.com", m.Header.Get("To"))
+	assert.Equal(t, "2 unread items in Home", m.Header.Get("Subject"))
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	parts := make(map[string]string)
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(quotedprintable.NewReader(p))
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+
+	text := parts["text/plain"]
+	assert.Contains(t, text, "Hello <world>")
+	assert.Contains(t, text, "by Peter, 1 Jul 2018 12:00")
+	assert.Contains(t, text, "https://example.com/hello")
+	assert.Contains(t, text, "Just a note")
+
+	html := parts["text/html"]
+	assert.Contains(t, html, `<a href="https://example.com/hello">Hello &lt;world&gt;</a>`)
+	assert.Contains(t, html, "&lt;script&gt;")
+	assert.NotContains(t, html, "<script>")
+	assert.Contains(t, html, "Just a note")
+}
+
+func TestShorten(t *testing.T) {
+	assert.Equal(t, "short", shorten("short", 10))
+	assert.Equal(t, "a few words…", shorten("a few words here", 13))
+}
+
+func TestMainHandler_ConfirmDigest(t *testing.T) {
+	users, cleanup := newTestUsers(t)
+	defer cleanup()
+
+	user, ok := users.lookup("https://example.com/")
+	if !assert.True(t, ok) {
+		return
+	}
+	d, err := user.backend.setDigest("home", digest{To: "me@example.com"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	h, err := newMainHandler(users, "https://microsub.example.com/", "", false, user.backend.pool)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", h.digestConfirmURL(user.id, "home", "wrong"), nil))
+	assert.Equal(t, 404, w.Code)
+	d, _ = user.backend.digest("home")
+	assert.False(t, d.Confirmed)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", h.digestConfirmURL(user.id, "home", d.Token), nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "is confirmed")
+	d, _ = user.backend.digest("home")
+	assert.True(t, d.Confirmed)
+}
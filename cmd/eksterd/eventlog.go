@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+// redisEventLog keeps the last events of a user in Redis, so they can be
+// replayed after a restart of eksterd
+type redisEventLog struct {
+	pool *redis.Pool
+
+	// key is a sorted set of the events, with the id as score
+	key string
+	// idKey contains the id of the last event
+	idKey string
+}
+
+// loggedEvent is the format of an event in the log
+type loggedEvent struct {
+	ID      int64           `json:"id"`
+	Event   string          `json:"event"`
+	Channel string          `json:"channel,omitempty"`
+	Data    json.RawMessage `json:"data"`
+	Short   json.RawMessage `json:"short,omitempty"`
+}
+
+func newRedisEventLog(pool *redis.Pool, prefix string) *redisEventLog {
+	return &redisEventLog{pool: pool, key: prefix + "events", idKey: prefix + "events:last_id"}
+}
+
+// Append gives msg the next id and adds it to the log
+func (l *redisEventLog) Append(msg sse.Message) (sse.Message, error) {
+	e := loggedEvent{Event: msg.Event, Channel: msg.Channel}
+	var err error
+	e.Data, err = json.Marshal(msg.Object)
+	if err != nil {
+		return msg, errors.Wrap(err, "could not encode event")
+	}
+	if msg.Short != nil {
+		e.Short, err = json.Marshal(msg.Short)
+		if err != nil {
+			return msg, errors.Wrap(err, "could not encode event")
+		}
+	}
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	e.ID, err = redis.Int64(conn.Do("INCR", l.idKey))
+	if err != nil {
+		return msg, errors.Wrap(err, "could not get event id")
+	}
+
+	entry, err := json.Marshal(e)
+	if err != nil {
+		return msg, errors.Wrap(err, "could not encode event")
+	}
+
+	// The event has an id, even when it isn't logged
+	msg.ID = e.ID
+
+	_, err = conn.Do("ZADD", l.key, e.ID, entry)
+	if err != nil {
+		return msg, errors.Wrap(err, "could not add event")
+	}
+	_, err = conn.Do("ZREMRANGEBYRANK", l.key, 0, -currentConfig().Events.LogSize-1)
+	if err != nil {
+		return msg, errors.Wrap(err, "could not trim event log")
+	}
+
+	return msg, nil
+}
+
+// LastID returns the id of the last event
+func (l *redisEventLog) LastID() (int64, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	id, err := redis.Int64(conn.Do("GET", l.idKey))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return id, err
+}
+
+// After returns the events after id
+func (l *redisEventLog) After(id int64) ([]sse.Message, bool, error) {
+	lastID, err := l.LastID()
+	if err != nil {
+		return nil, false, err
+	}
+	if id >= lastID {
+		return nil, id == lastID, nil
+	}
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	entries, err := redis.ByteSlices(conn.Do("ZRANGEBYSCORE", l.key, "("+strconv.FormatInt(id, 10), "+inf"))
+	if err != nil {
+		return nil, false, errors.Wrap(err, "could not get events")
+	}
+
+	var events []sse.Message
+	for _, entry := range entries {
+		var e loggedEvent
+		if err := json.Unmarshal(entry, &e); err != nil {
+			return nil, false, errors.Wrap(err, "could not decode event")
+		}
+		msg := sse.Message{ID: e.ID, Event: e.Event, Channel: e.Channel, Object: e.Data}
+		if e.Short != nil {
+			msg.Short = e.Short
+		}
+		events = append(events, msg)
+	}
+
+	return events, sse.CanReplay(id, lastID, events), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+func TestRedisEventLog_NoRedis(t *testing.T) {
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("no redis") }}
+	l := newRedisEventLog(pool, userPrefix("alice.example.org"))
+	assert.Equal(t, "user:alice.example.org:events", l.key)
+
+	// Without Redis the events are still sent, but without an id
+	msg, err := l.Append(sse.Message{Event: "new item"})
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), msg.ID)
+
+	_, ok, err := l.After(1)
+	assert.Error(t, err)
+	assert.False(t, ok)
+
+	// The broker sends a reset event when the log fails
+	broker := sse.NewBrokerWithOptions(sse.Options{Log: l})
+	defer broker.Close(sse.Message{Event: "shutdown"})
+	client, err := sse.StartConnectionAfter(broker, "1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "started", (<-client).Event)
+		assert.Equal(t, "reset", (<-client).Event)
+	}
+}
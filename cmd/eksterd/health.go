@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"p83.nl/go/ekster/pkg/logging"
+)
+
+// healthCheckTimeout is the time a single health check may take
+const healthCheckTimeout = 2 * time.Second
+
+// heartbeat records when a worker loop was last alive
+type heartbeat struct {
+	last atomic.Value
+}
+
+// beat marks the loop as alive
+func (h *heartbeat) beat() {
+	h.last.Store(time.Now())
+}
+
+// stop marks the loop as stopped
+func (h *heartbeat) stop() {
+	h.last.Store(time.Time{})
+}
+
+// check returns an error when the loop was not alive in the last maxAge
+func (h *heartbeat) check(maxAge time.Duration) error {
+	last, ok := h.last.Load().(time.Time)
+	if !ok || last.IsZero() {
+		return fmt.Errorf("not running")
+	}
+	if age := time.Since(last); age > maxAge {
+		return fmt.Errorf("last heartbeat %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// healthCheck checks one component of the server
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthResponse is the body of /healthz and /readyz. The endpoints are
+// public, so the response only has the overall status. The failed checks are
+// logged.
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+// healthHandler runs the checks and responds with 200 OK when all of them
+// pass, or with 503 Service Unavailable when one of them fails
+type healthHandler struct {
+	checks []healthCheck
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	res := healthResponse{Status: "ok"}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			if err := runHealthCheck(r.Context(), c); err != nil {
+				lock.Lock()
+				res.Status = "fail"
+				lock.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if res.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(&res)
+	if err != nil {
+		logger.Errorf("could not write health response: %v", err)
+	}
+}
+
+// runHealthCheck runs c with a timeout, a failure is logged
+func runHealthCheck(ctx context.Context, c healthCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timeout after %s", healthCheckTimeout)
+	}
+
+	if err != nil {
+		logging.FromContext(ctx).Warn("health check failed", "component", c.name, "err", err, "duration", time.Since(start).Round(time.Microsecond))
+	}
+	return err
+}
+
+// checkRedis pings the Redis server
+func checkRedis(pool *redis.Pool) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn, err := pool.GetContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = redis.DoWithTimeout(conn, healthCheckTimeout, "PING")
+		return err
+	}
+}
+
+// checkStores checks the stores of all users
+func checkStores(users *userBackends) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		for _, user := range users.all() {
+			if user.backend.store == nil {
+				continue
+			}
+			if err := user.backend.store.check(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// checkPollers checks that the feeds of all users are fetched
+func checkPollers(users *userBackends) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		maxAge := 3 * currentConfig().Fetch.Interval
+		for _, user := range users.all() {
+			if err := user.backend.heartbeat.check(maxAge); err != nil {
+				return fmt.Errorf("poller of user %s: %v", user.id, err)
+			}
+		}
+		return nil
+	}
+}
+
+// checkWebSub checks that WebSub subscriptions are renewed
+func checkWebSub(hub *hubIncomingBackend) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return hub.heartbeat.check(3 * currentConfig().WebSub.ResubscribeInterval)
+	}
+}
+
+// checkTemplates checks that the templates can be parsed, e.g. after a
+// change in the template directory
+func checkTemplates(ts *templateSet) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := ts.parse()
+		return err
+	}
+}
+
+// livenessChecks are the checks of /healthz, they fail when eksterd should be restarted
+func (app *App) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{"poller", checkPollers(app.users)},
+		{"websub", checkWebSub(app.hubBackend)},
+	}
+}
+
+// readinessChecks are the checks of /readyz, they fail when eksterd can't handle requests
+func (app *App) readinessChecks() []healthCheck {
+	checks := []healthCheck{
+		{"redis", checkRedis(app.options.pool)},
+		{"store", checkStores(app.users)},
+	}
+	checks = append(checks, app.livenessChecks()...)
+	if app.templates != nil {
+		checks = append(checks, healthCheck{"templates", checkTemplates(app.templates)})
+	}
+	return checks
+}
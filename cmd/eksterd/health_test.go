@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var h heartbeat
+	assert.EqualError(t, h.check(time.Minute), "not running")
+
+	h.beat()
+	assert.NoError(t, h.check(time.Minute))
+
+	h.last.Store(time.Now().Add(-time.Hour))
+	assert.EqualError(t, h.check(time.Minute), "last heartbeat 1h0m0s ago")
+
+	h.stop()
+	assert.EqualError(t, h.check(time.Minute), "not running")
+}
+
+func TestHealthHandler(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("connection refused") }
+
+	w := httptest.NewRecorder()
+	h := &healthHandler{checks: []healthCheck{{"a", ok}, {"b", ok}}}
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var res healthResponse
+	if assert.NoError(t, json.NewDecoder(w.Body).Decode(&res)) {
+		assert.Equal(t, "ok", res.Status)
+	}
+
+	w = httptest.NewRecorder()
+	h = &healthHandler{checks: []healthCheck{{"a", ok}, {"redis", fail}}}
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 503, w.Code)
+
+	// The errors are only logged
+	assert.NotContains(t, w.Body.String(), "redis")
+	assert.NotContains(t, w.Body.String(), "connection refused")
+	res = healthResponse{}
+	if assert.NoError(t, json.NewDecoder(w.Body).Decode(&res)) {
+		assert.Equal(t, "fail", res.Status)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/readyz", nil))
+	assert.Equal(t, 405, w.Code)
+}
+
+func TestCheckRedis(t *testing.T) {
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("no redis") }}
+	assert.EqualError(t, checkRedis(pool)(context.Background()), "no redis")
+}
+
+func TestCheckPollers(t *testing.T) {
+	users, cleanup := newTestUsers(t)
+	defer cleanup()
+
+	check := checkPollers(users)
+	assert.EqualError(t, check(context.Background()), "poller of user example.com: not running")
+
+	users.primary.backend.heartbeat.beat()
+	assert.NoError(t, check(context.Background()))
+}
+
+func TestCheckStores(t *testing.T) {
+	users, cleanup := newTestUsers(t)
+	defer cleanup()
+
+	check := checkStores(users)
+	assert.NoError(t, check(context.Background()))
+
+	users.primary.backend.store = newConfigStore(filepath.Join(users.dir, "missing", "ekster.json"))
+	assert.Error(t, check(context.Background()))
+}
+
+func TestCheckTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Without files in the directory, the compiled in templates are used
+	ts, err := newTemplateSet(dir, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, checkTemplates(ts)(context.Background()))
+
+	_ = ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(`{{define "content"}}{{ if }}{{end}}`), 0644)
+	assert.Error(t, checkTemplates(ts)(context.Background()))
+}
@@ -5,26 +5,36 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
+	"sync"
 
 	"p83.nl/go/ekster/pkg/indieauth"
+	"p83.nl/go/ekster/pkg/logging"
 	"p83.nl/go/ekster/pkg/microsub"
 	"p83.nl/go/ekster/pkg/util"
 
-	"github.com/alecthomas/template"
 	"github.com/gomodule/redigo/redis"
 	"willnorris.com/go/microformats"
 )
 
 type mainHandler struct {
-	Backend     *memoryBackend
-	BaseURL     string
-	TemplateDir string
-	pool        *redis.Pool
+	Users   *userBackends
+	BaseURL string
+	// Push sends Web Push notifications, without it devices can't subscribe
+	Push *pushBackend
+	// Digests sends the confirmation emails of digests
+	Digests *digestBackend
+	pool    *redis.Pool
+
+	templates *templateSet
+	static    http.Handler
+
+	secretLock sync.Mutex
+	secret     []byte
+	// secretSource is the secret from the config that secret is based on
+	secretSource string
 }
 
 type session struct {
@@ -34,6 +44,12 @@ type session struct {
 	State                 string `redis:"state"`
 	LoggedIn              bool   `redis:"logged_in"`
 	NextURI               string `redis:"next_uri"`
+	TokenEndpoint         string `redis:"token_endpoint"`
+	// CSRF is the token that forms send with the session
+	CSRF      string `redis:"csrf"`
+	Created   int64  `redis:"created"`
+	LastSeen  int64  `redis:"last_seen"`
+	UserAgent string `redis:"user_agent"`
 }
 
 type authResponse struct {
@@ -48,8 +64,9 @@ type authTokenResponse struct {
 }
 
 type indexPage struct {
-	Session session
-	Baseurl string
+	Session          session
+	Baseurl          string
+	MicrosubEndpoint string
 }
 type settingsPage struct {
 	Session session
@@ -61,9 +78,35 @@ type settingsPage struct {
 
 	Channels []microsub.Channel
 	Feeds    []microsub.Feed
+	Webhooks []webhook
+	Digest   *digest
+
+	// DigestSchedule is the schedule of digests without a schedule
+	DigestSchedule string
+	// MailEnabled is true when a mail server is configured
+	MailEnabled bool
 }
 type logsPage struct {
 	Session session
+	Entries []logging.Entry
+}
+type pushPage struct {
+	Session       session
+	Channels      []microsub.Channel
+	ChannelNames  map[string]string
+	Subscriptions []pushSubscription
+	// PublicKey is the VAPID key the browser needs to subscribe
+	PublicKey string
+}
+type sessionsPage struct {
+	Session  session
+	Sessions []sessionInfo
+}
+type webhooksPage struct {
+	Session     session
+	Channels    map[string]string
+	Entries     []webhookLogEntry
+	DeadLetters []webhookDelivery
 }
 
 type authPage struct {
@@ -88,71 +131,28 @@ type authRequest struct {
 	AccessToken string `redis:"access_token"`
 }
 
-func newMainHandler(backend *memoryBackend, baseURL, templateDir string, pool *redis.Pool) (*mainHandler, error) {
-	h := &mainHandler{Backend: backend}
+// newMainHandler creates the handler of the frontend. The templates in
+// templateDir replace the compiled in templates, with reloadTemplates they are
+// parsed again when they change.
+func newMainHandler(users *userBackends, baseURL, templateDir string, reloadTemplates bool, pool *redis.Pool) (*mainHandler, error) {
+	h := &mainHandler{Users: users}
 
 	h.BaseURL = baseURL
 
-	templateDir = strings.TrimRight(templateDir, "/")
-	h.TemplateDir = templateDir
+	templates, err := newTemplateSet(templateDir, reloadTemplates)
+	if err != nil {
+		return nil, err
+	}
+	h.templates = templates
+	h.static = templates.staticHandler()
 
 	h.pool = pool
 
 	return h, nil
 }
 
-func (h *mainHandler) templateFile(filename string) string {
-	return fmt.Sprintf("%s/%s", h.TemplateDir, filename)
-}
-
 func (h *mainHandler) renderTemplate(w io.Writer, filename string, data interface{}) error {
-	t, err := template.ParseFiles(h.templateFile("base.html"), h.templateFile(filename))
-	if err != nil {
-		return err
-	}
-	err = t.ExecuteTemplate(w, filename, data)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func getSessionCookie(w http.ResponseWriter, r *http.Request) string {
-	c, err := r.Cookie("session")
-	sessionVar := util.RandStringBytes(16)
-
-	if err == http.ErrNoCookie {
-		newCookie := &http.Cookie{
-			Name:    "session",
-			Value:   sessionVar,
-			Expires: time.Now().Add(24 * time.Hour),
-		}
-
-		http.SetCookie(w, newCookie)
-	} else if err == nil {
-		sessionVar = c.Value
-	}
-
-	return sessionVar
-}
-
-func loadSession(sessionVar string, conn redis.Conn) (session, error) {
-	var sess session
-	sessionKey := "session:" + sessionVar
-	data, err := redis.Values(conn.Do("HGETALL", sessionKey))
-	if err != nil {
-		return sess, err
-	}
-	err = redis.ScanStruct(data, &sess)
-	if err != nil {
-		return sess, err
-	}
-	return sess, nil
-}
-
-func saveSession(sessionVar string, sess *session, conn redis.Conn) error {
-	_, err := conn.Do("HMSET", redis.Args{}.Add("session:"+sessionVar).AddFlat(sess)...)
-	return err
+	return h.templates.execute(w, filename, data)
 }
 
 func verifyAuthCode(code, redirectURI, authEndpoint, clientID string) (bool, *authResponse, error) {
@@ -214,16 +214,28 @@ func isLoggedIn(backend *memoryBackend, sess *session) bool {
 		return true
 	}
 
-	if sess.Me != backend.Me {
+	if !sameUser(sess.Me, backend.Me) {
 		return false
 	}
 
 	return true
 }
 
+// sessionBackend returns the backend of the user that is logged in with the session
+func (h *mainHandler) sessionBackend(sess *session) (*memoryBackend, bool) {
+	if !sess.LoggedIn {
+		return nil, false
+	}
+	backend, ok := h.Users.backendFor(sess.Me)
+	if !ok || !isLoggedIn(backend, sess) {
+		return nil, false
+	}
+	return backend, true
+}
+
 func performIndieauthCallback(clientID string, r *http.Request, sess *session) (bool, *authResponse, error) {
 	state := r.Form.Get("state")
-	if state != sess.State {
+	if state == "" || state != sess.State {
 		return false, &authResponse{}, fmt.Errorf("mismatched state")
 	}
 
@@ -231,6 +243,40 @@ func performIndieauthCallback(clientID string, r *http.Request, sess *session) (
 	return verifyAuthCode(code, sess.RedirectURI, sess.AuthorizationEndpoint, clientID)
 }
 
+// verifyMe returns the url of the user that logged in. The authorization
+// endpoint can return another url than the one that was entered, that url is
+// only accepted when it's on the same host and discover finds the same
+// authorization endpoint for it.
+func verifyMe(entered, authorizationEndpoint, returned string, discover func(string) (parsedEndpoints, error)) (string, error) {
+	if returned == "" {
+		return "", fmt.Errorf("the authorization endpoint didn't return a me")
+	}
+	if sameUser(entered, returned) {
+		return entered, nil
+	}
+
+	enteredURL, err := url.Parse(entered)
+	if err != nil {
+		return "", err
+	}
+	returnedURL, err := url.Parse(returned)
+	if err != nil || (returnedURL.Scheme != "http" && returnedURL.Scheme != "https") {
+		return "", fmt.Errorf("%q is not a valid url", returned)
+	}
+	if !strings.EqualFold(enteredURL.Host, returnedURL.Host) {
+		return "", fmt.Errorf("%s is not on the host of %s", returned, entered)
+	}
+
+	endpoints, err := discover(returned)
+	if err != nil {
+		return "", fmt.Errorf("could not discover the endpoints of %s: %v", returned, err)
+	}
+	if endpoints.AuthorizationEndpoint == nil || endpoints.AuthorizationEndpoint.String() != authorizationEndpoint {
+		return "", fmt.Errorf("%s uses another authorization endpoint than %s", returned, entered)
+	}
+	return returned, nil
+}
+
 type app struct {
 	Name    string
 	IconURL string
@@ -275,28 +321,50 @@ func getAppInfo(clientID string) (app, error) {
 }
 
 func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+
+	if strings.HasPrefix(r.URL.Path, "/static/") {
+		h.static.ServeHTTP(w, r)
+		return
+	}
+
 	conn := h.pool.Get()
 	defer conn.Close()
 
 	err := r.ParseForm()
 	if err != nil {
-		log.Println(err)
+		logger.Warn("could not parse form", "err", err)
 		http.Error(w, fmt.Sprintf("Bad Request: %s", err.Error()), 400)
 		return
 	}
 
+	// Forms of the web interface need the CSRF token of the session. The token
+	// endpoint is used by clients that don't have a session.
+	if r.Method == http.MethodPost && r.URL.Path != "/auth/token" && !h.checkCSRF(r, conn) {
+		http.Error(w, "Forbidden: the form has expired, please go back and try again", 403)
+		return
+	}
+
+	if r.URL.Path == "/reader" || strings.HasPrefix(r.URL.Path, "/reader/") {
+		h.serveReader(w, r, conn)
+		return
+	}
+
 	if r.Method == http.MethodGet {
 		if r.URL.Path == "/" {
-			sessionVar := getSessionCookie(w, r)
-			sess, err := loadSession(sessionVar, conn)
+			_, sess, err := h.startSession(w, r, conn)
 			if err != nil {
-				fmt.Fprintf(w, "ERROR: %q\n", err)
+				logger.Errorf("could not start session: %v", err)
+				http.Error(w, "could not start session", 500)
 				return
 			}
 
 			var page indexPage
 			page.Session = sess
 			page.Baseurl = strings.TrimRight(h.BaseURL, "/")
+			if _, ok := h.sessionBackend(&sess); ok {
+				page.MicrosubEndpoint = h.Users.microsubEndpoint(sess.Me)
+			}
 
 			err = h.renderTemplate(w, "index.html", page)
 			if err != nil {
@@ -304,29 +372,39 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		} else if r.URL.Path == "/session/callback" {
-			c, err := r.Cookie("session")
-			if err == http.ErrNoCookie {
+			sessionID, sess, ok := h.currentSession(r, conn)
+			if !ok {
 				http.Redirect(w, r, "/", 302)
 				return
-			} else if err != nil {
-				http.Error(w, "could not read cookie", 500)
-				return
 			}
 
-			sessionVar := c.Value
-			sess, err := loadSession(sessionVar, conn)
-
 			verified, authResponse, err := performIndieauthCallback(h.BaseURL, r, &sess)
 			if err != nil {
 				fmt.Fprintf(w, "ERROR: %q\n", err)
 				return
 			}
 			if verified {
-				sess.Me = authResponse.Me
-				sess.LoggedIn = true
-				saveSession(sessionVar, &sess, conn)
-				log.Printf("SESSION: %#v\n", sess)
-				if sess.NextURI != "" {
+				me, err := verifyMe(sess.Me, sess.AuthorizationEndpoint, authResponse.Me, getEndpoints)
+				if err != nil {
+					logger.Warn("rejected login", "me", sess.Me, "returned", authResponse.Me, "err", err)
+					http.Error(w, fmt.Sprintf("Forbidden: %s", err), 403)
+					return
+				}
+				_, err = h.Users.provision(me, sess.TokenEndpoint)
+				if err != nil {
+					logger.Warn("could not provision user", "me", me, "err", err)
+					http.Error(w, fmt.Sprintf("Forbidden: %s", err), 403)
+					return
+				}
+				sess, err = h.login(w, r, conn, sessionID, sess, me)
+				if err != nil {
+					logger.Errorf("could not save session: %v", err)
+					http.Error(w, "could not save session", 500)
+					return
+				}
+				logger.Info("logged in", "me", sess.Me)
+				// Only return to pages of this server
+				if strings.HasPrefix(sess.NextURI, "/") && !strings.HasPrefix(sess.NextURI, "//") {
 					http.Redirect(w, r, sess.NextURI, 302)
 				} else {
 					http.Redirect(w, r, "/", 302)
@@ -335,30 +413,28 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		} else if r.URL.Path == "/settings/channel" {
-			c, err := r.Cookie("session")
-			if err == http.ErrNoCookie {
-				http.Redirect(w, r, "/", 302)
-				return
-			}
-			sessionVar := c.Value
-			sess, err := loadSession(sessionVar, conn)
-
-			if !isLoggedIn(h.Backend, &sess) {
-				w.WriteHeader(401)
-				fmt.Fprintf(w, "Unauthorized")
+			_, sess, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
 				return
 			}
 
 			var page settingsPage
 			page.Session = sess
 			currentChannel := r.URL.Query().Get("uid")
-			page.Channels, err = h.Backend.ChannelsGetList()
-			page.Feeds, err = h.Backend.FollowGetList(currentChannel)
+			page.Channels, err = backend.ChannelsGetList()
+			page.Feeds, err = backend.FollowGetList(currentChannel)
+			page.Webhooks = backend.webhooks(currentChannel)
+			if d, ok := backend.digest(currentChannel); ok {
+				page.Digest = &d
+			}
+			cfg := currentConfig()
+			page.DigestSchedule = cfg.Digests.Schedule
+			page.MailEnabled = cfg.SMTP.Addr != ""
 
 			for _, v := range page.Channels {
 				if v.UID == currentChannel {
 					page.CurrentChannel = v
-					if setting, e := h.Backend.Settings[v.UID]; e {
+					if setting, e := backend.channelSetting(v.UID); e {
 						page.CurrentSetting = setting
 					} else {
 						page.CurrentSetting = channelSetting{}
@@ -396,47 +472,141 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		} else if r.URL.Path == "/logs" {
-			c, err := r.Cookie("session")
-			if err == http.ErrNoCookie {
-				http.Redirect(w, r, "/", 302)
+			_, sess, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
 				return
 			}
-			sessionVar := c.Value
-			sess, err := loadSession(sessionVar, conn)
 
-			if !isLoggedIn(h.Backend, &sess) {
-				w.WriteHeader(401)
-				fmt.Fprintf(w, "Unauthorized")
+			// The logs contain messages about all users
+			if backend != h.Users.primary.backend {
+				w.WriteHeader(403)
+				fmt.Fprintf(w, "Forbidden")
 				return
 			}
 
 			var page logsPage
 			page.Session = sess
+			page.Entries = logRing.Entries()
 
 			err = h.renderTemplate(w, "logs.html", page)
 			if err != nil {
 				fmt.Fprintf(w, "ERROR: %s\n", err)
 			}
 			return
-		} else if r.URL.Path == "/settings" {
-			c, err := r.Cookie("session")
-			if err == http.ErrNoCookie {
-				http.Redirect(w, r, "/", 302)
+		} else if r.URL.Path == "/settings/webhooks" {
+			_, sess, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
 				return
 			}
-			sessionVar := c.Value
-			sess, err := loadSession(sessionVar, conn)
 
-			if !isLoggedIn(h.Backend, &sess) {
-				w.WriteHeader(401)
-				fmt.Fprintf(w, "Unauthorized")
+			var page webhooksPage
+			page.Session = sess
+			page.Channels = make(map[string]string)
+			channels, _ := backend.ChannelsGetList()
+			for _, c := range channels {
+				page.Channels[c.UID] = c.Name
+			}
+			page.Entries, err = webhookLog(conn, backend.prefix)
+			if err != nil {
+				logger.Errorf("could not read webhook log: %v", err)
+			}
+			page.DeadLetters, err = webhookDeadLetters(conn, backend.prefix)
+			if err != nil {
+				logger.Errorf("could not read webhook dead letters: %v", err)
+			}
+
+			err = h.renderTemplate(w, "webhooks.html", page)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+			}
+			return
+		} else if r.URL.Path == "/settings/push" {
+			_, sess, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
+				return
+			}
+
+			var page pushPage
+			page.Session = sess
+			page.Channels, _ = backend.ChannelsGetList()
+			page.ChannelNames = make(map[string]string)
+			for _, c := range page.Channels {
+				page.ChannelNames[c.UID] = c.Name
+			}
+			page.Subscriptions = backend.pushSubscriptions()
+			if h.Push != nil {
+				page.PublicKey, err = h.Push.publicKey()
+				if err != nil {
+					logger.Errorf("could not load VAPID key: %v", err)
+				}
+			}
+
+			err = h.renderTemplate(w, "push.html", page)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+			}
+			return
+		} else if r.URL.Path == "/settings/sessions" {
+			sessionID, sess, _, ok := h.loggedIn(w, r, conn)
+			if !ok {
+				return
+			}
+
+			var page sessionsPage
+			page.Session = sess
+			page.Sessions, err = userSessions(conn, sess.Me, sessionID)
+			if err != nil {
+				logger.Errorf("could not read sessions: %v", err)
+			}
+
+			err = h.renderTemplate(w, "sessions.html", page)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+			}
+			return
+		} else if r.URL.Path == "/push-sw.js" {
+			// The service worker is served from the root, so it can show
+			// notifications for all pages
+			script, err := h.templates.readFile("push-sw.js")
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(script)
+			return
+		} else if r.URL.Path == "/digest/confirm" {
+			// The link from the confirmation email, it works without a session
+			user, ok := h.Users.get(r.FormValue("user"))
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			channel := r.FormValue("channel")
+			err = user.backend.confirmDigest(channel, r.FormValue("token"))
+			if code := microsub.ErrorCode(err); code != "" {
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			if err != nil {
+				logger.Errorf("could not confirm digest: %v", err)
+				http.Error(w, "could not confirm digest", 500)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "The digest of %s is confirmed.\n", user.backend.channelName(channel))
+			return
+		} else if r.URL.Path == "/settings" {
+			_, sess, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
 				return
 			}
 
 			var page settingsPage
 			page.Session = sess
-			page.Channels, err = h.Backend.ChannelsGetList()
-			// page.Feeds = h.Backend.Feeds
+			page.Channels, err = backend.ChannelsGetList()
+			// page.Feeds = backend.Feeds
 
 			err = h.renderTemplate(w, "settings.html", page)
 			if err != nil {
@@ -444,23 +614,23 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		} else if r.URL.Path == "/auth" {
-			// check if we are logged in
-			// TODO: if not logged in, make sure we get back here
-
-			sessionVar := getSessionCookie(w, r)
+			// Without a login, the user returns here after logging in
+			sessionID, sess, err := h.startSession(w, r, conn)
+			if err != nil {
+				logger.Errorf("could not start session: %v", err)
+				http.Error(w, "could not start session", 500)
+				return
+			}
 
-			sess, err := loadSession(sessionVar, conn)
+			sess.NextURI = r.URL.String()
+			_ = saveSession(sessionID, &sess, conn)
 
-			if !isLoggedIn(h.Backend, &sess) {
-				sess.NextURI = r.URL.String()
-				saveSession(sessionVar, &sess, conn)
+			backend, ok := h.sessionBackend(&sess)
+			if !ok {
 				http.Redirect(w, r, "/", 302)
 				return
 			}
 
-			sess.NextURI = r.URL.String()
-			saveSession(sessionVar, &sess, conn)
-
 			query := r.URL.Query()
 
 			// responseType := query.Get("response_type") // TODO: check response_type
@@ -473,8 +643,9 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				scope = "create"
 			}
 
+			// The token is for the user that is logged in
 			authReq := authRequest{
-				Me:          me,
+				Me:          sess.Me,
 				ClientID:    clientID,
 				RedirectURI: redirectURI,
 				Scope:       scope,
@@ -483,10 +654,11 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			_, err = conn.Do("HMSET", redis.Args{}.Add("state:"+state).AddFlat(&authReq)...)
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not save auth request", "err", err)
 				fmt.Fprintf(w, "ERROR: %q\n", err)
 				return
 			}
+			_, _ = conn.Do("EXPIRE", "state:"+state, 10*60)
 
 			var page authPage
 			page.Session = sess
@@ -495,11 +667,11 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			page.RedirectURI = redirectURI
 			page.Scope = scope
 			page.State = state
-			page.Channels, err = h.Backend.ChannelsGetList()
+			page.Channels, err = backend.ChannelsGetList()
 
 			app, err := getAppInfo(clientID)
 			if err != nil {
-				log.Println(err)
+				logger.Warn("could not get app info", "client_id", clientID, "err", err)
 			}
 			page.App = app
 
@@ -511,14 +683,12 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if r.Method == http.MethodPost {
 		if r.URL.Path == "/session" {
-			c, err := r.Cookie("session")
-			if err == http.ErrNoCookie {
+			sessionID, sess, ok := h.currentSession(r, conn)
+			if !ok {
 				http.Redirect(w, r, "/", 302)
 				return
 			}
 
-			sessionVar := c.Value
-
 			// redirect to endpoint
 			me := r.Form.Get("url")
 
@@ -528,23 +698,17 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			state := util.RandStringBytes(16)
+			state := randomHex(16)
 			redirectURI := fmt.Sprintf("%s/session/callback", h.BaseURL)
 
-			sess, err := loadSession(sessionVar, conn)
-
-			if err != nil {
-				http.Redirect(w, r, "/", 302)
-				return
-			}
-
 			sess.AuthorizationEndpoint = endpoints.AuthorizationEndpoint.String()
+			sess.TokenEndpoint = endpoints.TokenEndpoint.String()
 			sess.Me = endpoints.Me.String()
 			sess.State = state
 			sess.RedirectURI = redirectURI
 			sess.LoggedIn = false
 
-			err = saveSession(sessionVar, &sess, conn)
+			err = saveSession(sessionID, &sess, conn)
 			if err != nil {
 				http.Redirect(w, r, "/", 302)
 				return
@@ -555,9 +719,14 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			return
 		} else if r.URL.Path == "/session/logout" {
-			httpSessionLogout(r, w, conn)
+			h.logout(w, r, conn)
 			return
 		} else if r.URL.Path == "/auth/approve" {
+			_, sess, _, ok := h.loggedIn(w, r, conn)
+			if !ok {
+				return
+			}
+
 			// create a code
 			code := util.RandStringBytes(32)
 			state := r.FormValue("state")
@@ -565,45 +734,50 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			values, err := redis.Values(conn.Do("HGETALL", "state:"+state))
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not load auth request", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
 			var auth authRequest
 			err = redis.ScanStruct(values, &auth)
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not load auth request", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
+			// Only the user that started the request can approve it
+			if auth.RedirectURI == "" || !sameUser(auth.Me, sess.Me) {
+				http.Error(w, "Forbidden: unknown authorization request", 403)
+				return
+			}
+			_, _ = conn.Do("DEL", "state:"+state)
 			auth.Code = code
 			auth.Channel = channel
 			_, err = conn.Do("HMSET", redis.Args{}.Add("code:"+code).AddFlat(&auth)...)
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not save auth code", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
 			_, err = conn.Do("EXPIRE", "code:"+code, 5*60)
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not set expiry of auth code", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
 
 			redirectURI, err := url.Parse(auth.RedirectURI)
 			if err != nil {
-				log.Println(err)
+				logger.Warn("could not parse redirect uri", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
-			log.Println(redirectURI)
 			q := redirectURI.Query()
 			q.Add("code", code)
 			q.Add("state", auth.State)
 			redirectURI.RawQuery = q.Encode()
 
-			log.Println(redirectURI)
+			logger.Debug("auth approved", "me", auth.Me, "client_id", auth.ClientID, "scope", auth.Scope)
 			http.Redirect(w, r, redirectURI.String(), 302)
 			return
 		} else if r.URL.Path == "/auth/token" {
@@ -620,21 +794,21 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			values, err := redis.Values(conn.Do("HGETALL", "code:"+code))
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not load auth code", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
 			var auth authRequest
 			err = redis.ScanStruct(values, &auth)
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not load auth code", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
 			token := util.RandStringBytes(32)
 			_, err = conn.Do("HMSET", redis.Args{}.Add("token:"+token).AddFlat(&auth)...)
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not save token", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
@@ -650,56 +824,184 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			enc := json.NewEncoder(w)
 			err = enc.Encode(&res)
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not write token response", "err", err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
 			return
 		} else if r.URL.Path == "/settings/channel" {
-			defer h.Backend.save()
-			uid := r.FormValue("uid")
-
-			if h.Backend.Settings == nil {
-				h.Backend.Settings = make(map[string]channelSetting)
+			_, _, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
+				return
 			}
 
+			uid := r.FormValue("uid")
+
 			excludeRegex := r.FormValue("exclude_regex")
 			includeRegex := r.FormValue("include_regex")
 			channelType := r.FormValue("type")
 
-			setting, e := h.Backend.Settings[uid]
-			if !e {
-				setting = channelSetting{}
-			}
+			setting, _ := backend.channelSetting(uid)
 			setting.ExcludeRegex = excludeRegex
 			setting.IncludeRegex = includeRegex
 			setting.ChannelType = channelType
 			if values, e := r.Form["exclude_type"]; e {
 				setting.ExcludeType = values
 			}
-			h.Backend.Settings[uid] = setting
-
-			h.Backend.Debug()
+			err = backend.setChannelSetting(uid, setting)
+			if err != nil {
+				logger.Errorf("could not save settings: %v", err)
+				http.Error(w, "could not save settings", 500)
+				return
+			}
 
 			http.Redirect(w, r, "/settings", 302)
 			return
+		} else if strings.HasPrefix(r.URL.Path, "/settings/webhooks") {
+			_, _, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
+				return
+			}
+
+			uid := r.FormValue("uid")
+
+			switch r.URL.Path {
+			case "/settings/webhooks":
+				_, err = backend.addWebhook(uid, r.FormValue("url"), r.FormValue("secret"))
+			case "/settings/webhooks/delete":
+				err = backend.removeWebhook(uid, r.FormValue("id"))
+			case "/settings/webhooks/retry":
+				err = retryDeadLetter(conn, backend.prefix, r.FormValue("id"))
+				if err == nil {
+					http.Redirect(w, r, "/settings/webhooks", 302)
+					return
+				}
+			default:
+				http.NotFound(w, r)
+				return
+			}
+			if code := microsub.ErrorCode(err); code != "" {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if err != nil {
+				logger.Errorf("could not change webhooks: %v", err)
+				http.Error(w, "could not change webhooks", 500)
+				return
+			}
+
+			http.Redirect(w, r, "/settings/channel?uid="+url.QueryEscape(uid), 302)
+			return
+		} else if strings.HasPrefix(r.URL.Path, "/settings/push") {
+			_, _, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
+				return
+			}
+
+			switch r.URL.Path {
+			case "/settings/push":
+				_, err = backend.addPushSubscription(pushSubscription{
+					Endpoint:  r.FormValue("endpoint"),
+					P256dh:    r.FormValue("p256dh"),
+					Auth:      r.FormValue("auth"),
+					Channels:  r.Form["channel[]"],
+					UserAgent: r.UserAgent(),
+				})
+			case "/settings/push/channels":
+				err = backend.setPushChannels(r.FormValue("id"), r.Form["channel[]"])
+			case "/settings/push/delete":
+				err = backend.removePushSubscription(r.FormValue("id"))
+			case "/settings/push/test":
+				err = sendTestPush(conn, backend, r.FormValue("id"))
+			default:
+				http.NotFound(w, r)
+				return
+			}
+			if code := microsub.ErrorCode(err); code != "" {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if err != nil {
+				logger.Errorf("could not change push subscriptions: %v", err)
+				http.Error(w, "could not change push subscriptions", 500)
+				return
+			}
+
+			http.Redirect(w, r, "/settings/push", 302)
+			return
+		} else if r.URL.Path == "/settings/sessions/revoke" || r.URL.Path == "/settings/sessions/revoke-others" {
+			sessionID, sess, _, ok := h.loggedIn(w, r, conn)
+			if !ok {
+				return
+			}
+
+			handle := r.FormValue("id")
+			if r.URL.Path == "/settings/sessions/revoke-others" {
+				handle = ""
+			} else if handle == "" {
+				http.Error(w, "id is missing", 400)
+				return
+			}
+			err = revokeSessions(conn, sess.Me, sessionID, handle)
+			if err != nil {
+				logger.Errorf("could not revoke sessions: %v", err)
+				http.Error(w, "could not revoke sessions", 500)
+				return
+			}
+
+			http.Redirect(w, r, "/settings/sessions", 302)
+			return
+		} else if r.URL.Path == "/settings/digest" || r.URL.Path == "/settings/digest/delete" {
+			_, _, backend, ok := h.loggedIn(w, r, conn)
+			if !ok {
+				return
+			}
+
+			uid := r.FormValue("uid")
+
+			if r.URL.Path == "/settings/digest" {
+				d, _ := backend.digest(uid)
+				d.To = r.FormValue("to")
+				d.Schedule = strings.TrimSpace(r.FormValue("schedule"))
+				d.MarkRead = r.FormValue("mark_read") == "1"
+				d, err = backend.setDigest(uid, d)
+				// Saving an unconfirmed digest sends the link again
+				if err == nil && !d.Confirmed && h.Digests != nil {
+					err = h.Digests.sendConfirmation(backend, uid, d, h.digestConfirmURL(backend.id, uid, d.Token))
+					if err != nil {
+						logger.Errorf("could not send digest confirmation: %v", err)
+						http.Error(w, "could not send the confirmation email", 500)
+						return
+					}
+				}
+			} else {
+				err = backend.removeDigest(uid)
+			}
+			if code := microsub.ErrorCode(err); code != "" {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if err != nil {
+				logger.Errorf("could not change digest: %v", err)
+				http.Error(w, "could not change digest", 500)
+				return
+			}
+
+			http.Redirect(w, r, "/settings/channel?uid="+url.QueryEscape(uid), 302)
+			return
 		}
 	}
 
 	http.NotFound(w, r)
 }
 
-func httpSessionLogout(r *http.Request, w http.ResponseWriter, conn redis.Conn) {
-	c, err := r.Cookie("session")
-	if err == http.ErrNoCookie {
-		http.Redirect(w, r, "/", 302)
-		return
-	}
-	if err == nil {
-		sessionVar := c.Value
-		_, _ = conn.Do("DEL", "session:"+sessionVar)
-	}
-	http.Redirect(w, r, "/", 302)
+// digestConfirmURL returns the link that confirms the address of a digest
+func (h *mainHandler) digestConfirmURL(user, channel, token string) string {
+	q := url.Values{}
+	q.Set("user", user)
+	q.Set("channel", channel)
+	q.Set("token", token)
+	return strings.TrimRight(h.BaseURL, "/") + "/digest/confirm?" + q.Encode()
 }
 
 type parsedEndpoints struct {
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/logging"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	h, err := newMainHandler(nil, "https://ekster.example.com/", "", false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	loggedIn := session{LoggedIn: true, Me: "https://example.com/", CSRF: "token123"}
+	created := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	home := microsub.Channel{UID: "home", Name: "Home"}
+
+	var logs logsPage
+	logs.Session = loggedIn
+	logs.Entries = []logging.Entry{
+		{
+			Time:    created,
+			Level:   logging.LevelError,
+			Message: "could not parse <script>alert(1)</script>",
+			Fields:  []logging.Field{{Key: "request_id", Value: "abc"}},
+		},
+	}
+
+	var webhooks webhooksPage
+	webhooks.Session = loggedIn
+	webhooks.Channels = map[string]string{"home": "Home"}
+	webhooks.Entries = []webhookLogEntry{
+		{Time: created, Delivery: "d1", Channel: "home", URL: "https://hooks.example.com/", Event: "new item", Attempt: 1, Status: 200},
+		{Time: created, Delivery: "d2", Channel: "0003", URL: "https://hooks.example.com/<b>", Event: "new item", Attempt: 2, Error: "unexpected status 500", Status: 500},
+	}
+	webhooks.DeadLetters = []webhookDelivery{
+		{ID: "d3", Channel: "home", URL: "https://hooks.example.com/", Event: "new item", Created: created, Attempts: 6, Error: "connection refused"},
+	}
+
+	var channelWebhooks settingsPage
+	channelWebhooks.Session = loggedIn
+	channelWebhooks.CurrentChannel = home
+	channelWebhooks.Webhooks = []webhook{{ID: "h1", URL: "https://hooks.example.com/", Secret: "s3cret"}}
+
+	var noDigest settingsPage
+	noDigest.Session = loggedIn
+	noDigest.CurrentChannel = home
+	noDigest.DigestSchedule = "0 7 * * *"
+
+	unconfirmedDigest := noDigest
+	unconfirmedDigest.MailEnabled = true
+	unconfirmedDigest.Digest = &digest{To: "me@example.com", Schedule: "@weekly", MarkRead: true}
+
+	confirmedDigest := unconfirmedDigest
+	confirmedDigest.Digest = &digest{To: "me@example.com", Schedule: "@weekly", Confirmed: true}
+
+	var push pushPage
+	push.Session = loggedIn
+	push.Channels = []microsub.Channel{{UID: "notifications", Name: "Notifications"}, {UID: "home", Name: "<b>Home</b>"}}
+	push.Subscriptions = []pushSubscription{
+		{ID: "s1", UserAgent: "Firefox <script>", Channels: []string{"home"}, Created: created},
+	}
+	push.PublicKey = "BP4z9KsN6nGRTbVYI"
+
+	var reader readerPage
+	reader.Session = loggedIn
+	reader.Mode = "timeline"
+	reader.Channels = []microsub.Channel{
+		{UID: "home", Name: "<b>Home</b>", Unread: microsub.Unread{Type: microsub.UnreadCount, UnreadCount: 3}},
+		{UID: "notifications", Name: "Notifications", Unread: microsub.Unread{Type: microsub.UnreadCount}},
+	}
+	reader.Channel = reader.Channels[0]
+	reader.Items = []readerItem{
+		{ID: "i1", Title: "Hello", Text: "<script>alert(1)</script>", URL: "https://example.com/1?a=1&b=2"},
+		{ID: "i2", Read: true, Text: "Read item"},
+	}
+	reader.Unread = []string{"i1"}
+	reader.Paging = microsub.Pagination{After: "a b"}
+	reader.Back = "/reader?channel=home"
+
+	var sessions sessionsPage
+	sessions.Session = loggedIn
+	sessions.Sessions = []sessionInfo{
+		{Handle: "h1", UserAgent: "Firefox", Created: created, LastSeen: created, Current: true},
+		{Handle: "h2", UserAgent: "Chrome <script>", Created: created, LastSeen: created.Add(time.Hour)},
+	}
+
+	tests := []struct {
+		name        string
+		template    string
+		page        interface{}
+		contains    []string
+		notContains []string
+	}{
+		{
+			name:     "logs",
+			template: "logs.html",
+			page:     logs,
+			contains: []string{
+				"2018-07-01 12:00:00",
+				"could not parse &lt;script&gt;alert(1)&lt;/script&gt;",
+				"request_id=abc",
+			},
+			notContains: []string{"<script>"},
+		},
+		{
+			name:     "webhooks",
+			template: "webhooks.html",
+			page:     webhooks,
+			contains: []string{
+				"Home",
+				"0003",
+				"https://hooks.example.com/&lt;b&gt;",
+				"unexpected status 500",
+				`name="id" value="d3"`,
+				"connection refused",
+			},
+		},
+		{
+			name:     "channel webhooks",
+			template: "channel.html",
+			page:     channelWebhooks,
+			contains: []string{
+				"https://hooks.example.com/",
+				"s3cret",
+				`name="id" value="h1"`,
+			},
+		},
+		{
+			name:     "channel without digest",
+			template: "channel.html",
+			page:     noDigest,
+			contains: []string{
+				"smtp.addr",
+				`placeholder="0 7 * * *"`,
+				"Start digest",
+			},
+			notContains: []string{"Stop digest"},
+		},
+		{
+			name:     "channel with unconfirmed digest",
+			template: "channel.html",
+			page:     unconfirmedDigest,
+			contains: []string{
+				`value="me@example.com"`,
+				`value="@weekly"`,
+				`name="mark_read" value="1" checked`,
+				"Stop digest",
+				"confirmation link was sent",
+			},
+			notContains: []string{"smtp.addr"},
+		},
+		{
+			name:        "channel with confirmed digest",
+			template:    "channel.html",
+			page:        confirmedDigest,
+			contains:    []string{`value="me@example.com"`, "Stop digest"},
+			notContains: []string{"confirmation link was sent", `name="mark_read" value="1" checked`},
+		},
+		{
+			name:     "push",
+			template: "push.html",
+			page:     push,
+			contains: []string{
+				"Firefox &lt;script&gt;",
+				"&lt;b&gt;Home&lt;/b&gt;",
+				`value="home" checked`,
+				`data-key="BP4z9KsN6nGRTbVYI"`,
+				"2018-07-01 12:00",
+			},
+		},
+		{
+			name:     "reader",
+			template: "reader.html",
+			page:     reader,
+			contains: []string{
+				"&lt;b&gt;Home&lt;/b&gt;",
+				"Hello",
+				"Read item",
+				"&lt;script&gt;alert(1)&lt;/script&gt;",
+				`href="https://example.com/1?a=1&amp;b=2"`,
+				`data-unread="home" >3</span>`,
+				`data-unread="notifications" hidden>0</span>`,
+				`name="entry[]" value="i1"`,
+				`name="action" value="unread"`,
+				`after=a+b">Older</a>`,
+			},
+			notContains: []string{"<script>alert(1)", "Newer"},
+		},
+		{
+			name:     "sessions",
+			template: "sessions.html",
+			page:     sessions,
+			contains: []string{
+				"This browser",
+				"Chrome &lt;script&gt;",
+				`name="id" value="h2"`,
+				`name="csrf" value="token123"`,
+				"last used 2018-07-01 13:00",
+				"Sign out all other sessions",
+			},
+			notContains: []string{`name="id" value="h1"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := h.renderTemplate(&buf, tt.template, tt.page)
+			if !assert.NoError(t, err) {
+				return
+			}
+			s := buf.String()
+			for _, want := range tt.contains {
+				assert.Contains(t, s, want)
+			}
+			for _, unwanted := range tt.notContains {
+				assert.NotContains(t, s, unwanted)
+			}
+		})
+	}
+}
+
+func TestVerifyMe(t *testing.T) {
+	// An authorization endpoint that returns the url of another user
+	malicious := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"me":"https://victim.example.com/"}`)
+	}))
+	defer malicious.Close()
+
+	sess := session{
+		Me:                    "https://attacker.example.com/",
+		AuthorizationEndpoint: malicious.URL + "/auth",
+		RedirectURI:           "https://microsub.example.com/session/callback",
+		State:                 "state",
+	}
+	r := httptest.NewRequest("GET", "/session/callback?state=state&code=code", nil)
+	_ = r.ParseForm()
+	verified, authResponse, err := performIndieauthCallback("https://microsub.example.com/", r, &sess)
+	if !assert.NoError(t, err) || !assert.True(t, verified) {
+		return
+	}
+	assert.Equal(t, "https://victim.example.com/", authResponse.Me)
+
+	discovered := map[string]string{
+		"https://victim.example.com/":    "https://victim.example.com/auth",
+		"https://attacker.example.com/":  malicious.URL + "/auth",
+		"https://example.com/":           "https://example.com/auth",
+		"https://example.com/other":      "https://example.com/auth",
+		"https://example.com/elsewhere/": "https://auth.example.net/",
+	}
+	discover := func(me string) (parsedEndpoints, error) {
+		u, ok := discovered[me]
+		if !ok {
+			return parsedEndpoints{}, fmt.Errorf("no endpoints")
+		}
+		authURL, _ := url.Parse(u)
+		return parsedEndpoints{AuthorizationEndpoint: authURL}, nil
+	}
+
+	_, err = verifyMe(sess.Me, sess.AuthorizationEndpoint, authResponse.Me, discover)
+	assert.Error(t, err)
+
+	tests := []struct {
+		name     string
+		entered  string
+		returned string
+		want     string
+	}{
+		{"same url", "https://example.com/", "https://example.com/", "https://example.com/"},
+		{"same user", "https://example.com", "https://EXAMPLE.com/", "https://example.com"},
+		{"same host and endpoint", "https://example.com/", "https://example.com/other", "https://example.com/other"},
+		{"other endpoint", "https://example.com/", "https://example.com/elsewhere/", ""},
+		{"other host", "https://example.com/", "https://victim.example.com/", ""},
+		{"not discovered", "https://example.com/", "https://example.com/missing", ""},
+		{"empty", "https://example.com/", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			me, err := verifyMe(tt.entered, "https://example.com/auth", tt.returned, discover)
+			if tt.want == "" {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, me)
+			}
+		})
+	}
+}
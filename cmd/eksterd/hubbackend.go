@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"expvar"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -18,9 +18,6 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
-// LeaseSeconds is the default number of seconds we want the subscription to last
-const LeaseSeconds = 24 * 60 * 60
-
 // HubBackend handles information for the incoming handler
 type HubBackend interface {
 	GetFeeds() []Feed // Deprecated
@@ -34,14 +31,19 @@ type HubBackend interface {
 
 type hubIncomingBackend struct {
 	backend *memoryBackend
+	users   *userBackends
 	baseURL string
 	pool    *redis.Pool
+
+	// heartbeat shows that subscriptions are renewed
+	heartbeat heartbeat
 }
 
 // Feed contains information about the feed subscriptions
 type Feed struct {
 	ID            int64  `redis:"id"`
 	Channel       string `redis:"channel"`
+	Me            string `redis:"me"`
 	URL           string `redis:"url"`
 	Callback      string `redis:"callback"`
 	Hub           string `redis:"hub"`
@@ -80,6 +82,9 @@ func (h *hubIncomingBackend) CreateFeed(topic string, channel string) (int64, er
 
 	conn.Do("HSET", fmt.Sprintf("feed:%d", id), "url", topic)
 	conn.Do("HSET", fmt.Sprintf("feed:%d", id), "channel", channel)
+	if h.backend != nil {
+		conn.Do("HSET", fmt.Sprintf("feed:%d", id), "me", h.backend.Me)
+	}
 	secret := util.RandStringBytes(16)
 	conn.Do("HSET", fmt.Sprintf("feed:%d", id), "secret", secret)
 
@@ -87,13 +92,13 @@ func (h *hubIncomingBackend) CreateFeed(topic string, channel string) (int64, er
 
 	hubURL, err := websub.GetHubURL(client, topic)
 	if err != nil {
-		log.Printf("WebSub Hub URL not found for topic=%s\n", topic)
+		logger.Warnf("WebSub Hub URL not found for topic=%s", topic)
 		return 0, err
 	}
 
 	callbackURL := fmt.Sprintf("%s/incoming/%d", h.baseURL, id)
 
-	log.Printf("WebSub Hub URL found for topic=%q hub=%q callback=%q\n", topic, hubURL, callbackURL)
+	logger.Debugf("WebSub Hub URL found for topic=%q hub=%q callback=%q", topic, hubURL, callbackURL)
 
 	if err == nil && hubURL != "" {
 		args := redis.Args{}.Add(fmt.Sprintf("feed:%d", id), "hub", hubURL, "callback", callbackURL)
@@ -105,7 +110,7 @@ func (h *hubIncomingBackend) CreateFeed(topic string, channel string) (int64, er
 		return id, nil
 	}
 
-	err = websub.Subscribe(client, hubURL, topic, callbackURL, secret, 24*3600)
+	err = websub.Subscribe(client, hubURL, topic, callbackURL, secret, leaseSeconds())
 	if err != nil {
 		return 0, err
 	}
@@ -116,7 +121,7 @@ func (h *hubIncomingBackend) CreateFeed(topic string, channel string) (int64, er
 func (h *hubIncomingBackend) UpdateFeed(feedID int64, contentType string, body io.Reader) error {
 	conn := h.pool.Get()
 	defer conn.Close()
-	log.Printf("updating feed %d", feedID)
+	logger.Debugf("updating feed %d", feedID)
 	u, err := redis.String(conn.Do("HGET", fmt.Sprintf("feed:%d", feedID), "url"))
 	if err != nil {
 		return err
@@ -125,11 +130,20 @@ func (h *hubIncomingBackend) UpdateFeed(feedID int64, contentType string, body i
 	if err != nil {
 		return err
 	}
+	// feeds without "me" are from before there were more users
+	me, err := redis.String(conn.Do("HGET", fmt.Sprintf("feed:%d", feedID), "me"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	backend, ok := h.users.backendFor(me)
+	if !ok {
+		return fmt.Errorf("unknown user %q for feed %d", me, feedID)
+	}
 
-	log.Printf("Updating feed %d - %s %s\n", feedID, u, channel)
-	err = h.backend.ProcessContent(channel, u, contentType, body)
+	logger.Debugf("Updating feed %d - %s %s %s", feedID, me, u, channel)
+	err = backend.ProcessContent(channel, u, contentType, body)
 	if err != nil {
-		log.Printf("could not process content for channel %s: %s", channel, err)
+		logger.Warnf("could not process content for channel %s: %s", channel, err)
 	}
 
 	return err
@@ -138,12 +152,12 @@ func (h *hubIncomingBackend) UpdateFeed(feedID int64, contentType string, body i
 func (h *hubIncomingBackend) FeedSetLeaseSeconds(feedID int64, leaseSeconds int64) error {
 	conn := h.pool.Get()
 	defer conn.Close()
-	log.Printf("updating feed %d lease_seconds", feedID)
+	logger.Debugf("updating feed %d lease_seconds", feedID)
 
 	args := redis.Args{}.Add(fmt.Sprintf("feed:%d", feedID), "lease_seconds", leaseSeconds, "resubscribe_at", time.Now().Add(time.Duration(60*(leaseSeconds-15))*time.Second).Unix())
 	_, err := conn.Do("HMSET", args...)
 	if err != nil {
-		log.Println(err)
+		logger.Errorf("could not set lease_seconds of feed %d: %v", feedID, err)
 		return err
 	}
 
@@ -152,10 +166,10 @@ func (h *hubIncomingBackend) FeedSetLeaseSeconds(feedID int64, leaseSeconds int6
 
 // GetFeeds is deprecated, use Feeds instead
 func (h *hubIncomingBackend) GetFeeds() []Feed {
-	log.Println("GetFeeds called, consider replacing with Feeds")
+	logger.Debug("GetFeeds called, consider replacing with Feeds")
 	feeds, err := h.Feeds()
 	if err != nil {
-		log.Printf("Feeds returned an error: %v", err)
+		logger.Errorf("Feeds returned an error: %v", err)
 	}
 	return feeds
 }
@@ -176,13 +190,13 @@ func (h *hubIncomingBackend) Feeds() ([]Feed, error) {
 		var feed Feed
 		values, err := redis.Values(conn.Do("HGETALL", feedKey))
 		if err != nil {
-			log.Printf("could not get feed info for key %s: %v", feedKey, err)
+			logger.Errorf("could not get feed info for key %s: %v", feedKey, err)
 			continue
 		}
 
 		err = redis.ScanStruct(values, &feed)
 		if err != nil {
-			log.Printf("could not scan struct for key %s: %v", feedKey, err)
+			logger.Errorf("could not scan struct for key %s: %v", feedKey, err)
 			continue
 		}
 
@@ -193,7 +207,7 @@ func (h *hubIncomingBackend) Feeds() ([]Feed, error) {
 				feed.ID, _ = strconv.ParseInt(parts[1], 10, 64)
 				_, err = conn.Do("HSET", feedKey, "id", feed.ID)
 				if err != nil {
-					log.Printf("could not save id for %s: %v", feedKey, err)
+					logger.Errorf("could not save id for %s: %v", feedKey, err)
 				}
 			}
 		}
@@ -202,15 +216,15 @@ func (h *hubIncomingBackend) Feeds() ([]Feed, error) {
 		callbackURL, err := url.Parse(feed.Callback)
 		if err != nil || !callbackURL.IsAbs() {
 			if err != nil {
-				log.Printf("could not parse callback url %q: %v", callbackURL, err)
+				logger.Errorf("could not parse callback url %q: %v", callbackURL, err)
 			} else {
-				log.Printf("url is relative; replace with absolute url: %q", callbackURL)
+				logger.Warnf("url is relative; replace with absolute url: %q", callbackURL)
 			}
 
 			feed.Callback = fmt.Sprintf("%s/incoming/%d", h.baseURL, feed.ID)
 			_, err = conn.Do("HSET", feedKey, "callback", feed.Callback)
 			if err != nil {
-				log.Printf("could not save id for %s: %v", feedKey, err)
+				logger.Errorf("could not save id for %s: %v", feedKey, err)
 			}
 		}
 
@@ -219,7 +233,7 @@ func (h *hubIncomingBackend) Feeds() ([]Feed, error) {
 			continue
 		}
 
-		log.Printf("Websub feed: %#v\n", feed)
+		logger.Debug("websub feed", "id", feed.ID, "url", feed.URL, "hub", feed.Hub)
 		feeds = append(feeds, feed)
 	}
 
@@ -228,45 +242,62 @@ func (h *hubIncomingBackend) Feeds() ([]Feed, error) {
 
 func (h *hubIncomingBackend) Subscribe(feed *Feed) error {
 	client := http.Client{}
-	return websub.Subscribe(&client, feed.Hub, feed.URL, feed.Callback, feed.Secret, LeaseSeconds)
+	return websub.Subscribe(&client, feed.Hub, feed.URL, feed.Callback, feed.Secret, leaseSeconds())
 }
 
-func (h *hubIncomingBackend) run() error {
-	ticker := time.NewTicker(10 * time.Minute)
-	quit := make(chan struct{})
+// leaseSeconds is the number of seconds we want the subscription to last
+func leaseSeconds() int {
+	return int(currentConfig().WebSub.Lease / time.Second)
+}
 
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				log.Println("Getting feeds for WebSub")
-				varWebsub.Add("runs", 1)
+// run renews the WebSub subscriptions until ctx is cancelled
+func (h *hubIncomingBackend) run(ctx context.Context) {
+	interval := currentConfig().WebSub.ResubscribeInterval
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
 
-				feeds, err := h.Feeds()
-				if err != nil {
-				}
+	h.heartbeat.beat()
+	defer h.heartbeat.stop()
 
-				for _, feed := range feeds {
-					log.Printf("Looking at %s\n", feed.URL)
-					if feed.ResubscribeAt == 0 || time.Now().After(time.Unix(feed.ResubscribeAt, 0)) {
-						if feed.Callback == "" {
-							feed.Callback = fmt.Sprintf("%s/incoming/%d", h.baseURL, feed.ID)
-						}
-						log.Printf("Send resubscribe for %q on %q with callback %q\n", feed.URL, feed.Hub, feed.Callback)
-						varWebsub.Add("resubscribe", 1)
-						err := h.Subscribe(&feed)
-						if err != nil {
-							log.Printf("Error while subscribing: %s", err)
-							varWebsub.Add("errors", 1)
-						}
+	for {
+		select {
+		case <-ticker.C:
+			logger.Debug("Getting feeds for WebSub")
+			varWebsub.Add("runs", 1)
+
+			feeds, err := h.Feeds()
+			if err != nil {
+			}
+
+			for _, feed := range feeds {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Debugf("Looking at %s", feed.URL)
+				if feed.ResubscribeAt == 0 || time.Now().After(time.Unix(feed.ResubscribeAt, 0)) {
+					if feed.Callback == "" {
+						feed.Callback = fmt.Sprintf("%s/incoming/%d", h.baseURL, feed.ID)
+					}
+					logger.Debugf("Send resubscribe for %q on %q with callback %q", feed.URL, feed.Hub, feed.Callback)
+					varWebsub.Add("resubscribe", 1)
+					err := h.Subscribe(&feed)
+					if err != nil {
+						logger.Errorf("Error while subscribing: %s", err)
+						varWebsub.Add("errors", 1)
 					}
 				}
-			case <-quit:
+			}
+
+			h.heartbeat.beat()
+
+			// The interval can be changed by reloading the config
+			if i := currentConfig().WebSub.ResubscribeInterval; i != interval {
 				ticker.Stop()
-				return
+				interval = i
+				ticker = time.NewTicker(interval)
 			}
+		case <-ctx.Done():
+			return
 		}
-	}()
-
-	return nil
+	}
 }
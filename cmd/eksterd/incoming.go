@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"regexp"
 	"strconv"
 
+	"p83.nl/go/ekster/pkg/logging"
 	"p83.nl/go/ekster/pkg/websub"
 )
 
@@ -29,9 +29,8 @@ func (h *incomingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("%s %s\n", r.Method, r.URL)
-	log.Println(r.URL.Query())
-	log.Println(r.PostForm)
+	logger := logging.FromContext(r.Context())
+	logger.Debug("incoming websub request", "method", r.Method, "path", r.URL.Path, "mode", r.Form.Get("hub.mode"), "topic", r.Form.Get("hub.topic"))
 
 	// find feed
 	matches := urlRegex.FindStringSubmatch(r.URL.Path)
@@ -74,7 +73,8 @@ func (h *incomingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// find secret
 	secret := h.Backend.GetSecret(feed)
 	if secret == "" {
-		log.Printf("missing secret for feed %d\n", feed)
+		metricWebsubPushes.With("unknown_feed").Inc()
+		logger.Warnf("missing secret for feed %d", feed)
 		http.Error(w, "Unknown", 400)
 		return
 	}
@@ -85,7 +85,9 @@ func (h *incomingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sig := r.Header.Get("X-Hub-Signature")
 	if sig != "" {
 		if err := websub.ValidateHubSignature(sig, feedContent, []byte(secret)); err != nil {
-			log.Printf("could not validate signature: %+v", err)
+			metricWebsubPushes.With("invalid_signature").Inc()
+			metricWebsubSignatureFailures.With().Inc()
+			logger.Errorf("could not validate signature: %+v", err)
 			http.Error(w, fmt.Sprintf("could not validate signature: %s", err), 400)
 			return
 		}
@@ -94,9 +96,11 @@ func (h *incomingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ct := r.Header.Get("Content-Type")
 	err = h.Backend.UpdateFeed(feed, ct, bytes.NewBuffer(feedContent))
 	if err != nil {
+		metricWebsubPushes.With("error").Inc()
 		http.Error(w, fmt.Sprintf("could not update feed: %s (%s)", ct, err), 400)
 		return
 	}
+	metricWebsubPushes.With("ok").Inc()
 
 	return
 }
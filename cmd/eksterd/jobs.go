@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"p83.nl/go/ekster/pkg/admin"
+	"p83.nl/go/ekster/pkg/logging"
+)
+
+// maxFinishedJobs is the number of finished jobs that are kept
+const maxFinishedJobs = 100
+
+// errJobsStopped is returned when a job is started after the server stopped
+var errJobsStopped = errors.New("jobs can't be started, the server is stopping")
+
+// jobRunner runs the jobs of the admin API in the background
+type jobRunner struct {
+	lock   sync.Mutex
+	jobs   map[string]*runningJob
+	nextID int
+
+	// ctx is the context of run, jobs are cancelled with it
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+type runningJob struct {
+	job    admin.Job
+	cancel context.CancelFunc
+}
+
+// jobProgress is used by a job to report its progress
+type jobProgress struct {
+	runner *jobRunner
+	id     string
+}
+
+func newJobRunner() *jobRunner {
+	return &jobRunner{jobs: make(map[string]*runningJob)}
+}
+
+// run allows jobs to start until ctx is cancelled, then it waits for the
+// running jobs to stop
+func (r *jobRunner) run(ctx context.Context) {
+	r.lock.Lock()
+	r.ctx = ctx
+	r.lock.Unlock()
+
+	<-ctx.Done()
+
+	// After this no jobs are started
+	r.lock.Lock()
+	r.lock.Unlock()
+	r.wg.Wait()
+}
+
+// start runs fn in the background as a job of type typ
+func (r *jobRunner) start(typ string, fn func(ctx context.Context, p *jobProgress) error) (admin.Job, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ctx == nil || r.ctx.Err() != nil {
+		return admin.Job{}, errJobsStopped
+	}
+
+	r.nextID++
+	id := strconv.Itoa(r.nextID)
+	ctx, cancel := context.WithCancel(r.ctx)
+	ctx = logging.NewContext(ctx, logger.With("job", id, "job_type", typ))
+
+	j := &runningJob{
+		job: admin.Job{
+			ID:      id,
+			Type:    typ,
+			Status:  admin.JobRunning,
+			Started: time.Now().UTC(),
+		},
+		cancel: cancel,
+	}
+	r.jobs[id] = j
+	r.prune()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+
+		logging.FromContext(ctx).Info("job started")
+		err := fn(ctx, &jobProgress{runner: r, id: id})
+		r.finish(ctx, id, err)
+	}()
+
+	return j.job, nil
+}
+
+func (r *jobRunner) finish(ctx context.Context, id string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	j := r.jobs[id]
+	finished := time.Now().UTC()
+	j.job.Finished = &finished
+
+	log := logging.FromContext(ctx)
+	switch {
+	case err == nil:
+		j.job.Status = admin.JobDone
+		log.Info("job done", "message", j.job.Message)
+	case ctx.Err() != nil:
+		j.job.Status = admin.JobCancelled
+		j.job.Error = ctx.Err().Error()
+		log.Info("job cancelled")
+	default:
+		j.job.Status = admin.JobFailed
+		j.job.Error = err.Error()
+		log.Error("job failed", "err", err)
+	}
+}
+
+// prune removes the oldest finished jobs, r.lock should be held
+func (r *jobRunner) prune() {
+	var finished []admin.Job
+	for _, j := range r.jobs {
+		if j.job.IsFinished() {
+			finished = append(finished, j.job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return jobNumber(finished[i]) < jobNumber(finished[j])
+	})
+	for _, j := range finished[:len(finished)-maxFinishedJobs] {
+		delete(r.jobs, j.ID)
+	}
+}
+
+// get returns the job with id
+func (r *jobRunner) get(id string) (admin.Job, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	j, ok := r.jobs[id]
+	if !ok {
+		return admin.Job{}, false
+	}
+	return j.job, true
+}
+
+// list returns all jobs, the newest first
+func (r *jobRunner) list() []admin.Job {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	jobs := []admin.Job{}
+	for _, j := range r.jobs {
+		jobs = append(jobs, j.job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobNumber(jobs[i]) > jobNumber(jobs[j])
+	})
+	return jobs
+}
+
+// cancel cancels the job with id, the job stops in the background
+func (r *jobRunner) cancel(id string) (admin.Job, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	j, ok := r.jobs[id]
+	if !ok {
+		return admin.Job{}, false
+	}
+	j.cancel()
+	return j.job, true
+}
+
+// jobNumber returns the id of job as a number, jobs are numbered in the order they started
+func jobNumber(job admin.Job) int {
+	n, _ := strconv.Atoi(job.ID)
+	return n
+}
+
+func (p *jobProgress) update(fn func(job *admin.Job)) {
+	p.runner.lock.Lock()
+	defer p.runner.lock.Unlock()
+	fn(&p.runner.jobs[p.id].job)
+}
+
+// total sets the number of steps of the job
+func (p *jobProgress) total(n int) {
+	p.update(func(job *admin.Job) { job.Total = n })
+}
+
+// step marks n steps as done
+func (p *jobProgress) step(n int) {
+	p.update(func(job *admin.Job) { job.Done += n })
+}
+
+// message sets the message of the job
+func (p *jobProgress) message(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	p.update(func(job *admin.Job) { job.Message = msg })
+}
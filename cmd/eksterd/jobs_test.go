@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/admin"
+)
+
+// waitForJob waits until the job with id is finished
+func waitForJob(t *testing.T, r *jobRunner, id string) admin.Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := r.get(id)
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if job.IsFinished() {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s is not finished", id)
+	return admin.Job{}
+}
+
+func startTestRunner() (*jobRunner, func()) {
+	r := newJobRunner()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(done)
+	}()
+	for {
+		r.lock.Lock()
+		started := r.ctx != nil
+		r.lock.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return r, func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestJobRunner(t *testing.T) {
+	r, stop := startTestRunner()
+	defer stop()
+
+	job, err := r.start("count", func(ctx context.Context, p *jobProgress) error {
+		p.total(3)
+		for i := 0; i < 3; i++ {
+			p.step(1)
+		}
+		p.message("counted %d", 3)
+		return nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1", job.ID)
+		assert.Equal(t, admin.JobRunning, job.Status)
+
+		job = waitForJob(t, r, job.ID)
+		assert.Equal(t, admin.JobDone, job.Status)
+		assert.Equal(t, 3, job.Done)
+		assert.Equal(t, 3, job.Total)
+		assert.Equal(t, "counted 3", job.Message)
+		assert.NotNil(t, job.Finished)
+	}
+
+	job, err = r.start("fail", func(ctx context.Context, p *jobProgress) error {
+		return errors.New("no redis")
+	})
+	if assert.NoError(t, err) {
+		job = waitForJob(t, r, job.ID)
+		assert.Equal(t, admin.JobFailed, job.Status)
+		assert.Equal(t, "no redis", job.Error)
+	}
+
+	jobs := r.list()
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, "2", jobs[0].ID)
+		assert.Equal(t, "1", jobs[1].ID)
+	}
+
+	_, ok := r.get("3")
+	assert.False(t, ok)
+}
+
+func TestJobRunner_Cancel(t *testing.T) {
+	r, stop := startTestRunner()
+	defer stop()
+
+	job, err := r.start("wait", func(ctx context.Context, p *jobProgress) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, ok := r.cancel(job.ID)
+	assert.True(t, ok)
+
+	job = waitForJob(t, r, job.ID)
+	assert.Equal(t, admin.JobCancelled, job.Status)
+
+	_, ok = r.cancel("unknown")
+	assert.False(t, ok)
+}
+
+func TestJobRunner_Stop(t *testing.T) {
+	r, stop := startTestRunner()
+
+	stopped := make(chan bool, 1)
+	_, err := r.start("wait", func(ctx context.Context, p *jobProgress) error {
+		<-ctx.Done()
+		stopped <- true
+		return ctx.Err()
+	})
+	assert.NoError(t, err)
+
+	// stop waits for the running job
+	stop()
+	assert.Len(t, stopped, 1)
+
+	_, err = r.start("late", func(ctx context.Context, p *jobProgress) error { return nil })
+	assert.Equal(t, errJobsStopped, err)
+}
+
+func TestJobRunner_Prune(t *testing.T) {
+	r, stop := startTestRunner()
+	defer stop()
+
+	var last admin.Job
+	for i := 0; i < maxFinishedJobs+10; i++ {
+		job, err := r.start("noop", func(ctx context.Context, p *jobProgress) error { return nil })
+		if !assert.NoError(t, err) {
+			return
+		}
+		last = waitForJob(t, r, job.ID)
+	}
+
+	// prune runs when a job starts, the new job is not finished yet
+	job, err := r.start("wait", func(ctx context.Context, p *jobProgress) error {
+		<-ctx.Done()
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, r.list(), maxFinishedJobs+1)
+
+	_, ok := r.get("1")
+	assert.False(t, ok, "the oldest job is removed")
+	_, ok = r.get(last.ID)
+	assert.True(t, ok)
+	assert.Equal(t, strconv.Itoa(maxFinishedJobs+11), job.ID)
+	r.cancel(job.ID)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertStops checks that run returns shortly after ctx is cancelled
+func assertStops(t *testing.T, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stopped := make(chan struct{})
+	go func() {
+		run(ctx)
+		close(stopped)
+	}()
+
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not stop after cancel")
+	}
+}
+
+func TestWorkersStop(t *testing.T) {
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("no redis") }}
+
+	backend := newMemoryBackend("https://example.com/")
+	backend.pool = pool
+
+	users, cleanup := newTestUsers(t)
+	defer cleanup()
+
+	t.Run("memoryBackend", func(t *testing.T) {
+		assertStops(t, backend.run)
+	})
+	t.Run("hubIncomingBackend", func(t *testing.T) {
+		assertStops(t, (&hubIncomingBackend{pool: pool}).run)
+	})
+	t.Run("webmentionBackend", func(t *testing.T) {
+		assertStops(t, (&webmentionBackend{users: users, pool: pool}).run)
+	})
+	t.Run("webhookBackend", func(t *testing.T) {
+		assertStops(t, (&webhookBackend{users: users, pool: pool}).run)
+	})
+	t.Run("pushBackend", func(t *testing.T) {
+		assertStops(t, (&pushBackend{users: users, pool: pool}).run)
+	})
+	t.Run("mediaBackend", func(t *testing.T) {
+		assertStops(t, func(ctx context.Context) { (&mediaBackend{pool: pool}).run(ctx, users) })
+	})
+	t.Run("userBackends", func(t *testing.T) {
+		assertStops(t, users.run)
+	})
+}
+
+func TestFetchContext_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := FetchContext(ctx, "http://example.com/")
+	assert.Error(t, err)
+}
+
+func TestUserBackends_ProvisionAfterStop(t *testing.T) {
+	users, cleanup := newTestUsers(t, "*")
+	defer cleanup()
+
+	assertStops(t, users.run)
+
+	// Provisioning still works, but the backend isn't started anymore
+	_, err := users.provision("https://alice.example.org/", "")
+	assert.NoError(t, err)
+	users.wg.Wait()
+}
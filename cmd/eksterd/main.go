@@ -16,20 +16,33 @@ Eksterd is a microsub server that is extendable.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
 	"p83.nl/go/ekster/pkg/auth"
+	"p83.nl/go/ekster/pkg/logging"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/netguard"
 
 	"p83.nl/go/ekster/pkg/server"
+	"p83.nl/go/ekster/pkg/sse"
 )
 
+// legacyBackendFile is imported into the store when the store doesn't exist yet
+const legacyBackendFile = "backend.json"
+
 // AppOptions are options for the app
 type AppOptions struct {
 	Port        int
@@ -38,24 +51,43 @@ type AppOptions struct {
 	RedisServer string
 	BaseURL     string
 	TemplateDir string
-	pool        *redis.Pool
+	// TemplateReload parses the templates in TemplateDir again when they change
+	TemplateReload bool
+	MediaDir       string
+	StoreFile      string
+	UsersDir       string
+	Users          []string
+	Metrics        bool
+	pool           *redis.Pool
 }
 
+var (
+	logger = logging.Default()
+	// logRing keeps the recent warnings and errors for the logs page
+	logRing = logging.NewRing(500, logging.LevelWarn)
+)
+
 func init() {
-	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
+	logger.SetRing(logRing)
+
+	// Messages of packages that use the log package go through the logger
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelInfo))
 }
 
 func newPool(addr string) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+		Dial:        func() (redis.Conn, error) { return instrumentConn(redis.Dial("tcp", addr)) },
 	}
 }
 
 // WithAuth adds authorization to a http.Handler
 func WithAuth(handler http.Handler, b *memoryBackend) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.FromContext(r.Context())
+
 		if r.Method == http.MethodOptions {
 			handler.ServeHTTP(w, r)
 			return
@@ -75,38 +107,128 @@ func WithAuth(handler http.Handler, b *memoryBackend) http.Handler {
 
 		authorized, err := b.AuthTokenAccepted(authorization, &token)
 		if err != nil {
-			log.Printf("token not accepted: %v", err)
+			logger.Warnf("token not accepted: %v", err)
 		}
 		if !authorized {
-			log.Printf("Token could not be validated")
-			http.Error(w, "Can't validate token", 403)
+			logger.Warn("Token could not be validated")
+			server.WriteError(w, microsub.UnauthorizedError("can't validate token"))
 			return
 		}
 
-		if token.Me != b.Me { // FIXME: Me should be part of the request
-			log.Printf("Missing \"me\" in token response: %#v\n", token)
-			http.Error(w, "Wrong me", 403)
+		if !sameUser(token.Me, b.Me) {
+			logger.Warn("token is not valid for this user", "me", token.Me, "user", b.Me)
+			server.WriteError(w, microsub.ForbiddenError("token is not valid for %s", b.Me))
 			return
 		}
 
-		handler.ServeHTTP(w, r)
+		// Unknown actions are passed on, the handler will return an error for them
+		if scope, ok := microsubScope(r); ok && !hasScope(token.Scope, scope) {
+			logger.Warnf("Token with scope %q is missing scope %q", token.Scope, scope)
+			writeInsufficientScope(w, scope)
+			return
+		}
+
+		ctx := logging.NewContext(r.Context(), logger.With("user", b.id))
+		handler.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 // App is the main app structure
 type App struct {
-	options    AppOptions
-	backend    *memoryBackend
-	hubBackend *hubIncomingBackend
+	options           AppOptions
+	users             *userBackends
+	hubBackend        *hubIncomingBackend
+	webmentionBackend *webmentionBackend
+	webhookBackend    *webhookBackend
+	digestBackend     *digestBackend
+	pushBackend       *pushBackend
+	mediaBackend      *mediaBackend
+	jobs              *jobRunner
+	// templates are the templates of the frontend, nil when headless
+	templates *templateSet
 }
 
-// Run runs the app
-func (app *App) Run() error {
-	app.backend.run()
-	app.hubBackend.run()
+// shutdownMessage is the last event that is sent to the clients of the event stream
+type shutdownMessage struct {
+	Reason string `json:"reason"`
+}
+
+// Run runs the app until ctx is cancelled. Then it stops accepting requests,
+// closes the event streams, stops the workers and saves the backends. The
+// shutdown takes at most the shutdown timeout from the config.
+func (app *App) Run(ctx context.Context) error {
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	var wg sync.WaitGroup
+	start := func(run func(ctx context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(workers)
+		}()
+	}
 
-	log.Printf("Listening on port %d\n", app.options.Port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", app.options.Port), nil)
+	start(app.users.run)
+	start(app.hubBackend.run)
+	start(app.webmentionBackend.run)
+	start(app.webhookBackend.run)
+	start(app.digestBackend.run)
+	start(app.pushBackend.run)
+	start(func(ctx context.Context) { app.mediaBackend.run(ctx, app.users) })
+	start(app.jobs.run)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", app.options.Port),
+		Handler: logging.Middleware(logger, http.DefaultServeMux),
+	}
+	srv.RegisterOnShutdown(func() {
+		app.users.close(sse.Message{Event: "shutdown", Object: shutdownMessage{Reason: "server is shutting down"}})
+	})
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Infof("Listening on port %d", app.options.Port)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := currentConfig().ShutdownTimeout
+	logger.Infof("Shutting down, waiting at most %s", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stopWorkers()
+
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Errorf("Could not stop all requests: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		logger.Error("Could not stop all workers in time")
+	}
+
+	saveErr := app.users.save()
+	if saveErr != nil {
+		return errors.Wrap(saveErr, "could not save backends")
+	}
+
+	logger.Info("Stopped")
+	return err
 }
 
 // NewApp initializes the App
@@ -115,41 +237,90 @@ func NewApp(options AppOptions) (*App, error) {
 		options: options,
 	}
 
-	backend, err := loadMemoryBackend(options.pool)
+	config := newConfigStore(options.StoreFile)
+	if !config.exists() {
+		if _, err := os.Stat(legacyBackendFile); err == nil {
+			err = config.importFile(legacyBackendFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	backend, err := loadMemoryBackend(options.pool, config, "")
 	if err != nil {
 		return nil, err
 	}
-	app.backend = backend
-	app.backend.AuthEnabled = options.AuthEnabled
-	app.backend.baseURL = options.BaseURL
-	app.backend.hubIncomingBackend.pool = options.pool
-	app.backend.hubIncomingBackend.baseURL = options.BaseURL
 
-	app.hubBackend = &hubIncomingBackend{backend: app.backend, baseURL: options.BaseURL, pool: options.pool}
+	app.users, err = newUserBackends(backend, options)
+	if err != nil {
+		return nil, err
+	}
 
-	http.Handle("/micropub", &micropubHandler{
-		Backend: app.backend,
-		pool:    options.pool,
-	})
+	app.hubBackend = &hubIncomingBackend{users: app.users, baseURL: options.BaseURL, pool: options.pool}
 
-	handler, broker := server.NewMicrosubHandler(app.backend)
-	if options.AuthEnabled {
-		handler = WithAuth(handler, app.backend)
+	store, err := newFileBlobStore(options.MediaDir)
+	if err != nil {
+		return nil, err
 	}
+	app.mediaBackend = &mediaBackend{store: store, pool: options.pool, baseURL: options.BaseURL}
 
-	app.backend.broker = broker
+	micropub := &micropubHandler{
+		Users: app.users,
+		Media: app.mediaBackend,
+		pool:  options.pool,
+	}
+	http.Handle("/micropub", micropub)
+	http.Handle(micropubItemsPath, micropub)
+	http.Handle(mediaEndpointPath, &mediaHandler{
+		Backend: app.mediaBackend,
+		Users:   app.users,
+		pool:    options.pool,
+	})
+	http.Handle(mediaPath, &mediaFileHandler{
+		Backend: app.mediaBackend,
+	})
 
-	http.Handle("/microsub", handler)
+	// The user of the config file uses /microsub, other users have their own endpoint
+	http.Handle("/microsub", app.users.primary.handler)
+	http.Handle("/microsub/", app.users)
 
 	http.Handle("/incoming/", &incomingHandler{
 		Backend: app.hubBackend,
 	})
 
+	app.webmentionBackend = &webmentionBackend{users: app.users, pool: options.pool, client: netguard.Client(30 * time.Second)}
+	app.webhookBackend = &webhookBackend{users: app.users, pool: options.pool, client: netguard.Client(0)}
+	app.digestBackend = &digestBackend{users: app.users, pool: options.pool, send: sendMail}
+	app.pushBackend = &pushBackend{users: app.users, pool: options.pool, client: netguard.Client(0)}
+
+	if options.Metrics {
+		http.Handle("/metrics", metricsHandler())
+	}
+	http.Handle("/healthz", &healthHandler{checks: app.livenessChecks()})
+	http.Handle("/readyz", &healthHandler{checks: app.readinessChecks()})
+
+	app.jobs = newJobRunner()
+	http.Handle("/admin/", &adminHandler{
+		users:       app.users,
+		hub:         app.hubBackend,
+		jobs:        app.jobs,
+		pool:        options.pool,
+		authEnabled: options.AuthEnabled,
+	})
+
+	http.Handle("/webmention", &webmentionHandler{
+		Backend: app.webmentionBackend,
+	})
+
 	if !options.Headless {
-		handler, err := newMainHandler(app.backend, options.BaseURL, options.TemplateDir, options.pool)
+		handler, err := newMainHandler(app.users, options.BaseURL, options.TemplateDir, options.TemplateReload, options.pool)
 		if err != nil {
 			return nil, errors.Wrap(err, "could not create main handler")
 		}
+		handler.Push = app.pushBackend
+		handler.Digests = app.digestBackend
+		app.templates = handler.templates
 		http.Handle("/", handler)
 	}
 
@@ -157,43 +328,37 @@ func NewApp(options AppOptions) (*App, error) {
 }
 
 func main() {
-	log.Println("eksterd - microsub server")
-
-	var options AppOptions
+	logger.Info("eksterd - microsub server")
 
-	flag.IntVar(&options.Port, "port", 80, "port for serving api")
-	flag.BoolVar(&options.AuthEnabled, "auth", true, "use auth")
-	flag.BoolVar(&options.Headless, "headless", false, "disable frontend")
-	flag.StringVar(&options.RedisServer, "redis", "redis:6379", "redis server")
-	flag.StringVar(&options.BaseURL, "baseurl", "", "http server baseurl")
-	flag.StringVar(&options.TemplateDir, "templates", "./templates", "template directory")
+	var flags Config
+	configFile := flag.String("config", os.Getenv("EKSTER_CONFIG"), "YAML config file")
+	defineConfigFlags(flag.CommandLine, &flags)
 
 	flag.Parse()
 
-	if options.AuthEnabled {
-		log.Println("Using auth")
-	} else {
-		log.Println("Authentication disabled")
+	args := flag.Args()
+
+	cfg, err := loadConfig(*configFile, os.LookupEnv, flag.CommandLine, &flags)
+
+	if len(args) >= 2 && args[0] == "config" && args[1] == "check" {
+		os.Exit(checkConfig(os.Stdout, cfg, err))
 	}
 
-	if options.BaseURL == "" {
-		if envVar, e := os.LookupEnv("EKSTER_BASEURL"); e {
-			options.BaseURL = envVar
-		} else {
-			log.Fatal("EKSTER_BASEURL environment variable not found, please set with external url, -baseurl url option")
-		}
+	if err != nil {
+		logger.Errorf("Error in config: %s", err)
+		os.Exit(1)
 	}
 
-	if options.TemplateDir == "" {
-		if envVar, e := os.LookupEnv("EKSTER_TEMPLATES"); e {
-			options.TemplateDir = envVar
-		} else {
-			log.Fatal("EKSTER_TEMPLATES environment variable not found, use env var or -templates dir option")
-		}
+	setCurrentConfig(cfg)
+	options := cfg.appOptions()
+
+	if options.AuthEnabled {
+		logger.Info("Using auth")
+	} else {
+		logger.Warn("Authentication disabled")
 	}
 
 	createBackend := false
-	args := flag.Args()
 
 	if len(args) >= 1 {
 		if args[0] == "new" {
@@ -202,15 +367,16 @@ func main() {
 	}
 
 	if createBackend {
-		err := createMemoryBackend()
+		err := createMemoryBackend(newConfigStore(options.StoreFile))
 		if err != nil {
-			log.Fatalf("Error while saving backend.json: %s", err)
+			logger.Errorf("Error while saving %s: %s", options.StoreFile, err)
+			os.Exit(1)
 		}
 
 		// TODO(peter): automatically gather this information from login or otherwise
-		log.Println(`Config file "backend.json" is created in the current directory.`)
-		log.Println(`Update "Me" variable to your website address "https://example.com/"`)
-		log.Println(`Update "TokenEndpoint" variable to the address of your token endpoint "https://example.com/token"`)
+		logger.Infof("Config file %q is created.", options.StoreFile)
+		logger.Info(`Update "me" variable to your website address "https://example.com/"`)
+		logger.Info(`Update "token_endpoint" variable to the address of your token endpoint "https://example.com/token"`)
 
 		return
 	}
@@ -220,11 +386,68 @@ func main() {
 
 	app, err := NewApp(options)
 	if err != nil {
-		log.Fatal(err)
+		logger.Errorf("Could not start: %s", err)
+		os.Exit(1)
+	}
+
+	go app.reloadOnSignal(func() (Config, error) {
+		return loadConfig(*configFile, os.LookupEnv, flag.CommandLine, &flags)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		logger.Infof("Received %s", sig)
+		cancel()
+	}()
+
+	err = app.Run(ctx)
+	if err != nil {
+		logger.Errorf("Stopped with error: %s", err)
+		os.Exit(1)
+	}
+}
+
+// checkConfig prints the config or the error and returns the exit code for
+// "eksterd config check"
+func checkConfig(w io.Writer, cfg Config, err error) int {
+	if err != nil {
+		fmt.Fprintf(w, "Config is not valid:\n%s\n", err)
+		return 1
 	}
 
-	err = app.Run()
+	data, err := yaml.Marshal(cfg)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(w, "Could not show config: %s\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(w, "%s\nConfig is valid\n", data)
+	return 0
+}
+
+// reloadOnSignal reloads the config when eksterd receives SIGHUP
+func (app *App) reloadOnSignal(load func() (Config, error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		logger.Info("Reloading config")
+		cfg, err := load()
+		if err != nil {
+			logger.Warnf("Config is not reloaded: %s", err)
+			continue
+		}
+		app.reload(cfg)
 	}
 }
+
+// reload applies the settings that can be changed while the server is running
+func (app *App) reload(cfg Config) {
+	cfg = reloadConfig(currentConfig(), cfg)
+	setCurrentConfig(cfg)
+	app.users.setAllowed(cfg.Users)
+	logger.Info("Config reloaded")
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"p83.nl/go/ekster/pkg/util"
+)
+
+const (
+	// MediaMaxSize is the maximum size in bytes of an uploaded file
+	MediaMaxSize = 10 * 1024 * 1024
+
+	// MediaGracePeriod is the time an uploaded file is kept, before it's removed when no post references it
+	MediaGracePeriod = 24 * time.Hour
+
+	mediaEndpointPath = "/micropub/media"
+	mediaPath         = "/media/"
+)
+
+// mediaTypes contains the accepted content types and the extension used to save them
+var mediaTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
+
+var mediaNameRegex = regexp.MustCompile(`^[a-zA-Z]{32}\.[a-z0-9]+$`)
+
+// blobStore saves uploaded files
+type blobStore interface {
+	Put(name string, r io.Reader) error
+	Open(name string) (io.ReadCloser, error)
+	Delete(name string) error
+}
+
+// fileBlobStore saves blobs as files in a directory
+type fileBlobStore struct {
+	dir string
+}
+
+func newFileBlobStore(dir string) (*fileBlobStore, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create media directory %s", dir)
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+func (s *fileBlobStore) Put(name string, r io.Reader) error {
+	f, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileBlobStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, name))
+}
+
+func (s *fileBlobStore) Delete(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+// mediaFile is the information about an uploaded file that is saved in Redis
+type mediaFile struct {
+	Name        string `redis:"name"`
+	ContentType string `redis:"content_type"`
+	Size        int64  `redis:"size"`
+	Uploaded    int64  `redis:"uploaded"`
+}
+
+// mediaBackend saves the uploaded files in the store. The information about
+// the files is kept in Redis per user, with the prefix of the user that
+// uploaded the file. Only posts of that user keep the file.
+type mediaBackend struct {
+	store   blobStore
+	pool    *redis.Pool
+	baseURL string
+}
+
+// Save checks and saves the file of the user with prefix and returns the url
+// of the file
+func (mb *mediaBackend) Save(prefix string, r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(head)
+	contentType, _, _ = mime.ParseMediaType(contentType)
+	ext, ok := mediaTypes[contentType]
+	if !ok {
+		return "", fmt.Errorf("files of type %s are not accepted", contentType)
+	}
+
+	name := util.RandStringBytes(32) + ext
+
+	counter := &countingReader{r: io.LimitReader(br, MediaMaxSize+1)}
+	err = mb.store.Put(name, counter)
+	if err != nil {
+		return "", errors.Wrap(err, "could not save file")
+	}
+
+	if counter.n > MediaMaxSize {
+		_ = mb.store.Delete(name)
+		return "", fmt.Errorf("file is larger than %d bytes", MediaMaxSize)
+	}
+
+	conn := mb.pool.Get()
+	defer conn.Close()
+
+	file := mediaFile{Name: name, ContentType: contentType, Size: counter.n, Uploaded: time.Now().Unix()}
+	_, err = conn.Do("HMSET", redis.Args{}.Add(prefix+"media:"+name).AddFlat(&file)...)
+	if err != nil {
+		_ = mb.store.Delete(name)
+		return "", err
+	}
+	_, err = conn.Do("SADD", prefix+"media:all", name)
+	if err != nil {
+		_, _ = conn.Do("DEL", prefix+"media:"+name)
+		_ = mb.store.Delete(name)
+		return "", err
+	}
+
+	return mb.baseURL + mediaPath + name, nil
+}
+
+// mediaName returns the name of the file, when u is the url of an uploaded file
+func (mb *mediaBackend) mediaName(u string) (string, bool) {
+	prefix := mb.baseURL + mediaPath
+	if !strings.HasPrefix(u, prefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(u, prefix)
+	return name, mediaNameRegex.MatchString(name)
+}
+
+// updateReferences remembers which uploaded files are used by the post of
+// the user with prefix. Files that were uploaded by other users are skipped.
+func (mb *mediaBackend) updateReferences(conn redis.Conn, prefix, postID string, obj mf2Object) error {
+	postKey := prefix + "micropub:post:" + postID + ":media"
+
+	previous, err := redis.Strings(conn.Do("SMEMBERS", postKey))
+	if err != nil {
+		return err
+	}
+	for _, name := range previous {
+		_, _ = conn.Do("SREM", prefix+"media:"+name+":posts", postID)
+	}
+	_, _ = conn.Do("DEL", postKey)
+
+	for _, values := range obj.Properties {
+		for _, v := range values {
+			var u string
+			switch t := v.(type) {
+			case string:
+				u = t
+			case map[string]interface{}:
+				u, _ = t["value"].(string)
+			}
+			name, ok := mb.mediaName(u)
+			if !ok {
+				continue
+			}
+			uploaded, err := redis.Bool(conn.Do("SISMEMBER", prefix+"media:all", name))
+			if err != nil {
+				return err
+			}
+			if !uploaded {
+				continue
+			}
+			_, err = conn.Do("SADD", prefix+"media:"+name+":posts", postID)
+			if err != nil {
+				return err
+			}
+			_, err = conn.Do("SADD", postKey, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// run removes unused files until ctx is cancelled, the time between two runs
+// is media_prune_interval from the config
+func (mb *mediaBackend) run(ctx context.Context, users *userBackends) {
+	for {
+		select {
+		case <-time.After(currentConfig().MediaPruneInterval):
+			err := mb.cleanup(users)
+			if err != nil {
+				logger.Errorf("could not clean up media: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// cleanup removes uploaded files that are not used by posts that still exist
+func (mb *mediaBackend) cleanup(users *userBackends) error {
+	conn := mb.pool.Get()
+	defer conn.Close()
+
+	for _, user := range users.all() {
+		err := mb.cleanupUser(conn, user.backend)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cleanupUser removes the files of the user of b that are not used anymore
+func (mb *mediaBackend) cleanupUser(conn redis.Conn, b *memoryBackend) error {
+	names, err := redis.Strings(conn.Do("SMEMBERS", b.prefix+"media:all"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var file mediaFile
+		values, err := redis.Values(conn.Do("HGETALL", b.prefix+"media:"+name))
+		if err != nil {
+			return err
+		}
+
+		// Without the information about the file, it can't be used by a
+		// post, so the file is removed as well
+		if len(values) > 0 {
+			err = redis.ScanStruct(values, &file)
+			if err != nil {
+				logger.Errorf("could not read media info for %s: %v", name, err)
+				continue
+			}
+
+			if time.Since(time.Unix(file.Uploaded, 0)) < MediaGracePeriod {
+				continue
+			}
+
+			used, err := mb.isReferenced(conn, b, name)
+			if err != nil {
+				return err
+			}
+			if used {
+				continue
+			}
+		}
+
+		logger.Infof("Removing unreferenced media %s of user %s", name, b.id)
+		err = mb.remove(conn, b.prefix, name)
+		if err != nil {
+			logger.Errorf("could not remove media %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the file from the store and the information about it from
+// Redis. The file is deleted first, so a file that can't be deleted is tried
+// again in the next cleanup.
+func (mb *mediaBackend) remove(conn redis.Conn, prefix, name string) error {
+	err := mb.store.Delete(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err = conn.Do("DEL", prefix+"media:"+name, prefix+"media:"+name+":posts")
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("SREM", prefix+"media:all", name)
+	return err
+}
+
+// isReferenced checks if a post of the user of b uses the file. The post
+// must not be deleted, and its item must still be in the timeline of the
+// channel, items that are trimmed from a stream don't keep the file.
+// Posts that don't exist anymore are removed from the references.
+func (mb *mediaBackend) isReferenced(conn redis.Conn, b *memoryBackend, name string) (bool, error) {
+	postsKey := b.prefix + "media:" + name + ":posts"
+	postIDs, err := redis.Strings(conn.Do("SMEMBERS", postsKey))
+	if err != nil {
+		return false, err
+	}
+
+	for _, id := range postIDs {
+		values, err := redis.Values(conn.Do("HGETALL", b.prefix+"micropub:post:"+id))
+		if err != nil {
+			return false, err
+		}
+		if len(values) == 0 {
+			_, _ = conn.Do("SREM", postsKey, id)
+			continue
+		}
+		var post micropubPost
+		if redis.ScanStruct(values, &post) != nil || post.Deleted {
+			continue
+		}
+		if !b.channelExists(post.Channel) {
+			continue
+		}
+
+		tl := b.getTimeline(post.Channel)
+		if tl == nil {
+			continue
+		}
+		found, err := tl.HasItem(post.ID)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type mediaHandler struct {
+	Backend *mediaBackend
+	Users   *userBackends
+	pool    *redis.Pool
+}
+
+// ServeHTTP handles uploads to the media endpoint
+func (h *mediaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMicropubError(w, 405, micropubInvalidRequest, "method not allowed")
+		return
+	}
+
+	// The body is only read after the token is checked
+	r.Body = http.MaxBytesReader(w, r.Body, MediaMaxSize+1024*1024)
+	defer r.Body.Close()
+
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	token, err := getTokenFromAuthorization(r, conn)
+	if err != nil {
+		logger.Warn("invalid access token", "err", err)
+		writeMicropubError(w, 401, micropubUnauthorized, "missing or invalid access token")
+		return
+	}
+
+	if !hasScope(token.Scope, micropubScope("media")...) {
+		writeInsufficientScope(w, micropubScope("media")...)
+		return
+	}
+
+	backend, ok := h.Users.backendFor(token.Me)
+	if !ok {
+		writeMicropubError(w, 401, micropubUnauthorized, fmt.Sprintf("unknown user %s", token.Me))
+		return
+	}
+
+	err = r.ParseMultipartForm(1024 * 1024)
+	if err != nil {
+		writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("could not parse multipart request: %v", err))
+		return
+	}
+	defer func() { _ = r.MultipartForm.RemoveAll() }()
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeMicropubError(w, 400, micropubInvalidRequest, "missing file")
+		return
+	}
+	defer file.Close()
+
+	u, err := h.Backend.Save(backend.prefix, file)
+	if err != nil {
+		writeMicropubError(w, 400, micropubInvalidRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", u)
+	w.WriteHeader(http.StatusCreated)
+}
+
+type mediaFileHandler struct {
+	Backend *mediaBackend
+}
+
+// ServeHTTP serves the uploaded files
+func (h *mediaFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, mediaPath)
+	if !mediaNameRegex.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := h.Backend.store.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = io.Copy(w, f)
+	if err != nil {
+		logger.Errorf("could not serve media %s: %v", name, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMediaFileHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ekster-media")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newFileBlobStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	name := strings.Repeat("a", 32) + ".png"
+	err = store.Put(name, strings.NewReader("not really a png"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	handler := &mediaFileHandler{Backend: &mediaBackend{store: store}}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, mediaPath+name, nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "not really a png", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, mediaPath+"../backend.json", nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestMediaName(t *testing.T) {
+	mb := &mediaBackend{baseURL: "https://ekster.example"}
+
+	name, ok := mb.mediaName("https://ekster.example/media/" + strings.Repeat("b", 32) + ".jpg")
+	assert.True(t, ok)
+	assert.Equal(t, strings.Repeat("b", 32)+".jpg", name)
+
+	_, ok = mb.mediaName("https://elsewhere.example/media/" + strings.Repeat("b", 32) + ".jpg")
+	assert.False(t, ok)
+}
+
+// readTracker records if the body of a request was read
+type readTracker struct {
+	read bool
+}
+
+func (r *readTracker) Read(p []byte) (int, error) {
+	r.read = true
+	return 0, io.EOF
+}
+
+func TestMediaHandler_TokenBeforeBody(t *testing.T) {
+	// Redis is not available in the tests, so the token is not valid
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("no redis") }}
+	handler := &mediaHandler{Backend: &mediaBackend{pool: pool}, pool: pool}
+
+	body := &readTracker{}
+	r := httptest.NewRequest(http.MethodPost, mediaEndpointPath, body)
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+	r.Header.Set("Authorization", "Bearer invalid")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, 401, w.Code)
+	assert.False(t, body.read, "the body should not be read without a valid token")
+}
+
+func TestMediaBackend_CleanupTrimmedItems(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Timeline.PageSize = 1
+	cfg.Timeline.StreamMaxLength = 2
+	setCurrentConfig(cfg)
+	defer setCurrentConfig(defaultConfig())
+
+	dir, err := ioutil.TempDir("", "ekster-media")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newFileBlobStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	users, cleanup := newTestUsers(t, "https://alice.example.org/")
+	defer cleanup()
+	alice, err := users.provision("https://alice.example.org/", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	pool, _ := newFakePool()
+	users.primary.backend.pool = pool
+	alice.backend.pool = pool
+	mb := &mediaBackend{store: store, pool: pool, baseURL: "https://microsub.example.com"}
+	h := &micropubHandler{Users: users, Media: mb, pool: pool, Backend: alice.backend, logger: logger}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	// upload saves a file, that is old enough to be removed
+	upload := func() (string, string) {
+		u, err := mb.Save(alice.backend.prefix, strings.NewReader("GIF89a not really a gif"))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		name, _ := mb.mediaName(u)
+		_, err = conn.Do("HSET", alice.backend.prefix+"media:"+name, "uploaded", time.Now().Add(-2*MediaGracePeriod).Unix())
+		assert.NoError(t, err)
+		return u, name
+	}
+	post := func(photo string) {
+		w := httptest.NewRecorder()
+		h.create(w, conn, "notifications", mf2Object{Properties: map[string][]interface{}{
+			"content": {"Hello world"},
+			"photo":   {photo},
+		}})
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	trimmedURL, trimmed := upload()
+	post(trimmedURL)
+	err = mb.cleanup(users)
+	if assert.NoError(t, err) {
+		assert.FileExists(t, filepath.Join(dir, trimmed), "the item is still in the stream")
+	}
+
+	// The stream keeps two items, so the first item is trimmed
+	keptURL, kept := upload()
+	post(keptURL)
+	post("https://example.com/photo.jpg")
+
+	err = mb.cleanup(users)
+	if assert.NoError(t, err) {
+		_, err = os.Stat(filepath.Join(dir, trimmed))
+		assert.True(t, os.IsNotExist(err), "the file of the trimmed item is removed")
+		assert.FileExists(t, filepath.Join(dir, kept))
+	}
+
+	isMember, err := redis.Bool(conn.Do("SISMEMBER", alice.backend.prefix+"media:all", trimmed))
+	if assert.NoError(t, err) {
+		assert.False(t, isMember)
+	}
+}
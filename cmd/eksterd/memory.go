@@ -3,13 +3,11 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
@@ -18,6 +16,7 @@ import (
 	"github.com/pkg/errors"
 	"p83.nl/go/ekster/pkg/auth"
 	"p83.nl/go/ekster/pkg/fetch"
+	"p83.nl/go/ekster/pkg/logging"
 	"p83.nl/go/ekster/pkg/microsub"
 	"p83.nl/go/ekster/pkg/sse"
 	"p83.nl/go/ekster/pkg/timeline"
@@ -37,40 +36,38 @@ type memoryBackend struct {
 	Channels map[string]microsub.Channel
 	Feeds    map[string][]microsub.Feed
 	Settings map[string]channelSetting
+	Webhooks map[string][]webhook
+	Digests  map[string]digest
 	NextUID  int
 
+	PushSubscriptions []pushSubscription
+
 	Me            string // FIXME: should be removed
 	TokenEndpoint string // FIXME: should be removed
 	AuthEnabled   bool
 
 	ticker *time.Ticker
-	quit   chan struct{}
+	// heartbeat shows that the feeds are fetched
+	heartbeat heartbeat
 
 	broker *sse.Broker
 
 	pool *redis.Pool
-}
-
-type channelSetting struct {
-	ExcludeRegex string
-	IncludeRegex string
-	ExcludeType  []string
-	ChannelType  string
-}
-
-type channelMessage struct {
-	Version int              `json:"version"`
-	Channel microsub.Channel `json:"channel"`
-}
 
-type channelDeletedMessage struct {
-	Version int    `json:"version"`
-	UID     string `json:"uid"`
+	// store saves the channels, feeds and settings, without a store the
+	// backend is only kept in memory
+	store *configStore
+	// prefix is added to the Redis keys of the channels and timelines
+	prefix string
+	// id is the id of the user of the backend
+	id string
 }
 
-type newItemMessage struct {
-	Item    microsub.Item `json:"item"`
-	Channel string        `json:"channel"`
+type channelSetting struct {
+	ExcludeRegex string   `json:"exclude_regex,omitempty"`
+	IncludeRegex string   `json:"include_regex,omitempty"`
+	ExcludeType  []string `json:"exclude_type,omitempty"`
+	ChannelType  string   `json:"channel_type,omitempty"`
 }
 
 // Debug interface for easy of use in other packages
@@ -89,7 +86,7 @@ func (b *memoryBackend) AuthTokenAccepted(header string, r *auth.TokenResponse)
 	defer func() {
 		err := conn.Close()
 		if err != nil {
-			log.Printf("could not close redis connection: %v", err)
+			logger.Errorf("could not close redis connection: %v", err)
 		}
 	}()
 	return cachedCheckAuthToken(conn, header, b.TokenEndpoint, r)
@@ -104,16 +101,38 @@ func (b *memoryBackend) Debug() {
 }
 
 func (b *memoryBackend) load() error {
-	filename := "backend.json"
-	f, err := os.Open(filename)
+	cfg, err := b.store.load()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	jw := json.NewDecoder(f)
-	err = jw.Decode(b)
-	if err != nil {
-		return err
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.Me = cfg.Me
+	b.TokenEndpoint = cfg.TokenEndpoint
+	b.NextUID = cfg.NextUID
+	b.Channels = cfg.Channels
+	b.Feeds = cfg.Feeds
+	b.Settings = cfg.Settings
+	b.Webhooks = cfg.Webhooks
+	b.Digests = cfg.Digests
+	b.PushSubscriptions = cfg.PushSubscriptions
+
+	if b.Channels == nil {
+		b.Channels = make(map[string]microsub.Channel)
+	}
+	if b.Feeds == nil {
+		b.Feeds = make(map[string][]microsub.Feed)
+	}
+	if b.Settings == nil {
+		b.Settings = make(map[string]channelSetting)
+	}
+	if b.Webhooks == nil {
+		b.Webhooks = make(map[string][]webhook)
+	}
+	if b.Digests == nil {
+		b.Digests = make(map[string]digest)
 	}
 
 	return nil
@@ -123,35 +142,67 @@ func (b *memoryBackend) refreshChannels() {
 	conn := b.pool.Get()
 	defer conn.Close()
 
-	conn.Do("DEL", "channels")
+	conn.Do("DEL", b.prefix+"channels")
 
-	updateChannelInRedis(conn, "notifications", 1)
+	updateChannelInRedis(conn, b.prefix, "notifications", 1)
 
 	b.lock.RLock()
 	for uid, channel := range b.Channels {
-		log.Printf("loading channel %s - %s\n", uid, channel.Name)
-		updateChannelInRedis(conn, channel.UID, DefaultPrio)
+		logger.Debugf("loading channel %s - %s", uid, channel.Name)
+		updateChannelInRedis(conn, b.prefix, channel.UID, DefaultPrio)
 	}
 
 	b.lock.RUnlock()
 }
 
-func (b *memoryBackend) save() error {
-	filename := "backend.json"
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	jw := json.NewEncoder(f)
-	jw.SetIndent("", "    ")
+// config returns a copy of the part of the backend that is saved in the store
+func (b *memoryBackend) config() backendConfig {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
-	return jw.Encode(b)
+
+	cfg := backendConfig{
+		Me:            b.Me,
+		TokenEndpoint: b.TokenEndpoint,
+		NextUID:       b.NextUID,
+		Channels:      make(map[string]microsub.Channel, len(b.Channels)),
+		Feeds:         make(map[string][]microsub.Feed, len(b.Feeds)),
+		Settings:      make(map[string]channelSetting, len(b.Settings)),
+		Webhooks:      make(map[string][]webhook, len(b.Webhooks)),
+		Digests:       make(map[string]digest, len(b.Digests)),
+
+		PushSubscriptions: make([]pushSubscription, 0, len(b.PushSubscriptions)),
+	}
+	for k, v := range b.Channels {
+		cfg.Channels[k] = v
+	}
+	for k, v := range b.Feeds {
+		cfg.Feeds[k] = append([]microsub.Feed(nil), v...)
+	}
+	for k, v := range b.Settings {
+		cfg.Settings[k] = v
+	}
+	for k, v := range b.Webhooks {
+		cfg.Webhooks[k] = append([]webhook(nil), v...)
+	}
+	for k, v := range b.Digests {
+		cfg.Digests[k] = v
+	}
+	for _, s := range b.PushSubscriptions {
+		s.Channels = append([]string(nil), s.Channels...)
+		cfg.PushSubscriptions = append(cfg.PushSubscriptions, s)
+	}
+	return cfg
 }
 
-func loadMemoryBackend(pool *redis.Pool) (*memoryBackend, error) {
-	backend := &memoryBackend{pool: pool}
+func (b *memoryBackend) save() error {
+	if b.store == nil {
+		return nil
+	}
+	return b.store.save(b.config)
+}
+
+func loadMemoryBackend(pool *redis.Pool, store *configStore, prefix string) (*memoryBackend, error) {
+	backend := &memoryBackend{pool: pool, store: store, prefix: prefix}
 	err := backend.load()
 	if err != nil {
 		return nil, errors.Wrap(err, "while loading backend")
@@ -160,11 +211,21 @@ func loadMemoryBackend(pool *redis.Pool) (*memoryBackend, error) {
 	return backend, nil
 }
 
-func createMemoryBackend() error {
-	backend := memoryBackend{}
+func createMemoryBackend(store *configStore) error {
+	backend := newMemoryBackend("https://example.com/")
+	backend.store = store
+	return backend.save()
+}
+
+// newMemoryBackend creates a backend with the default channels for me
+func newMemoryBackend(me string) *memoryBackend {
+	backend := &memoryBackend{}
 	backend.lock.Lock()
 
 	backend.Feeds = make(map[string][]microsub.Feed)
+	backend.Settings = make(map[string]channelSetting)
+	backend.Webhooks = make(map[string][]webhook)
+	backend.Digests = make(map[string]digest)
 	channels := []microsub.Channel{
 		{UID: "notifications", Name: "Notifications"},
 		{UID: "home", Name: "Home"},
@@ -176,12 +237,11 @@ func createMemoryBackend() error {
 	}
 
 	backend.NextUID = 1000000
-	// FIXME: can't be used in Backend
-	backend.Me = "https://example.com/"
+	backend.Me = me
 
 	backend.lock.Unlock()
 
-	return backend.save()
+	return backend
 }
 
 // ChannelsGetList gets channels
@@ -193,9 +253,9 @@ func (b *memoryBackend) ChannelsGetList() ([]microsub.Channel, error) {
 	defer b.lock.RUnlock()
 
 	var channels []microsub.Channel
-	uids, err := redis.Strings(conn.Do("SORT", "channels", "BY", "channel_sortorder_*", "ASC"))
+	uids, err := redis.Strings(conn.Do("SORT", b.prefix+"channels", "BY", b.prefix+"channel_sortorder_*", "ASC"))
 	if err != nil {
-		log.Printf("Sorting channels failed: %v\n", err)
+		logger.Errorf("Sorting channels failed: %v", err)
 		for _, v := range b.Channels {
 			channels = append(channels, v)
 		}
@@ -228,9 +288,9 @@ func (b *memoryBackend) ChannelsCreate(name string) (microsub.Channel, error) {
 	conn := b.pool.Get()
 	defer conn.Close()
 
-	updateChannelInRedis(conn, channel.UID, DefaultPrio)
+	updateChannelInRedis(conn, b.prefix, channel.UID, DefaultPrio)
 
-	b.broker.Notifier <- sse.Message{Event: "new channel", Object: channelMessage{1, channel}}
+	b.broker.Send(sse.Message{Event: microsub.EventNewChannel, Channel: channel.UID, Object: microsub.ChannelEvent{Version: microsub.EventVersion, Channel: channel}})
 
 	return channel, nil
 }
@@ -250,12 +310,12 @@ func (b *memoryBackend) ChannelsUpdate(uid, name string) (microsub.Channel, erro
 		b.Channels[uid] = c
 		b.lock.Unlock()
 
-		b.broker.Notifier <- sse.Message{Event: "update channel", Object: channelMessage{1, c}}
+		b.broker.Send(sse.Message{Event: microsub.EventUpdateChannel, Channel: c.UID, Object: microsub.ChannelEvent{Version: microsub.EventVersion, Channel: c}})
 
 		return c, nil
 	}
 
-	return microsub.Channel{}, fmt.Errorf("channel %s does not exist", uid)
+	return microsub.Channel{}, microsub.NotFoundError("channel %s does not exist", uid)
 }
 
 // ChannelsDelete deletes a channel
@@ -273,20 +333,60 @@ func (b *memoryBackend) ChannelsDelete(uid string) error {
 	}
 	b.lock.RUnlock()
 
-	removeChannelFromRedis(conn, uid)
+	removeChannelFromRedis(conn, b.prefix, uid)
 
 	b.lock.Lock()
 	delete(b.Channels, uid)
 	delete(b.Feeds, uid)
+	delete(b.Webhooks, uid)
+	delete(b.Digests, uid)
+	for i, s := range b.PushSubscriptions {
+		var channels []string
+		for _, c := range s.Channels {
+			if c != uid {
+				channels = append(channels, c)
+			}
+		}
+		b.PushSubscriptions[i].Channels = channels
+	}
 	b.lock.Unlock()
 
 	if removed {
-		b.broker.Notifier <- sse.Message{Event: "delete channel", Object: channelDeletedMessage{1, uid}}
+		b.broker.Send(sse.Message{Event: microsub.EventDeleteChannel, Channel: uid, Object: microsub.ChannelDeletedEvent{Version: microsub.EventVersion, UID: uid}})
 	}
 
 	return nil
 }
 
+// ChannelsOrder changes the order of the channels to the order of uids, the
+// notifications channel stays first
+func (b *memoryBackend) ChannelsOrder(uids []string) error {
+	for _, uid := range uids {
+		if !b.channelExists(uid) {
+			return microsub.NotFoundError("channel %s does not exist", uid)
+		}
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	prio := 2
+	for _, uid := range uids {
+		if uid == "notifications" {
+			continue
+		}
+		_, err := conn.Do("SET", b.prefix+"channel_sortorder_"+uid, prio)
+		if err != nil {
+			return errors.Wrap(err, "could not change order of channels")
+		}
+		prio++
+	}
+
+	b.broker.Send(sse.Message{Event: microsub.EventOrderChannels, Object: microsub.ChannelsOrderEvent{Version: microsub.EventVersion, Channels: uids}})
+
+	return nil
+}
+
 func (b *memoryBackend) getFeeds() map[string][]string {
 	feeds := make(map[string][]string)
 	b.lock.RLock()
@@ -299,58 +399,82 @@ func (b *memoryBackend) getFeeds() map[string][]string {
 	return feeds
 }
 
-func (b *memoryBackend) run() {
-	b.ticker = time.NewTicker(10 * time.Minute)
-	b.quit = make(chan struct{})
-
-	go func() {
-		for {
-			select {
-			case <-b.ticker.C:
-				feeds := b.getFeeds()
-
-				count := 0
-
-				for uid := range feeds {
-					for _, feedURL := range feeds[uid] {
-						resp, err := b.Fetch3(uid, feedURL)
-						if err != nil {
-							_ = b.channelAddItem("notifications", microsub.Item{
-								Type: "entry",
-								Name: "Error while fetching feed",
-								Content: &microsub.Content{
-									Text: fmt.Sprintf("Error while updating feed %s: %v", feedURL, err),
-								},
-								UID: time.Now().String(),
-							})
-							count++
-							log.Printf("Error while Fetch3 of %s: %v\n", feedURL, err)
-							continue
-						}
-						_ = b.ProcessContent(uid, feedURL, resp.Header.Get("Content-Type"), resp.Body)
-						_ = resp.Body.Close()
-					}
-				}
+// run updates the feeds until ctx is cancelled
+func (b *memoryBackend) run(ctx context.Context) {
+	interval := currentConfig().Fetch.Interval
+	b.ticker = time.NewTicker(interval)
+	defer func() { b.ticker.Stop() }()
 
-				if count > 0 {
-					_ = b.updateChannelUnreadCount("notifications")
-				}
+	b.heartbeat.beat()
+	defer b.heartbeat.stop()
+
+	for {
+		select {
+		case <-b.ticker.C:
+			b.fetchFeeds(ctx)
+			b.heartbeat.beat()
 
-			case <-b.quit:
+			// The interval can be changed by reloading the config
+			if i := currentConfig().Fetch.Interval; i != interval {
 				b.ticker.Stop()
+				interval = i
+				b.ticker = time.NewTicker(interval)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchFeeds fetches all feeds, it stops when ctx is cancelled
+func (b *memoryBackend) fetchFeeds(ctx context.Context) {
+	feeds := b.getFeeds()
+
+	count := 0
+
+	for uid := range feeds {
+		for _, feedURL := range feeds[uid] {
+			if ctx.Err() != nil {
+				logger.Info("Stopped fetching feeds")
 				return
 			}
+
+			resp, err := FetchContext(ctx, feedURL)
+			if err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
+				_ = b.channelAddItem("notifications", microsub.Item{
+					Type: "entry",
+					Name: "Error while fetching feed",
+					Content: &microsub.Content{
+						Text: fmt.Sprintf("Error while updating feed %s: %v", feedURL, err),
+					},
+					UID: time.Now().String(),
+				})
+				count++
+				logger.Warnf("Error while updating feed %s: %v", feedURL, err)
+				continue
+			}
+			_ = b.ProcessContent(uid, feedURL, resp.Header.Get("Content-Type"), resp.Body)
+			_ = resp.Body.Close()
 		}
-	}()
+	}
+
+	if count > 0 {
+		_ = b.updateChannelUnreadCount("notifications")
+	}
+
+	metricFeedsUpdated.With(b.id).SetToCurrentTime()
 }
 
 func (b *memoryBackend) TimelineGet(before, after, channel string) (microsub.Timeline, error) {
-	log.Printf("TimelineGet %s\n", channel)
+	logger.Debugf("TimelineGet %s", channel)
 
-	// Check if feed exists
-	_, err := b.FollowGetList(channel)
-	if err != nil {
-		return microsub.Timeline{Items: []microsub.Item{}}, err
+	// Check if channel exists
+	if !b.channelExists(channel) {
+		return microsub.Timeline{Items: []microsub.Item{}}, microsub.NotFoundError("channel %s does not exist", channel)
 	}
 
 	timelineBackend := b.getTimeline(channel)
@@ -361,16 +485,31 @@ func (b *memoryBackend) TimelineGet(before, after, channel string) (microsub.Tim
 }
 
 func (b *memoryBackend) FollowGetList(uid string) ([]microsub.Feed, error) {
+	if !b.channelExists(uid) {
+		return nil, microsub.NotFoundError("channel %s does not exist", uid)
+	}
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 	return b.Feeds[uid], nil
 }
 
 func (b *memoryBackend) FollowURL(uid string, url string) (microsub.Feed, error) {
-	defer b.save()
+	return b.followURL(context.Background(), uid, url)
+}
+
+func (b *memoryBackend) followURL(ctx context.Context, uid string, url string) (microsub.Feed, error) {
 	feed := microsub.Feed{Type: "feed", URL: url}
 
-	resp, err := b.Fetch3(uid, feed.URL)
+	if !b.channelExists(uid) {
+		return feed, microsub.NotFoundError("channel %s does not exist", uid)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return feed, microsub.InvalidRequestError("url %s should start with http:// or https://", url)
+	}
+
+	defer b.save()
+
+	resp, err := b.Fetch3(ctx, uid, feed.URL)
 	if err != nil {
 		_ = b.channelAddItem("notifications", microsub.Item{
 			Type: "entry",
@@ -393,6 +532,8 @@ func (b *memoryBackend) FollowURL(uid string, url string) (microsub.Feed, error)
 
 	_, _ = b.CreateFeed(url, uid)
 
+	b.broker.Send(sse.Message{Event: microsub.EventFollow, Channel: uid, Object: microsub.FollowEvent{Version: microsub.EventVersion, Channel: uid, Feed: feed}})
+
 	return feed, nil
 }
 
@@ -406,12 +547,18 @@ func (b *memoryBackend) UnfollowURL(uid string, url string) error {
 			break
 		}
 	}
+	var feed microsub.Feed
 	if index >= 0 {
 		feeds := b.Feeds[uid]
+		feed = feeds[index]
 		b.Feeds[uid] = append(feeds[:index], feeds[index+1:]...)
 	}
 	b.lock.Unlock()
 
+	if index >= 0 {
+		b.broker.Send(sse.Message{Event: microsub.EventUnfollow, Channel: uid, Object: microsub.FollowEvent{Version: microsub.EventVersion, Channel: uid, Feed: feed}})
+	}
+
 	return nil
 }
 
@@ -424,7 +571,7 @@ func checkURL(u string) bool {
 	resp, err := http.Head(testURL.String())
 
 	if err != nil {
-		log.Printf("Error while HEAD %s: %v\n", u, err)
+		logger.Warnf("Error while HEAD %s: %v", u, err)
 		return false
 	}
 
@@ -452,18 +599,22 @@ func getPossibleURLs(query string) []string {
 }
 
 func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
+	return b.search(context.Background(), query)
+}
+
+func (b *memoryBackend) search(ctx context.Context, query string) ([]microsub.Feed, error) {
+	logger := logging.FromContext(ctx)
 	urls := getPossibleURLs(query)
 
 	// needs to be like this, because we get a null result otherwise in the json output
 	feeds := []microsub.Feed{}
 
-	cachingFetch := WithCaching(b.pool, Fetch2)
+	cachingFetch := b.cachingFetch(ctx)
 
 	for _, u := range urls {
-		log.Println(u)
 		resp, err := cachingFetch(u)
 		if err != nil {
-			log.Printf("Error while fetching %s: %v\n", u, err)
+			logger.Warnf("Error while fetching %s: %v", u, err)
 			continue
 		}
 		defer resp.Body.Close()
@@ -471,13 +622,13 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 		fetchURL, err := url.Parse(u)
 		md := microformats.Parse(resp.Body, fetchURL)
 		if err != nil {
-			log.Printf("Error while fetching %s: %v\n", u, err)
+			logger.Warnf("Error while fetching %s: %v", u, err)
 			continue
 		}
 
 		feedResp, err := cachingFetch(fetchURL.String())
 		if err != nil {
-			log.Printf("Error in fetch of %s - %v\n", fetchURL, err)
+			logger.Warnf("Error in fetch of %s - %v", fetchURL, err)
 			continue
 		}
 		defer feedResp.Body.Close()
@@ -485,7 +636,7 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 		// TODO: Combine FeedHeader and FeedItems so we can use it here
 		parsedFeed, err := fetch.FeedHeader(cachingFetch, fetchURL.String(), feedResp.Header.Get("Content-Type"), feedResp.Body)
 		if err != nil {
-			log.Printf("Error in parse of %s - %v\n", fetchURL, err)
+			logger.Warnf("Error in parse of %s - %v", fetchURL, err)
 			continue
 		}
 
@@ -495,12 +646,12 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 		if alts, e := md.Rels["alternate"]; e {
 			for _, alt := range alts {
 				relURL := md.RelURLs[alt]
-				log.Printf("alternate found with type %s %#v\n", relURL.Type, relURL)
+				logger.Debugf("alternate found with type %s: %s", relURL.Type, alt)
 
 				if strings.HasPrefix(relURL.Type, "text/html") || strings.HasPrefix(relURL.Type, "application/json") || strings.HasPrefix(relURL.Type, "application/xml") || strings.HasPrefix(relURL.Type, "text/xml") || strings.HasPrefix(relURL.Type, "application/rss+xml") || strings.HasPrefix(relURL.Type, "application/atom+xml") {
 					feedResp, err := cachingFetch(alt)
 					if err != nil {
-						log.Printf("Error in fetch of %s - %v\n", alt, err)
+						logger.Warnf("Error in fetch of %s - %v", alt, err)
 						continue
 					}
 					// FIXME: don't defer in for loop (possible memory leak)
@@ -508,7 +659,7 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 
 					parsedFeed, err := fetch.FeedHeader(cachingFetch, alt, feedResp.Header.Get("Content-Type"), feedResp.Body)
 					if err != nil {
-						log.Printf("Error in parse of %s - %v\n", alt, err)
+						logger.Warnf("Error in parse of %s - %v", alt, err)
 						continue
 					}
 
@@ -522,7 +673,11 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 }
 
 func (b *memoryBackend) PreviewURL(previewURL string) (microsub.Timeline, error) {
-	cachingFetch := WithCaching(b.pool, Fetch2)
+	return b.previewURL(context.Background(), previewURL)
+}
+
+func (b *memoryBackend) previewURL(ctx context.Context, previewURL string) (microsub.Timeline, error) {
+	cachingFetch := b.cachingFetch(ctx)
 	resp, err := cachingFetch(previewURL)
 	if err != nil {
 		return microsub.Timeline{}, fmt.Errorf("error while fetching %s: %v", previewURL, err)
@@ -539,6 +694,10 @@ func (b *memoryBackend) PreviewURL(previewURL string) (microsub.Timeline, error)
 }
 
 func (b *memoryBackend) MarkRead(channel string, uids []string) error {
+	if !b.channelExists(channel) {
+		return microsub.NotFoundError("channel %s does not exist", channel)
+	}
+
 	tl := b.getTimeline(channel)
 	err := tl.MarkRead(uids)
 
@@ -551,13 +710,73 @@ func (b *memoryBackend) MarkRead(channel string, uids []string) error {
 		return err
 	}
 
+	b.sendItemsEvent(microsub.EventMarkRead, channel, uids)
+
+	return nil
+}
+
+// MarkUnread marks the items as unread
+func (b *memoryBackend) MarkUnread(channel string, uids []string) error {
+	if !b.channelExists(channel) {
+		return microsub.NotFoundError("channel %s does not exist", channel)
+	}
+
+	tl := b.getTimeline(channel)
+	err := tl.MarkUnread(uids)
+	if err == timeline.ErrNotSupported {
+		return microsub.InvalidRequestError("items in channel %s can't be marked unread", channel)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = b.updateChannelUnreadCount(channel)
+	if err != nil {
+		return err
+	}
+
+	b.sendItemsEvent(microsub.EventMarkUnread, channel, uids)
+
+	return nil
+}
+
+// RemoveItems removes the items from the channel
+func (b *memoryBackend) RemoveItems(channel string, uids []string) error {
+	if !b.channelExists(channel) {
+		return microsub.NotFoundError("channel %s does not exist", channel)
+	}
+
+	for _, uid := range uids {
+		err := b.channelRemoveItem(channel, uid)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := b.updateChannelUnreadCount(channel)
+	if err != nil {
+		return err
+	}
+
+	b.sendItemsEvent(microsub.EventRemoveItems, channel, uids)
+
 	return nil
 }
 
+func (b *memoryBackend) sendItemsEvent(event, channel string, uids []string) {
+	b.broker.Send(sse.Message{Event: event, Channel: channel, Object: microsub.ItemsEvent{Version: microsub.EventVersion, Channel: channel, Entries: uids}})
+}
+
 func (b *memoryBackend) Events() (chan sse.Message, error) {
 	return sse.StartConnection(b.broker)
 }
 
+// EventsAfter starts an event stream with the events selected by filter, that
+// begins with the events after lastEventID
+func (b *memoryBackend) EventsAfter(lastEventID string, filter sse.Filter) (chan sse.Message, error) {
+	return sse.StartFilteredConnection(b.broker, lastEventID, filter)
+}
+
 func (b *memoryBackend) ProcessContent(channel, fetchURL, contentType string, body io.Reader) error {
 	cachingFetch := WithCaching(b.pool, Fetch2)
 
@@ -570,7 +789,7 @@ func (b *memoryBackend) ProcessContent(channel, fetchURL, contentType string, bo
 		item.Read = false
 		err = b.channelAddItemWithMatcher(channel, item)
 		if err != nil {
-			log.Printf("ERROR: %s\n", err)
+			logger.Errorf("could not add item %s to channel %s: %v", item.ID, channel, err)
 		}
 	}
 
@@ -583,9 +802,41 @@ func (b *memoryBackend) ProcessContent(channel, fetchURL, contentType string, bo
 }
 
 // Fetch3 fills stuff
-func (b *memoryBackend) Fetch3(channel, fetchURL string) (*http.Response, error) {
-	log.Printf("Fetching channel=%s fetchURL=%s\n", channel, fetchURL)
-	return Fetch2(fetchURL)
+func (b *memoryBackend) Fetch3(ctx context.Context, channel, fetchURL string) (*http.Response, error) {
+	logging.FromContext(ctx).Debugf("Fetching channel=%s fetchURL=%s", channel, fetchURL)
+	return FetchContext(ctx, fetchURL)
+}
+
+// cachingFetch returns a cached fetcher that uses ctx for the requests
+func (b *memoryBackend) cachingFetch(ctx context.Context) fetch.FetcherFunc {
+	return WithCaching(b.pool, func(fetchURL string) (*http.Response, error) {
+		return FetchContext(ctx, fetchURL)
+	})
+}
+
+// requestBackend is the backend for a single request. Its fetches use the
+// context of the request, so they are logged with the request id and are
+// cancelled with the request.
+type requestBackend struct {
+	*memoryBackend
+	ctx context.Context
+}
+
+// WithContext returns the backend for a request with ctx
+func (b *memoryBackend) WithContext(ctx context.Context) microsub.Microsub {
+	return &requestBackend{memoryBackend: b, ctx: ctx}
+}
+
+func (b *requestBackend) FollowURL(uid string, url string) (microsub.Feed, error) {
+	return b.followURL(b.ctx, uid, url)
+}
+
+func (b *requestBackend) Search(query string) ([]microsub.Feed, error) {
+	return b.search(b.ctx, query)
+}
+
+func (b *requestBackend) PreviewURL(previewURL string) (microsub.Timeline, error) {
+	return b.previewURL(b.ctx, previewURL)
 }
 
 func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.Item) error {
@@ -597,36 +848,43 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 	var updatedChannels []string
 
 	b.lock.RLock()
-	settings := b.Settings
+	settings := make(map[string]channelSetting, len(b.Settings))
+	for k, v := range b.Settings {
+		settings[k] = v
+	}
 	b.lock.RUnlock()
 
 	for channelKey, setting := range settings {
 		if len(setting.ExcludeType) > 0 {
+			excluded := func() error {
+				metricItemsFiltered.With(b.id, channel, "exclude_type").Inc()
+				return nil
+			}
 			for _, v := range setting.ExcludeType {
 				switch v {
 				case "repost":
 					if len(item.RepostOf) > 0 {
-						return nil
+						return excluded()
 					}
 					break
 				case "like":
 					if len(item.LikeOf) > 0 {
-						return nil
+						return excluded()
 					}
 					break
 				case "bookmark":
 					if len(item.BookmarkOf) > 0 {
-						return nil
+						return excluded()
 					}
 					break
 				case "reply":
 					if len(item.InReplyTo) > 0 {
-						return nil
+						return excluded()
 					}
 					break
 				case "checkin":
 					if item.Checkin != nil {
-						return nil
+						return excluded()
 					}
 					break
 				}
@@ -635,12 +893,12 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 		if setting.IncludeRegex != "" {
 			re, err := regexp.Compile(setting.IncludeRegex)
 			if err != nil {
-				log.Printf("error in regexp: %q, %s\n", setting.IncludeRegex, err)
+				logger.Errorf("error in regexp: %q, %s", setting.IncludeRegex, err)
 				return nil
 			}
 
 			if matchItem(item, re) {
-				log.Printf("Included %#v\n", item)
+				logger.Debug("item included", "channel", channelKey, "id", item.ID, "url", item.URL)
 				err := b.channelAddItem(channelKey, item)
 				if err != nil {
 					continue
@@ -654,24 +912,23 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 	for _, value := range updatedChannels {
 		err := b.updateChannelUnreadCount(value)
 		if err != nil {
-			log.Printf("error while updating unread count for %s: %s", value, err)
+			logger.Errorf("error while updating unread count for %s: %s", value, err)
 			continue
 		}
 	}
 
 	// Check for the exclude regex
-	b.lock.RLock()
-	setting, exists := b.Settings[channel]
-	b.lock.RUnlock()
+	setting, exists := b.channelSetting(channel)
 
 	if exists && setting.ExcludeRegex != "" {
 		excludeRegex, err := regexp.Compile(setting.ExcludeRegex)
 		if err != nil {
-			log.Printf("error in regexp: %q\n", excludeRegex)
+			logger.Errorf("error in regexp: %q, %s", setting.ExcludeRegex, err)
 			return nil
 		}
 		if matchItem(item, excludeRegex) {
-			log.Printf("Excluded %#v\n", item)
+			logger.Debug("item excluded", "channel", channel, "id", item.ID, "url", item.URL)
+			metricItemsFiltered.With(b.id, channel, "exclude_regex").Inc()
 			return nil
 		}
 	}
@@ -711,12 +968,26 @@ func (b *memoryBackend) channelAddItem(channel string, item microsub.Item) error
 
 	// Sent message to Server-Sent-Events
 	if added {
-		b.broker.Notifier <- sse.Message{Event: "new item", Object: newItemMessage{item, channel}}
+		metricItemsAdded.With(b.id, channel).Inc()
+		b.broker.Send(sse.Message{
+			Event:   microsub.EventNewItem,
+			Channel: channel,
+			Object:  microsub.NewItemEvent{Item: item, Channel: channel},
+			// Clients that only want ids receive the item without its content
+			Short: microsub.NewItemEvent{Item: microsub.Item{ID: item.ID, UID: item.UID}, Channel: channel},
+		})
+		b.enqueueWebhooks(channel, item)
+		b.enqueuePush(channel, item)
 	}
 
 	return err
 }
 
+func (b *memoryBackend) channelRemoveItem(channel string, uid string) error {
+	timelineBackend := b.getTimeline(channel)
+	return timelineBackend.RemoveItem(uid)
+}
+
 func (b *memoryBackend) updateChannelUnreadCount(channel string) error {
 	b.lock.RLock()
 	c, exists := b.Channels[channel]
@@ -735,7 +1006,7 @@ func (b *memoryBackend) updateChannelUnreadCount(channel string) error {
 
 		// Sent message to Server-Sent-Events
 		if currentCount != unread {
-			b.broker.Notifier <- sse.Message{Event: "new item in channel", Object: c}
+			b.broker.Send(sse.Message{Event: microsub.EventNewItemInChannel, Channel: c.UID, Object: c})
 		}
 
 		b.lock.Lock()
@@ -762,12 +1033,12 @@ func WithCaching(pool *redis.Pool, ff fetch.FetcherFunc) fetch.FetcherFunc {
 
 		data, err := redis.Bytes(conn.Do("GET", cacheKey))
 		if err == nil {
-			log.Printf("HIT %s\n", fetchURL)
+			logger.Debugf("HIT %s", fetchURL)
 			rd := bufio.NewReader(bytes.NewReader(data))
 			return http.ReadResponse(rd, req)
 		}
 
-		log.Printf("MISS %s\n", fetchURL)
+		logger.Debugf("MISS %s", fetchURL)
 
 		resp, err := ff(fetchURL)
 		if err != nil {
@@ -785,7 +1056,7 @@ func WithCaching(pool *redis.Pool, ff fetch.FetcherFunc) fetch.FetcherFunc {
 		cur := b.Bytes()
 		copy(cachedCopy, cur)
 
-		conn.Do("SET", cacheKey, cachedCopy, "EX", 60*60)
+		conn.Do("SET", cacheKey, cachedCopy, "EX", int(currentConfig().Fetch.CacheTTL/time.Second))
 
 		cachedResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(cachedCopy)), req)
 		return cachedResp, err
@@ -794,6 +1065,11 @@ func WithCaching(pool *redis.Pool, ff fetch.FetcherFunc) fetch.FetcherFunc {
 
 // Fetch2 fetches stuff
 func Fetch2(fetchURL string) (*http.Response, error) {
+	return FetchContext(context.Background(), fetchURL)
+}
+
+// FetchContext fetches fetchURL, the request is cancelled with ctx
+func FetchContext(ctx context.Context, fetchURL string) (*http.Response, error) {
 	if !strings.HasPrefix(fetchURL, "http") {
 		return nil, fmt.Errorf("error parsing %s as url, has no http(s) prefix", fetchURL)
 	}
@@ -804,12 +1080,20 @@ func Fetch2(fetchURL string) (*http.Response, error) {
 	}
 
 	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
 
+	start := time.Now()
 	client := http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
+		observeFetch(start, 0, err)
 		return nil, fmt.Errorf("fetch failed: %s: %s", u, err)
 	}
+	observeFetch(start, resp.StatusCode, nil)
+	logging.FromContext(ctx).Debug("fetched", "url", fetchURL, "status", resp.StatusCode, "duration", time.Since(start))
 
 	return resp, err
 }
@@ -819,14 +1103,14 @@ func (b *memoryBackend) getTimeline(channel string) timeline.Backend {
 	if channel == "notifications" {
 		timelineType = "stream"
 	} else {
-		if setting, ok := b.Settings[channel]; ok {
+		if setting, ok := b.channelSetting(channel); ok {
 			if setting.ChannelType != "" {
 				timelineType = setting.ChannelType
 			}
 		}
 	}
 
-	return timeline.Create(channel, timelineType, b.pool)
+	return timeline.CreateWithPrefix(b.prefix, channel, timelineType, b.pool)
 }
 
 func (b *memoryBackend) createChannel(name string) microsub.Channel {
@@ -839,6 +1123,19 @@ func (b *memoryBackend) createChannel(name string) microsub.Channel {
 	return channel
 }
 
+// channelExists returns true when the channel exists, the notifications channel always exists
+func (b *memoryBackend) channelExists(uid string) bool {
+	if uid == "notifications" {
+		return true
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	_, e := b.Channels[uid]
+	return e
+}
+
 func (b *memoryBackend) fetchChannel(name string) (microsub.Channel, bool) {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
@@ -852,6 +1149,32 @@ func (b *memoryBackend) fetchChannel(name string) (microsub.Channel, bool) {
 	return microsub.Channel{}, false
 }
 
+func (b *memoryBackend) channelSetting(uid string) (channelSetting, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	setting, e := b.Settings[uid]
+	return setting, e
+}
+
+// setChannelSetting changes the settings of channel uid and saves the backend
+func (b *memoryBackend) setChannelSetting(uid string, setting channelSetting) error {
+	b.lock.Lock()
+	if b.Settings == nil {
+		b.Settings = make(map[string]channelSetting)
+	}
+	b.Settings[uid] = setting
+	b.lock.Unlock()
+
+	err := b.save()
+	if err != nil {
+		return err
+	}
+
+	b.broker.Send(sse.Message{Event: microsub.EventUpdateSettings, Channel: uid, Object: microsub.SettingsEvent{Version: microsub.EventVersion, Channel: uid, Settings: microsub.ChannelSettings(setting)}})
+
+	return nil
+}
+
 func (b *memoryBackend) setChannel(channel microsub.Channel) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -861,12 +1184,12 @@ func (b *memoryBackend) setChannel(channel microsub.Channel) {
 	b.NextUID++
 }
 
-func updateChannelInRedis(conn redis.Conn, uid string, prio int) {
-	conn.Do("SADD", "channels", uid)
-	conn.Do("SETNX", "channel_sortorder_"+uid, prio)
+func updateChannelInRedis(conn redis.Conn, prefix, uid string, prio int) {
+	conn.Do("SADD", prefix+"channels", uid)
+	conn.Do("SETNX", prefix+"channel_sortorder_"+uid, prio)
 }
 
-func removeChannelFromRedis(conn redis.Conn, uid string) {
-	conn.Do("SREM", "channels", uid)
-	conn.Do("DEL", "channel_sortorder_"+uid)
+func removeChannelFromRedis(conn redis.Conn, prefix, uid string) {
+	conn.Do("SREM", prefix+"channels", uid)
+	conn.Do("DEL", prefix+"channel_sortorder_"+uid)
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"reflect"
-	"sync"
 	"testing"
 	"time"
 
@@ -14,7 +13,6 @@ import (
 func Test_memoryBackend_ChannelsCreate(t *testing.T) {
 	type fields struct {
 		hubIncomingBackend hubIncomingBackend
-		lock               sync.RWMutex
 		Channels           map[string]microsub.Channel
 		Feeds              map[string][]microsub.Feed
 		Settings           map[string]channelSetting
@@ -23,7 +21,6 @@ func Test_memoryBackend_ChannelsCreate(t *testing.T) {
 		TokenEndpoint      string
 		AuthEnabled        bool
 		ticker             *time.Ticker
-		quit               chan struct{}
 		broker             *sse.Broker
 		pool               *redis.Pool
 	}
@@ -41,7 +38,6 @@ func Test_memoryBackend_ChannelsCreate(t *testing.T) {
 			name: "Duplicate channel",
 			fields: fields{
 				hubIncomingBackend: hubIncomingBackend{},
-				lock:               sync.RWMutex{},
 				Channels: func() map[string]microsub.Channel {
 					channels := make(map[string]microsub.Channel)
 					channels["1234"] = microsub.Channel{
@@ -65,7 +61,6 @@ func Test_memoryBackend_ChannelsCreate(t *testing.T) {
 				TokenEndpoint: "",
 				AuthEnabled:   false,
 				ticker:        nil,
-				quit:          nil,
 				broker:        nil,
 				pool:          nil,
 			},
@@ -88,7 +83,6 @@ func Test_memoryBackend_ChannelsCreate(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			b := &memoryBackend{
 				hubIncomingBackend: tt.fields.hubIncomingBackend,
-				lock:               tt.fields.lock,
 				Channels:           tt.fields.Channels,
 				Feeds:              tt.fields.Feeds,
 				Settings:           tt.fields.Settings,
@@ -97,7 +91,6 @@ func Test_memoryBackend_ChannelsCreate(t *testing.T) {
 				TokenEndpoint:      tt.fields.TokenEndpoint,
 				AuthEnabled:        tt.fields.AuthEnabled,
 				ticker:             tt.fields.ticker,
-				quit:               tt.fields.quit,
 				broker:             tt.fields.broker,
 				pool:               tt.fields.pool,
 			}
@@ -112,3 +105,16 @@ func Test_memoryBackend_ChannelsCreate(t *testing.T) {
 		})
 	}
 }
+
+func Test_memoryBackend_MarkUnreadStream(t *testing.T) {
+	// The backend has no broker, sending an event would panic
+	b := newMemoryBackend("https://example.com/")
+
+	err := b.MarkUnread("notifications", []string{"1-0"})
+	if err == nil {
+		t.Fatal("expected an error for a stream timeline")
+	}
+	if code := microsub.ErrorCode(err); code != microsub.ErrorInvalidRequest {
+		t.Errorf("error code = %q, want %q", code, microsub.ErrorInvalidRequest)
+	}
+}
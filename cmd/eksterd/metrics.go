@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"p83.nl/go/ekster/pkg/metrics"
+)
+
+var (
+	metricFetches = metrics.NewCounter("ekster_fetch_total",
+		"Number of fetched urls by class of the HTTP status (2xx, 3xx, 4xx or 5xx), status is \"error\" when the request failed.", "status")
+	metricFetchDuration = metrics.NewHistogram("ekster_fetch_duration_seconds",
+		"Duration of fetches.", metrics.DefBuckets)
+	metricFetchLastSuccess = metrics.NewGauge("ekster_fetch_last_success_timestamp_seconds",
+		"Time of the last successful fetch.")
+	metricFeedsUpdated = metrics.NewGauge("ekster_feeds_last_update_timestamp_seconds",
+		"Time when the last update of all feeds of the user was finished.", "user")
+
+	metricItemsAdded = metrics.NewCounter("ekster_items_added_total",
+		"Number of items added by user and channel.", "user", "channel")
+	metricItemsFiltered = metrics.NewCounter("ekster_items_filtered_total",
+		"Number of items that were not added, because of the channel settings.", "user", "channel", "reason")
+
+	metricWebsubPushes = metrics.NewCounter("ekster_websub_pushes_total",
+		"Number of content notifications received from WebSub hubs, by result.", "result")
+	metricWebsubSignatureFailures = metrics.NewCounter("ekster_websub_signature_failures_total",
+		"Number of content notifications with an invalid signature.")
+
+	metricWebhookDeliveries = metrics.NewCounter("ekster_webhook_deliveries_total",
+		"Number of webhook deliveries by result (ok, error or dead).", "result")
+	metricDigests = metrics.NewCounter("ekster_digests_sent_total",
+		"Number of email digests by result (ok or error).", "result")
+	metricWebPush = metrics.NewCounter("ekster_webpush_notifications_total",
+		"Number of Web Push notifications by result (ok, error, gone or throttled).", "result")
+
+	metricAuthCache = metrics.NewCounter("ekster_auth_cache_total",
+		"Number of access token checks by result of the cache lookup (hit or miss).", "result")
+
+	metricRedisDuration = metrics.NewHistogram("ekster_redis_command_duration_seconds",
+		"Duration of Redis commands.", []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 5}, "command")
+	metricRedisErrors = metrics.NewCounter("ekster_redis_errors_total",
+		"Number of Redis commands that returned an error.", "command")
+
+	metricStoreSaveDuration = metrics.NewHistogram("ekster_store_save_duration_seconds",
+		"Duration of saving the config store.", metrics.DefBuckets)
+	metricStoreSaveErrors = metrics.NewCounter("ekster_store_save_errors_total",
+		"Number of failed saves of the config store.")
+)
+
+// statusClass returns the class of an HTTP status code for the status label,
+// the label has a small number of values
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "invalid"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+// observeFetch records the result of a fetch. The url is not used as a label,
+// the feeds are chosen by the users.
+func observeFetch(start time.Time, statusCode int, err error) {
+	metricFetchDuration.With().ObserveSince(start)
+	if err != nil {
+		metricFetches.With("error").Inc()
+		return
+	}
+	metricFetches.With(statusClass(statusCode)).Inc()
+	if statusCode >= 200 && statusCode < 300 {
+		metricFetchLastSuccess.With().SetToCurrentTime()
+	}
+}
+
+// metricsHandler serves the metrics. With metrics_token in the config, the
+// request needs the token in the Authorization header.
+func metricsHandler() http.Handler {
+	handler := metrics.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := currentConfig().MetricsToken; token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// instrumentedConn records the duration of Redis commands
+type instrumentedConn struct {
+	redis.Conn
+}
+
+// instrumentConn adds metrics to conn, it's used with the result of redis.Dial
+func instrumentConn(conn redis.Conn, err error) (redis.Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn}, nil
+}
+
+func (c instrumentedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(commandName, args...)
+
+	command := strings.ToUpper(commandName)
+	metricRedisDuration.With(command).ObserveSince(start)
+	if err != nil && err != redis.ErrNil {
+		metricRedisErrors.With(command).Inc()
+	}
+	return reply, err
+}
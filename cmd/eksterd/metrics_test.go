@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/metrics"
+)
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(200))
+	assert.Equal(t, "4xx", statusClass(404))
+	assert.Equal(t, "5xx", statusClass(503))
+	assert.Equal(t, "invalid", statusClass(0))
+}
+
+func TestFetchContext_Metrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	ok := metricFetches.With("2xx").Value()
+	notFound := metricFetches.With("4xx").Value()
+
+	for _, path := range []string{"/feed", "/feed", "/missing"} {
+		resp, err := FetchContext(context.Background(), server.URL+path)
+		if assert.NoError(t, err) {
+			_ = resp.Body.Close()
+		}
+	}
+
+	assert.Equal(t, ok+2, metricFetches.With("2xx").Value())
+	assert.Equal(t, notFound+1, metricFetches.With("4xx").Value())
+	assert.NotZero(t, metricFetchLastSuccess.With().Value())
+
+	var buf bytes.Buffer
+	_, err := metrics.DefaultRegistry.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `ekster_fetch_total{status="2xx"}`)
+	assert.Contains(t, buf.String(), "ekster_fetch_duration_seconds_count")
+	assert.NotContains(t, buf.String(), "127.0.0.1")
+	assert.Contains(t, buf.String(), "ekster_sse_clients")
+}
+
+func TestMetricsHandler_Token(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MetricsToken = "0123456789abcdef"
+	setCurrentConfig(cfg)
+	defer setCurrentConfig(defaultConfig())
+
+	handler := metricsHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r = httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "ekster_fetch_total")
+}
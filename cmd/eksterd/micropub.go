@@ -4,12 +4,15 @@ import (
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strings"
 	"time"
 
 	"p83.nl/go/ekster/pkg/jf2"
+	"p83.nl/go/ekster/pkg/logging"
 	"p83.nl/go/ekster/pkg/microsub"
 
 	"github.com/gomodule/redigo/redis"
@@ -17,16 +20,97 @@ import (
 	"willnorris.com/go/microformats"
 )
 
+// Micropub error codes
+const (
+	micropubInvalidRequest = "invalid_request"
+	micropubUnauthorized   = "unauthorized"
+	micropubNotFound       = "not_found"
+	micropubServerError    = "server_error"
+)
+
+// micropubItemsPath is the path of the urls created for posts without url
+const micropubItemsPath = "/micropub/items/"
+
 type micropubHandler struct {
+	Users *userBackends
+	Media *mediaBackend
+	pool  *redis.Pool
+
+	// Backend is the backend of the user of the request
 	Backend *memoryBackend
-	pool    *redis.Pool
+	// logger logs with the request id of the request
+	logger *logging.Logger
+}
+
+// micropubError is the error response of the Micropub endpoint
+type micropubError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// mf2Object is a microformats2 object, as used by Micropub
+type mf2Object struct {
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+}
+
+// micropubRequest is the JSON request body of Micropub
+type micropubRequest struct {
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+	Action     string                   `json:"action"`
+	URL        string                   `json:"url"`
+	Replace    map[string][]interface{} `json:"replace"`
+	Add        map[string][]interface{} `json:"add"`
+	Delete     interface{}              `json:"delete"`
+}
+
+// micropubPost is the information about a post that is saved in Redis
+type micropubPost struct {
+	ID      string `redis:"id"`
+	Channel string `redis:"channel"`
+	Me      string `redis:"me"`
+	URL     string `redis:"url"`
+	Source  []byte `redis:"source"`
+	Deleted bool   `redis:"deleted"`
+}
+
+type micropubDestination struct {
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+}
+
+type micropubConfig struct {
+	MediaEndpoint string                `json:"media-endpoint"`
+	Destination   []micropubDestination `json:"destination"`
+	SyndicateTo   []interface{}         `json:"syndicate-to"`
+	Q             []string              `json:"q"`
+}
+
+func writeMicropubError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(micropubError{Error: code, ErrorDescription: description})
+	if err != nil {
+		logger.Errorf("could not write micropub error: %v", err)
+	}
+}
+
+func writeMicropubJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		logger.Errorf("could not write micropub response: %v", err)
+	}
 }
 
 func (h *micropubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+
 	defer func() {
 		err := r.Body.Close()
 		if err != nil {
-			log.Printf("could not close request body: %v", err)
+			logger.Errorf("could not close request body: %v", err)
 		}
 	}()
 
@@ -34,134 +118,761 @@ func (h *micropubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		err := conn.Close()
 		if err != nil {
-			log.Printf("could not close redis connection: %v", err)
+			logger.Errorf("could not close redis connection: %v", err)
 		}
 	}()
 
-	err := r.ParseForm()
+	err := parseMicropubForm(r)
 	if err != nil {
-		http.Error(w, "bad request", 400)
+		writeMicropubError(w, 400, micropubInvalidRequest, err.Error())
+		return
+	}
+
+	token, err := getTokenFromAuthorization(r, conn)
+	if err != nil {
+		logger.Warn("invalid access token", "err", err)
+		writeMicropubError(w, 401, micropubUnauthorized, "missing or invalid access token")
+		return
+	}
+
+	backend, ok := h.Users.backendFor(token.Me)
+	if !ok {
+		writeMicropubError(w, 401, micropubUnauthorized, fmt.Sprintf("unknown user %s", token.Me))
+		return
+	}
+	h = &micropubHandler{Users: h.Users, Media: h.Media, pool: h.pool, Backend: backend, logger: logger.With("user", backend.id)}
+
+	if r.Method == http.MethodGet {
+		if strings.HasPrefix(r.URL.Path, micropubItemsPath) {
+			h.serveItem(w, conn, h.Backend.baseURL+r.URL.Path)
+			return
+		}
+		h.serveQuery(w, r, conn)
 		return
 	}
 
 	if r.Method == http.MethodPost {
-		var channel string
+		h.handlePost(w, r, conn, token)
+		return
+	}
 
-		channel, err = getChannelFromAuthorization(r, conn)
+	writeMicropubError(w, 405, micropubInvalidRequest, "method not allowed")
+}
+
+// parseMicropubForm parses the form values from the query, urlencoded and multipart bodies
+func parseMicropubForm(r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		return r.ParseMultipartForm(32 << 20)
+	}
+	return r.ParseForm()
+}
+
+func (h *micropubHandler) serveQuery(w http.ResponseWriter, r *http.Request, conn redis.Conn) {
+	q := r.URL.Query().Get("q")
+
+	switch q {
+	case "config":
+		config := micropubConfig{
+			MediaEndpoint: h.Backend.baseURL + mediaEndpointPath,
+			Destination:   h.destinations(),
+			SyndicateTo:   []interface{}{},
+			Q:             []string{"config", "source", "destination", "syndicate-to"},
+		}
+		writeMicropubJSON(w, config)
+	case "destination":
+		writeMicropubJSON(w, map[string]interface{}{"destination": h.destinations()})
+	case "syndicate-to":
+		writeMicropubJSON(w, map[string]interface{}{"syndicate-to": []interface{}{}})
+	case "source":
+		u := r.URL.Query().Get("url")
+		if u == "" {
+			writeMicropubError(w, 400, micropubInvalidRequest, "missing url parameter")
+			return
+		}
+		post, err := h.loadPost(conn, u)
+		if err == redis.ErrNil {
+			writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("post %s does not exist", u))
+			return
+		} else if err != nil {
+			h.logger.Errorf("could not load post %s: %v", u, err)
+			writeMicropubError(w, 500, micropubServerError, "could not load post")
+			return
+		}
+		var obj mf2Object
+		err = json.Unmarshal(post.Source, &obj)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, "unauthorized", 401)
+			writeMicropubError(w, 500, micropubServerError, "could not decode post")
 			return
 		}
-
-		// no channel is found
-		if channel == "" {
-			http.Error(w, "bad request, unknown channel", 400)
+		properties := r.URL.Query()["properties[]"]
+		if len(properties) == 0 {
+			properties = r.URL.Query()["properties"]
+		}
+		if len(properties) > 0 {
+			selected := make(map[string][]interface{})
+			for _, p := range properties {
+				if v, e := obj.Properties[p]; e {
+					selected[p] = v
+				}
+			}
+			writeMicropubJSON(w, map[string]interface{}{"properties": selected})
 			return
 		}
+		writeMicropubJSON(w, obj)
+	default:
+		writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("unsupported query %q", q))
+	}
+}
+
+// serveItem shows the source of a post that was created without an url
+func (h *micropubHandler) serveItem(w http.ResponseWriter, conn redis.Conn, u string) {
+	post, err := h.loadPost(conn, u)
+	if err != nil || post.Deleted {
+		writeMicropubError(w, 404, micropubNotFound, "post not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/mf2+json")
+	_, _ = w.Write(post.Source)
+}
 
-		item, err := parseIncomingItem(r)
+func (h *micropubHandler) destinations() []micropubDestination {
+	destinations := []micropubDestination{}
+	channels, err := h.Backend.ChannelsGetList()
+	if err != nil {
+		h.logger.Errorf("could not get channels: %v", err)
+		return destinations
+	}
+	for _, c := range channels {
+		destinations = append(destinations, micropubDestination{UID: c.UID, Name: c.Name})
+	}
+	return destinations
+}
+
+func (h *micropubHandler) handlePost(w http.ResponseWriter, r *http.Request, conn redis.Conn, token micropubToken) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var req micropubRequest
+	var commands map[string][]string
+
+	switch mediaType {
+	case "application/jf2+json":
+		var item microsub.Item
+		err := json.NewDecoder(r.Body).Decode(&item)
 		if err != nil {
-			http.Error(w, err.Error(), 400)
+			writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("could not decode request body as jf2: %v", err))
 			return
 		}
-
-		item.Read = false
-		newID, err := generateItemID(conn, channel)
+		obj := itemToMf2(item)
+		req.Type = obj.Type
+		req.Properties = obj.Properties
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("could not decode request body as json: %v", err))
 			return
 		}
-		item.ID = newID
+		commands = extractJSONCommands(req.Properties)
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if action := r.Form.Get("action"); action != "" {
+			req.Action = action
+			req.URL = r.Form.Get("url")
+		} else {
+			if !hasScope(token.Scope, micropubScope("create")...) {
+				writeInsufficientScope(w, micropubScope("create")...)
+				return
+			}
+			var obj mf2Object
+			obj, commands = mf2FromForm(r.Form)
+			err := h.saveUploadedFiles(r, &obj)
+			if err != nil {
+				writeMicropubError(w, 400, micropubInvalidRequest, err.Error())
+				return
+			}
+			req.Type = obj.Type
+			req.Properties = obj.Properties
+		}
+	default:
+		writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("content-type %s is not supported", mediaType))
+		return
+	}
 
-		err = h.Backend.channelAddItemWithMatcher(channel, *item)
-		if err != nil {
-			log.Printf("could not add item to channel %s: %v", channel, err)
+	if scopes := micropubScope(req.Action); scopes != nil && !hasScope(token.Scope, scopes...) {
+		writeInsufficientScope(w, scopes...)
+		return
+	}
+
+	channel := token.Channel
+
+	switch req.Action {
+	case "":
+		if dest, e := commands["mp-destination"]; e && len(dest) > 0 {
+			channel = dest[0]
 		}
-		err = h.Backend.updateChannelUnreadCount(channel)
-		if err != nil {
-			log.Printf("could not update channel unread content %s: %v", channel, err)
+		h.create(w, conn, channel, mf2Object{Type: req.Type, Properties: req.Properties})
+	case "update":
+		h.update(w, conn, req)
+	case "delete":
+		h.delete(w, conn, req.URL, true)
+	case "undelete":
+		h.delete(w, conn, req.URL, false)
+	default:
+		writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("unknown action %q", req.Action))
+	}
+}
+
+func (h *micropubHandler) create(w http.ResponseWriter, conn redis.Conn, channel string, obj mf2Object) {
+	// no channel is found
+	if channel == "" {
+		writeMicropubError(w, 400, micropubInvalidRequest, "unknown channel")
+		return
+	}
+
+	h.Backend.lock.RLock()
+	_, channelExists := h.Backend.Channels[channel]
+	h.Backend.lock.RUnlock()
+	if !channelExists {
+		writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("unknown destination %q", channel))
+		return
+	}
+
+	if len(obj.Type) == 0 {
+		obj.Type = []string{"h-entry"}
+	}
+	if obj.Properties == nil {
+		obj.Properties = make(map[string][]interface{})
+	}
+	if _, e := obj.Properties["published"]; !e {
+		obj.Properties["published"] = []interface{}{time.Now().Format(time.RFC3339)}
+	}
+
+	postURL := getStringProperty(obj, "url")
+	if postURL != "" {
+		if !ownsURL(h.Backend.Me, postURL) {
+			writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("url %s does not belong to %s", postURL, h.Backend.Me))
+			return
+		}
+		_, err := h.loadPost(conn, postURL)
+		if err == nil {
+			writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("post %s already exists", postURL))
+			return
+		} else if err != redis.ErrNil {
+			h.logger.Errorf("could not load post %s: %v", postURL, err)
+			writeMicropubError(w, 500, micropubServerError, "could not load post")
+			return
 		}
+	}
+
+	newID, err := generateItemID(conn, h.Backend.prefix, channel)
+	if err != nil {
+		writeMicropubError(w, 500, micropubServerError, err.Error())
+		return
+	}
+
+	if postURL == "" {
+		postURL = h.Backend.baseURL + micropubItemsPath + newID
+	}
+
+	item, err := mf2ToItem(obj)
+	if err != nil {
+		writeMicropubError(w, 400, micropubInvalidRequest, err.Error())
+		return
+	}
+	item.ID = newID
+	item.URL = postURL
+	item.Read = false
+
+	post := micropubPost{ID: newID, Channel: channel, Me: h.Backend.Me, URL: postURL}
+	err = h.savePost(conn, &post, obj)
+	if err != nil {
+		h.logger.Errorf("could not save post %s: %v", postURL, err)
+		writeMicropubError(w, 500, micropubServerError, "could not save post")
+		return
+	}
+
+	err = h.Backend.channelAddItemWithMatcher(channel, item)
+	if err != nil {
+		h.logger.Errorf("could not add item to channel %s: %v", channel, err)
+	}
+	err = h.Backend.updateChannelUnreadCount(channel)
+	if err != nil {
+		h.logger.Errorf("could not update channel unread content %s: %v", channel, err)
+	}
+
+	w.Header().Set("Location", postURL)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *micropubHandler) update(w http.ResponseWriter, conn redis.Conn, req micropubRequest) {
+	if req.URL == "" {
+		writeMicropubError(w, 400, micropubInvalidRequest, "missing url")
+		return
+	}
+
+	post, err := h.loadPost(conn, req.URL)
+	if err == redis.ErrNil || (err == nil && post.Deleted) {
+		writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("post %s does not exist", req.URL))
+		return
+	} else if err != nil {
+		writeMicropubError(w, 500, micropubServerError, "could not load post")
+		return
+	}
+
+	var obj mf2Object
+	err = json.Unmarshal(post.Source, &obj)
+	if err != nil {
+		writeMicropubError(w, 500, micropubServerError, "could not decode post")
+		return
+	}
+
+	err = applyMicropubUpdate(&obj, req)
+	if err != nil {
+		writeMicropubError(w, 400, micropubInvalidRequest, err.Error())
+		return
+	}
+
+	item, err := mf2ToItem(obj)
+	if err != nil {
+		writeMicropubError(w, 400, micropubInvalidRequest, err.Error())
+		return
+	}
+	item.ID = post.ID
+	item.URL = post.URL
+	item.Read = false
 
-		w.Header().Set("Content-Type", "application/json")
+	err = h.savePost(conn, &post, obj)
+	if err != nil {
+		writeMicropubError(w, 500, micropubServerError, "could not save post")
+		return
+	}
+
+	err = h.Backend.channelRemoveItem(post.Channel, post.ID)
+	if err != nil {
+		h.logger.Errorf("could not remove previous version of %s: %v", post.URL, err)
+	}
+	err = h.Backend.channelAddItem(post.Channel, item)
+	if err != nil {
+		h.logger.Errorf("could not add item to channel %s: %v", post.Channel, err)
+	}
+	err = h.Backend.updateChannelUnreadCount(post.Channel)
+	if err != nil {
+		h.logger.Errorf("could not update channel unread content %s: %v", post.Channel, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *micropubHandler) delete(w http.ResponseWriter, conn redis.Conn, u string, deleted bool) {
+	if u == "" {
+		writeMicropubError(w, 400, micropubInvalidRequest, "missing url")
+		return
+	}
+
+	post, err := h.loadPost(conn, u)
+	if err == redis.ErrNil {
+		writeMicropubError(w, 400, micropubInvalidRequest, fmt.Sprintf("post %s does not exist", u))
+		return
+	} else if err != nil {
+		writeMicropubError(w, 500, micropubServerError, "could not load post")
+		return
+	}
 
-		if err = json.NewEncoder(w).Encode(map[string]string{"ok": "1"}); err != nil {
-			http.Error(w, "internal server error", 500)
+	if deleted {
+		err = h.Backend.channelRemoveItem(post.Channel, post.ID)
+	} else {
+		var obj mf2Object
+		var item microsub.Item
+		err = json.Unmarshal(post.Source, &obj)
+		if err == nil {
+			item, err = mf2ToItem(obj)
 		}
+		if err == nil {
+			item.ID = post.ID
+			item.URL = post.URL
+			err = h.Backend.channelAddItem(post.Channel, item)
+		}
+	}
+	if err != nil {
+		h.logger.Errorf("could not change post %s: %v", u, err)
+		writeMicropubError(w, 500, micropubServerError, "could not change post")
 		return
 	}
 
-	http.Error(w, "Method not allowed", 405)
+	_, err = conn.Do("HSET", h.Backend.prefix+"micropub:post:"+post.ID, "deleted", deleted)
+	if err != nil {
+		writeMicropubError(w, 500, micropubServerError, "could not save post")
+		return
+	}
+
+	err = h.Backend.updateChannelUnreadCount(post.Channel)
+	if err != nil {
+		h.logger.Errorf("could not update channel unread content %s: %v", post.Channel, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func generateItemID(conn redis.Conn, channel string) (string, error) {
-	id, err := redis.Int(conn.Do("INCR", fmt.Sprintf("source:%s:next_id", channel)))
+// generateItemID returns a new id for an item of the user with prefix. The
+// prefix is part of the hash, so users with the same channel uid don't get the
+// same ids.
+func generateItemID(conn redis.Conn, prefix, channel string) (string, error) {
+	id, err := redis.Int(conn.Do("INCR", fmt.Sprintf("%ssource:%s:next_id", prefix, channel)))
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("source:%s:%d", channel, id)))), nil
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%ssource:%s:%d", prefix, channel, id)))), nil
 }
 
-func parseIncomingItem(r *http.Request) (*microsub.Item, error) {
-	var item microsub.Item
+// ownsURL returns true when u is on the site of me. When me has a path, u
+// must be below that path.
+func ownsURL(me, u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return false
+	}
+	site := canonicalMe(me)
+	if !strings.HasSuffix(site, "/") {
+		site += "/"
+	}
+	return strings.HasPrefix(canonicalMe(u)+"/", site)
+}
 
-	contentType := r.Header.Get("content-type")
+// saveUploadedFiles saves the files of a multipart request and adds their
+// urls to the properties
+func (h *micropubHandler) saveUploadedFiles(r *http.Request, obj *mf2Object) error {
+	if r.MultipartForm == nil {
+		return nil
+	}
 
-	if contentType == "application/jf2+json" {
-		dec := json.NewDecoder(r.Body)
-		err := dec.Decode(&item)
-		if err != nil {
-			return nil, errors.Wrapf(err, "could not decode request body as jf2: %v", err)
+	for k, files := range r.MultipartForm.File {
+		k = strings.TrimSuffix(k, "[]")
+		if k != "photo" && k != "video" && k != "audio" {
+			continue
 		}
-	} else if contentType == "application/json" {
-		var mfItem microformats.Microformat
-		dec := json.NewDecoder(r.Body)
-		err := dec.Decode(&mfItem)
-		if err != nil {
-			return nil, errors.Wrapf(err, "could not decode request body as json: %v", err)
-		}
-		author := microsub.Card{}
-		var ok bool
-		item, ok = jf2.SimplifyMicroformatItem(&mfItem, author)
-		if !ok {
-			return nil, fmt.Errorf("could not simplify microformat item to jf2")
-		}
-	} else if contentType == "application/x-www-form-urlencoded" {
-		content := r.FormValue("content")
-		name := r.FormValue("name")
-		item.Type = "entry"
-		item.Name = name
-		item.Content = &microsub.Content{Text: content}
-		item.Published = time.Now().Format(time.RFC3339)
-	} else {
-		return nil, fmt.Errorf("content-type %s is not supported", contentType)
+		for _, fh := range files {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			u, err := h.Media.Save(h.Backend.prefix, f)
+			_ = f.Close()
+			if err != nil {
+				return errors.Wrapf(err, "could not save %s", fh.Filename)
+			}
+			obj.Properties[k] = append(obj.Properties[k], u)
+		}
+	}
+
+	return nil
+}
+
+// loadPost loads the post with url u, posts of other users are not found
+func (h *micropubHandler) loadPost(conn redis.Conn, u string) (micropubPost, error) {
+	post, err := loadMicropubPost(conn, h.Backend.prefix, u)
+	if err != nil {
+		return post, err
+	}
+	if backend, ok := h.Users.backendFor(post.Me); !ok || backend != h.Backend {
+		return post, redis.ErrNil
+	}
+	return post, nil
+}
+
+func (h *micropubHandler) savePost(conn redis.Conn, post *micropubPost, obj mf2Object) error {
+	err := saveMicropubPost(conn, h.Backend.prefix, post, obj)
+	if err != nil {
+		return err
+	}
+	return h.Media.updateReferences(conn, h.Backend.prefix, post.ID, obj)
+}
+
+// saveMicropubPost saves the post under the keys of the user with prefix
+func saveMicropubPost(conn redis.Conn, prefix string, post *micropubPost, obj mf2Object) error {
+	source, err := json.Marshal(&obj)
+	if err != nil {
+		return err
+	}
+	post.Source = source
+
+	_, err = conn.Do("HMSET", redis.Args{}.Add(prefix+"micropub:post:"+post.ID).AddFlat(post)...)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", prefix+"micropub:urls", post.URL, post.ID)
+	return err
+}
+
+// loadMicropubPost loads the post with url u of the user with prefix
+func loadMicropubPost(conn redis.Conn, prefix, u string) (micropubPost, error) {
+	var post micropubPost
+
+	id, err := redis.String(conn.Do("HGET", prefix+"micropub:urls", u))
+	if err != nil {
+		return post, err
+	}
+
+	values, err := redis.Values(conn.Do("HGETALL", prefix+"micropub:post:"+id))
+	if err != nil {
+		return post, err
+	}
+	if len(values) == 0 {
+		return post, redis.ErrNil
+	}
+
+	err = redis.ScanStruct(values, &post)
+	return post, err
+}
+
+// mf2FromForm converts a form encoded create request into a mf2 object and
+// the mp-* commands
+func mf2FromForm(form url.Values) (mf2Object, map[string][]string) {
+	obj := mf2Object{
+		Type:       []string{"h-entry"},
+		Properties: make(map[string][]interface{}),
+	}
+	commands := make(map[string][]string)
+
+	for k, values := range form {
+		k = strings.TrimSuffix(k, "[]")
+
+		switch {
+		case k == "access_token" || k == "action":
+			continue
+		case k == "h":
+			if len(values) > 0 {
+				obj.Type = []string{"h-" + values[0]}
+			}
+		case strings.HasPrefix(k, "mp-"):
+			commands[k] = append(commands[k], values...)
+		default:
+			for _, v := range values {
+				obj.Properties[k] = append(obj.Properties[k], v)
+			}
+		}
+	}
+
+	return obj, commands
+}
+
+// extractJSONCommands removes the mp-* commands from the properties
+func extractJSONCommands(properties map[string][]interface{}) map[string][]string {
+	commands := make(map[string][]string)
+	for k, values := range properties {
+		if !strings.HasPrefix(k, "mp-") {
+			continue
+		}
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				commands[k] = append(commands[k], s)
+			}
+		}
+		delete(properties, k)
+	}
+	return commands
+}
+
+// applyMicropubUpdate applies the replace, add and delete operations of req
+func applyMicropubUpdate(obj *mf2Object, req micropubRequest) error {
+	if obj.Properties == nil {
+		obj.Properties = make(map[string][]interface{})
+	}
+
+	for k, v := range req.Replace {
+		obj.Properties[k] = v
+	}
+
+	for k, v := range req.Add {
+		obj.Properties[k] = append(obj.Properties[k], v...)
+	}
+
+	switch del := req.Delete.(type) {
+	case nil:
+	case []interface{}:
+		for _, k := range del {
+			name, ok := k.(string)
+			if !ok {
+				return fmt.Errorf("delete should contain property names")
+			}
+			delete(obj.Properties, name)
+		}
+	case map[string]interface{}:
+		for k, v := range del {
+			values, ok := v.([]interface{})
+			if !ok {
+				return fmt.Errorf("delete values of %q should be an array", k)
+			}
+			var kept []interface{}
+			for _, existing := range obj.Properties[k] {
+				remove := false
+				for _, value := range values {
+					if reflect.DeepEqual(existing, value) {
+						remove = true
+						break
+					}
+				}
+				if !remove {
+					kept = append(kept, existing)
+				}
+			}
+			if len(kept) == 0 {
+				delete(obj.Properties, k)
+			} else {
+				obj.Properties[k] = kept
+			}
+		}
+	default:
+		return fmt.Errorf("delete should be an array or an object")
 	}
-	return &item, nil
+
+	return nil
 }
 
-func getChannelFromAuthorization(r *http.Request, conn redis.Conn) (string, error) {
+// mf2ToItem simplifies a mf2 object to a microsub.Item
+func mf2ToItem(obj mf2Object) (microsub.Item, error) {
+	if len(obj.Type) == 0 {
+		return microsub.Item{}, fmt.Errorf("missing type")
+	}
+	mfItem := microformats.Microformat{Type: obj.Type, Properties: obj.Properties}
+	item, ok := jf2.SimplifyMicroformatItem(&mfItem, microsub.Card{})
+	if !ok {
+		return item, errors.Errorf("type %s is not supported", obj.Type[0])
+	}
+	if item.Author != nil && *item.Author == (microsub.Card{}) {
+		item.Author = nil
+	}
+	return item, nil
+}
+
+// itemToMf2 converts a jf2 item to a mf2 object, so it can be used as the source of a post
+func itemToMf2(item microsub.Item) mf2Object {
+	itemType := item.Type
+	if itemType == "" {
+		itemType = "entry"
+	}
+	obj := mf2Object{
+		Type:       []string{"h-" + itemType},
+		Properties: make(map[string][]interface{}),
+	}
+
+	scalars := map[string]string{
+		"name":      item.Name,
+		"published": item.Published,
+		"updated":   item.Updated,
+		"url":       item.URL,
+		"uid":       item.UID,
+		"summary":   item.Summary,
+		"latitude":  item.Latitude,
+		"longitude": item.Longitude,
+	}
+	for k, v := range scalars {
+		if v != "" {
+			obj.Properties[k] = []interface{}{v}
+		}
+	}
+
+	lists := map[string][]string{
+		"category":    item.Category,
+		"photo":       item.Photo,
+		"like-of":     item.LikeOf,
+		"bookmark-of": item.BookmarkOf,
+		"repost-of":   item.RepostOf,
+		"in-reply-to": item.InReplyTo,
+	}
+	for k, values := range lists {
+		for _, v := range values {
+			obj.Properties[k] = append(obj.Properties[k], v)
+		}
+	}
+
+	if item.Author != nil {
+		properties := make(map[string]interface{})
+		for k, v := range map[string]string{"name": item.Author.Name, "url": item.Author.URL, "photo": item.Author.Photo} {
+			if v != "" {
+				properties[k] = []interface{}{v}
+			}
+		}
+		obj.Properties["author"] = []interface{}{
+			map[string]interface{}{
+				"type":       []interface{}{"h-card"},
+				"properties": properties,
+			},
+		}
+	}
+
+	if item.Content != nil {
+		content := make(map[string]interface{})
+		if item.Content.Text != "" {
+			content["value"] = item.Content.Text
+		}
+		if item.Content.HTML != "" {
+			content["html"] = item.Content.HTML
+		}
+		obj.Properties["content"] = []interface{}{content}
+	}
+
+	return obj
+}
+
+func getStringProperty(obj mf2Object, name string) string {
+	if values, e := obj.Properties[name]; e && len(values) > 0 {
+		if s, ok := values[0].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func getAccessToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return authHeader[7:]
+	}
+	return r.Form.Get("access_token")
+}
+
+// micropubToken is the information of a token that is needed by the Micropub endpoint
+type micropubToken struct {
+	Me      string `redis:"me"`
+	Channel string `redis:"channel"`
+	Scope   string `redis:"scope"`
+}
+
+func getTokenFromAuthorization(r *http.Request, conn redis.Conn) (micropubToken, error) {
+	var token micropubToken
+
 	// backward compatible
 	sourceID := r.URL.Query().Get("source_id")
 	if sourceID != "" {
 		channel, err := redis.String(conn.Do("HGET", "sources", sourceID))
 		if err != nil {
-			return "", errors.Wrapf(err, "could not get channel for sourceID: %s", sourceID)
+			return token, errors.Wrapf(err, "could not get channel for sourceID: %s", sourceID)
 		}
 
-		return channel, nil
+		// source ids are only used to create posts
+		token.Channel = channel
+		token.Scope = ScopeCreate
+		return token, nil
 	}
 
 	// full micropub with indieauth
-	authHeader := r.Header.Get("Authorization")
-	if strings.HasPrefix(authHeader, "Bearer ") {
-		token := authHeader[7:]
-		channel, err := redis.String(conn.Do("HGET", "token:"+token, "channel"))
+	if accessToken := getAccessToken(r); accessToken != "" {
+		values, err := redis.Values(conn.Do("HGETALL", "token:"+accessToken))
 		if err != nil {
-			return "", errors.Wrap(err, "could not get channel for token")
+			return token, errors.Wrap(err, "could not get token")
+		}
+		if len(values) == 0 {
+			return token, fmt.Errorf("token not found")
+		}
+		err = redis.ScanStruct(values, &token)
+		if err != nil {
+			return token, errors.Wrap(err, "could not read token")
+		}
+		if token.Channel == "" {
+			return token, fmt.Errorf("token has no channel")
 		}
 
-		return channel, nil
+		return token, nil
 	}
 
-	return "", fmt.Errorf("could not get channel from authorization")
+	return token, fmt.Errorf("could not get channel from authorization")
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func TestMf2FromForm(t *testing.T) {
+	form := url.Values{}
+	form.Set("h", "entry")
+	form.Set("content", "Hello world")
+	form.Add("category[]", "one")
+	form.Add("category[]", "two")
+	form.Set("mp-destination", "0001")
+	form.Set("access_token", "secret")
+
+	obj, commands := mf2FromForm(form)
+
+	assert.Equal(t, []string{"h-entry"}, obj.Type)
+	assert.Equal(t, []interface{}{"Hello world"}, obj.Properties["content"])
+	assert.Equal(t, []interface{}{"one", "two"}, obj.Properties["category"])
+	assert.NotContains(t, obj.Properties, "access_token")
+	assert.NotContains(t, obj.Properties, "mp-destination")
+	assert.Equal(t, []string{"0001"}, commands["mp-destination"])
+
+	item, err := mf2ToItem(obj)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "entry", item.Type)
+		assert.Equal(t, []string{"one", "two"}, item.Category)
+		if assert.NotNil(t, item.Content) {
+			assert.Equal(t, "Hello world", item.Content.Text)
+		}
+	}
+}
+
+func TestApplyMicropubUpdate(t *testing.T) {
+	obj := mf2Object{
+		Type: []string{"h-entry"},
+		Properties: map[string][]interface{}{
+			"content":  {"old content"},
+			"category": {"one", "two", "three"},
+			"name":     {"title"},
+		},
+	}
+
+	var req micropubRequest
+	err := json.Unmarshal([]byte(`{
+		"action": "update",
+		"url": "https://example.com/post",
+		"replace": {"content": ["new content"]},
+		"add": {"syndication": ["https://elsewhere.example/1"]},
+		"delete": {"category": ["two"]}
+	}`), &req)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = applyMicropubUpdate(&obj, req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{"new content"}, obj.Properties["content"])
+		assert.Equal(t, []interface{}{"https://elsewhere.example/1"}, obj.Properties["syndication"])
+		assert.Equal(t, []interface{}{"one", "three"}, obj.Properties["category"])
+	}
+
+	err = json.Unmarshal([]byte(`{"action": "update", "delete": ["name"]}`), &req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Replace = nil
+	req.Add = nil
+
+	err = applyMicropubUpdate(&obj, req)
+	if assert.NoError(t, err) {
+		assert.NotContains(t, obj.Properties, "name")
+	}
+}
+
+func TestItemToMf2(t *testing.T) {
+	item := microsub.Item{
+		Type:    "entry",
+		Name:    "Title",
+		Content: &microsub.Content{Text: "text", HTML: "<p>text</p>"},
+		LikeOf:  []string{"https://example.com/"},
+		Author:  &microsub.Card{Type: "card", Name: "Author", URL: "https://author.example/"},
+	}
+
+	converted, err := mf2ToItem(itemToMf2(item))
+	if assert.NoError(t, err) {
+		assert.Equal(t, item.Name, converted.Name)
+		assert.Equal(t, item.Content, converted.Content)
+		assert.Equal(t, item.LikeOf, converted.LikeOf)
+		assert.Equal(t, item.Author, converted.Author)
+	}
+}
+
+func TestMicropub_URLOfOtherUser(t *testing.T) {
+	users, cleanup := newTestUsers(t, "https://alice.example.org/")
+	defer cleanup()
+
+	alice, err := users.provision("https://alice.example.org/", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	pool, _ := newFakePool()
+	users.primary.backend.pool = pool
+	alice.backend.pool = pool
+	media := &mediaBackend{pool: pool, baseURL: "https://microsub.example.com"}
+
+	handlerFor := func(b *memoryBackend) *micropubHandler {
+		return &micropubHandler{Users: users, Media: media, pool: pool, Backend: b, logger: logger}
+	}
+	aliceHandler := handlerFor(alice.backend)
+	otherHandler := handlerFor(users.primary.backend)
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	post := func(h *micropubHandler, u string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.create(w, conn, "home", mf2Object{Properties: map[string][]interface{}{
+			"content": {"Hello world"},
+			"url":     {u},
+		}})
+		return w
+	}
+
+	const aliceURL = "https://alice.example.org/notes/1"
+
+	w := post(aliceHandler, aliceURL)
+	if !assert.Equal(t, http.StatusCreated, w.Code) {
+		return
+	}
+	assert.Equal(t, aliceURL, w.Header().Get("Location"))
+
+	// The other user can't take over the url of alice
+	w = post(otherHandler, aliceURL)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, err = otherHandler.loadPost(conn, aliceURL)
+	assert.Equal(t, redis.ErrNil, err)
+
+	w = post(aliceHandler, aliceURL)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the url is used already")
+
+	w = post(otherHandler, "https://example.com/notes/1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// Alice can still update and delete the post
+	w = httptest.NewRecorder()
+	aliceHandler.update(w, conn, micropubRequest{
+		Action:  "update",
+		URL:     aliceURL,
+		Replace: map[string][]interface{}{"content": {"Hello again"}},
+	})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	otherHandler.delete(w, conn, aliceURL, true)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	aliceHandler.delete(w, conn, aliceURL, true)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	p, err := aliceHandler.loadPost(conn, aliceURL)
+	if assert.NoError(t, err) {
+		assert.True(t, p.Deleted)
+		assert.Equal(t, "https://alice.example.org/", p.Me)
+	}
+}
+
+func TestOwnsURL(t *testing.T) {
+	assert.True(t, ownsURL("https://example.com/", "https://example.com/notes/1"))
+	assert.True(t, ownsURL("https://example.com", "https://EXAMPLE.com/"))
+	assert.True(t, ownsURL("https://example.com/alice/", "https://example.com/alice/1"))
+	assert.True(t, ownsURL("https://example.com/alice", "https://example.com/alice/1"))
+	assert.False(t, ownsURL("https://example.com/alice", "https://example.com/alicebob/1"))
+	assert.False(t, ownsURL("https://example.com/", "https://alice.example.org/notes/1"))
+	assert.False(t, ownsURL("https://example.com/", "/notes/1"))
+	assert.False(t, ownsURL("", "https://example.com/notes/1"))
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/netguard"
+	"p83.nl/go/ekster/pkg/webpush"
+)
+
+const (
+	// pushQueueKey is the list of notifications that should be sent now
+	pushQueueKey = "webpush:queue"
+	// pushVAPIDKey is the VAPID key, when there is none in the config
+	pushVAPIDKey = "webpush:vapid_key"
+	// pushTimeout is the time a request to a push service can take
+	pushTimeout = 30 * time.Second
+)
+
+// pushSubscription is a device that receives notifications for the new items
+// of channels
+type pushSubscription struct {
+	ID        string    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	P256dh    string    `json:"p256dh"`
+	Auth      string    `json:"auth"`
+	Channels  []string  `json:"channels"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+func (s pushSubscription) subscription() webpush.Subscription {
+	return webpush.Subscription{Endpoint: s.Endpoint, Keys: webpush.Keys{P256dh: s.P256dh, Auth: s.Auth}}
+}
+
+// HasChannel returns true when the device is notified of new items in channel
+func (s pushSubscription) HasChannel(channel string) bool {
+	for _, c := range s.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// pushMessage is the payload of a notification, it's shown by the service
+// worker in push-sw.js
+type pushMessage struct {
+	Version int    `json:"version"`
+	Event   string `json:"event"`
+	Channel string `json:"channel"`
+	Title   string `json:"title"`
+	Body    string `json:"body,omitempty"`
+	URL     string `json:"url,omitempty"`
+}
+
+// pushDelivery is a notification that should be sent to a device
+type pushDelivery struct {
+	User         string          `json:"user"`
+	Subscription string          `json:"subscription"`
+	Channel      string          `json:"channel"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// pushBackend sends the queued notifications of all users
+type pushBackend struct {
+	users  *userBackends
+	pool   *redis.Pool
+	client *http.Client
+
+	lock sync.Mutex
+	key  *ecdsa.PrivateKey
+	// keySource is the key from the config that key was parsed from
+	keySource string
+}
+
+// addPushSubscription saves the device, or changes the channels of a device
+// that was saved before
+func (b *memoryBackend) addPushSubscription(sub pushSubscription) (pushSubscription, error) {
+	if err := sub.subscription().Validate(); err != nil {
+		return sub, microsub.InvalidRequestError("%v", err)
+	}
+	for _, channel := range sub.Channels {
+		if !b.channelExists(channel) {
+			return sub, microsub.NotFoundError("channel %s does not exist", channel)
+		}
+	}
+	// The address is checked again when the notification is sent
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err := netguard.CheckURL(ctx, sub.Endpoint)
+	cancel()
+	if err != nil {
+		return sub, microsub.InvalidRequestError("endpoint %s is not allowed: %v", sub.Endpoint, err)
+	}
+
+	b.lock.Lock()
+	found := false
+	for i, s := range b.PushSubscriptions {
+		if s.Endpoint == sub.Endpoint {
+			sub.ID = s.ID
+			sub.Created = s.Created
+			b.PushSubscriptions[i] = sub
+			found = true
+			break
+		}
+	}
+	if !found {
+		sub.ID = randomHex(8)
+		sub.Created = time.Now()
+		b.PushSubscriptions = append(b.PushSubscriptions, sub)
+	}
+	b.lock.Unlock()
+
+	return sub, b.save()
+}
+
+// setPushChannels changes the channels of the device with id
+func (b *memoryBackend) setPushChannels(id string, channels []string) error {
+	for _, channel := range channels {
+		if !b.channelExists(channel) {
+			return microsub.NotFoundError("channel %s does not exist", channel)
+		}
+	}
+
+	b.lock.Lock()
+	found := false
+	for i, s := range b.PushSubscriptions {
+		if s.ID == id {
+			b.PushSubscriptions[i].Channels = channels
+			found = true
+			break
+		}
+	}
+	b.lock.Unlock()
+
+	if !found {
+		return microsub.NotFoundError("push subscription %s does not exist", id)
+	}
+	return b.save()
+}
+
+// removePushSubscription removes the device with id
+func (b *memoryBackend) removePushSubscription(id string) error {
+	b.lock.Lock()
+	for i, s := range b.PushSubscriptions {
+		if s.ID == id {
+			b.PushSubscriptions = append(b.PushSubscriptions[:i:i], b.PushSubscriptions[i+1:]...)
+			break
+		}
+	}
+	b.lock.Unlock()
+
+	return b.save()
+}
+
+// pushSubscriptions returns the devices of the user
+func (b *memoryBackend) pushSubscriptions() []pushSubscription {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return append([]pushSubscription(nil), b.PushSubscriptions...)
+}
+
+// pushSubscription returns the device with id
+func (b *memoryBackend) pushSubscription(id string) (pushSubscription, bool) {
+	for _, s := range b.pushSubscriptions() {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return pushSubscription{}, false
+}
+
+// newPushMessage returns the notification for a new item in channel
+func newPushMessage(channel, channelName string, item microsub.Item) pushMessage {
+	di := newDigestItem(item)
+	msg := pushMessage{
+		Version: 1,
+		Event:   microsub.EventNewItem,
+		Channel: channel,
+		Title:   channelName + ": " + shorten(di.Title, 100),
+		Body:    shorten(di.Text, 200),
+	}
+	// Very long urls don't fit in the payload
+	if len(item.URL) <= 1000 {
+		msg.URL = item.URL
+	}
+	if di.Author != "" {
+		msg.Body = strings.TrimSpace(di.Author + "\n" + msg.Body)
+	}
+	return msg
+}
+
+// enqueuePush queues a notification of the new item for the devices that
+// want notifications of channel. A device receives at most one notification
+// for a channel per webpush.throttle.
+func (b *memoryBackend) enqueuePush(channel string, item microsub.Item) {
+	var subs []pushSubscription
+	for _, s := range b.pushSubscriptions() {
+		if s.HasChannel(channel) {
+			subs = append(subs, s)
+		}
+	}
+	if len(subs) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(newPushMessage(channel, b.channelName(channel), item))
+	if err != nil {
+		logger.Errorf("could not encode push message: %v", err)
+		return
+	}
+
+	throttle := currentConfig().WebPush.Throttle
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	for _, s := range subs {
+		if throttle > 0 {
+			key := fmt.Sprintf("%swebpush:throttle:%s:%s", b.prefix, s.ID, channel)
+			ok, err := redis.String(conn.Do("SET", key, 1, "PX", int64(throttle/time.Millisecond), "NX"))
+			if err == redis.ErrNil {
+				metricWebPush.With("throttled").Inc()
+				continue
+			}
+			if err != nil || ok != "OK" {
+				logger.Errorf("could not throttle push notification: %v", err)
+				continue
+			}
+		}
+		err := pushNotification(conn, pushDelivery{User: b.id, Subscription: s.ID, Channel: channel, Payload: payload})
+		if err != nil {
+			logger.Errorf("could not queue push notification: %v", err)
+		}
+	}
+}
+
+func pushNotification(conn redis.Conn, d pushDelivery) error {
+	data, err := json.Marshal(&d)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("LPUSH", pushQueueKey, data)
+	return err
+}
+
+// vapidKey returns the key from the config. Without a key in the config, a
+// key is created once and kept in Redis, so all instances use the same key.
+func (pb *pushBackend) vapidKey() (*ecdsa.PrivateKey, error) {
+	source := currentConfig().WebPush.VAPIDKey
+
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+
+	if pb.key != nil && pb.keySource == source {
+		return pb.key, nil
+	}
+
+	if source == "" {
+		conn := pb.pool.Get()
+		defer conn.Close()
+
+		key, err := webpush.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.Do("SETNX", pushVAPIDKey, webpush.EncodeKey(key))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not save VAPID key")
+		}
+		encoded, err := redis.String(conn.Do("GET", pushVAPIDKey))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read VAPID key")
+		}
+		key, err = webpush.ParseKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		pb.key, pb.keySource = key, source
+		return key, nil
+	}
+
+	key, err := webpush.ParseKey(source)
+	if err != nil {
+		return nil, err
+	}
+	pb.key, pb.keySource = key, source
+	return key, nil
+}
+
+// publicKey returns the public VAPID key for the browsers
+func (pb *pushBackend) publicKey() (string, error) {
+	key, err := pb.vapidKey()
+	if err != nil {
+		return "", err
+	}
+	return webpush.PublicKey(key), nil
+}
+
+// run sends the queued notifications with webpush.workers workers until ctx
+// is cancelled
+func (pb *pushBackend) run(ctx context.Context) {
+	queue := &deliveryQueue{
+		name:    "push notification",
+		key:     pushQueueKey,
+		pool:    pb.pool,
+		workers: currentConfig().WebPush.Workers,
+		deliver: pb.sendData,
+	}
+	queue.run(ctx)
+}
+
+// sendData decodes a notification from the queue and sends it
+func (pb *pushBackend) sendData(ctx context.Context, data []byte) error {
+	var d pushDelivery
+	err := json.Unmarshal(data, &d)
+	if err != nil {
+		return errors.Wrap(err, "could not decode push notification")
+	}
+	return errors.Wrapf(pb.send(ctx, d), "subscription %s", d.Subscription)
+}
+
+// send sends the notification to the push service of the device. Devices
+// that the push service doesn't know anymore are removed.
+func (pb *pushBackend) send(ctx context.Context, d pushDelivery) error {
+	user, ok := pb.users.get(d.User)
+	if !ok {
+		return nil
+	}
+	sub, ok := user.backend.pushSubscription(d.Subscription)
+	if !ok {
+		// The device was removed
+		return nil
+	}
+
+	key, err := pb.vapidKey()
+	if err != nil {
+		return err
+	}
+
+	cfg := currentConfig()
+	subject := cfg.WebPush.Subject
+	if subject == "" {
+		subject = cfg.BaseURL
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, pushTimeout)
+	_, err = webpush.Send(sendCtx, pb.client, sub.subscription(), d.Payload, webpush.Options{
+		Key:     key,
+		Subject: subject,
+		TTL:     cfg.WebPush.TTL,
+	})
+	cancel()
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+
+	switch {
+	case err == webpush.ErrGone:
+		metricWebPush.With("gone").Inc()
+		logger.Infof("removed push subscription %s of %s, it has expired", sub.ID, d.User)
+		return user.backend.removePushSubscription(sub.ID)
+	case err != nil:
+		metricWebPush.With("error").Inc()
+		return err
+	}
+	metricWebPush.With("ok").Inc()
+	return nil
+}
+
+// sendTestPush queues a notification for the device with id, without
+// throttling
+func sendTestPush(conn redis.Conn, b *memoryBackend, id string) error {
+	if _, ok := b.pushSubscription(id); !ok {
+		return microsub.NotFoundError("push subscription %s does not exist", id)
+	}
+	payload, err := json.Marshal(pushMessage{
+		Version: 1,
+		Event:   "test",
+		Title:   "Ekster",
+		Body:    "Notifications work on this device",
+	})
+	if err != nil {
+		return err
+	}
+	return pushNotification(conn, pushDelivery{User: b.id, Subscription: id, Payload: payload})
+}
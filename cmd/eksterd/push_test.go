@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/netguard"
+	"p83.nl/go/ekster/pkg/webpush"
+)
+
+const (
+	testP256dh = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	testAuth   = "BTBZMqHH6r4Tts7J_aSIgg"
+)
+
+func TestMemoryBackend_PushSubscriptions(t *testing.T) {
+	backend := newMemoryBackend("https://example.com/")
+
+	_, err := backend.addPushSubscription(pushSubscription{Endpoint: "http://push.example.net/1", P256dh: testP256dh, Auth: testAuth})
+	assert.Equal(t, microsub.ErrorInvalidRequest, microsub.ErrorCode(err))
+	_, err = backend.addPushSubscription(pushSubscription{Endpoint: "https://push.example.net/1", P256dh: testP256dh, Auth: testAuth, Channels: []string{"missing"}})
+	assert.Equal(t, microsub.ErrorNotFound, microsub.ErrorCode(err))
+
+	_, err = backend.addPushSubscription(pushSubscription{Endpoint: "https://localhost/1", P256dh: testP256dh, Auth: testAuth})
+	assert.Equal(t, microsub.ErrorInvalidRequest, microsub.ErrorCode(err))
+
+	// Addresses instead of names, because the tests can't resolve names
+	sub, err := backend.addPushSubscription(pushSubscription{Endpoint: "https://93.184.216.34/1", P256dh: testP256dh, Auth: testAuth, Channels: []string{"notifications"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, sub.ID)
+	assert.True(t, sub.HasChannel("notifications"))
+	assert.False(t, sub.HasChannel("home"))
+
+	// Subscribing the same device again changes the subscription
+	again, err := backend.addPushSubscription(pushSubscription{Endpoint: "https://93.184.216.34/1", P256dh: testP256dh, Auth: testAuth, Channels: []string{"home"}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, sub.ID, again.ID)
+		assert.Len(t, backend.pushSubscriptions(), 1)
+	}
+
+	assert.NoError(t, backend.setPushChannels(sub.ID, []string{"home", "notifications"}))
+	s, ok := backend.pushSubscription(sub.ID)
+	if assert.True(t, ok) {
+		assert.Equal(t, []string{"home", "notifications"}, s.Channels)
+	}
+	assert.Equal(t, microsub.ErrorNotFound, microsub.ErrorCode(backend.setPushChannels("missing", nil)))
+
+	// The subscriptions are saved with the channels and feeds
+	assert.Equal(t, []pushSubscription{s}, backend.config().PushSubscriptions)
+
+	assert.NoError(t, backend.removePushSubscription(sub.ID))
+	assert.Empty(t, backend.pushSubscriptions())
+}
+
+func TestNewPushMessage(t *testing.T) {
+	msg := newPushMessage("home", "Home", microsub.Item{
+		Name:    "Hello world",
+		URL:     "https://example.com/hello",
+		Author:  &microsub.Card{Name: "Peter"},
+		Content: &microsub.Content{Text: "A post about things"},
+	})
+	assert.Equal(t, pushMessage{
+		Version: 1,
+		Event:   "new item",
+		Channel: "home",
+		Title:   "Home: Hello world",
+		Body:    "Peter\nA post about things",
+		URL:     "https://example.com/hello",
+	}, msg)
+}
+
+func TestPushBackend_Send(t *testing.T) {
+	key, _ := webpush.GenerateKey()
+	cfg := defaultConfig()
+	cfg.BaseURL = "https://microsub.example.com"
+	cfg.WebPush.VAPIDKey = webpush.EncodeKey(key)
+	setCurrentConfig(cfg)
+	defer setCurrentConfig(defaultConfig())
+
+	var received []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r)
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	users, cleanup := newTestUsers(t)
+	defer cleanup()
+	backend := users.primary.backend
+	backend.PushSubscriptions = []pushSubscription{
+		{ID: "s1", Endpoint: server.URL + "/push", P256dh: testP256dh, Auth: testAuth, Channels: []string{"home"}},
+		{ID: "s2", Endpoint: server.URL + "/gone", P256dh: testP256dh, Auth: testAuth, Channels: []string{"home"}},
+	}
+
+	pb := &pushBackend{users: users, pool: backend.pool, client: server.Client()}
+	payload, _ := json.Marshal(pushMessage{Version: 1, Title: "Hello"})
+
+	err := pb.send(context.Background(), pushDelivery{User: users.primary.id, Subscription: "s1", Channel: "home", Payload: payload})
+	if assert.NoError(t, err) && assert.Len(t, received, 1) {
+		assert.Equal(t, "aes128gcm", received[0].Header.Get("Content-Encoding"))
+		assert.Contains(t, received[0].Header.Get("Authorization"), "k="+webpush.PublicKey(key))
+	}
+
+	// A subscription that is gone is removed
+	err = pb.send(context.Background(), pushDelivery{User: users.primary.id, Subscription: "s2", Channel: "home", Payload: payload})
+	assert.NoError(t, err)
+	_, ok := backend.pushSubscription("s2")
+	assert.False(t, ok)
+
+	// Nothing is sent to removed subscriptions
+	err = pb.send(context.Background(), pushDelivery{User: users.primary.id, Subscription: "s2", Channel: "home", Payload: payload})
+	assert.NoError(t, err)
+	assert.Len(t, received, 2)
+
+	// The client of the pushBackend doesn't connect to local addresses
+	pb.client = netguard.Client(0)
+	err = pb.send(context.Background(), pushDelivery{User: users.primary.id, Subscription: "s1", Channel: "home", Payload: payload})
+	assert.True(t, errors.Is(err, netguard.ErrNotPublic))
+	assert.Len(t, received, 2)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// deliveryQueue is a Redis list of deliveries, that are sent by a pool of
+// workers. Deliveries are added with LPUSH and taken with BRPOP, so a slow
+// receiver only blocks one of the workers.
+type deliveryQueue struct {
+	// name is used in the logs
+	name    string
+	key     string
+	pool    *redis.Pool
+	workers int
+	// deliver sends one delivery, as it was pushed on the queue
+	deliver func(ctx context.Context, data []byte) error
+}
+
+// run starts the workers and waits until they are stopped by ctx
+func (q *deliveryQueue) run(ctx context.Context) {
+	workers := q.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// work delivers the queued deliveries until ctx is cancelled. A delivery that
+// is interrupted is queued again.
+func (q *deliveryQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		data, ok, err := q.dequeue(5)
+		if err != nil {
+			logger.Errorf("could not read from %s queue: %v", q.name, err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		err = q.deliver(ctx, data)
+		if err != nil && ctx.Err() != nil {
+			conn := q.pool.Get()
+			_, err = conn.Do("RPUSH", q.key, data)
+			conn.Close()
+			if err != nil {
+				logger.Errorf("could not queue %s again: %v", q.name, err)
+			}
+			return
+		}
+		if err != nil {
+			logger.Warnf("could not deliver %s: %v", q.name, err)
+		}
+	}
+}
+
+// dequeue waits at most timeout seconds for the next delivery
+func (q *deliveryQueue) dequeue(timeout int) ([]byte, bool, error) {
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("BRPOP", q.key, timeout))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(values) != 2 {
+		return nil, false, fmt.Errorf("unexpected reply from BRPOP")
+	}
+	return values[1], true, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"p83.nl/go/ekster/pkg/logging"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+// readerEvents are the events that change the reader page
+var readerEvents = []string{
+	microsub.EventNewItem,
+	microsub.EventNewItemInChannel,
+	microsub.EventMarkRead,
+	microsub.EventMarkUnread,
+	microsub.EventRemoveItems,
+	microsub.EventNewChannel,
+	microsub.EventUpdateChannel,
+	microsub.EventDeleteChannel,
+}
+
+// readerPage is the reader. Mode is "timeline", "following" or "preview".
+type readerPage struct {
+	Session  session
+	Mode     string
+	Channels []microsub.Channel
+	Channel  microsub.Channel
+
+	Items  []readerItem
+	Paging microsub.Pagination
+	// Unread are the ids of the unread items on the page
+	Unread []string
+
+	Feeds   []microsub.Feed
+	Query   string
+	Results []microsub.Feed
+
+	PreviewURL string
+	Error      string
+
+	// Back is the url of the page, forms return to it
+	Back string
+}
+
+// readerItem is an item as it's shown in the reader. The content is shown
+// as text, the HTML of other sites is not included in the page.
+type readerItem struct {
+	ID        string
+	Read      bool
+	Title     string
+	Author    string
+	Published string
+	Text      string
+	URL       string
+	Photos    []string
+}
+
+func newReaderItem(item microsub.Item) readerItem {
+	ri := readerItem{
+		ID:        item.ID,
+		Read:      item.Read,
+		Title:     item.Name,
+		Published: item.Published,
+		URL:       httpURL(item.URL),
+		Text:      item.Summary,
+	}
+	for _, photo := range item.Photo {
+		if photo = httpURL(photo); photo != "" {
+			ri.Photos = append(ri.Photos, photo)
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, item.Published); err == nil {
+		ri.Published = t.Format("2 Jan 2006 15:04")
+	}
+	if item.Author != nil {
+		ri.Author = item.Author.Name
+	}
+	if item.Content != nil && item.Content.Text != "" {
+		ri.Text = strings.TrimSpace(item.Content.Text)
+	}
+	if strings.TrimSpace(ri.Title) == strings.TrimSpace(ri.Text) {
+		ri.Title = ""
+	}
+	return ri
+}
+
+// httpURL returns u when it's an http or https url, other links are not
+// shown in the reader
+func httpURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return ""
+	}
+	return u
+}
+
+// readerBack returns the url the reader returns to after a form is posted,
+// only pages of the reader are allowed
+func readerBack(r *http.Request, channel string) string {
+	back := r.FormValue("back")
+	if (back == "/reader" || strings.HasPrefix(back, "/reader?") || strings.HasPrefix(back, "/reader/")) && !strings.Contains(back, "//") {
+		return back
+	}
+	return "/reader?channel=" + url.QueryEscape(channel)
+}
+
+// serveReader serves the pages and forms of the reader under /reader
+func (h *mainHandler) serveReader(w http.ResponseWriter, r *http.Request, conn redis.Conn) {
+	logger := logging.FromContext(r.Context())
+
+	_, sess, backend, ok := h.loggedIn(w, r, conn)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		channel := r.FormValue("channel")
+		var err error
+
+		switch r.URL.Path {
+		case "/reader/mark":
+			entries := r.Form["entry[]"]
+			if entry := r.FormValue("entry"); entry != "" {
+				entries = append(entries, entry)
+			}
+			if r.FormValue("action") == "unread" {
+				err = backend.MarkUnread(channel, entries)
+			} else {
+				err = backend.MarkRead(channel, entries)
+			}
+		case "/reader/follow":
+			_, err = backend.FollowURL(channel, r.FormValue("url"))
+		case "/reader/unfollow":
+			err = backend.UnfollowURL(channel, r.FormValue("url"))
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if code := microsub.ErrorCode(err); code != "" {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err != nil {
+			logger.Errorf("reader: %s failed: %v", r.URL.Path, err)
+			http.Error(w, "could not change the channel", 500)
+			return
+		}
+
+		http.Redirect(w, r, readerBack(r, channel), 302)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/reader/events" {
+		h.serveReaderEvents(w, r, backend)
+		return
+	}
+
+	var page readerPage
+	page.Session = sess
+	page.Back = r.URL.RequestURI()
+
+	page.Channels, _ = backend.ChannelsGetList()
+	uid := r.FormValue("channel")
+	for _, c := range page.Channels {
+		if c.UID == uid || (uid == "" && page.Channel.UID == "") {
+			page.Channel = c
+		}
+	}
+	if uid != "" && page.Channel.UID != uid {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/reader":
+		page.Mode = "timeline"
+		if page.Channel.UID == "" {
+			break
+		}
+		timeline, err := backend.TimelineGet(r.FormValue("before"), r.FormValue("after"), page.Channel.UID)
+		if err != nil {
+			logger.Errorf("reader: could not read timeline of %s: %v", page.Channel.UID, err)
+			page.Error = "Could not read the timeline"
+		}
+		for _, item := range timeline.Items {
+			page.Items = append(page.Items, newReaderItem(item))
+			if !item.Read {
+				page.Unread = append(page.Unread, item.ID)
+			}
+		}
+		page.Paging = timeline.Paging
+	case "/reader/following":
+		page.Mode = "following"
+		page.Feeds, _ = backend.FollowGetList(page.Channel.UID)
+		page.Query = strings.TrimSpace(r.FormValue("q"))
+		if page.Query != "" {
+			var err error
+			page.Results, err = backend.search(r.Context(), page.Query)
+			if err != nil {
+				page.Error = err.Error()
+			} else if len(page.Results) == 0 {
+				page.Error = "No feeds found"
+			}
+		}
+	case "/reader/preview":
+		page.Mode = "preview"
+		page.PreviewURL = r.FormValue("url")
+		timeline, err := backend.previewURL(r.Context(), page.PreviewURL)
+		if err != nil {
+			page.Error = err.Error()
+		}
+		for _, item := range timeline.Items {
+			page.Items = append(page.Items, newReaderItem(item))
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	err := h.renderTemplate(w, "reader.html", page)
+	if err != nil {
+		fmt.Fprintf(w, "ERROR: %s\n", err)
+	}
+}
+
+// serveReaderEvents sends the events that change the reader page. The
+// reader uses the session instead of a token.
+func (h *mainHandler) serveReaderEvents(w http.ResponseWriter, r *http.Request, backend *memoryBackend) {
+	filter := sse.Filter{Events: readerEvents, IDsOnly: true}
+	events, err := backend.EventsAfter(r.Header.Get("Last-Event-ID"), filter)
+	if err != nil {
+		http.Error(w, "could not start event stream", 500)
+		return
+	}
+	defer backend.broker.CloseClient(events)
+
+	go func() {
+		<-r.Context().Done()
+		backend.broker.CloseClient(events)
+	}()
+
+	err = sse.WriteMessages(w, events)
+	if err != nil {
+		logging.FromContext(r.Context()).Warnf("reader: could not write events: %v", err)
+	}
+}
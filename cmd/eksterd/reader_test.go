@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func TestNewReaderItem(t *testing.T) {
+	item := newReaderItem(microsub.Item{
+		ID:        "1",
+		Name:      "A post about things",
+		URL:       "javascript:alert(1)",
+		Published: "2018-07-01T12:00:00Z",
+		Photo:     []string{"https://example.com/photo.jpg", "data:image/png;base64,AAAA"},
+		Author:    &microsub.Card{Name: "Peter"},
+		Content:   &microsub.Content{Text: " A post about things\n"},
+	})
+	assert.Equal(t, readerItem{
+		ID:        "1",
+		Author:    "Peter",
+		Published: "1 Jul 2018 12:00",
+		Text:      "A post about things",
+		Photos:    []string{"https://example.com/photo.jpg"},
+	}, item)
+}
+
+func TestReaderBack(t *testing.T) {
+	tests := []struct {
+		back string
+		want string
+	}{
+		{"/reader?channel=home&after=x", "/reader?channel=home&after=x"},
+		{"/reader/following?channel=home", "/reader/following?channel=home"},
+		{"/settings", "/reader?channel=notifications"},
+		{"https://evil.example.com/reader", "/reader?channel=notifications"},
+		{"/reader//evil.example.com", "/reader?channel=notifications"},
+		{"/readerx", "/reader?channel=notifications"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/reader/mark", nil)
+		r.Form = url.Values{"back": {tt.back}}
+		assert.Equal(t, tt.want, readerBack(r, "notifications"), tt.back)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeRedis keeps the data of the few Redis commands the tests need in
+// memory. Redis is not available in the tests.
+type fakeRedis struct {
+	lock    sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	zsets   map[string]map[string]float64
+	streams map[string][]fakeStreamEntry
+	nextID  int64
+}
+
+type fakeStreamEntry struct {
+	id     string
+	fields []string
+}
+
+func newFakePool() (*redis.Pool, *fakeRedis) {
+	r := &fakeRedis{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		sets:    make(map[string]map[string]bool),
+		zsets:   make(map[string]map[string]float64),
+		streams: make(map[string][]fakeStreamEntry),
+	}
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return &fakeConn{r: r}, nil }}
+	return pool, r
+}
+
+// fakeArg converts an argument to a string, like redigo does when it writes
+// the argument
+func fakeArg(arg interface{}) string {
+	switch a := arg.(type) {
+	case string:
+		return a
+	case []byte:
+		return string(a)
+	case bool:
+		if a {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(a, 'g', -1, 64)
+	default:
+		return fmt.Sprint(a)
+	}
+}
+
+func (r *fakeRedis) do(cmd string, args []string) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch strings.ToUpper(cmd) {
+	case "":
+		return nil, nil
+	case "DEL":
+		n := int64(0)
+		for _, key := range args {
+			if r.exists(key) {
+				n++
+			}
+			delete(r.strings, key)
+			delete(r.hashes, key)
+			delete(r.sets, key)
+			delete(r.zsets, key)
+			delete(r.streams, key)
+		}
+		return n, nil
+	case "INCR":
+		n, _ := strconv.ParseInt(r.strings[args[0]], 10, 64)
+		n++
+		r.strings[args[0]] = strconv.FormatInt(n, 10)
+		return n, nil
+	case "HSET", "HMSET":
+		h := r.hashes[args[0]]
+		if h == nil {
+			h = make(map[string]string)
+			r.hashes[args[0]] = h
+		}
+		n := int64(0)
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, e := h[args[i]]; !e {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		if strings.ToUpper(cmd) == "HMSET" {
+			return "OK", nil
+		}
+		return n, nil
+	case "HGET":
+		v, e := r.hashes[args[0]][args[1]]
+		if !e {
+			return nil, nil
+		}
+		return []byte(v), nil
+	case "HGETALL":
+		var fields []string
+		for k := range r.hashes[args[0]] {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+		values := []interface{}{}
+		for _, k := range fields {
+			values = append(values, []byte(k), []byte(r.hashes[args[0]][k]))
+		}
+		return values, nil
+	case "SADD":
+		s := r.sets[args[0]]
+		if s == nil {
+			s = make(map[string]bool)
+			r.sets[args[0]] = s
+		}
+		n := int64(0)
+		for _, m := range args[1:] {
+			if !s[m] {
+				n++
+			}
+			s[m] = true
+		}
+		return n, nil
+	case "SREM":
+		n := int64(0)
+		for _, m := range args[1:] {
+			if r.sets[args[0]][m] {
+				n++
+				delete(r.sets[args[0]], m)
+			}
+		}
+		return n, nil
+	case "SISMEMBER":
+		if r.sets[args[0]][args[1]] {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "SMEMBERS":
+		var members []string
+		for m := range r.sets[args[0]] {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		values := []interface{}{}
+		for _, m := range members {
+			values = append(values, []byte(m))
+		}
+		return values, nil
+	case "ZADD":
+		z := r.zsets[args[0]]
+		if z == nil {
+			z = make(map[string]float64)
+			r.zsets[args[0]] = z
+		}
+		n := int64(0)
+		for i := 1; i+1 < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return nil, err
+			}
+			if _, e := z[args[i+1]]; !e {
+				n++
+			}
+			z[args[i+1]] = score
+		}
+		return n, nil
+	case "ZREM":
+		n := int64(0)
+		for _, m := range args[1:] {
+			if _, e := r.zsets[args[0]][m]; e {
+				n++
+				delete(r.zsets[args[0]], m)
+			}
+		}
+		return n, nil
+	case "ZCARD":
+		return int64(len(r.zsets[args[0]])), nil
+	case "ZSCORE":
+		score, e := r.zsets[args[0]][args[1]]
+		if !e {
+			return nil, nil
+		}
+		return []byte(strconv.FormatFloat(score, 'g', -1, 64)), nil
+	case "XADD":
+		r.nextID++
+		id := fmt.Sprintf("%d-0", r.nextID)
+		r.streams[args[0]] = append(r.streams[args[0]], fakeStreamEntry{id: id, fields: args[2:]})
+		return []byte(id), nil
+	case "XTRIM":
+		// The approximate trim of Redis is done exactly
+		n, err := strconv.Atoi(args[len(args)-1])
+		if err != nil {
+			return nil, err
+		}
+		entries := r.streams[args[0]]
+		if len(entries) <= n {
+			return int64(0), nil
+		}
+		r.streams[args[0]] = entries[len(entries)-n:]
+		return int64(len(entries) - n), nil
+	case "XRANGE":
+		// Only the full range is supported
+		values := []interface{}{}
+		for _, entry := range r.streams[args[0]] {
+			fields := []interface{}{}
+			for _, f := range entry.fields {
+				fields = append(fields, []byte(f))
+			}
+			values = append(values, []interface{}{[]byte(entry.id), fields})
+		}
+		return values, nil
+	case "XLEN":
+		return int64(len(r.streams[args[0]])), nil
+	case "XDEL":
+		var kept []fakeStreamEntry
+		for _, entry := range r.streams[args[0]] {
+			deleted := false
+			for _, id := range args[1:] {
+				deleted = deleted || entry.id == id
+			}
+			if !deleted {
+				kept = append(kept, entry)
+			}
+		}
+		n := len(r.streams[args[0]]) - len(kept)
+		r.streams[args[0]] = kept
+		return int64(n), nil
+	}
+
+	return nil, fmt.Errorf("fake redis does not support %s", cmd)
+}
+
+func (r *fakeRedis) exists(key string) bool {
+	_, s := r.strings[key]
+	_, h := r.hashes[key]
+	_, set := r.sets[key]
+	_, z := r.zsets[key]
+	_, x := r.streams[key]
+	return s || h || set || z || x
+}
+
+// fakeConn is a connection to fakeRedis
+type fakeConn struct {
+	r       *fakeRedis
+	pending []interface{}
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	s := make([]string, len(args))
+	for i, a := range args {
+		s[i] = fakeArg(a)
+	}
+	return c.r.do(cmd, s)
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	reply, err := c.Do(cmd, args...)
+	if err != nil {
+		reply = redis.Error(err.Error())
+	}
+	c.pending = append(c.pending, reply)
+	return nil
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	if len(c.pending) == 0 {
+		return nil, fmt.Errorf("no pending replies")
+	}
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *fakeConn) Flush() error { return nil }
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Err() error   { return nil }
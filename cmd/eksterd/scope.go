@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/server"
+)
+
+// Microsub scopes
+const (
+	ScopeRead     = "read"
+	ScopeFollow   = "follow"
+	ScopeMute     = "mute"
+	ScopeBlock    = "block"
+	ScopeChannels = "channels"
+
+	// ScopeAdmin allows the use of the admin API, only for the primary user
+	ScopeAdmin = "admin"
+)
+
+// Micropub scopes
+const (
+	ScopeCreate   = "create"
+	ScopeUpdate   = "update"
+	ScopeDelete   = "delete"
+	ScopeUndelete = "undelete"
+	ScopeMedia    = "media"
+)
+
+// microsubScopes contains the scope that is required for an action, by http method
+var microsubScopes = map[string]map[string]string{
+	http.MethodGet: {
+		"channels": ScopeRead,
+		"timeline": ScopeRead,
+		"events":   ScopeRead,
+		"follow":   ScopeFollow,
+		"search":   ScopeFollow,
+		"preview":  ScopeFollow,
+		"mute":     ScopeMute,
+		"block":    ScopeBlock,
+	},
+	http.MethodPost: {
+		"channels": ScopeChannels,
+		"timeline": ScopeRead,
+		"follow":   ScopeFollow,
+		"unfollow": ScopeFollow,
+		"search":   ScopeFollow,
+		"preview":  ScopeFollow,
+		"mute":     ScopeMute,
+		"unmute":   ScopeMute,
+		"block":    ScopeBlock,
+		"unblock":  ScopeBlock,
+	},
+}
+
+// microsubScope returns the scope that is required for the Microsub request,
+// it returns false when the action is not known.
+func microsubScope(r *http.Request) (string, bool) {
+	actions, e := microsubScopes[r.Method]
+	if !e {
+		return "", false
+	}
+	scope, e := actions[r.FormValue("action")]
+	return scope, e
+}
+
+// micropubScope returns the scopes of which one is required for the Micropub action
+func micropubScope(action string) []string {
+	switch action {
+	case "", "create":
+		// "post" is the scope used by older clients
+		return []string{ScopeCreate, "post"}
+	case "update":
+		return []string{ScopeUpdate}
+	case "delete":
+		return []string{ScopeDelete}
+	case "undelete":
+		return []string{ScopeUndelete, ScopeDelete}
+	case "media":
+		return []string{ScopeMedia, ScopeCreate}
+	}
+	return nil
+}
+
+// hasScope returns true when the space separated list of granted scopes
+// contains at least one of the required scopes.
+func hasScope(granted string, required ...string) bool {
+	for _, s := range strings.Fields(granted) {
+		for _, r := range required {
+			if s == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeInsufficientScope writes the error response for a token without the required scope
+func writeInsufficientScope(w http.ResponseWriter, required ...string) {
+	server.WriteError(w, microsub.InsufficientScopeError(strings.Join(required, " ")))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func TestMicrosubScope(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		scope  string
+		known  bool
+	}{
+		{"GET", "/microsub?action=channels", ScopeRead, true},
+		{"GET", "/microsub?action=timeline&channel=0001", ScopeRead, true},
+		{"GET", "/microsub?action=events", ScopeRead, true},
+		{"GET", "/microsub?action=follow&channel=0001", ScopeFollow, true},
+		{"POST", "/microsub?action=channels&name=Test", ScopeChannels, true},
+		{"POST", "/microsub?action=timeline&method=mark_read", ScopeRead, true},
+		{"POST", "/microsub?action=unfollow", ScopeFollow, true},
+		{"POST", "/microsub?action=unmute", ScopeMute, true},
+		{"POST", "/microsub?action=unblock", ScopeBlock, true},
+		{"GET", "/microsub?action=unknown", "", false},
+		{"DELETE", "/microsub?action=channels", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			scope, known := microsubScope(r)
+			assert.Equal(t, tt.known, known)
+			assert.Equal(t, tt.scope, scope)
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	assert.True(t, hasScope("read follow channels", ScopeFollow))
+	assert.True(t, hasScope("post", micropubScope("create")...))
+	assert.True(t, hasScope("create", micropubScope("media")...))
+	assert.True(t, hasScope("delete", micropubScope("undelete")...))
+	assert.False(t, hasScope("read", ScopeChannels))
+	assert.False(t, hasScope("", ScopeRead))
+	assert.False(t, hasScope("readfollow", ScopeRead))
+	assert.False(t, hasScope("create", micropubScope("update")...))
+}
+
+func TestWriteInsufficientScope(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeInsufficientScope(w, ScopeChannels)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", scope="channels"`, w.Header().Get("WWW-Authenticate"))
+
+	var res microsub.Error
+	if assert.NoError(t, json.NewDecoder(w.Body).Decode(&res)) {
+		assert.Equal(t, microsub.ErrorInsufficientScope, res.Code)
+		assert.Equal(t, "channels", res.Scope)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sessionCookie is the cookie with the signed session id
+	sessionCookie = "session"
+	// sessionSecretKey is the secret that signs the cookies, when there is
+	// none in the config
+	sessionSecretKey = "session_secret"
+	// anonymousSessionTTL is the time a session is kept before the user logs in
+	anonymousSessionTTL = time.Hour
+	// lastSeenInterval is the time between updates of the last use of a session
+	lastSeenInterval = time.Minute
+)
+
+// sessionInfo is a session of the user on the sessions page
+type sessionInfo struct {
+	// Handle identifies the session in forms, it's not the session id
+	Handle    string
+	Created   time.Time
+	LastSeen  time.Time
+	UserAgent string
+	Current   bool
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+// userSessionsKey is the set of the ids of the sessions of a user
+func userSessionsKey(me string) string {
+	sum := sha256.Sum256([]byte(canonicalMe(me)))
+	return "sessions:" + hex.EncodeToString(sum[:16])
+}
+
+// sessionHandle returns the id of the session that is shown in the page
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signSession returns the cookie value for the session id
+func signSession(secret []byte, id string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySession returns the session id of a cookie value that was signed with
+// secret
+func verifySession(secret []byte, value string) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i <= 0 {
+		return "", false
+	}
+	id := value[:i]
+	if !hmac.Equal([]byte(signSession(secret, id)), []byte(value)) {
+		return "", false
+	}
+	return id, true
+}
+
+// expired returns true when a session that is logged in is older than the
+// lifetime of sessions
+func (s *session) expired(now time.Time) bool {
+	return s.LoggedIn && now.After(time.Unix(s.Created, 0).Add(currentConfig().Sessions.Lifetime))
+}
+
+// ttl returns the time the session is kept in Redis
+func (s *session) ttl(now time.Time) time.Duration {
+	if !s.LoggedIn {
+		return anonymousSessionTTL
+	}
+	return time.Unix(s.Created, 0).Add(currentConfig().Sessions.Lifetime).Sub(now)
+}
+
+func loadSession(id string, conn redis.Conn) (session, error) {
+	var sess session
+	data, err := redis.Values(conn.Do("HGETALL", sessionKey(id)))
+	if err != nil {
+		return sess, err
+	}
+	err = redis.ScanStruct(data, &sess)
+	if err != nil {
+		return sess, err
+	}
+	return sess, nil
+}
+
+func saveSession(id string, sess *session, conn redis.Conn) error {
+	ttl := sess.ttl(time.Now())
+	if ttl <= 0 {
+		return fmt.Errorf("session has expired")
+	}
+	_, err := conn.Do("HMSET", redis.Args{}.Add(sessionKey(id)).AddFlat(sess)...)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("PEXPIRE", sessionKey(id), int64(ttl/time.Millisecond))
+	return err
+}
+
+// sessionSecret returns the secret from the config. Without a secret in the
+// config, a secret is created once and kept in Redis, so all instances use
+// the same secret.
+func (h *mainHandler) sessionSecret(conn redis.Conn) ([]byte, error) {
+	source := currentConfig().Sessions.Secret
+
+	h.secretLock.Lock()
+	defer h.secretLock.Unlock()
+
+	if h.secret != nil && h.secretSource == source {
+		return h.secret, nil
+	}
+
+	secret := source
+	if secret == "" {
+		_, err := conn.Do("SETNX", sessionSecretKey, randomHex(32))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not save session secret")
+		}
+		secret, err = redis.String(conn.Do("GET", sessionSecretKey))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read session secret")
+		}
+	}
+	h.secret, h.secretSource = []byte(secret), source
+	return h.secret, nil
+}
+
+// setSessionCookie sends the signed cookie of the session. The cookie of a
+// session that is logged in lasts as long as the session.
+func (h *mainHandler) setSessionCookie(w http.ResponseWriter, conn redis.Conn, id string, sess *session) error {
+	secret, err := h.sessionSecret(conn)
+	if err != nil {
+		return err
+	}
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    signSession(secret, id),
+		Path:     "/",
+		Secure:   strings.HasPrefix(h.BaseURL, "https://"),
+		HttpOnly: true,
+		// Lax sends the cookie when the authorization endpoint redirects back
+		SameSite: http.SameSiteLaxMode,
+	}
+	if sess.LoggedIn {
+		cookie.MaxAge = int(sess.ttl(time.Now()) / time.Second)
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// currentSession returns the session of the cookie in r. It returns false
+// when there is no cookie, the signature is wrong or the session has expired.
+func (h *mainHandler) currentSession(r *http.Request, conn redis.Conn) (string, session, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", session{}, false
+	}
+	secret, err := h.sessionSecret(conn)
+	if err != nil {
+		return "", session{}, false
+	}
+	id, ok := verifySession(secret, c.Value)
+	if !ok {
+		return "", session{}, false
+	}
+	sess, err := loadSession(id, conn)
+	if err != nil || sess.Created == 0 || sess.expired(time.Now()) {
+		return "", session{}, false
+	}
+	return id, sess, true
+}
+
+// startSession returns the current session, or starts a new session when
+// there is none
+func (h *mainHandler) startSession(w http.ResponseWriter, r *http.Request, conn redis.Conn) (string, session, error) {
+	if id, sess, ok := h.currentSession(r, conn); ok {
+		return id, sess, nil
+	}
+
+	now := time.Now()
+	id := randomHex(32)
+	sess := session{
+		CSRF:      randomHex(32),
+		Created:   now.Unix(),
+		LastSeen:  now.Unix(),
+		UserAgent: r.UserAgent(),
+	}
+	if err := saveSession(id, &sess, conn); err != nil {
+		return "", sess, err
+	}
+	if err := h.setSessionCookie(w, conn, id, &sess); err != nil {
+		return "", sess, err
+	}
+	return id, sess, nil
+}
+
+// loggedIn returns the session and the backend of the user that is logged in.
+// Without a session it redirects to the front page.
+func (h *mainHandler) loggedIn(w http.ResponseWriter, r *http.Request, conn redis.Conn) (string, session, *memoryBackend, bool) {
+	id, sess, ok := h.currentSession(r, conn)
+	if !ok {
+		http.Redirect(w, r, "/", 302)
+		return "", sess, nil, false
+	}
+	backend, ok := h.sessionBackend(&sess)
+	if !ok {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Unauthorized")
+		return "", sess, nil, false
+	}
+
+	if now := time.Now(); now.Sub(time.Unix(sess.LastSeen, 0)) > lastSeenInterval {
+		sess.LastSeen = now.Unix()
+		_, _ = conn.Do("HSET", sessionKey(id), "last_seen", sess.LastSeen)
+	}
+	return id, sess, backend, true
+}
+
+// checkCSRF returns true when the form contains the CSRF token of the session
+func (h *mainHandler) checkCSRF(r *http.Request, conn redis.Conn) bool {
+	_, sess, ok := h.currentSession(r, conn)
+	if !ok || sess.CSRF == "" {
+		return false
+	}
+	token := r.PostForm.Get("csrf")
+	if token == "" {
+		token = r.Header.Get("X-CSRF-Token")
+	}
+	return hmac.Equal([]byte(token), []byte(sess.CSRF))
+}
+
+// login replaces the session with a new session for me, so the id of the
+// session from before the login can't be used
+func (h *mainHandler) login(w http.ResponseWriter, r *http.Request, conn redis.Conn, oldID string, old session, me string) (session, error) {
+	now := time.Now()
+	id := randomHex(32)
+	sess := session{
+		AuthorizationEndpoint: old.AuthorizationEndpoint,
+		TokenEndpoint:         old.TokenEndpoint,
+		Me:                    me,
+		LoggedIn:              true,
+		NextURI:               old.NextURI,
+		CSRF:                  randomHex(32),
+		Created:               now.Unix(),
+		LastSeen:              now.Unix(),
+		UserAgent:             r.UserAgent(),
+	}
+	if err := saveSession(id, &sess, conn); err != nil {
+		return sess, err
+	}
+
+	key := userSessionsKey(me)
+	if _, err := conn.Do("SADD", key, id); err != nil {
+		return sess, err
+	}
+	_, _ = conn.Do("PEXPIRE", key, int64(currentConfig().Sessions.Lifetime/time.Millisecond))
+	_, _ = conn.Do("DEL", sessionKey(oldID))
+
+	return sess, h.setSessionCookie(w, conn, id, &sess)
+}
+
+// logout removes the current session
+func (h *mainHandler) logout(w http.ResponseWriter, r *http.Request, conn redis.Conn) {
+	if id, sess, ok := h.currentSession(r, conn); ok {
+		_ = revokeSession(conn, sess.Me, id)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", 302)
+}
+
+// revokeSession removes the session id of me
+func revokeSession(conn redis.Conn, me, id string) error {
+	_, err := conn.Do("DEL", sessionKey(id))
+	if err != nil {
+		return err
+	}
+	if me != "" {
+		_, err = conn.Do("SREM", userSessionsKey(me), id)
+	}
+	return err
+}
+
+// userSessions returns the sessions of me, the session with currentID is
+// marked as current. Sessions that have expired are removed from the list.
+func userSessions(conn redis.Conn, me, currentID string) ([]sessionInfo, error) {
+	ids, err := redis.Strings(conn.Do("SMEMBERS", userSessionsKey(me)))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var infos []sessionInfo
+	for _, id := range ids {
+		sess, err := loadSession(id, conn)
+		if err != nil {
+			return nil, err
+		}
+		if !sess.LoggedIn || sess.expired(now) || !sameUser(sess.Me, me) {
+			_, _ = conn.Do("SREM", userSessionsKey(me), id)
+			continue
+		}
+		infos = append(infos, sessionInfo{
+			Handle:    sessionHandle(id),
+			Created:   time.Unix(sess.Created, 0),
+			LastSeen:  time.Unix(sess.LastSeen, 0),
+			UserAgent: sess.UserAgent,
+			Current:   id == currentID,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastSeen.After(infos[j].LastSeen)
+	})
+	return infos, nil
+}
+
+// revokeSessions removes the sessions of me with handle, or all sessions
+// except the session with currentID when handle is empty
+func revokeSessions(conn redis.Conn, me, currentID, handle string) error {
+	ids, err := redis.Strings(conn.Do("SMEMBERS", userSessionsKey(me)))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id == currentID {
+			continue
+		}
+		if handle == "" || sessionHandle(id) == handle {
+			if err := revokeSession(conn, me, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
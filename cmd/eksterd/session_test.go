@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignSession(t *testing.T) {
+	secret := []byte("a secret that is long enough for the tests")
+
+	value := signSession(secret, "abc123")
+	id, ok := verifySession(secret, value)
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", id)
+
+	_, ok = verifySession([]byte("another secret"), value)
+	assert.False(t, ok)
+	_, ok = verifySession(secret, "abc124"+value[len("abc123"):])
+	assert.False(t, ok)
+	_, ok = verifySession(secret, "abc123")
+	assert.False(t, ok)
+	_, ok = verifySession(secret, "")
+	assert.False(t, ok)
+}
+
+func TestSession_TTL(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Sessions.Lifetime = 24 * time.Hour
+	setCurrentConfig(cfg)
+	defer setCurrentConfig(defaultConfig())
+
+	now := time.Unix(time.Now().Unix(), 0)
+
+	anonymous := session{Created: now.Add(-48 * time.Hour).Unix()}
+	assert.Equal(t, anonymousSessionTTL, anonymous.ttl(now))
+	assert.False(t, anonymous.expired(now))
+
+	sess := session{LoggedIn: true, Created: now.Add(-time.Hour).Unix()}
+	assert.Equal(t, 23*time.Hour, sess.ttl(now))
+	assert.False(t, sess.expired(now))
+	assert.True(t, sess.expired(now.Add(24*time.Hour)))
+}
+
+func TestSessionHandle(t *testing.T) {
+	handle := sessionHandle("abc123")
+	assert.Len(t, handle, 16)
+	assert.NotContains(t, handle, "abc123")
+	assert.Equal(t, handle, sessionHandle("abc123"))
+	assert.NotEqual(t, handle, sessionHandle("abc124"))
+}
+
+func TestMainHandler_CSRF(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Sessions.Secret = strings.Repeat("s", 32)
+	setCurrentConfig(cfg)
+	defer setCurrentConfig(defaultConfig())
+
+	h, err := newMainHandler(nil, "https://ekster.example.com/", "", false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	h.pool = &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("no redis") }}
+
+	for _, cookie := range []*http.Cookie{
+		nil,
+		{Name: sessionCookie, Value: "abc123"},
+		{Name: sessionCookie, Value: signSession([]byte("another secret"), "abc123")},
+	} {
+		form := url.Values{"uid": {"home"}, "csrf": {"token"}}
+		r := httptest.NewRequest("POST", "/settings/channel", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, 403, w.Code)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// configVersion is the current schema version of the config file. Files with
+// an older version are upgraded with configMigrations when they are loaded.
+const configVersion = 1
+
+// backendConfig contains the channels, feeds and settings of a backend, as it
+// is saved in the config file.
+type backendConfig struct {
+	Version  int       `json:"version"`
+	Revision int64     `json:"revision"`
+	Saved    time.Time `json:"saved"`
+
+	Me            string `json:"me"`
+	TokenEndpoint string `json:"token_endpoint"`
+	NextUID       int    `json:"next_uid"`
+
+	Channels map[string]microsub.Channel `json:"channels"`
+	Feeds    map[string][]microsub.Feed  `json:"feeds"`
+	Settings map[string]channelSetting   `json:"settings"`
+	Webhooks map[string][]webhook        `json:"webhooks,omitempty"`
+	Digests  map[string]digest           `json:"digests,omitempty"`
+
+	PushSubscriptions []pushSubscription `json:"push_subscriptions,omitempty"`
+}
+
+// configMigrations upgrade a config file from version i to version i+1. The
+// migrations work on the decoded JSON, so they don't depend on the current
+// structs.
+var configMigrations = []func(cfg map[string]interface{}) error{
+	migrateBackendJSON,
+}
+
+// migrateBackendJSON upgrades the backend.json format (version 0) to version 1
+func migrateBackendJSON(cfg map[string]interface{}) error {
+	renames := map[string]string{
+		"Me":            "me",
+		"TokenEndpoint": "token_endpoint",
+		"NextUID":       "next_uid",
+		"Channels":      "channels",
+		"Feeds":         "feeds",
+		"Settings":      "settings",
+	}
+	for from, to := range renames {
+		if v, ok := cfg[from]; ok {
+			cfg[to] = v
+			delete(cfg, from)
+		}
+	}
+
+	// AuthEnabled is an option of the server, not part of the config
+	delete(cfg, "AuthEnabled")
+
+	settings, _ := cfg["settings"].(map[string]interface{})
+	settingRenames := map[string]string{
+		"ExcludeRegex": "exclude_regex",
+		"IncludeRegex": "include_regex",
+		"ExcludeType":  "exclude_type",
+		"ChannelType":  "channel_type",
+	}
+	for uid, s := range settings {
+		setting, ok := s.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("setting for channel %s is not an object", uid)
+		}
+		for from, to := range settingRenames {
+			if v, ok := setting[from]; ok {
+				setting[to] = v
+				delete(setting, from)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configStore saves the config of a backend in a file. Every save writes a
+// complete new file next to the old one and renames it, so a crash leaves
+// either the old or the new version, never a partially written file.
+type configStore struct {
+	path string
+
+	lock     sync.Mutex
+	revision int64
+	last     []byte
+	// err is the error of the last save
+	err error
+}
+
+func newConfigStore(path string) *configStore {
+	return &configStore{path: path}
+}
+
+// exists returns true when the config file exists
+func (s *configStore) exists() bool {
+	_, err := os.Stat(s.path)
+	return err == nil
+}
+
+// load reads the config file and upgrades it to the current version. An
+// upgraded file is saved right away, the old version is kept next to it.
+func (s *configStore) load() (backendConfig, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return backendConfig{}, err
+	}
+
+	cfg, version, err := decodeConfig(data)
+	if err != nil {
+		return backendConfig{}, errors.Wrapf(err, "could not read %s", s.path)
+	}
+
+	if version < configVersion {
+		backup := fmt.Sprintf("%s.v%d", s.path, version)
+		err = writeFileAtomic(backup, data)
+		if err != nil {
+			return backendConfig{}, errors.Wrapf(err, "could not save backup %s", backup)
+		}
+		logger.Infof("Upgraded %s from version %d to %d, the old version is saved in %s", s.path, version, configVersion, backup)
+
+		err = s.write(&cfg)
+		if err != nil {
+			return backendConfig{}, err
+		}
+	}
+
+	s.revision = cfg.Revision
+	return cfg, nil
+}
+
+// save writes the config returned by snapshot. The snapshot is taken while
+// holding the lock of the store, so concurrent saves can't write an older
+// config over a newer one.
+func (s *configStore) save(snapshot func() backendConfig) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cfg := snapshot()
+	return s.write(&cfg)
+}
+
+// write saves cfg as the next revision, when it's different from the last saved config
+func (s *configStore) write(cfg *backendConfig) error {
+	cfg.Version = configVersion
+	cfg.Revision = 0
+	cfg.Saved = time.Time{}
+
+	content, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(content, s.last) {
+		return nil
+	}
+
+	cfg.Revision = s.revision + 1
+	cfg.Saved = time.Now().UTC()
+
+	data, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = writeFileAtomic(s.path, append(data, '\n'))
+	metricStoreSaveDuration.With().ObserveSince(start)
+	if err != nil {
+		metricStoreSaveErrors.With().Inc()
+		s.err = errors.Wrapf(err, "could not save %s", s.path)
+		return s.err
+	}
+	s.err = nil
+
+	s.revision = cfg.Revision
+	s.last = content
+	return nil
+}
+
+// check returns an error when the directory of the store is missing or the
+// last save failed
+func (s *configStore) check() error {
+	if _, err := os.Stat(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// importFile imports a backend.json file into the store
+func (s *configStore) importFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	cfg, version, err := decodeConfig(data)
+	if err != nil {
+		return errors.Wrapf(err, "could not import %s", filename)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err = s.write(&cfg)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Imported %s (version %d) into %s", filename, version, s.path)
+	return nil
+}
+
+// decodeConfig decodes a config file of any version and upgrades it to the
+// current version. It returns the version of the file.
+func decodeConfig(data []byte) (backendConfig, int, error) {
+	var raw map[string]interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return backendConfig{}, 0, err
+	}
+
+	version := 0
+	if v, ok := raw["version"].(float64); ok {
+		version = int(v)
+	}
+	if version > configVersion {
+		return backendConfig{}, version, fmt.Errorf("version %d is newer than the supported version %d", version, configVersion)
+	}
+
+	for v := version; v < configVersion; v++ {
+		err = configMigrations[v](raw)
+		if err != nil {
+			return backendConfig{}, version, errors.Wrapf(err, "migration to version %d failed", v+1)
+		}
+		raw["version"] = v + 1
+	}
+
+	upgraded, err := json.Marshal(raw)
+	if err != nil {
+		return backendConfig{}, version, err
+	}
+
+	var cfg backendConfig
+	err = json.Unmarshal(upgraded, &cfg)
+	return cfg, version, err
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it to filename.
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+
+	f, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return err
+	}
+
+	// Sync the directory, so the rename is saved as well
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return nil
+}
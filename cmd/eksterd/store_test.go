@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+const legacyBackendJSON = `{
+    "Channels": {
+        "home": {"uid": "home", "name": "Home", "unread": 0},
+        "notifications": {"uid": "notifications", "name": "Notifications", "unread": 0}
+    },
+    "Feeds": {
+        "home": [{"type": "feed", "url": "https://example.com/feed"}]
+    },
+    "Settings": {
+        "home": {"ExcludeRegex": "spam", "IncludeRegex": "", "ExcludeType": ["like"], "ChannelType": "stream"}
+    },
+    "NextUID": 1000002,
+    "Me": "https://example.com/",
+    "TokenEndpoint": "https://example.com/token",
+    "AuthEnabled": true
+}`
+
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "ekster-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+func assertLegacyConfig(t *testing.T, cfg backendConfig) {
+	assert.Equal(t, "https://example.com/", cfg.Me)
+	assert.Equal(t, "https://example.com/token", cfg.TokenEndpoint)
+	assert.Equal(t, 1000002, cfg.NextUID)
+	assert.Equal(t, "Home", cfg.Channels["home"].Name)
+	if assert.Len(t, cfg.Feeds["home"], 1) {
+		assert.Equal(t, "https://example.com/feed", cfg.Feeds["home"][0].URL)
+	}
+	assert.Equal(t, channelSetting{ExcludeRegex: "spam", ExcludeType: []string{"like"}, ChannelType: "stream"}, cfg.Settings["home"])
+}
+
+func TestConfigStore_LoadMigratesBackendJSON(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "backend.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(legacyBackendJSON), 0600))
+
+	store := newConfigStore(path)
+	cfg, err := store.load()
+	if assert.NoError(t, err) {
+		assertLegacyConfig(t, cfg)
+		assert.Equal(t, configVersion, cfg.Version)
+	}
+
+	// The old version is kept
+	backup, err := ioutil.ReadFile(path + ".v0")
+	if assert.NoError(t, err) {
+		assert.Equal(t, legacyBackendJSON, string(backup))
+	}
+
+	// The file is saved in the current version
+	data, err := ioutil.ReadFile(path)
+	if assert.NoError(t, err) {
+		var raw map[string]interface{}
+		assert.NoError(t, json.Unmarshal(data, &raw))
+		assert.Equal(t, float64(configVersion), raw["version"])
+		assert.Equal(t, float64(1), raw["revision"])
+		assert.NotContains(t, raw, "AuthEnabled")
+	}
+
+	cfg, err = newConfigStore(path).load()
+	if assert.NoError(t, err) {
+		assertLegacyConfig(t, cfg)
+		assert.Equal(t, int64(1), cfg.Revision)
+	}
+}
+
+func TestConfigStore_Save(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "ekster.json")
+	store := newConfigStore(path)
+	assert.False(t, store.exists())
+
+	cfg := backendConfig{Me: "https://example.com/", Channels: map[string]microsub.Channel{"home": {UID: "home", Name: "Home"}}}
+	snapshot := func() backendConfig { return cfg }
+
+	assert.NoError(t, store.save(snapshot))
+	assert.True(t, store.exists())
+	assert.Equal(t, int64(1), store.revision)
+
+	// Unchanged configs are not written again
+	assert.NoError(t, store.save(snapshot))
+	assert.Equal(t, int64(1), store.revision)
+
+	cfg.Channels = map[string]microsub.Channel{"home": {UID: "home", Name: "Start"}}
+	assert.NoError(t, store.save(snapshot))
+	assert.Equal(t, int64(2), store.revision)
+
+	loaded, err := newConfigStore(path).load()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), loaded.Revision)
+		assert.Equal(t, "Start", loaded.Channels["home"].Name)
+	}
+
+	// No temporary files are left behind
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path}, files)
+}
+
+func TestConfigStore_NewerVersion(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "ekster.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"version": 1000}`), 0600))
+
+	_, err := newConfigStore(path).load()
+	assert.Error(t, err)
+}
+
+func TestConfigStore_ImportFile(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	legacy := filepath.Join(dir, "backend.json")
+	assert.NoError(t, ioutil.WriteFile(legacy, []byte(legacyBackendJSON), 0600))
+
+	store := newConfigStore(filepath.Join(dir, "ekster.json"))
+	assert.NoError(t, store.importFile(legacy))
+
+	cfg, err := store.load()
+	if assert.NoError(t, err) {
+		assertLegacyConfig(t, cfg)
+	}
+
+	// The imported file is not changed
+	data, err := ioutil.ReadFile(legacy)
+	if assert.NoError(t, err) {
+		assert.Equal(t, legacyBackendJSON, string(data))
+	}
+}
+
+func TestMemoryBackend_SaveSettings(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "ekster.json")
+	backend := newMemoryBackend("https://example.com/")
+	backend.store = newConfigStore(path)
+	backend.broker = sse.NewBroker()
+	defer backend.broker.Close(sse.Message{Event: "shutdown"})
+	events, err := sse.StartConnection(backend.broker)
+	assert.NoError(t, err)
+
+	setting := channelSetting{ExcludeRegex: "spam", ChannelType: "stream"}
+	assert.NoError(t, backend.setChannelSetting("home", setting))
+
+	assert.Equal(t, "started", (<-events).Event)
+	msg := <-events
+	assert.Equal(t, microsub.EventUpdateSettings, msg.Event)
+	assert.Equal(t, microsub.SettingsEvent{Version: microsub.EventVersion, Channel: "home", Settings: microsub.ChannelSettings(setting)}, msg.Object)
+
+	// Redis is not available in the tests
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("no redis") }}
+
+	loaded, err := loadMemoryBackend(pool, newConfigStore(path), "")
+	if assert.NoError(t, err) {
+		s, ok := loaded.channelSetting("home")
+		assert.True(t, ok)
+		assert.Equal(t, setting, s)
+		assert.Equal(t, "https://example.com/", loaded.Me)
+		assert.Len(t, loaded.Channels, 2)
+	}
+}
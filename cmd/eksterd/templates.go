@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/template"
+	"github.com/pkg/errors"
+	"p83.nl/go/ekster/templates"
+)
+
+// overlayFS opens the files in dir, and the files of fallback that are not in
+// dir
+type overlayFS struct {
+	dir      fs.FS
+	fallback fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.dir.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return o.fallback.Open(name)
+}
+
+// templateSet contains the parsed templates of the frontend. The templates
+// are compiled into the binary, files in dir replace them. The templates are
+// parsed once, with reload they are parsed again when a file in dir changes.
+type templateSet struct {
+	fsys   fs.FS
+	dir    string
+	reload bool
+
+	lock      sync.RWMutex
+	templates map[string]*template.Template
+	modTimes  map[string]time.Time
+}
+
+func newTemplateSet(dir string, reload bool) (*templateSet, error) {
+	ts := &templateSet{fsys: templates.FS, dir: dir, reload: reload}
+	if dir != "" {
+		ts.fsys = overlayFS{dir: os.DirFS(dir), fallback: templates.FS}
+	}
+	if err := ts.load(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// load parses the templates and replaces the current templates
+func (ts *templateSet) load() error {
+	modTimes := ts.dirModTimes()
+	parsed, err := ts.parse()
+	if err != nil {
+		return err
+	}
+
+	ts.lock.Lock()
+	ts.templates = parsed
+	ts.modTimes = modTimes
+	ts.lock.Unlock()
+	return nil
+}
+
+// parse parses every page together with base.html
+func (ts *templateSet) parse() (map[string]*template.Template, error) {
+	base, err := fs.ReadFile(ts.fsys, "base.html")
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := fs.Glob(templates.FS, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	if ts.dir != "" {
+		files, err := filepath.Glob(filepath.Join(ts.dir, "*.html"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			names = append(names, filepath.Base(file))
+		}
+	}
+
+	parsed := make(map[string]*template.Template)
+	for _, name := range names {
+		if name == "base.html" || parsed[name] != nil {
+			continue
+		}
+		page, err := fs.ReadFile(ts.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New("base.html").Parse(string(base))
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.New(name).Parse(string(page))
+		if err != nil {
+			return nil, err
+		}
+		parsed[name] = t
+	}
+	return parsed, nil
+}
+
+// dirModTimes returns the modification times of the files in dir
+func (ts *templateSet) dirModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	if ts.dir == "" {
+		return modTimes
+	}
+	files, _ := filepath.Glob(filepath.Join(ts.dir, "*.html"))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed returns true when a file in dir was added, removed or changed since
+// the templates were parsed
+func (ts *templateSet) changed() bool {
+	modTimes := ts.dirModTimes()
+
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+
+	if len(modTimes) != len(ts.modTimes) {
+		return true
+	}
+	for file, t := range modTimes {
+		if !ts.modTimes[file].Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// execute renders the page name with data
+func (ts *templateSet) execute(w io.Writer, name string, data interface{}) error {
+	if ts.reload && ts.changed() {
+		if err := ts.load(); err != nil {
+			return errors.Wrap(err, "could not reload templates")
+		}
+	}
+
+	ts.lock.RLock()
+	t, ok := ts.templates[name]
+	ts.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("template %s does not exist", name)
+	}
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// readFile returns the contents of a file next to the templates, like push-sw.js
+func (ts *templateSet) readFile(name string) ([]byte, error) {
+	return fs.ReadFile(ts.fsys, name)
+}
+
+// staticHandler serves the files in static/ on /static/
+func (ts *templateSet) staticHandler() http.Handler {
+	static, err := fs.Sub(ts.fsys, "static")
+	if err != nil {
+		return http.NotFoundHandler()
+	}
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/static/")
+		if name == "" || strings.HasSuffix(name, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if ts.reload {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateSet_Override(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	page := filepath.Join(dir, "logs.html")
+	_ = ioutil.WriteFile(page, []byte(`custom {{ len .Entries }}`), 0644)
+
+	ts, err := newTemplateSet(dir, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var buf bytes.Buffer
+	if assert.NoError(t, ts.execute(&buf, "logs.html", logsPage{})) {
+		assert.Equal(t, "custom 0", buf.String())
+	}
+
+	// Pages that are not in the directory are compiled in
+	buf.Reset()
+	if assert.NoError(t, ts.execute(&buf, "push.html", pushPage{})) {
+		assert.Contains(t, buf.String(), "Push notifications")
+	}
+
+	// With reload, a changed file is parsed again
+	_ = ioutil.WriteFile(page, []byte(`changed`), 0644)
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(page, later, later)
+	buf.Reset()
+	if assert.NoError(t, ts.execute(&buf, "logs.html", logsPage{})) {
+		assert.Equal(t, "changed", buf.String())
+	}
+
+	assert.Error(t, ts.execute(&buf, "missing.html", nil))
+}
+
+func TestTemplateSet_Static(t *testing.T) {
+	ts, err := newTemplateSet("", false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	static := ts.staticHandler()
+
+	w := httptest.NewRecorder()
+	static.ServeHTTP(w, httptest.NewRequest("GET", "/static/ekster.css", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/css")
+	assert.Equal(t, "public, max-age=86400", w.Header().Get("Cache-Control"))
+
+	// The stylesheet is part of the binary, it's not loaded from a CDN
+	w = httptest.NewRecorder()
+	static.ServeHTTP(w, httptest.NewRequest("GET", "/static/bulma.min.css", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), ".navbar")
+
+	w = httptest.NewRecorder()
+	static.ServeHTTP(w, httptest.NewRequest("GET", "/static/", nil))
+	assert.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	static.ServeHTTP(w, httptest.NewRequest("GET", "/static/missing.css", nil))
+	assert.Equal(t, 404, w.Code)
+
+	script, err := ts.readFile("push-sw.js")
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(script), "showNotification")
+	}
+}
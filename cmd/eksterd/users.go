@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/server"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+// userBackends contains the backends of the users of the server. The first
+// user is the one from the config file, the other users are added when they
+// sign in for the first time.
+type userBackends struct {
+	lock    sync.RWMutex
+	primary *userBackend
+	users   map[string]*userBackend
+	// ids contains the id of each user by canonicalMe
+	ids map[string]string
+
+	// dir is the directory where the backends of the other users are saved
+	dir string
+	// allowed contains the urls of the users that are allowed to sign in, "*" allows everyone
+	allowed []string
+
+	pool        *redis.Pool
+	baseURL     string
+	authEnabled bool
+
+	// ctx is the context of run, backends of new users are started with it
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+// The Microsub handler uses these to pass the request context and the event
+// filters to the backend
+var (
+	_ server.ContextBackend = (*memoryBackend)(nil)
+	_ server.ReplayBackend  = (*memoryBackend)(nil)
+)
+
+// userBackend is the backend and Microsub handler of one user
+type userBackend struct {
+	id      string
+	backend *memoryBackend
+	handler http.Handler
+}
+
+// canonicalMe returns the form of me that is used to compare users. The host
+// is lowercase without the default port, and the path is kept as it is.
+func canonicalMe(me string) string {
+	u, err := url.Parse(strings.TrimSpace(me))
+	if err != nil || u.Host == "" {
+		return strings.TrimSpace(me)
+	}
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return host + path
+}
+
+// sameUser returns true when a and b are urls of the same user
+func sameUser(a, b string) bool {
+	return canonicalMe(a) == canonicalMe(b)
+}
+
+// userID returns the readable id for a new user with url me. Different urls
+// can have the same readable id, use userBackends.lookup to find the id of a
+// user.
+func userID(me string) string {
+	s := me
+	if u, err := url.Parse(me); err == nil && u.Host != "" {
+		s = u.Host + u.Path
+	}
+	s = strings.Trim(strings.ToLower(s), "/")
+
+	var sb strings.Builder
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune('-')
+		}
+	}
+	return sb.String()
+}
+
+func newUserBackends(primary *memoryBackend, options AppOptions) (*userBackends, error) {
+	users := &userBackends{
+		users:       make(map[string]*userBackend),
+		ids:         make(map[string]string),
+		dir:         options.UsersDir,
+		allowed:     options.Users,
+		pool:        options.pool,
+		baseURL:     options.BaseURL,
+		authEnabled: options.AuthEnabled,
+	}
+
+	var err error
+	users.primary, err = users.add(userID(primary.Me), primary)
+	if err != nil {
+		return nil, err
+	}
+
+	err = users.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// load loads the backends of the other users from dir
+func (u *userBackends) load() error {
+	files, err := filepath.Glob(filepath.Join(u.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+		backend, err := loadMemoryBackend(u.pool, newConfigStore(file), userPrefix(id))
+		if err != nil {
+			return errors.Wrapf(err, "could not load user %s", id)
+		}
+		_, err = u.add(id, backend)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Loaded user %s (%s)", id, backend.Me)
+	}
+
+	return nil
+}
+
+func userPrefix(id string) string {
+	return "user:" + id + ":"
+}
+
+// add creates the Microsub handler for the backend and adds the user. It
+// returns an error when another user has the same url.
+func (u *userBackends) add(id string, backend *memoryBackend) (*userBackend, error) {
+	me := canonicalMe(backend.Me)
+	u.lock.RLock()
+	other, exists := u.ids[me]
+	u.lock.RUnlock()
+	if exists && other != id {
+		return nil, fmt.Errorf("users %s and %s both have url %s", other, id, backend.Me)
+	}
+
+	backend.id = id
+	backend.AuthEnabled = u.authEnabled
+	backend.baseURL = u.baseURL
+	backend.hubIncomingBackend.backend = backend
+	backend.hubIncomingBackend.pool = u.pool
+	backend.hubIncomingBackend.baseURL = u.baseURL
+
+	cfg := currentConfig().Events
+	policy, _ := sse.ParsePolicy(cfg.SlowClient)
+	broker := sse.NewBrokerWithOptions(sse.Options{
+		QueueSize: cfg.QueueSize,
+		Policy:    policy,
+		Log:       newRedisEventLog(u.pool, backend.prefix),
+	})
+	handler := server.NewMicrosubHandlerWithBroker(backend, broker)
+	if u.authEnabled {
+		handler = WithAuth(handler, backend)
+	}
+	backend.broker = broker
+
+	user := &userBackend{id: id, backend: backend, handler: handler}
+
+	u.lock.Lock()
+	u.users[id] = user
+	u.ids[me] = id
+	u.lock.Unlock()
+
+	return user, nil
+}
+
+func (u *userBackends) get(id string) (*userBackend, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	user, e := u.users[id]
+	return user, e
+}
+
+// lookup returns the user with url me
+func (u *userBackends) lookup(me string) (*userBackend, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	id, ok := u.ids[canonicalMe(me)]
+	if !ok {
+		return nil, false
+	}
+	user, ok := u.users[id]
+	return user, ok
+}
+
+// all returns the users sorted by id
+func (u *userBackends) all() []*userBackend {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	var users []*userBackend
+	for _, user := range u.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].id < users[j].id
+	})
+	return users
+}
+
+// backendFor returns the backend of the user with url me. Without me, it
+// returns the backend from the config file.
+func (u *userBackends) backendFor(me string) (*memoryBackend, bool) {
+	if me == "" {
+		return u.primary.backend, true
+	}
+	user, ok := u.lookup(me)
+	if !ok {
+		return nil, false
+	}
+	return user.backend, true
+}
+
+// backendForHost returns the backend of the user with a website on host
+func (u *userBackends) backendForHost(host string) (*memoryBackend, bool) {
+	for _, user := range u.all() {
+		me, err := url.Parse(user.backend.Me)
+		if err == nil && strings.EqualFold(me.Hostname(), host) {
+			return user.backend, true
+		}
+	}
+
+	// When no url is configured, all hosts are accepted
+	me, err := url.Parse(u.primary.backend.Me)
+	if err != nil || me.Host == "" {
+		return u.primary.backend, true
+	}
+
+	return nil, false
+}
+
+// setAllowed changes the urls of the users that are allowed to sign in
+func (u *userBackends) setAllowed(allowed []string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.allowed = allowed
+}
+
+// isAllowed returns true when the user with url me is allowed to use the server
+func (u *userBackends) isAllowed(me string) bool {
+	if sameUser(me, u.primary.backend.Me) {
+		return true
+	}
+
+	u.lock.RLock()
+	allowed := u.allowed
+	u.lock.RUnlock()
+
+	for _, allowed := range allowed {
+		if allowed == "*" || sameUser(allowed, me) {
+			return true
+		}
+	}
+	return false
+}
+
+// provision returns the backend of the user with url me, and creates the
+// backend when the user signs in for the first time. A new user gets the
+// readable id of me, or an id with a hash of me when another user has the
+// readable id already.
+func (u *userBackends) provision(me, tokenEndpoint string) (*userBackend, error) {
+	if user, ok := u.lookup(me); ok {
+		if user.backend.TokenEndpoint == "" && tokenEndpoint != "" {
+			user.backend.TokenEndpoint = tokenEndpoint
+			err := user.backend.save()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+	}
+
+	if !u.isAllowed(me) {
+		return nil, fmt.Errorf("user %s is not allowed to use this server", me)
+	}
+
+	id := userID(me)
+	if _, taken := u.get(id); taken {
+		sum := sha256.Sum256([]byte(canonicalMe(me)))
+		id += "-" + hex.EncodeToString(sum[:4])
+	}
+	if _, taken := u.get(id); taken {
+		return nil, fmt.Errorf("the id %s of user %s is used by another user", id, me)
+	}
+
+	err := os.MkdirAll(u.dir, 0750)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create users directory")
+	}
+
+	backend := newMemoryBackend(me)
+	backend.TokenEndpoint = tokenEndpoint
+	backend.pool = u.pool
+	backend.store = newConfigStore(filepath.Join(u.dir, id+".json"))
+	backend.prefix = userPrefix(id)
+
+	err = backend.save()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not save backend for %s", me)
+	}
+	backend.refreshChannels()
+
+	user, err := u.add(id, backend)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Created user %s (%s)", id, me)
+
+	u.lock.Lock()
+	if u.ctx != nil && u.ctx.Err() == nil {
+		u.start(backend)
+	}
+	u.lock.Unlock()
+
+	return user, nil
+}
+
+// microsubEndpoint returns the url of the Microsub endpoint of the user
+func (u *userBackends) microsubEndpoint(me string) string {
+	user, ok := u.lookup(me)
+	if !ok || user == u.primary {
+		return u.baseURL + "/microsub"
+	}
+	return u.baseURL + "/microsub/" + user.id
+}
+
+// run runs the backends of all users until ctx is cancelled
+func (u *userBackends) run(ctx context.Context) {
+	users := u.all()
+
+	u.lock.Lock()
+	u.ctx = ctx
+	for _, user := range users {
+		u.start(user.backend)
+	}
+	u.lock.Unlock()
+
+	<-ctx.Done()
+
+	// Wait for provision when it's starting a backend, after this no
+	// backends are started, because ctx is cancelled
+	u.lock.Lock()
+	u.lock.Unlock()
+	u.wg.Wait()
+}
+
+// start runs the backend, u.lock should be held
+func (u *userBackends) start(backend *memoryBackend) {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		backend.run(u.ctx)
+	}()
+}
+
+// save saves the backends of all users
+func (u *userBackends) save() error {
+	var lastErr error
+	for _, user := range u.all() {
+		err := user.backend.save()
+		if err != nil {
+			logger.Errorf("could not save backend of %s: %v", user.id, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// close closes the event brokers of all users, msg is sent to all clients
+func (u *userBackends) close(msg sse.Message) {
+	for _, user := range u.all() {
+		user.backend.broker.Close(msg)
+	}
+}
+
+// ServeHTTP sends requests for /microsub/<id> to the Microsub handler of the user
+func (u *userBackends) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/microsub/")
+	user, ok := u.get(id)
+	if !ok {
+		server.WriteError(w, microsub.NotFoundError("unknown user %s", id))
+		return
+	}
+	user.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserID(t *testing.T) {
+	assert.Equal(t, "example.com", userID("https://example.com/"))
+	assert.Equal(t, "example.com", userID("https://Example.com"))
+	assert.Equal(t, "example.com-alice", userID("https://example.com/alice/"))
+	assert.Equal(t, "example.com-8080", userID("http://example.com:8080/"))
+}
+
+func TestSameUser(t *testing.T) {
+	assert.True(t, sameUser("https://example.com/", "https://Example.com"))
+	assert.True(t, sameUser("https://example.com:443/alice/", "https://example.com/alice/"))
+	assert.False(t, sameUser("https://example.com/alice/", "https://example.com/Alice/"))
+	assert.False(t, sameUser("https://example.com/a-b", "https://example.com/a/b"))
+	assert.False(t, sameUser("https://example.com/", "https://example.com:8080/"))
+}
+
+func newTestUsers(t *testing.T, allowed ...string) (*userBackends, func()) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Redis is not available in the tests
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("no redis") }}
+
+	primary := newMemoryBackend("https://example.com/")
+	primary.pool = pool
+
+	users, err := newUserBackends(primary, AppOptions{
+		UsersDir:    filepath.Join(dir, "users"),
+		Users:       allowed,
+		BaseURL:     "https://microsub.example.com",
+		AuthEnabled: true,
+		pool:        pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return users, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestUserBackends_Provision(t *testing.T) {
+	users, cleanup := newTestUsers(t, "https://alice.example.org/")
+	defer cleanup()
+
+	_, err := users.provision("https://mallory.example.net/", "https://tokens.example.net/")
+	assert.Error(t, err)
+
+	user, err := users.provision("https://alice.example.org/", "https://tokens.example.org/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice.example.org", user.id)
+		assert.Equal(t, "user:alice.example.org:", user.backend.prefix)
+		assert.Equal(t, "https://tokens.example.org/", user.backend.TokenEndpoint)
+		assert.Contains(t, user.backend.Channels, "notifications")
+		assert.FileExists(t, filepath.Join(users.dir, "alice.example.org.json"))
+	}
+
+	backend, ok := users.backendFor("https://alice.example.org")
+	if assert.True(t, ok) {
+		assert.Equal(t, user.backend, backend)
+	}
+
+	backend, ok = users.backendFor("")
+	if assert.True(t, ok) {
+		assert.Equal(t, users.primary.backend, backend)
+	}
+
+	backend, ok = users.backendForHost("alice.example.org")
+	if assert.True(t, ok) {
+		assert.Equal(t, user.backend, backend)
+	}
+	_, ok = users.backendForHost("mallory.example.net")
+	assert.False(t, ok)
+
+	assert.Equal(t, "https://microsub.example.com/microsub", users.microsubEndpoint("https://example.com/"))
+	assert.Equal(t, "https://microsub.example.com/microsub/alice.example.org", users.microsubEndpoint("https://alice.example.org/"))
+
+	// A restarted server finds the users again
+	err = users.load()
+	if assert.NoError(t, err) {
+		loaded, ok := users.get("alice.example.org")
+		if assert.True(t, ok) {
+			assert.Equal(t, "https://alice.example.org/", loaded.backend.Me)
+		}
+	}
+}
+
+func TestUserBackends_ProvisionCollision(t *testing.T) {
+	users, cleanup := newTestUsers(t, "*")
+	defer cleanup()
+
+	first, err := users.provision("https://example.org/a-b", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	second, err := users.provision("https://example.org/a/b", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "example.org-a-b", first.id)
+	assert.NotEqual(t, first.id, second.id)
+	assert.NotEqual(t, first.backend, second.backend)
+	assert.Equal(t, "https://example.org/a/b", second.backend.Me)
+
+	backend, ok := users.backendFor("https://example.org/a-b")
+	if assert.True(t, ok) {
+		assert.Equal(t, first.backend, backend)
+	}
+	backend, ok = users.backendFor("https://example.org/a/b")
+	if assert.True(t, ok) {
+		assert.Equal(t, second.backend, backend)
+	}
+
+	// The users are found again after a restart
+	assert.NoError(t, users.load())
+	user, ok := users.lookup("https://example.org/a/b")
+	if assert.True(t, ok) {
+		assert.Equal(t, second.id, user.id)
+	}
+
+	// Two users with the same url are rejected
+	_, err = users.add("other", newMemoryBackend("https://example.org/a/b"))
+	assert.Error(t, err)
+}
+
+func TestUserBackends_ServeHTTP(t *testing.T) {
+	users, cleanup := newTestUsers(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	users.ServeHTTP(w, httptest.NewRequest("GET", "/microsub/unknown?action=channels", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Known users need a valid token
+	w = httptest.NewRecorder()
+	users.ServeHTTP(w, httptest.NewRequest("GET", "/microsub/example.com?action=channels", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestUserBackends_IsAllowed(t *testing.T) {
+	users, cleanup := newTestUsers(t)
+	defer cleanup()
+
+	assert.True(t, users.isAllowed("https://example.com"))
+	assert.False(t, users.isAllowed("https://alice.example.org/"))
+
+	users.allowed = []string{"*"}
+	assert.True(t, users.isAllowed("https://alice.example.org/"))
+}
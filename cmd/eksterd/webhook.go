@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/netguard"
+	"p83.nl/go/ekster/pkg/websub"
+)
+
+const (
+	// webhookQueueKey is the list of deliveries that should be sent now
+	webhookQueueKey = "webhook:queue"
+	// webhookRetryKey is a sorted set of deliveries that failed, with the
+	// time of the next attempt as score
+	webhookRetryKey = "webhook:retry"
+
+	// webhookLogSize is the number of deliveries in the log of a user
+	webhookLogSize = 100
+	// webhookDeadSize is the number of dead letters kept for a user
+	webhookDeadSize = 1000
+	// webhookMaxRetryDelay is the maximum time between two attempts
+	webhookMaxRetryDelay = time.Hour
+)
+
+// webhook is a url that receives the new items of a channel
+type webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret"`
+	Created time.Time `json:"created"`
+}
+
+// webhookPayload is the body of a webhook request
+type webhookPayload struct {
+	Version int           `json:"version"`
+	Event   string        `json:"event"`
+	Channel string        `json:"channel"`
+	Item    microsub.Item `json:"item"`
+}
+
+// webhookDelivery is a payload that should be sent to a webhook
+type webhookDelivery struct {
+	ID       string          `json:"id"`
+	User     string          `json:"user"`
+	Channel  string          `json:"channel"`
+	Hook     string          `json:"hook"`
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+	Created  time.Time       `json:"created"`
+	Attempts int             `json:"attempts"`
+	// Error is the error of the last attempt
+	Error string `json:"error,omitempty"`
+}
+
+// webhookLogEntry is an attempt to deliver a webhook
+type webhookLogEntry struct {
+	Time     time.Time `json:"time"`
+	Delivery string    `json:"delivery"`
+	Channel  string    `json:"channel"`
+	URL      string    `json:"url"`
+	Event    string    `json:"event"`
+	Attempt  int       `json:"attempt"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// webhookBackend delivers the queued webhooks of all users
+type webhookBackend struct {
+	users  *userBackends
+	pool   *redis.Pool
+	client *http.Client
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// addWebhook registers a webhook for channel. Without a secret, a random
+// secret is created.
+func (b *memoryBackend) addWebhook(channel, hookURL, secret string) (webhook, error) {
+	if !b.channelExists(channel) {
+		return webhook{}, microsub.NotFoundError("channel %s does not exist", channel)
+	}
+	u, err := url.Parse(hookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webhook{}, microsub.InvalidRequestError("url %s should start with http:// or https://", hookURL)
+	}
+	// The address is checked again when the delivery connects, in case the
+	// name resolves to another address later
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = netguard.CheckHost(ctx, u.Hostname())
+	cancel()
+	if err != nil {
+		return webhook{}, microsub.InvalidRequestError("url %s is not allowed: %v", hookURL, err)
+	}
+	if secret == "" {
+		secret = randomHex(16)
+	}
+
+	hook := webhook{ID: randomHex(8), URL: hookURL, Secret: secret, Created: time.Now()}
+
+	b.lock.Lock()
+	if b.Webhooks == nil {
+		b.Webhooks = make(map[string][]webhook)
+	}
+	b.Webhooks[channel] = append(b.Webhooks[channel], hook)
+	b.lock.Unlock()
+
+	return hook, b.save()
+}
+
+// removeWebhook removes the webhook with id from channel
+func (b *memoryBackend) removeWebhook(channel, id string) error {
+	b.lock.Lock()
+	hooks := b.Webhooks[channel]
+	for i, hook := range hooks {
+		if hook.ID == id {
+			b.Webhooks[channel] = append(hooks[:i:i], hooks[i+1:]...)
+			break
+		}
+	}
+	b.lock.Unlock()
+
+	return b.save()
+}
+
+// webhooks returns the webhooks of channel
+func (b *memoryBackend) webhooks(channel string) []webhook {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return append([]webhook(nil), b.Webhooks[channel]...)
+}
+
+// webhook returns the webhook of channel with id
+func (b *memoryBackend) webhook(channel, id string) (webhook, bool) {
+	for _, hook := range b.webhooks(channel) {
+		if hook.ID == id {
+			return hook, true
+		}
+	}
+	return webhook{}, false
+}
+
+// enqueueWebhooks queues the new item for the webhooks of channel
+func (b *memoryBackend) enqueueWebhooks(channel string, item microsub.Item) {
+	hooks := b.webhooks(channel)
+	if len(hooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(webhookPayload{Version: 1, Event: microsub.EventNewItem, Channel: channel, Item: item})
+	if err != nil {
+		logger.Errorf("could not encode webhook payload: %v", err)
+		return
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	for _, hook := range hooks {
+		d := webhookDelivery{
+			ID:      randomHex(8),
+			User:    b.id,
+			Channel: channel,
+			Hook:    hook.ID,
+			URL:     hook.URL,
+			Event:   microsub.EventNewItem,
+			Payload: payload,
+			Created: time.Now(),
+		}
+		if err := pushWebhook(conn, "LPUSH", webhookQueueKey, d); err != nil {
+			logger.Errorf("could not queue webhook for %s: %v", hook.URL, err)
+		}
+	}
+}
+
+func pushWebhook(conn redis.Conn, cmd, key string, d webhookDelivery) error {
+	data, err := json.Marshal(&d)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do(cmd, key, data)
+	return err
+}
+
+// webhookRetryDelay returns the time before the next attempt, after attempts
+// failed attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := time.Minute
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetryDelay {
+		return webhookMaxRetryDelay
+	}
+	return delay
+}
+
+// run delivers the queued webhooks with webhooks.workers workers until ctx is
+// cancelled, and queues the retries that are due
+func (wb *webhookBackend) run(ctx context.Context) {
+	queue := &deliveryQueue{
+		name:    "webhook",
+		key:     webhookQueueKey,
+		pool:    wb.pool,
+		workers: currentConfig().Webhooks.Workers,
+		deliver: wb.deliverData,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			err := wb.queueRetries(time.Now())
+			if err != nil {
+				logger.Errorf("could not queue webhook retries: %v", err)
+			}
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	queue.run(ctx)
+	<-done
+}
+
+// deliverData decodes a delivery from the queue and delivers it
+func (wb *webhookBackend) deliverData(ctx context.Context, data []byte) error {
+	var d webhookDelivery
+	err := json.Unmarshal(data, &d)
+	if err != nil {
+		return errors.Wrap(err, "could not decode webhook delivery")
+	}
+	return errors.Wrapf(wb.deliver(ctx, d), "webhook %s for %s", d.ID, d.URL)
+}
+
+// queueRetries moves the deliveries that should be tried again before now to
+// the queue
+func (wb *webhookBackend) queueRetries(now time.Time) error {
+	conn := wb.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("ZRANGEBYSCORE", webhookRetryKey, "-inf", now.Unix()))
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		// Only the process that removes the delivery queues it
+		n, err := redis.Int(conn.Do("ZREM", webhookRetryKey, v))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		_, err = conn.Do("LPUSH", webhookQueueKey, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends the delivery to its webhook. Failed deliveries are tried
+// again later, or moved to the dead letters of the user after
+// webhooks.max_attempts.
+func (wb *webhookBackend) deliver(ctx context.Context, d webhookDelivery) error {
+	user, ok := wb.users.get(d.User)
+	if !ok {
+		logger.Warnf("dropped webhook %s for unknown user %s", d.ID, d.User)
+		return nil
+	}
+	hook, ok := user.backend.webhook(d.Channel, d.Hook)
+	if !ok {
+		// The webhook was removed
+		return nil
+	}
+
+	cfg := currentConfig().Webhooks
+
+	postCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	status, err := postWebhook(postCtx, wb.client, hook, d)
+	cancel()
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+
+	d.Attempts++
+	entry := webhookLogEntry{
+		Time:     time.Now(),
+		Delivery: d.ID,
+		Channel:  d.Channel,
+		URL:      hook.URL,
+		Event:    d.Event,
+		Attempt:  d.Attempts,
+		Status:   status,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		d.Error = err.Error()
+		metricWebhookDeliveries.With("error").Inc()
+	} else {
+		metricWebhookDeliveries.With("ok").Inc()
+	}
+
+	conn := wb.pool.Get()
+	defer conn.Close()
+
+	prefix := user.backend.prefix
+	if logErr := pushWebhookLog(conn, prefix, entry); logErr != nil {
+		logger.Errorf("could not log webhook delivery: %v", logErr)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	if d.Attempts >= cfg.MaxAttempts {
+		metricWebhookDeliveries.With("dead").Inc()
+		logger.Warnf("webhook %s for %s failed %d times, moved to dead letters: %v", d.ID, hook.URL, d.Attempts, err)
+		err = pushWebhook(conn, "LPUSH", prefix+"webhooks:dead", d)
+		if err != nil {
+			return errors.Wrap(err, "could not add dead letter")
+		}
+		_, err = conn.Do("LTRIM", prefix+"webhooks:dead", 0, webhookDeadSize-1)
+		return err
+	}
+
+	data, err := json.Marshal(&d)
+	if err != nil {
+		return err
+	}
+	next := time.Now().Add(webhookRetryDelay(d.Attempts))
+	_, err = conn.Do("ZADD", webhookRetryKey, next.Unix(), data)
+	return errors.Wrap(err, "could not schedule retry")
+}
+
+// postWebhook sends the payload of d to hook. The payload is signed with the
+// secret of the webhook, like WebSub content notifications.
+func postWebhook(ctx context.Context, client *http.Client, hook webhook, d webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ekster webhooks")
+	req.Header.Set("X-Hub-Signature", websub.HubSignature(d.Payload, []byte(hook.Secret)))
+	req.Header.Set("X-Ekster-Event", d.Event)
+	req.Header.Set("X-Ekster-Delivery", d.ID)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+func pushWebhookLog(conn redis.Conn, prefix string, entry webhookLogEntry) error {
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("LPUSH", prefix+"webhooks:log", data)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("LTRIM", prefix+"webhooks:log", 0, webhookLogSize-1)
+	return err
+}
+
+// webhookLog returns the last deliveries of the user, the newest first
+func webhookLog(conn redis.Conn, prefix string) ([]webhookLogEntry, error) {
+	values, err := redis.ByteSlices(conn.Do("LRANGE", prefix+"webhooks:log", 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	var entries []webhookLogEntry
+	for _, v := range values {
+		var entry webhookLogEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return nil, errors.Wrap(err, "could not decode webhook log")
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// webhookDeadLetters returns the deliveries of the user that failed too
+// often, the newest first
+func webhookDeadLetters(conn redis.Conn, prefix string) ([]webhookDelivery, error) {
+	values, err := redis.ByteSlices(conn.Do("LRANGE", prefix+"webhooks:dead", 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []webhookDelivery
+	for _, v := range values {
+		var d webhookDelivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			return nil, errors.Wrap(err, "could not decode dead letter")
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// retryDeadLetter queues the dead letter with id again
+func retryDeadLetter(conn redis.Conn, prefix, id string) error {
+	values, err := redis.ByteSlices(conn.Do("LRANGE", prefix+"webhooks:dead", 0, -1))
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		var d webhookDelivery
+		if err := json.Unmarshal(v, &d); err != nil || d.ID != id {
+			continue
+		}
+		_, err = conn.Do("LREM", prefix+"webhooks:dead", 1, v)
+		if err != nil {
+			return err
+		}
+		d.Attempts = 0
+		d.Error = ""
+		return pushWebhook(conn, "LPUSH", webhookQueueKey, d)
+	}
+	return fmt.Errorf("dead letter %s not found", id)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/netguard"
+	"p83.nl/go/ekster/pkg/websub"
+)
+
+func TestPostWebhook(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/fail" {
+			http.Error(w, "failed", 500)
+		}
+	}))
+	defer server.Close()
+
+	payload, _ := json.Marshal(webhookPayload{Version: 1, Event: microsub.EventNewItem, Channel: "home", Item: microsub.Item{Type: "entry", Name: "Hello"}})
+	d := webhookDelivery{ID: "d1", Event: microsub.EventNewItem, Payload: payload}
+	hook := webhook{ID: "h1", URL: server.URL + "/hook", Secret: "secret"}
+
+	status, err := postWebhook(context.Background(), server.Client(), hook, d)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "application/json", received.Header.Get("Content-Type"))
+		assert.Equal(t, "new item", received.Header.Get("X-Ekster-Event"))
+		assert.Equal(t, "d1", received.Header.Get("X-Ekster-Delivery"))
+		assert.NoError(t, websub.ValidateHubSignature(received.Header.Get("X-Hub-Signature"), body, []byte("secret")))
+
+		var p webhookPayload
+		if assert.NoError(t, json.Unmarshal(body, &p)) {
+			assert.Equal(t, "home", p.Channel)
+			assert.Equal(t, "Hello", p.Item.Name)
+		}
+	}
+
+	hook.URL = server.URL + "/fail"
+	status, err = postWebhook(context.Background(), server.Client(), hook, d)
+	assert.Error(t, err)
+	assert.Equal(t, 500, status)
+
+	// The client of the webhookBackend doesn't connect to local addresses
+	_, err = postWebhook(context.Background(), netguard.Client(0), hook, d)
+	assert.True(t, errors.Is(err, netguard.ErrNotPublic))
+}
+
+func TestMemoryBackend_Webhooks(t *testing.T) {
+	backend := newMemoryBackend("https://example.com/")
+
+	_, err := backend.addWebhook("missing", "https://hooks.example.com/", "")
+	assert.Equal(t, microsub.ErrorNotFound, microsub.ErrorCode(err))
+	_, err = backend.addWebhook("home", "ftp://hooks.example.com/", "")
+	assert.Equal(t, microsub.ErrorInvalidRequest, microsub.ErrorCode(err))
+	for _, hookURL := range []string{"http://localhost:8080/", "http://127.0.0.1/", "http://10.0.0.1/", "http://169.254.169.254/", "http://[::1]/"} {
+		_, err = backend.addWebhook("home", hookURL, "")
+		assert.Equal(t, microsub.ErrorInvalidRequest, microsub.ErrorCode(err), hookURL)
+	}
+
+	// Addresses instead of names, because the tests can't resolve names
+	first, err := backend.addWebhook("home", "https://93.184.216.34/1", "")
+	if assert.NoError(t, err) {
+		assert.NotEmpty(t, first.ID)
+		assert.Len(t, first.Secret, 32)
+	}
+	second, err := backend.addWebhook("home", "https://93.184.216.34/2", "mine")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mine", second.Secret)
+	}
+	assert.Equal(t, []webhook{first, second}, backend.webhooks("home"))
+
+	// The webhooks are saved with the channels and feeds
+	assert.Equal(t, []webhook{first, second}, backend.config().Webhooks["home"])
+
+	assert.NoError(t, backend.removeWebhook("home", first.ID))
+	_, ok := backend.webhook("home", first.ID)
+	assert.False(t, ok)
+	hook, ok := backend.webhook("home", second.ID)
+	assert.True(t, ok)
+	assert.Equal(t, second, hook)
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, webhookRetryDelay(1))
+	assert.Equal(t, 4*time.Minute, webhookRetryDelay(3))
+	assert.Equal(t, time.Hour, webhookRetryDelay(10))
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"p83.nl/go/ekster/pkg/jf2"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/netguard"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"willnorris.com/go/microformats"
+)
+
+const (
+	webmentionQueueKey = "webmention:queue"
+
+	// webmentionMaxBodySize is the maximum number of bytes read from a source
+	webmentionMaxBodySize = 1024 * 1024
+)
+
+// Mention types
+const (
+	MentionTypeReply    = "reply"
+	MentionTypeLike     = "like"
+	MentionTypeRepost   = "repost"
+	MentionTypeBookmark = "bookmark"
+	MentionTypeMention  = "mention"
+)
+
+// webmention is a received, not yet verified, webmention
+type webmention struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Received int64  `json:"received"`
+}
+
+// mentionInfo is the information we remember about a processed webmention
+type mentionInfo struct {
+	Source  string `redis:"source"`
+	Target  string `redis:"target"`
+	Type    string `redis:"type"`
+	ItemID  string `redis:"item_id"`
+	Updated int64  `redis:"updated"`
+}
+
+type webmentionBackend struct {
+	users *userBackends
+	pool  *redis.Pool
+	// client fetches the sources, it only connects to public addresses
+	client *http.Client
+}
+
+type webmentionHandler struct {
+	Backend *webmentionBackend
+}
+
+func (h *webmentionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "could not parse form data", http.StatusBadRequest)
+		return
+	}
+
+	source := r.PostForm.Get("source")
+	target := r.PostForm.Get("target")
+
+	err = h.Backend.validate(source, target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.Backend.Enqueue(webmention{Source: source, Target: target, Received: time.Now().Unix()})
+	if err != nil {
+		logger.Errorf("could not queue webmention: %v", err)
+		http.Error(w, "could not queue webmention", 500)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = fmt.Fprintln(w, "Webmention accepted, it will be processed asynchronously")
+}
+
+// validate checks the request synchronously, as required by the Webmention spec
+func (wb *webmentionBackend) validate(source, target string) error {
+	sourceURL, err := url.Parse(source)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") {
+		return fmt.Errorf("source %q is not a valid http(s) url", source)
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") {
+		return fmt.Errorf("target %q is not a valid http(s) url", target)
+	}
+
+	if source == target {
+		return fmt.Errorf("source and target should be different")
+	}
+
+	if _, ok := wb.targetBackend(targetURL); !ok {
+		return fmt.Errorf("target %q is not accepted by this endpoint", target)
+	}
+
+	return nil
+}
+
+// targetBackend returns the backend of the user with a website on the host of
+// target. Mentions of other websites are not accepted, also when no url is
+// configured.
+func (wb *webmentionBackend) targetBackend(target *url.URL) (*memoryBackend, bool) {
+	backend, ok := wb.users.backendForHost(target.Hostname())
+	if !ok {
+		return nil, false
+	}
+	me, err := url.Parse(backend.Me)
+	if err != nil || !strings.EqualFold(me.Hostname(), target.Hostname()) {
+		return nil, false
+	}
+	return backend, true
+}
+
+// Enqueue adds the webmention to the queue of mentions that should be verified
+func (wb *webmentionBackend) Enqueue(mention webmention) error {
+	conn := wb.pool.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(&mention)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("LPUSH", webmentionQueueKey, data)
+	return err
+}
+
+// run processes the queued webmentions until ctx is cancelled. A webmention
+// that is interrupted is queued again.
+func (wb *webmentionBackend) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		mention, ok, err := wb.dequeue(5)
+		if err != nil {
+			logger.Errorf("could not read from webmention queue: %v", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		err = wb.process(ctx, mention)
+		if err != nil && ctx.Err() != nil {
+			err = wb.requeue(mention)
+			if err != nil {
+				logger.Errorf("could not queue webmention from %s to %s again: %v", mention.Source, mention.Target, err)
+			}
+			return
+		}
+		if err != nil {
+			logger.Warnf("could not process webmention from %s to %s: %v", mention.Source, mention.Target, err)
+		}
+	}
+}
+
+// requeue adds the webmention to the front of the queue, it will be the next
+// one that is processed
+func (wb *webmentionBackend) requeue(mention webmention) error {
+	conn := wb.pool.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(&mention)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("RPUSH", webmentionQueueKey, data)
+	return err
+}
+
+// dequeue waits at most timeout seconds for the next webmention
+func (wb *webmentionBackend) dequeue(timeout int) (webmention, bool, error) {
+	var mention webmention
+
+	conn := wb.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("BRPOP", webmentionQueueKey, timeout))
+	if err == redis.ErrNil {
+		return mention, false, nil
+	}
+	if err != nil {
+		return mention, false, err
+	}
+	if len(values) != 2 {
+		return mention, false, fmt.Errorf("unexpected reply from BRPOP")
+	}
+
+	err = json.Unmarshal(values[1], &mention)
+	if err != nil {
+		return mention, false, errors.Wrap(err, "could not decode webmention")
+	}
+
+	return mention, true, nil
+}
+
+// process verifies the webmention and adds, updates or removes the
+// notification for it
+func (wb *webmentionBackend) process(ctx context.Context, mention webmention) error {
+	logger.Debugf("Processing webmention source=%s target=%s", mention.Source, mention.Target)
+
+	id := mentionID(mention.Source, mention.Target)
+
+	targetURL, err := url.Parse(mention.Target)
+	if err != nil {
+		return err
+	}
+	backend, ok := wb.targetBackend(targetURL)
+	if !ok {
+		return fmt.Errorf("no user for target %s", mention.Target)
+	}
+
+	resp, err := wb.fetch(ctx, mention.Source)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return wb.remove(backend, id)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("source returned status code %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength > webmentionMaxBodySize {
+		return fmt.Errorf("source is larger than %d bytes", webmentionMaxBodySize)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, webmentionMaxBodySize+1))
+	if err != nil {
+		return errors.Wrap(err, "could not read source")
+	}
+	if len(body) > webmentionMaxBodySize {
+		return fmt.Errorf("source is larger than %d bytes", webmentionMaxBodySize)
+	}
+
+	sourceURL, err := url.Parse(mention.Source)
+	if err != nil {
+		return err
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+
+	if !linksToTarget(sourceURL, contentType, body, mention.Target) {
+		// The source was updated and doesn't link to the target anymore
+		return wb.remove(backend, id)
+	}
+
+	item := mentionItem(sourceURL, contentType, body)
+	item.ID = id
+	item.Read = false
+
+	mentionType := getMentionType(item, mention.Target)
+	addMentionDescription(&item, mentionType)
+
+	// An update of an existing mention replaces the item
+	err = backend.channelRemoveItem("notifications", id)
+	if err != nil {
+		return errors.Wrap(err, "could not remove previous version")
+	}
+
+	err = backend.channelAddItem("notifications", item)
+	if err != nil {
+		return errors.Wrap(err, "could not add mention to notifications")
+	}
+
+	err = wb.saveInfo(id, mentionInfo{
+		Source:  mention.Source,
+		Target:  mention.Target,
+		Type:    mentionType,
+		ItemID:  id,
+		Updated: time.Now().Unix(),
+	})
+	if err != nil {
+		logger.Errorf("could not save webmention info: %v", err)
+	}
+
+	return backend.updateChannelUnreadCount("notifications")
+}
+
+// fetch gets the source of a webmention. The source is chosen by the sender,
+// so it's only fetched from a public address.
+func (wb *webmentionBackend) fetch(ctx context.Context, source string) (*http.Response, error) {
+	err := netguard.CheckURL(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := wb.client
+	if client == nil {
+		client = netguard.Client(30 * time.Second)
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+// remove removes the item of a webmention that was deleted
+func (wb *webmentionBackend) remove(backend *memoryBackend, id string) error {
+	conn := wb.pool.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", "webmention:"+id))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	err = backend.channelRemoveItem("notifications", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("DEL", "webmention:"+id)
+	if err != nil {
+		return err
+	}
+
+	return backend.updateChannelUnreadCount("notifications")
+}
+
+func (wb *webmentionBackend) saveInfo(id string, info mentionInfo) error {
+	conn := wb.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HMSET", redis.Args{}.Add("webmention:"+id).AddFlat(&info)...)
+	return err
+}
+
+// mentionID creates a stable id for a source and target pair, so updates
+// replace the earlier item
+func mentionID(source, target string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("webmention:%s:%s", source, target))))
+}
+
+// linksToTarget checks if the body of the source contains a link to target
+func linksToTarget(source *url.URL, contentType string, body []byte, target string) bool {
+	if !strings.HasPrefix(contentType, "text/html") {
+		return bytes.Contains(body, []byte(target))
+	}
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case html.ErrorToken:
+			return false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			for {
+				key, val, more := tokenizer.TagAttr()
+				k := string(key)
+				if k == "href" || k == "src" {
+					if u, err := source.Parse(string(val)); err == nil && u.String() == target {
+						return true
+					}
+				}
+				if !more {
+					break
+				}
+			}
+		}
+	}
+}
+
+// mentionItem creates the item that will be shown in the notifications channel
+func mentionItem(source *url.URL, contentType string, body []byte) microsub.Item {
+	item := microsub.Item{Type: "entry", URL: source.String()}
+
+	if strings.HasPrefix(contentType, "text/html") {
+		data := microformats.Parse(bytes.NewReader(body), source)
+		items := jf2.SimplifyMicroformatDataItems(data)
+
+		if len(items) > 0 {
+			item = items[0]
+		}
+		for _, it := range items {
+			if it.URL == source.String() {
+				item = it
+				break
+			}
+		}
+	}
+
+	if item.URL == "" {
+		item.URL = source.String()
+	}
+
+	if item.Published == "" {
+		item.Published = time.Now().Format(time.RFC3339)
+	}
+
+	return item
+}
+
+// getMentionType finds the type of response the item is to target
+func getMentionType(item microsub.Item, target string) string {
+	switch {
+	case containsURL(item.InReplyTo, target):
+		return MentionTypeReply
+	case containsURL(item.LikeOf, target):
+		return MentionTypeLike
+	case containsURL(item.RepostOf, target):
+		return MentionTypeRepost
+	case containsURL(item.BookmarkOf, target):
+		return MentionTypeBookmark
+	}
+	return MentionTypeMention
+}
+
+// addMentionDescription adds text to the item, when it has no content to show
+func addMentionDescription(item *microsub.Item, mentionType string) {
+	if item.Content != nil && (item.Content.Text != "" || item.Content.HTML != "") {
+		return
+	}
+
+	author := "Someone"
+	if item.Author != nil && item.Author.Name != "" {
+		author = item.Author.Name
+	}
+
+	var text string
+	switch mentionType {
+	case MentionTypeLike:
+		text = "liked your post"
+	case MentionTypeRepost:
+		text = "reposted your post"
+	case MentionTypeBookmark:
+		text = "bookmarked your post"
+	case MentionTypeReply:
+		text = "replied to your post"
+	default:
+		text = "mentioned your post"
+	}
+
+	item.Content = &microsub.Content{Text: fmt.Sprintf("%s %s", author, text)}
+}
+
+func containsURL(urls []string, target string) bool {
+	for _, u := range urls {
+		if u == target {
+			return true
+		}
+	}
+	return false
+}
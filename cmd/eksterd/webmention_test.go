@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinksToTarget(t *testing.T) {
+	source, _ := url.Parse("https://source.example/post/1")
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        bool
+	}{
+		{"absolute link", "text/html", `<p><a href="https://example.com/post">post</a></p>`, true},
+		{"image", "text/html; charset=utf-8", `<img src="https://example.com/post">`, true},
+		{"other link", "text/html", `<a href="https://example.com/other">other</a>`, false},
+		{"only text", "text/html", `<p>https://example.com/post</p>`, false},
+		{"relative link", "text/html", `<a href="/post">post</a>`, false},
+		{"plain text", "text/plain", `see https://example.com/post`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := linksToTarget(source, tt.contentType, []byte(tt.body), "https://example.com/post")
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMentionItemType(t *testing.T) {
+	source, _ := url.Parse("https://source.example/like/1")
+	body := `
+<div class="h-entry">
+  <a class="u-url" href="https://source.example/like/1">permalink</a>
+  <a class="u-like-of" href="https://example.com/post">liked</a>
+  <a class="p-author h-card" href="https://source.example/">Source</a>
+</div>`
+
+	item := mentionItem(source, "text/html", []byte(body))
+	assert.Equal(t, "https://source.example/like/1", item.URL)
+
+	mentionType := getMentionType(item, "https://example.com/post")
+	assert.Equal(t, MentionTypeLike, mentionType)
+
+	addMentionDescription(&item, mentionType)
+	if assert.NotNil(t, item.Content) {
+		assert.Equal(t, "Source liked your post", item.Content.Text)
+	}
+}
+
+func TestMentionIDIsStable(t *testing.T) {
+	a := mentionID("https://source.example/1", "https://example.com/post")
+	b := mentionID("https://source.example/1", "https://example.com/post")
+	c := mentionID("https://source.example/2", "https://example.com/post")
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+}
+
+func TestWebmentionTargetBackend(t *testing.T) {
+	users, cleanup := newTestUsers(t)
+	defer cleanup()
+	wb := &webmentionBackend{users: users}
+
+	target, _ := url.Parse("https://example.com/post/1")
+	_, ok := wb.targetBackend(target)
+	assert.True(t, ok)
+
+	target, _ = url.Parse("https://other.example/post/1")
+	_, ok = wb.targetBackend(target)
+	assert.False(t, ok)
+
+	// Without a configured url, mentions are not accepted
+	users.primary.backend.Me = ""
+	_, ok = wb.targetBackend(target)
+	assert.False(t, ok)
+}
+
+func TestWebmentionFetchLocal(t *testing.T) {
+	wb := &webmentionBackend{}
+	for _, source := range []string{"http://127.0.0.1:6379/", "http://169.254.169.254/latest/meta-data/", "http://localhost/"} {
+		_, err := wb.fetch(context.Background(), source)
+		assert.Error(t, err, source)
+	}
+}
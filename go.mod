@@ -1,6 +1,6 @@
 module p83.nl/go/ekster
 
-go 1.14
+go 1.16
 
 require (
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751
@@ -11,5 +11,6 @@ require (
 	github.com/stretchr/testify v1.5.1
 	github.com/tomnomnom/linkheader v0.0.0-20180905144013-02ca5825eb80 // indirect
 	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	gopkg.in/yaml.v2 v2.2.2
 	willnorris.com/go/microformats v1.1.0
 )
@@ -0,0 +1,65 @@
+// Package admin contains the types and a client of the admin API of eksterd.
+//
+// The admin API is served on /admin/ and is used for operational tasks:
+//
+//	POST   /admin/feeds/refresh?url=URL[&user=ID]         fetch one feed now
+//	POST   /admin/feeds/reindex                           rebuild the index of WebSub feeds
+//	POST   /admin/websub/resubscribe[?url=URL]            renew WebSub subscriptions
+//	POST   /admin/unread/rebuild[?user=ID][&channel=UID]  count the unread items again
+//	POST   /admin/cache/clear                             remove the cached pages
+//	GET    /admin/jobs                                    list the jobs
+//	GET    /admin/jobs/ID                                 show a job
+//	DELETE /admin/jobs/ID                                 cancel a job
+//
+// Operations that take a long time start a job, the response is the job with
+// status 202 Accepted.
+package admin
+
+import (
+	"time"
+)
+
+// The statuses of a job
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is an operation that runs in the background
+type Job struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+
+	// Done is the number of steps that are finished, Total is the number
+	// of steps, when it's known
+	Done  int `json:"done"`
+	Total int `json:"total,omitempty"`
+
+	// Message describes the result of the job
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// IsFinished returns true when the job is not running anymore
+func (j Job) IsFinished() bool {
+	return j.Status != JobRunning
+}
+
+// RefreshResult is the response of /admin/feeds/refresh
+type RefreshResult struct {
+	URL   string          `json:"url"`
+	Feeds []RefreshedFeed `json:"feeds"`
+}
+
+// RefreshedFeed is a channel of a user that follows the refreshed feed
+type RefreshedFeed struct {
+	User    string `json:"user"`
+	Channel string `json:"channel"`
+	Error   string `json:"error,omitempty"`
+}
@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// Client is a HTTP client for the admin API
+type Client struct {
+	// Endpoint is the url of the admin API, e.g. https://microsub.example.com/admin/
+	Endpoint *url.URL
+	Token    string
+}
+
+// RefreshFeed fetches the feed with url now. With user, only the feed of
+// that user is refreshed.
+func (c *Client) RefreshFeed(feedURL, user string) (RefreshResult, error) {
+	var res RefreshResult
+	args := url.Values{}
+	args.Set("url", feedURL)
+	if user != "" {
+		args.Set("user", user)
+	}
+	err := c.do(http.MethodPost, "feeds/refresh", args, &res)
+	return res, err
+}
+
+// StartJob starts the job of the operation at path, e.g. "cache/clear"
+func (c *Client) StartJob(path string, args url.Values) (Job, error) {
+	var job Job
+	err := c.do(http.MethodPost, path, args, &job)
+	return job, err
+}
+
+// Jobs returns the jobs, the newest first
+func (c *Client) Jobs() ([]Job, error) {
+	var jobs []Job
+	err := c.do(http.MethodGet, "jobs", nil, &jobs)
+	return jobs, err
+}
+
+// Job returns the job with id
+func (c *Client) Job(id string) (Job, error) {
+	var job Job
+	err := c.do(http.MethodGet, "jobs/"+url.PathEscape(id), nil, &job)
+	return job, err
+}
+
+// CancelJob cancels the job with id
+func (c *Client) CancelJob(id string) (Job, error) {
+	var job Job
+	err := c.do(http.MethodDelete, "jobs/"+url.PathEscape(id), nil, &job)
+	return job, err
+}
+
+// Wait polls the job until it's finished. It calls progress after every poll.
+func (c *Client) Wait(id string, interval time.Duration, progress func(Job)) (Job, error) {
+	for {
+		job, err := c.Job(id)
+		if err != nil {
+			return job, err
+		}
+		if progress != nil {
+			progress(job)
+		}
+		if job.IsFinished() {
+			return job, nil
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (c *Client) do(method, path string, args url.Values, v interface{}) error {
+	u, err := c.Endpoint.Parse(path)
+	if err != nil {
+		return err
+	}
+	if args != nil {
+		u.RawQuery = args.Encode()
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/json")
+
+	client := http.Client{Timeout: time.Minute}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted {
+		var merr microsub.Error
+		if err := json.Unmarshal(body, &merr); err == nil && merr.Code != "" {
+			return &merr
+		}
+		return fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
+	}
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+const (
+	// defaultRetry is the time before reconnecting, when the server doesn't
+	// send a retry field
+	defaultRetry = 3 * time.Second
+	// maxRetry is the maximum time between reconnects
+	maxRetry = time.Minute
+)
+
+// Events opens an event stream to the server. See EventsContext.
+func (c *Client) Events() (chan sse.Message, error) {
+	return c.EventsContext(context.Background(), "", sse.Filter{})
+}
+
+// EventsContext opens an event stream to the server, with the events after
+// lastEventID that match filter. When the connection is lost, it reconnects
+// with the id of the last event it received, and waits longer after every
+// failed attempt. The Object of the messages contains the payload decoded
+// with microsub.DecodeEvent. The channel is closed when ctx is done, or when
+// the server doesn't accept the request.
+func (c *Client) EventsContext(ctx context.Context, lastEventID string, filter sse.Filter) (chan sse.Message, error) {
+	res, err := c.eventsRequest(ctx, lastEventID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan sse.Message)
+
+	go func() {
+		defer close(ch)
+
+		retry := defaultRetry
+		failures := 0
+
+		for {
+			d := sse.NewDecoder(res.Body, lastEventID)
+			received := false
+			for {
+				msg, err := d.Decode()
+				if err != nil {
+					if err != io.EOF && ctx.Err() == nil {
+						log.Printf("could not read events: %v", err)
+					}
+					break
+				}
+				received = true
+
+				obj, err := microsub.DecodeEvent(msg.Event, []byte(msg.Data))
+				if err != nil {
+					log.Printf("could not decode event %q: %v", msg.Event, err)
+				} else {
+					msg.Object = obj
+				}
+
+				select {
+				case ch <- msg:
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					break
+				}
+			}
+			res.Body.Close()
+
+			lastEventID = d.LastEventID()
+			if r := d.Retry(); r > 0 {
+				retry = r
+			}
+			if received {
+				failures = 0
+			} else {
+				failures++
+			}
+
+			for {
+				select {
+				case <-time.After(backoff(retry, failures)):
+				case <-ctx.Done():
+					return
+				}
+
+				res, err = c.eventsRequest(ctx, lastEventID, filter)
+				if err == nil {
+					break
+				}
+				if !temporary(err) {
+					log.Printf("could not reconnect to events: %v", err)
+					return
+				}
+				failures++
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// backoff returns the time to wait before reconnecting, after a number of
+// failed attempts
+func backoff(retry time.Duration, failures int) time.Duration {
+	for i := 0; i < failures && retry < maxRetry; i++ {
+		retry *= 2
+	}
+	if retry > maxRetry {
+		return maxRetry
+	}
+	return retry
+}
+
+// temporary returns false for errors where reconnecting doesn't help, like an
+// invalid token
+func temporary(err error) bool {
+	switch microsub.ErrorCode(err) {
+	case microsub.ErrorUnauthorized, microsub.ErrorForbidden, microsub.ErrorInsufficientScope, microsub.ErrorInvalidRequest, microsub.ErrorNotFound:
+		return false
+	}
+	return true
+}
+
+func (c *Client) eventsRequest(ctx context.Context, lastEventID string, filter sse.Filter) (*http.Response, error) {
+	u := *c.MicrosubEndpoint
+	q := u.Query()
+	q.Add("action", "events")
+	for _, channel := range filter.Channels {
+		q.Add("channel[]", channel)
+	}
+	for _, event := range filter.Events {
+		q.Add("event[]", event)
+	}
+	if filter.IDsOnly {
+		q.Add("ids_only", "true")
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	req.Header.Add("Accept", "text/event-stream")
+	req.Header.Add("Cache-Control", "no-cache")
+	if lastEventID != "" {
+		req.Header.Add("Last-Event-ID", lastEventID)
+	}
+
+	if c.Logging {
+		x, _ := httputil.DumpRequestOut(req, true)
+		log.Printf("REQUEST:\n\n%s\n\n", x)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Logging {
+		// The body is the event stream, it doesn't end
+		x, _ := httputil.DumpResponse(res, false)
+		log.Printf("RESPONSE:\n\n%s\n\n", x)
+	}
+
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, readError(res)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+func TestClient_EventsReconnect(t *testing.T) {
+	var lock sync.Mutex
+	var requests []*http.Request
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r)
+		n := len(requests)
+		lock.Unlock()
+
+		switch n {
+		case 1:
+			fmt.Fprint(w, "retry: 10\n\nevent: mark read\nid: 1\ndata: {\"version\":1,\n")
+			fmt.Fprint(w, "data: \"channel\":\"home\",\"entries\":[\"a\"]}\n\n")
+		case 2:
+			// The server closes the connection without events
+		case 3:
+			fmt.Fprint(w, "event: delete channel\nid: 2\ndata: {\"version\":1,\"uid\":\"home\"}\n\n")
+		default:
+			http.Error(w, "Can't validate token", 401)
+		}
+	}))
+	defer server.Close()
+
+	c := Client{Token: "1234"}
+	c.MicrosubEndpoint, _ = url.Parse(server.URL + "/microsub")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, err := c.EventsContext(ctx, "", sse.Filter{Channels: []string{"home"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var messages []sse.Message
+	for msg := range events {
+		messages = append(messages, msg)
+	}
+
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, int64(1), messages[0].ID)
+		assert.Equal(t, microsub.ItemsEvent{Version: 1, Channel: "home", Entries: []string{"a"}}, messages[0].Object)
+		assert.Equal(t, int64(2), messages[1].ID)
+		assert.Equal(t, microsub.ChannelDeletedEvent{Version: 1, UID: "home"}, messages[1].Object)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if assert.Len(t, requests, 4) {
+		assert.Equal(t, "", requests[0].Header.Get("Last-Event-ID"))
+		assert.Equal(t, "1", requests[1].Header.Get("Last-Event-ID"))
+		assert.Equal(t, "1", requests[2].Header.Get("Last-Event-ID"))
+		assert.Equal(t, "2", requests[3].Header.Get("Last-Event-ID"))
+		assert.Equal(t, []string{"home"}, requests[0].URL.Query()["channel[]"])
+		assert.Equal(t, "Bearer 1234", requests[0].Header.Get("Authorization"))
+	}
+}
+
+func TestClient_EventsUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Can't validate token", 401)
+	}))
+	defer server.Close()
+
+	c := Client{Token: "1234"}
+	c.MicrosubEndpoint, _ = url.Parse(server.URL + "/microsub")
+
+	_, err := c.Events()
+	assert.Equal(t, microsub.ErrorUnauthorized, microsub.ErrorCode(err))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 3*time.Second, backoff(3*time.Second, 0))
+	assert.Equal(t, 12*time.Second, backoff(3*time.Second, 2))
+	assert.Equal(t, maxRetry, backoff(3*time.Second, 10))
+	assert.Equal(t, maxRetry, backoff(3*time.Second, 1000))
+}
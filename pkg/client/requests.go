@@ -11,7 +11,6 @@ import (
 	"strings"
 
 	"p83.nl/go/ekster/pkg/microsub"
-	"p83.nl/go/ekster/pkg/sse"
 )
 
 // Client is a HTTP client for Microsub
@@ -47,13 +46,21 @@ func (c *Client) microsubGetRequest(action string, args map[string]string) (*htt
 	}
 
 	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
 	if c.Logging {
 		x, _ := httputil.DumpResponse(res, true)
 		log.Printf("RESPONSE:\n\n%s\n\n", x)
 	}
 
-	return res, err
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, readError(res)
+	}
+
+	return res, nil
 }
 
 func (c *Client) microsubPostRequest(action string, args map[string]string) (*http.Response, error) {
@@ -80,6 +87,9 @@ func (c *Client) microsubPostRequest(action string, args map[string]string) (*ht
 	}
 
 	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
 	if c.Logging {
 		x, _ := httputil.DumpResponse(res, true)
@@ -87,11 +97,11 @@ func (c *Client) microsubPostRequest(action string, args map[string]string) (*ht
 	}
 
 	if res.StatusCode != 200 {
-		msg, _ := ioutil.ReadAll(res.Body)
-		return nil, fmt.Errorf("unsuccessful response: %d: %q", res.StatusCode, string(msg))
+		defer res.Body.Close()
+		return nil, readError(res)
 	}
 
-	return res, err
+	return res, nil
 }
 
 func (c *Client) microsubPostFormRequest(action string, args map[string]string, data url.Values) (*http.Response, error) {
@@ -111,15 +121,50 @@ func (c *Client) microsubPostFormRequest(action string, args map[string]string,
 	}
 
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
 	if res.StatusCode != 200 {
-		msg, _ := ioutil.ReadAll(res.Body)
-		return nil, fmt.Errorf("unsuccessful response: %d: %q", res.StatusCode, string(msg))
+		defer res.Body.Close()
+		return nil, readError(res)
+	}
+
+	return res, nil
+}
+
+// readError creates an error for an unsuccessful response. Callers can use
+// errors.As to get the *microsub.Error and inspect the error code.
+func readError(res *http.Response) error {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
+	}
+
+	var merr microsub.Error
+	if err := json.Unmarshal(body, &merr); err == nil && merr.Code != "" {
+		return &merr
+	}
+
+	// Not all servers return JSON errors, use the status code instead
+	code := ""
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		code = microsub.ErrorNotFound
+	case http.StatusBadRequest:
+		code = microsub.ErrorInvalidRequest
+	case http.StatusUnauthorized:
+		code = microsub.ErrorUnauthorized
+	case http.StatusForbidden:
+		code = microsub.ErrorForbidden
+	default:
+		return fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
 	}
 
-	return res, err
+	return &microsub.Error{Code: code, Description: strings.TrimSpace(string(body))}
 }
 
 // ChannelsGetList gets the channels from a Microsub server
@@ -130,13 +175,6 @@ func (c *Client) ChannelsGetList() ([]microsub.Channel, error) {
 		return []microsub.Channel{}, err
 	}
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return []microsub.Channel{}, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
-		}
-		return []microsub.Channel{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
-	}
 
 	type channelsResponse struct {
 		Channels []microsub.Channel `json:"channels"`
@@ -160,13 +198,6 @@ func (c *Client) TimelineGet(before, after, channel string) (microsub.Timeline,
 		return microsub.Timeline{}, err
 	}
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return microsub.Timeline{}, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
-		}
-		return microsub.Timeline{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
-	}
 	dec := json.NewDecoder(res.Body)
 	var timeline microsub.Timeline
 	err = dec.Decode(&timeline)
@@ -187,13 +218,6 @@ func (c *Client) PreviewURL(url string) (microsub.Timeline, error) {
 	defer res.Body.Close()
 
 	var timeline microsub.Timeline
-	if res.StatusCode != 200 {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return timeline, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
-		}
-		return timeline, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
-	}
 	dec := json.NewDecoder(res.Body)
 	err = dec.Decode(&timeline)
 	if err != nil {
@@ -208,16 +232,9 @@ func (c *Client) FollowGetList(channel string) ([]microsub.Feed, error) {
 	args["channel"] = channel
 	res, err := c.microsubGetRequest("follow", args)
 	if err != nil {
-		return []microsub.Feed{}, nil
+		return []microsub.Feed{}, err
 	}
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return []microsub.Feed{}, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
-		}
-		return []microsub.Feed{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
-	}
 	dec := json.NewDecoder(res.Body)
 	type followResponse struct {
 		Items []microsub.Feed `json:"items"`
@@ -225,7 +242,7 @@ func (c *Client) FollowGetList(channel string) ([]microsub.Feed, error) {
 	var response followResponse
 	err = dec.Decode(&response)
 	if err != nil {
-		return []microsub.Feed{}, nil
+		return []microsub.Feed{}, err
 	}
 	return response.Items, nil
 }
@@ -236,14 +253,14 @@ func (c *Client) ChannelsCreate(name string) (microsub.Channel, error) {
 	args["name"] = name
 	res, err := c.microsubPostRequest("channels", args)
 	if err != nil {
-		return microsub.Channel{}, nil
+		return microsub.Channel{}, err
 	}
 	defer res.Body.Close()
 	var channel microsub.Channel
 	dec := json.NewDecoder(res.Body)
 	err = dec.Decode(&channel)
 	if err != nil {
-		return microsub.Channel{}, nil
+		return microsub.Channel{}, err
 	}
 	return channel, nil
 }
@@ -352,33 +369,48 @@ func (c *Client) MarkRead(channel string, uids []string) error {
 	return nil
 }
 
-// Events open an event channel to the server.
-func (c *Client) Events() (chan sse.Message, error) {
-
-	ch := make(chan sse.Message)
-
-	errorCounter := 0
-	go func() {
-		for {
-			res, err := c.microsubGetRequest("events", nil)
-			if err != nil {
-				log.Printf("could not request events: %+v", err)
-				errorCounter++
-				if errorCounter > 5 {
-					break
-				}
-				continue
-			}
-
-			err = sse.Reader(res.Body, ch)
-			if err != nil {
-				log.Printf("could not create reader: %+v", err)
-				break
-			}
-		}
-
-		close(ch)
-	}()
-
-	return ch, nil
+// MarkUnread marks items as unread
+func (c *Client) MarkUnread(channel string, uids []string) error {
+	return c.timelineItems("mark_unread", channel, uids)
+}
+
+// RemoveItems removes items from the timeline
+func (c *Client) RemoveItems(channel string, uids []string) error {
+	return c.timelineItems("remove", channel, uids)
+}
+
+func (c *Client) timelineItems(method, channel string, uids []string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = method
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("entry[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest("timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// ChannelsOrder changes the order of the channels
+func (c *Client) ChannelsOrder(uids []string) error {
+	args := make(map[string]string)
+	args["method"] = "order"
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("channels[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest("channels", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
 }
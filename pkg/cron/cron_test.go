@@ -0,0 +1,56 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestSchedule_Next(t *testing.T) {
+	tests := []struct {
+		spec string
+		from string
+		next string
+	}{
+		{"* * * * *", "2020-03-01 10:00", "2020-03-01 10:01"},
+		{"0 7 * * *", "2020-03-01 06:59", "2020-03-01 07:00"},
+		{"0 7 * * *", "2020-03-01 07:00", "2020-03-02 07:00"},
+		{"@daily", "2020-12-31 12:00", "2021-01-01 00:00"},
+		{"@hourly", "2020-03-01 10:30", "2020-03-01 11:00"},
+		{"*/15 9-17 * * 1-5", "2020-03-06 17:50", "2020-03-09 09:00"},
+		{"30 8 * * 7", "2020-03-02 00:00", "2020-03-08 08:30"},
+		{"0 0 29 2 *", "2020-03-01 00:00", "2024-02-29 00:00"},
+		{"0 12 1,15 * 1", "2020-03-03 00:00", "2020-03-09 12:00"},
+		{"0 12 1,15 * 1", "2020-03-10 00:00", "2020-03-15 12:00"},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if assert.NoError(t, err, tt.spec) {
+			assert.Equal(t, date(tt.next), s.Next(date(tt.from)), tt.spec)
+		}
+	}
+}
+
+func TestSchedule_NextNever(t *testing.T) {
+	s, err := Parse("0 0 31 2 *")
+	if assert.NoError(t, err) {
+		assert.True(t, s.Next(date("2020-01-01 00:00")).IsZero())
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@yearly"} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -58,6 +58,8 @@ func simplifyContent(k string, v []interface{}) *microsub.Content {
 
 	var content microsub.Content
 	switch t := v[0].(type) {
+	case string:
+		content.Text = t
 	case map[string]string:
 		if text, e := t["value"]; e {
 			content.Text = text
@@ -193,8 +195,14 @@ func simplifyToItem(itemType string, item map[string][]interface{}, author micro
 		case "photo":
 			if resultPtr := itemPtr(&feedItem, k); resultPtr != nil {
 				for _, c := range v {
-					if photo, ok := c.(string); ok {
+					switch photo := c.(type) {
+					case string:
 						*resultPtr = append(*resultPtr, photo)
+					case map[string]interface{}:
+						// Micropub JSON allows {"value": url, "alt": text}
+						if value, ok := photo["value"].(string); ok {
+							*resultPtr = append(*resultPtr, value)
+						}
 					}
 				}
 			}
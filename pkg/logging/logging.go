@@ -0,0 +1,372 @@
+// Package logging contains a structured logger with levels.
+//
+// Messages are logged with key value pairs:
+//
+//	logger.Info("fetched feed", "url", feedURL, "status", resp.StatusCode)
+//
+// Tokens and secrets in messages and values are redacted before they are
+// written. Warnings and errors can be kept in a Ring, to show them in the
+// user interface.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the importance of a log message
+type Level int
+
+// The levels of log messages
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel returns the level with the name s
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format is the format of the log output
+type Format string
+
+// The formats of the log output
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// Field is a key value pair of a log message
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Entry is a log message
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// FieldsString returns the fields in the text format
+func (e Entry) FieldsString() string {
+	var sb strings.Builder
+	for i, f := range e.Fields {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(f.Key)
+		sb.WriteByte('=')
+		sb.WriteString(quote(f.Value))
+	}
+	return sb.String()
+}
+
+// output contains the settings that are shared by a logger and the loggers
+// created from it with With.
+type output struct {
+	lock   sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+	ring   *Ring
+}
+
+// Logger writes log messages
+type Logger struct {
+	out    *output
+	fields []Field
+}
+
+// New creates a logger that writes messages of level and higher to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: level, format: FormatText}}
+}
+
+var defaultLogger = New(os.Stderr, LevelInfo)
+
+// Default returns the default logger. Changing the settings of the default
+// logger changes all loggers created from it.
+func Default() *Logger {
+	return defaultLogger
+}
+
+// SetOutput changes the writer of the logger
+func (l *Logger) SetOutput(w io.Writer) {
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.w = w
+}
+
+// SetLevel changes the minimum level of messages that are written
+func (l *Logger) SetLevel(level Level) {
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.level = level
+}
+
+// SetFormat changes the format of the output
+func (l *Logger) SetFormat(format Format) {
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.format = format
+}
+
+// SetRing keeps the messages of the ring's level and higher in the ring
+func (l *Logger) SetRing(ring *Ring) {
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.ring = ring
+}
+
+// With returns a logger that adds the key value pairs to all messages
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]Field, 0, len(l.fields)+len(keyValues)/2)
+	fields = append(fields, l.fields...)
+	fields = append(fields, makeFields(keyValues)...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Debug logs a message with key value pairs at debug level
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(LevelDebug, msg, keyValues)
+}
+
+// Info logs a message with key value pairs at info level
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(LevelInfo, msg, keyValues)
+}
+
+// Warn logs a message with key value pairs at warn level
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(LevelWarn, msg, keyValues)
+}
+
+// Error logs a message with key value pairs at error level
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(LevelError, msg, keyValues)
+}
+
+// Debugf logs a formatted message at debug level
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args)
+}
+
+// Infof logs a formatted message at info level
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args)
+}
+
+// Warnf logs a formatted message at warn level
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args)
+}
+
+// Errorf logs a formatted message at error level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args)
+}
+
+func (l *Logger) logf(level Level, format string, args []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	l.write(level, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), nil)
+}
+
+func (l *Logger) log(level Level, msg string, keyValues []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	l.write(level, msg, keyValues)
+}
+
+func (l *Logger) enabled(level Level) bool {
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	return level >= l.out.level || (l.out.ring != nil && level >= l.out.ring.level)
+}
+
+func (l *Logger) write(level Level, msg string, keyValues []interface{}) {
+	entry := Entry{
+		Time:    time.Now().UTC(),
+		Level:   level,
+		Message: Redact(msg),
+		Fields:  append(append([]Field(nil), l.fields...), makeFields(keyValues)...),
+	}
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+
+	if l.out.ring != nil {
+		l.out.ring.add(entry)
+	}
+
+	if level < l.out.level {
+		return
+	}
+
+	var line string
+	if l.out.format == FormatJSON {
+		line = formatJSON(entry)
+	} else {
+		line = formatText(entry)
+	}
+	_, _ = io.WriteString(l.out.w, line)
+}
+
+func formatText(e Entry) string {
+	var sb strings.Builder
+	sb.WriteString("time=")
+	sb.WriteString(e.Time.Format(time.RFC3339Nano))
+	sb.WriteString(" level=")
+	sb.WriteString(e.Level.String())
+	sb.WriteString(" msg=")
+	sb.WriteString(quote(e.Message))
+	if len(e.Fields) > 0 {
+		sb.WriteByte(' ')
+		sb.WriteString(e.FieldsString())
+	}
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+func formatJSON(e Entry) string {
+	var sb strings.Builder
+	writeJSONField := func(key, value string) {
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(value)
+		sb.Write(k)
+		sb.WriteByte(':')
+		sb.Write(v)
+	}
+	sb.WriteByte('{')
+	writeJSONField("time", e.Time.Format(time.RFC3339Nano))
+	sb.WriteByte(',')
+	writeJSONField("level", e.Level.String())
+	sb.WriteByte(',')
+	writeJSONField("msg", e.Message)
+	for _, f := range e.Fields {
+		sb.WriteByte(',')
+		writeJSONField(f.Key, f.Value)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// quote quotes s when it contains spaces, quotes or equal signs
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func makeFields(keyValues []interface{}) []Field {
+	var fields []Field
+	for i := 0; i < len(keyValues); i += 2 {
+		key, ok := keyValues[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyValues[i])
+		}
+		if i+1 == len(keyValues) {
+			fields = append(fields, Field{Key: "!BADKEY", Value: Redact(key)})
+			break
+		}
+		fields = append(fields, Field{Key: key, Value: redactValue(key, keyValues[i+1])})
+	}
+	return fields
+}
+
+func formatValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case error:
+		if x == nil {
+			return "<nil>"
+		}
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// Writer returns a writer that logs every line that is written to it. It's
+// used with log.SetOutput to send the messages of the standard log package to
+// the logger. Lines that look like errors are logged at warn level, other
+// lines at level.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		level := w.level
+		lower := strings.ToLower(line)
+		if level < LevelWarn && (strings.Contains(lower, "error") || strings.Contains(lower, "could not") || strings.Contains(lower, "failed")) {
+			level = LevelWarn
+		}
+		w.logger.log(level, line, nil)
+	}
+	return len(p), nil
+}
+
+type loggerKey struct{}
+
+// NewContext returns a context that contains the logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger of the context, or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return Default()
+}
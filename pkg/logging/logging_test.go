@@ -0,0 +1,194 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "info", "warn", "error"} {
+		level, err := ParseLevel(name)
+		if assert.NoError(t, err) {
+			assert.Equal(t, name, level.String())
+		}
+	}
+	level, err := ParseLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, level)
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestLogger_Text(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+
+	logger.Debug("not logged")
+	logger.With("user", "alice").Info("fetched feed", "url", "https://example.com/", "status", 200, "err", errors.New("no items"))
+	logger.Warnf("could not fetch %s", "https://example.com/")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `level=info msg="fetched feed" user=alice url=https://example.com/ status=200 err="no items"`)
+		assert.Contains(t, lines[1], `level=warn msg="could not fetch https://example.com/"`)
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelDebug)
+	logger.SetFormat(FormatJSON)
+
+	logger.Debug("message", "key", "value with \"quotes\"")
+
+	var line map[string]string
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &line)) {
+		assert.Equal(t, "debug", line["level"])
+		assert.Equal(t, "message", line["msg"])
+		assert.Equal(t, `value with "quotes"`, line["key"])
+		assert.NotEmpty(t, line["time"])
+	}
+}
+
+func TestLogger_SetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelWarn)
+	child := logger.With("a", 1)
+
+	child.Info("hidden")
+	assert.Empty(t, buf.String())
+
+	logger.SetLevel(LevelInfo)
+	child.Info("shown")
+	assert.Contains(t, buf.String(), "msg=shown a=1")
+}
+
+func TestLogger_Redact(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+
+	logger.Info("request", "access_token", "abc123", "Authorization", "Bearer abc123", "session", "xyz")
+	logger.Infof("token not accepted: Bearer abc123")
+	logger.Infof("callback https://example.com/cb?code=abc123&state=s")
+	logger.Infof("%#v", struct{ Me, AccessToken string }{"https://example.com/", "abc123"})
+
+	out := buf.String()
+	assert.NotContains(t, out, "abc123")
+	assert.NotContains(t, out, "xyz")
+	assert.Contains(t, out, "access_token=[REDACTED]")
+	assert.Contains(t, out, "Bearer [REDACTED]")
+	assert.Contains(t, out, "code=[REDACTED]&state=s")
+	assert.Contains(t, out, "https://example.com/")
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"Authorization: Bearer abc.def", "Authorization: Bearer [REDACTED]"},
+		{"/micropub?access_token=abc&q=config", "/micropub?access_token=[REDACTED]&q=config"},
+		{`{"access_token":"abc","me":"https://example.com/"}`, `{"access_token":"[REDACTED]","me":"https://example.com/"}`},
+		{"hub.secret=abc hub.mode=subscribe", "hub.secret=[REDACTED] hub.mode=subscribe"},
+		{"status_code=200", "status_code=200"},
+		{"could not get token: dial tcp", "could not get token: dial tcp"},
+		{`{Me:"https://example.com/" AccessToken:"abc"}`, `{Me:"https://example.com/" AccessToken:"[REDACTED]"}`},
+		{"nothing secret here", "nothing secret here"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.out, Redact(test.in), test.in)
+	}
+}
+
+func TestRing(t *testing.T) {
+	ring := NewRing(3, LevelWarn)
+	logger := New(&bytes.Buffer{}, LevelError)
+	logger.SetRing(ring)
+
+	logger.Info("info")
+	for i := 1; i <= 4; i++ {
+		logger.Warnf("warning %d", i)
+	}
+
+	entries := ring.Entries()
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, "warning 4", entries[0].Message)
+		assert.Equal(t, "warning 2", entries[2].Message)
+		assert.Equal(t, LevelWarn, entries[0].Level)
+	}
+}
+
+func TestRing_NotFull(t *testing.T) {
+	ring := NewRing(10, LevelWarn)
+	logger := New(&bytes.Buffer{}, LevelInfo)
+	logger.SetRing(ring)
+
+	logger.Error("first", "key", "value")
+	logger.Error("second")
+
+	entries := ring.Entries()
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "second", entries[0].Message)
+		assert.Equal(t, "key=value", entries[1].FieldsString())
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+	ring := NewRing(10, LevelWarn)
+	logger.SetRing(ring)
+
+	std := log.New(logger.Writer(LevelInfo), "", 0)
+	std.Println("started")
+	std.Printf("could not parse feed: %v", errors.New("EOF"))
+
+	assert.Contains(t, buf.String(), "level=info msg=started")
+	assert.Contains(t, buf.String(), `level=warn msg="could not parse feed: EOF"`)
+	assert.Len(t, ring.Entries(), 1)
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo)
+
+	var requestID string
+	handler := Middleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = RequestID(r.Context())
+		FromContext(r.Context()).Info("handled")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/microsub", nil))
+	assert.Len(t, requestID, 16)
+	assert.Equal(t, requestID, w.Header().Get(RequestIDHeader))
+	assert.Contains(t, buf.String(), fmt.Sprintf("msg=handled request_id=%s", requestID))
+
+	r := httptest.NewRequest("GET", "/microsub", nil)
+	r.Header.Set(RequestIDHeader, "abc-123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "abc-123", requestID)
+
+	r = httptest.NewRequest("GET", "/microsub", nil)
+	r.Header.Set(RequestIDHeader, "<script>")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.NotEqual(t, "<script>", requestID)
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Equal(t, Default(), FromContext(context.Background()))
+
+	logger := New(&bytes.Buffer{}, LevelInfo)
+	assert.Equal(t, logger, FromContext(NewContext(context.Background(), logger)))
+}
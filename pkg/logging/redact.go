@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces the secrets in log messages
+const Redacted = "[REDACTED]"
+
+var redactPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Authorization headers
+	{regexp.MustCompile(`(?i)\b(bearer\s+)[^\s"',;]+`), "${1}" + Redacted},
+	// Query strings and form posts
+	{regexp.MustCompile(`(?i)\b((?:access_token|refresh_token|token|code|client_secret|secret|hub\.secret|password|session)=)[^&\s"',;]+`), "${1}" + Redacted},
+	// JSON
+	{regexp.MustCompile(`(?i)("(?:access_token|refresh_token|token|code|client_secret|secret|password)"\s*:\s*")[^"]*`), "${1}" + Redacted},
+	// Go structs printed with %v or %#v
+	{regexp.MustCompile(`\b((?:AccessToken|RefreshToken|Token|Secret|Password|ClientSecret):"?)[^"\s,}]+`), "${1}" + Redacted},
+}
+
+// Redact removes tokens and secrets from s
+func Redact(s string) string {
+	for _, p := range redactPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+var sensitiveKeys = []string{"token", "secret", "password", "authorization", "cookie", "session"}
+
+// isSensitive returns true when the values of key should never be logged
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactValue(key string, v interface{}) string {
+	if isSensitive(key) {
+		return Redacted
+	}
+	return Redact(formatValue(v))
+}
@@ -0,0 +1,49 @@
+package logging
+
+import "sync"
+
+// Ring keeps the last log messages of a minimum level in memory
+type Ring struct {
+	lock    sync.Mutex
+	level   Level
+	entries []Entry
+	next    int
+	full    bool
+}
+
+// NewRing creates a ring that keeps the last size messages of level and higher
+func NewRing(size int, level Level) *Ring {
+	return &Ring{level: level, entries: make([]Entry, size)}
+}
+
+func (r *Ring) add(e Entry) {
+	if e.Level < r.level || len(r.entries) == 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Entries returns the messages in the ring, the newest message first
+func (r *Ring) Entries() []Entry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+
+	entries := make([]Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return entries
+}
@@ -0,0 +1,468 @@
+// Package metrics contains counters, gauges and histograms that can be
+// exported in the Prometheus text format.
+//
+// Metrics are created with labels, and the values are kept per combination of
+// label values:
+//
+//	fetches := metrics.NewCounter("fetch_total", "Number of fetches", "host")
+//	fetches.With("example.com").Inc()
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are the default buckets for histograms of durations in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry contains metrics
+type Registry struct {
+	lock    sync.RWMutex
+	metrics map[string]metric
+}
+
+// DefaultRegistry is the registry that is used by NewCounter, NewGauge and
+// NewHistogram
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// register adds the metric, it panics when a metric with the same name exists
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, e := r.metrics[m.name()]; e {
+		panic(fmt.Sprintf("metrics: %s is registered twice", m.name()))
+	}
+	r.metrics[m.name()] = m
+}
+
+// WriteTo writes all metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.RLock()
+	var names []string
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.lock.RUnlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.(*bufio.Writer).Flush()
+}
+
+// Handler returns a http.Handler that serves the metrics of the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+// Handler serves the metrics of the DefaultRegistry
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// vec keeps the values of a metric for each combination of label values
+type vec struct {
+	metricName string
+	help       string
+	typ        string
+	labels     []string
+
+	lock   sync.Mutex
+	values map[string]*labeled
+}
+
+type labeled struct {
+	labelValues []string
+	value       interface{}
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{metricName: name, help: help, typ: typ, labels: labels, values: make(map[string]*labeled)}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// get returns the value for the label values, it's created with create when
+// it doesn't exist
+func (v *vec) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.metricName, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if l, e := v.values[key]; e {
+		return l.value
+	}
+
+	l := &labeled{labelValues: append([]string(nil), labelValues...), value: create()}
+	v.values[key] = l
+	return l.value
+}
+
+// each calls fn for all values, sorted by label values
+func (v *vec) each(fn func(labels string, value interface{})) {
+	v.lock.Lock()
+	var keys []string
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*labeled, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, v.values[key])
+	}
+	v.lock.Unlock()
+
+	for _, l := range values {
+		fn(formatLabels(v.labels, l.labelValues), l.value)
+	}
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.metricName, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.metricName, v.typ)
+}
+
+// value is a float64 that can be changed concurrently
+type value struct {
+	lock sync.Mutex
+	v    float64
+}
+
+func (v *value) add(delta float64) {
+	v.lock.Lock()
+	v.v += delta
+	v.lock.Unlock()
+}
+
+func (v *value) set(f float64) {
+	v.lock.Lock()
+	v.v = f
+	v.lock.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.v
+}
+
+// CounterVec is a counter with labels
+type CounterVec struct {
+	vec
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	v value
+}
+
+// NewCounter creates a counter in the DefaultRegistry
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounter(name, help, labels...)
+}
+
+// NewCounter creates a counter in the registry
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// With returns the counter for the label values
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return c.get(labelValues, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, v interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, labels, formatFloat(v.(*Counter).Value()))
+	})
+}
+
+// Inc adds 1 to the counter
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add adds delta to the counter, delta should not be negative
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters can't go down")
+	}
+	c.v.add(delta)
+}
+
+// Value returns the value of the counter
+func (c *Counter) Value() float64 {
+	return c.v.get()
+}
+
+// GaugeVec is a gauge with labels
+type GaugeVec struct {
+	vec
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	v value
+}
+
+// NewGauge creates a gauge in the DefaultRegistry
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGauge(name, help, labels...)
+}
+
+// NewGauge creates a gauge in the registry
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// With returns the gauge for the label values
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return g.get(labelValues, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, v interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, labels, formatFloat(v.(*Gauge).Value()))
+	})
+}
+
+// Set sets the value of the gauge
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// SetToCurrentTime sets the gauge to the current unix time in seconds
+func (g *Gauge) SetToCurrentTime() {
+	g.v.set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+// Inc adds 1 to the gauge
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec subtracts 1 from the gauge
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+// Add adds delta to the gauge
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+// Value returns the value of the gauge
+func (g *Gauge) Value() float64 {
+	return g.v.get()
+}
+
+// HistogramVec is a histogram with labels
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewHistogram creates a histogram in the DefaultRegistry. The buckets are
+// the upper bounds of the buckets, in increasing order.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram creates a histogram in the registry
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	h := &HistogramVec{vec: newVec(name, help, "histogram", labels), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// With returns the histogram for the label values
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.get(labelValues, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, v interface{}) {
+		hist := v.(*Histogram)
+		hist.lock.Lock()
+		counts := append([]uint64(nil), hist.counts...)
+		count, sum := hist.count, hist.sum
+		hist.lock.Unlock()
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, withLabel(labels, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, withLabel(labels, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, labels, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, labels, count)
+	})
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(f float64) {
+	i := sort.SearchFloat64s(h.buckets, f)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += f
+}
+
+// ObserveSince observes the number of seconds since start
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// GaugeFunc is a gauge without labels of which the value is returned by a function
+type GaugeFunc struct {
+	vec
+	fn func() float64
+}
+
+// NewGaugeFunc creates a gauge in the DefaultRegistry that calls fn for its value
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return DefaultRegistry.NewGaugeFunc(name, help, fn)
+}
+
+// NewGaugeFunc creates a gauge in the registry that calls fn for its value
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{vec: newVec(name, help, "gauge", nil), fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// withLabel adds a label to formatted labels
+func withLabel(labels, name, value string) string {
+	label := name + `="` + escapeLabelValue(value) + `"`
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
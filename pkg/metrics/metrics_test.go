@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	fetches := r.NewCounter("fetch_total", "Number of fetches", "host", "status")
+	fetches.With("example.com", "200").Inc()
+	fetches.With("example.com", "200").Add(2)
+	fetches.With("example.org", "error").Inc()
+
+	clients := r.NewGauge("clients", "Connected clients")
+	clients.With().Inc()
+	clients.With().Inc()
+	clients.With().Dec()
+
+	duration := r.NewHistogram("duration_seconds", "Duration", []float64{0.1, 1}, "command")
+	duration.With("GET").Observe(0.05)
+	duration.With("GET").Observe(0.5)
+	duration.With("GET").Observe(5)
+
+	r.NewGaugeFunc("answer", "The answer", func() float64 { return 42 })
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	assert.NoError(t, err)
+
+	expected := `# HELP answer The answer
+# TYPE answer gauge
+answer 42
+# HELP clients Connected clients
+# TYPE clients gauge
+clients 1
+# HELP duration_seconds Duration
+# TYPE duration_seconds histogram
+duration_seconds_bucket{command="GET",le="0.1"} 1
+duration_seconds_bucket{command="GET",le="1"} 2
+duration_seconds_bucket{command="GET",le="+Inf"} 3
+duration_seconds_sum{command="GET"} 5.55
+duration_seconds_count{command="GET"} 3
+# HELP fetch_total Number of fetches
+# TYPE fetch_total counter
+fetch_total{host="example.com",status="200"} 3
+fetch_total{host="example.org",status="error"} 1
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("c", "Help with \\ and\nnewline", "l").With("a\"b\\c\nd").Inc()
+
+	var buf bytes.Buffer
+	_, _ = r.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `# HELP c Help with \\ and\nnewline`)
+	assert.Contains(t, buf.String(), `c{l="a\"b\\c\nd"} 1`)
+}
+
+func TestRegistry_Panics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("c", "counter", "l")
+
+	assert.Panics(t, func() { r.NewGauge("c", "again") })
+	assert.Panics(t, func() { c.With() })
+	assert.Panics(t, func() { c.With("a").Add(-1) })
+	assert.Panics(t, func() { r.NewHistogram("h", "histogram", []float64{1, 0.5}) })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("c", "counter").With().Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "c 1\n")
+}
@@ -0,0 +1,87 @@
+package microsub
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes used in error responses
+const (
+	ErrorNotFound          = "not_found"
+	ErrorInvalidRequest    = "invalid_request"
+	ErrorUnauthorized      = "unauthorized"
+	ErrorForbidden         = "forbidden"
+	ErrorInsufficientScope = "insufficient_scope"
+	ErrorInternal          = "internal_server_error"
+)
+
+// Error is an error response of a Microsub server. Backends return it to
+// let the server respond with the right status code.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// Error returns the description of the error
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// StatusCode returns the HTTP status code for the error
+func (e *Error) StatusCode() int {
+	switch e.Code {
+	case ErrorNotFound:
+		return http.StatusNotFound
+	case ErrorInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorUnauthorized:
+		return http.StatusUnauthorized
+	case ErrorForbidden, ErrorInsufficientScope:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// NotFoundError returns an error for a channel, feed or item that does not exist
+func NotFoundError(format string, a ...interface{}) error {
+	return &Error{Code: ErrorNotFound, Description: fmt.Sprintf(format, a...)}
+}
+
+// InvalidRequestError returns an error for a request with missing or wrong parameters
+func InvalidRequestError(format string, a ...interface{}) error {
+	return &Error{Code: ErrorInvalidRequest, Description: fmt.Sprintf(format, a...)}
+}
+
+// UnauthorizedError returns an error for a request without a valid access token
+func UnauthorizedError(format string, a ...interface{}) error {
+	return &Error{Code: ErrorUnauthorized, Description: fmt.Sprintf(format, a...)}
+}
+
+// ForbiddenError returns an error for a request that is not allowed for the user
+func ForbiddenError(format string, a ...interface{}) error {
+	return &Error{Code: ErrorForbidden, Description: fmt.Sprintf(format, a...)}
+}
+
+// InsufficientScopeError returns an error for an access token without the required scope
+func InsufficientScopeError(scope string) error {
+	return &Error{
+		Code:        ErrorInsufficientScope,
+		Description: fmt.Sprintf("the access token needs scope %q for this request", scope),
+		Scope:       scope,
+	}
+}
+
+// ErrorCode returns the error code of err, or an empty string when err is
+// not an *Error.
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
@@ -0,0 +1,25 @@
+package microsub
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError_StatusCode(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, NotFoundError("channel %s", "0001").(*Error).StatusCode())
+	assert.Equal(t, http.StatusBadRequest, InvalidRequestError("missing").(*Error).StatusCode())
+	assert.Equal(t, http.StatusUnauthorized, UnauthorizedError("token").(*Error).StatusCode())
+	assert.Equal(t, http.StatusForbidden, ForbiddenError("me").(*Error).StatusCode())
+	assert.Equal(t, http.StatusForbidden, InsufficientScopeError("read").(*Error).StatusCode())
+	assert.Equal(t, http.StatusInternalServerError, (&Error{Code: "unknown"}).StatusCode())
+}
+
+func TestErrorCode(t *testing.T) {
+	err := fmt.Errorf("timeline: %w", NotFoundError("channel %s does not exist", "0001"))
+	assert.Equal(t, ErrorNotFound, ErrorCode(err))
+	assert.Equal(t, "", ErrorCode(fmt.Errorf("other error")))
+	assert.Equal(t, "not_found: channel 0001 does not exist", NotFoundError("channel %s does not exist", "0001").Error())
+}
@@ -0,0 +1,128 @@
+package microsub
+
+import (
+	"encoding/json"
+)
+
+// The names of the events in the event stream
+const (
+	EventNewChannel       = "new channel"
+	EventUpdateChannel    = "update channel"
+	EventDeleteChannel    = "delete channel"
+	EventOrderChannels    = "order channels"
+	EventNewItem          = "new item"
+	EventNewItemInChannel = "new item in channel"
+	EventMarkRead         = "mark read"
+	EventMarkUnread       = "mark unread"
+	EventRemoveItems      = "remove items"
+	EventFollow           = "follow"
+	EventUnfollow         = "unfollow"
+	EventUpdateSettings   = "update settings"
+)
+
+// EventVersion is the version of the payloads of the events
+const EventVersion = 1
+
+// ChannelEvent is the payload of "new channel" and "update channel"
+type ChannelEvent struct {
+	Version int     `json:"version"`
+	Channel Channel `json:"channel"`
+}
+
+// ChannelDeletedEvent is the payload of "delete channel"
+type ChannelDeletedEvent struct {
+	Version int    `json:"version"`
+	UID     string `json:"uid"`
+}
+
+// ChannelsOrderEvent is the payload of "order channels", it contains the uids
+// of the channels in the new order
+type ChannelsOrderEvent struct {
+	Version  int      `json:"version"`
+	Channels []string `json:"channels"`
+}
+
+// NewItemEvent is the payload of "new item". Clients that only want ids
+// receive the item with only _id and uid.
+type NewItemEvent struct {
+	Item    Item   `json:"item"`
+	Channel string `json:"channel"`
+}
+
+// ItemsEvent is the payload of "mark read", "mark unread" and "remove items",
+// Entries are the ids of the items
+type ItemsEvent struct {
+	Version int      `json:"version"`
+	Channel string   `json:"channel"`
+	Entries []string `json:"entries"`
+}
+
+// FollowEvent is the payload of "follow" and "unfollow"
+type FollowEvent struct {
+	Version int    `json:"version"`
+	Channel string `json:"channel"`
+	Feed    Feed   `json:"feed"`
+}
+
+// ChannelSettings are the settings of a channel in ekster
+type ChannelSettings struct {
+	ExcludeRegex string   `json:"exclude_regex,omitempty"`
+	IncludeRegex string   `json:"include_regex,omitempty"`
+	ExcludeType  []string `json:"exclude_type,omitempty"`
+	ChannelType  string   `json:"channel_type,omitempty"`
+}
+
+// SettingsEvent is the payload of "update settings"
+type SettingsEvent struct {
+	Version  int             `json:"version"`
+	Channel  string          `json:"channel"`
+	Settings ChannelSettings `json:"settings"`
+}
+
+// DecodeEvent decodes the data of event into the type of its payload. The
+// payload of "new item in channel" is the Channel with its unread count. It
+// returns nil for events without a type, like "ping".
+func DecodeEvent(event string, data []byte) (interface{}, error) {
+	var v interface{}
+	var err error
+	switch event {
+	case EventNewChannel, EventUpdateChannel:
+		var e ChannelEvent
+		err = json.Unmarshal(data, &e)
+		v = e
+	case EventDeleteChannel:
+		var e ChannelDeletedEvent
+		err = json.Unmarshal(data, &e)
+		v = e
+	case EventOrderChannels:
+		var e ChannelsOrderEvent
+		err = json.Unmarshal(data, &e)
+		v = e
+	case EventNewItem:
+		var e NewItemEvent
+		err = json.Unmarshal(data, &e)
+		v = e
+	case EventNewItemInChannel:
+		var e Channel
+		err = json.Unmarshal(data, &e)
+		v = e
+	case EventMarkRead, EventMarkUnread, EventRemoveItems:
+		var e ItemsEvent
+		err = json.Unmarshal(data, &e)
+		v = e
+	case EventFollow, EventUnfollow:
+		var e FollowEvent
+		err = json.Unmarshal(data, &e)
+		v = e
+	case EventUpdateSettings:
+		var e SettingsEvent
+		err = json.Unmarshal(data, &e)
+		v = e
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,43 @@
+package microsub
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	tests := []struct {
+		event string
+		value interface{}
+	}{
+		{EventNewChannel, ChannelEvent{Version: EventVersion, Channel: Channel{UID: "0001", Name: "Home"}}},
+		{EventDeleteChannel, ChannelDeletedEvent{Version: EventVersion, UID: "0001"}},
+		{EventOrderChannels, ChannelsOrderEvent{Version: EventVersion, Channels: []string{"0002", "0001"}}},
+		{EventNewItem, NewItemEvent{Item: Item{ID: "1", Type: "entry"}, Channel: "0001"}},
+		{EventMarkUnread, ItemsEvent{Version: EventVersion, Channel: "0001", Entries: []string{"1", "2"}}},
+		{EventUnfollow, FollowEvent{Version: EventVersion, Channel: "0001", Feed: Feed{Type: "feed", URL: "https://example.com/"}}},
+		{EventUpdateSettings, SettingsEvent{Version: EventVersion, Channel: "0001", Settings: ChannelSettings{ExcludeType: []string{"like"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			data, err := json.Marshal(tt.value)
+			if assert.NoError(t, err) {
+				v, err := DecodeEvent(tt.event, data)
+				if assert.NoError(t, err) {
+					assert.Equal(t, tt.value, v)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeEvent_Unknown(t *testing.T) {
+	v, err := DecodeEvent("ping", []byte(`{"ping":"ping"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	_, err = DecodeEvent(EventMarkRead, []byte(`{"entries":1}`))
+	assert.Error(t, err)
+}
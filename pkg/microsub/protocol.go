@@ -112,10 +112,13 @@ type Microsub interface {
 	ChannelsCreate(name string) (Channel, error)
 	ChannelsUpdate(uid, name string) (Channel, error)
 	ChannelsDelete(uid string) error
+	ChannelsOrder(uids []string) error
 
 	TimelineGet(before, after, channel string) (Timeline, error)
 
 	MarkRead(channel string, entry []string) error
+	MarkUnread(channel string, entry []string) error
+	RemoveItems(channel string, entry []string) error
 
 	FollowGetList(uid string) ([]Feed, error)
 	FollowURL(uid string, url string) (Feed, error)
@@ -0,0 +1,145 @@
+// Package netguard prevents requests to addresses on the local network.
+//
+// Urls from other users, like webhooks, push endpoints and webmention
+// sources, should only be fetched on the public internet. CheckURL checks an
+// url before it's saved, DialContext checks the address again when the
+// connection is made, so a name that resolves to a different address later is
+// also rejected.
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrNotPublic is returned for an address that is not on the public internet
+var ErrNotPublic = errors.New("address is not public")
+
+var blocked []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // this network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // private
+		"192.0.0.0/24",   // protocol assignments
+		"192.168.0.0/16", // private
+		"198.18.0.0/15",  // benchmarking
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved and broadcast
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"64:ff9b::/96",   // NAT64
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+		"ff00::/8",       // multicast
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		blocked = append(blocked, n)
+	}
+}
+
+// IsPublic returns true when ip is an address on the public internet
+func IsPublic(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range blocked {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsPublicHost returns false when host is an address that is not public, or
+// localhost. Other names are not resolved, use CheckHost for them.
+func IsPublicHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return IsPublic(ip)
+	}
+	return !strings.EqualFold(strings.TrimSuffix(host, "."), "localhost")
+}
+
+// CheckHost returns an error when host is an address that is not public, or a
+// name that resolves to such an address
+func CheckHost(ctx context.Context, host string) error {
+	if !IsPublicHost(host) {
+		return fmt.Errorf("%s: %w", host, ErrNotPublic)
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !IsPublic(addr.IP) {
+			return fmt.Errorf("%s resolves to %s: %w", host, addr.IP, ErrNotPublic)
+		}
+	}
+	return nil
+}
+
+// CheckURL returns an error when rawurl is not an http(s) url of a public host
+func CheckURL(ctx context.Context, rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("%q is not a valid http(s) url", rawurl)
+	}
+	return CheckHost(ctx, u.Hostname())
+}
+
+// control is called by the dialer after the name is resolved, with the
+// address it connects to
+func control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublic(ip) {
+		return fmt.Errorf("%s: %w", host, ErrNotPublic)
+	}
+	return nil
+}
+
+// DialContext connects to address like net.Dialer, but refuses connections to
+// addresses that are not public
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   control,
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// Client returns an http client that only connects to public addresses. It
+// doesn't use a proxy, because the proxy would connect to the address.
+func Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsPublic(net.ParseIP(tt.ip)))
+		})
+	}
+}
+
+func TestIsPublicHost(t *testing.T) {
+	assert.True(t, IsPublicHost("93.184.216.34"))
+	assert.True(t, IsPublicHost("push.example.net"))
+	assert.False(t, IsPublicHost("127.0.0.1"))
+	assert.False(t, IsPublicHost("fe80::1"))
+	assert.False(t, IsPublicHost("localhost"))
+	assert.False(t, IsPublicHost("LOCALHOST."))
+}
+
+func TestCheckURL(t *testing.T) {
+	ctx := context.Background()
+	assert.NoError(t, CheckURL(ctx, "https://93.184.216.34/hook"))
+	assert.True(t, errors.Is(CheckURL(ctx, "http://127.0.0.1:8080/"), ErrNotPublic))
+	assert.True(t, errors.Is(CheckURL(ctx, "http://[::1]/"), ErrNotPublic))
+	assert.True(t, errors.Is(CheckURL(ctx, "http://localhost/"), ErrNotPublic))
+	assert.Error(t, CheckURL(ctx, "ftp://93.184.216.34/"))
+	assert.Error(t, CheckURL(ctx, "/relative"))
+}
+
+func TestClient_Loopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err := Client(time.Second).Get(server.URL)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrNotPublic))
+	}
+}
@@ -5,12 +5,18 @@ It follows the spec at https://indieweb.org/Microsub-spec.
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 
+	"p83.nl/go/ekster/pkg/logging"
 	"p83.nl/go/ekster/pkg/microsub"
 	"p83.nl/go/ekster/pkg/sse"
 )
@@ -24,19 +30,77 @@ const (
 	OutputContentType = "application/json; charset=utf-8"
 )
 
+// ContextBackend is implemented by backends that use the context of a
+// request, e.g. to cancel fetches or to log with the request id.
+type ContextBackend interface {
+	WithContext(ctx context.Context) microsub.Microsub
+}
+
+// ReplayBackend is implemented by backends that can filter events and send
+// the events a client missed while it was disconnected.
+type ReplayBackend interface {
+	EventsAfter(lastEventID string, filter sse.Filter) (chan sse.Message, error)
+}
+
 type microsubHandler struct {
 	backend microsub.Microsub
 	Broker  *sse.Broker
 }
 
-func respondJSON(w http.ResponseWriter, value interface{}) {
+// WriteError writes err as a Microsub error response. Errors that are not a
+// *microsub.Error are logged, and returned as an internal server error
+// without the details.
+func WriteError(w http.ResponseWriter, err error) {
+	writeError(w, logging.Default(), err)
+}
+
+func respondError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, logging.FromContext(r.Context()), err)
+}
+
+// publicError returns err when it's a *microsub.Error. Other errors are
+// logged, the returned error only contains ref.
+func publicError(logger *logging.Logger, err error, ref string) *microsub.Error {
+	var merr *microsub.Error
+	if errors.As(err, &merr) {
+		return merr
+	}
+	if ref == "" {
+		ref = logging.NewRequestID()
+	}
+	logger.Error("internal error", "err", err, "ref", ref)
+	return &microsub.Error{Code: microsub.ErrorInternal, Description: "internal server error, reference " + ref}
+}
+
+func writeError(w http.ResponseWriter, logger *logging.Logger, err error) {
+	merr := publicError(logger, err, w.Header().Get(logging.RequestIDHeader))
+
+	switch merr.Code {
+	case microsub.ErrorUnauthorized:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	case microsub.ErrorInsufficientScope:
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, merr.Scope))
+	}
+
+	w.Header().Set("Content-Type", OutputContentType)
+	w.WriteHeader(merr.StatusCode())
+
+	jw := json.NewEncoder(w)
+	jw.SetEscapeHTML(false)
+	err = jw.Encode(merr)
+	if err != nil {
+		log.Printf("could not write error response: %v", err)
+	}
+}
+
+func respondJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
 	jw := json.NewEncoder(w)
 	jw.SetIndent("", "    ")
 	jw.SetEscapeHTML(false)
 	w.Header().Add("Content-Type", OutputContentType)
 	err := jw.Encode(value)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		respondError(w, r, err)
 	}
 }
 
@@ -44,11 +108,24 @@ func respondJSON(w http.ResponseWriter, value interface{}) {
 // It returns a handler for HTTP and a broker that will send events.
 func NewMicrosubHandler(backend microsub.Microsub) (http.Handler, *sse.Broker) {
 	broker := sse.NewBroker()
-	return &microsubHandler{backend, broker}, broker
+	return NewMicrosubHandlerWithBroker(backend, broker), broker
+}
+
+// NewMicrosubHandlerWithBroker returns a handler for HTTP that uses broker
+// for the event stream.
+func NewMicrosubHandlerWithBroker(backend microsub.Microsub, broker *sse.Broker) http.Handler {
+	return &microsubHandler{backend, broker}
 }
 
 // Methods required by http.Handler
 func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+
+	backend := h.backend
+	if b, ok := backend.(ContextBackend); ok {
+		backend = b.WithContext(r.Context())
+	}
+
 	r.ParseForm()
 
 	// log.Printf("Incoming request: %s %s\n", r.Method, r.URL)
@@ -67,42 +144,76 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		values := r.URL.Query()
 		action := values.Get("action")
 		if action == "channels" {
-			channels, err := h.backend.ChannelsGetList()
+			channels, err := backend.ChannelsGetList()
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				respondError(w, r, err)
 				return
 			}
-			respondJSON(w, map[string][]microsub.Channel{
+			respondJSON(w, r, map[string][]microsub.Channel{
 				"channels": channels,
 			})
 		} else if action == "timeline" {
-			timeline, err := h.backend.TimelineGet(values.Get("before"), values.Get("after"), values.Get("channel"))
+			if values.Get("channel") == "" {
+				respondError(w, r, microsub.InvalidRequestError("missing parameter channel"))
+				return
+			}
+			timeline, err := backend.TimelineGet(values.Get("before"), values.Get("after"), values.Get("channel"))
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				respondError(w, r, err)
 				return
 			}
-			respondJSON(w, timeline)
+			respondJSON(w, r, timeline)
 		} else if action == "preview" {
-			timeline, err := h.backend.PreviewURL(values.Get("url"))
+			if values.Get("url") == "" {
+				respondError(w, r, microsub.InvalidRequestError("missing parameter url"))
+				return
+			}
+			timeline, err := backend.PreviewURL(values.Get("url"))
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				respondError(w, r, err)
 				return
 			}
-			respondJSON(w, timeline)
+			respondJSON(w, r, timeline)
 		} else if action == "follow" {
 			channel := values.Get("channel")
-			following, err := h.backend.FollowGetList(channel)
+			if channel == "" {
+				respondError(w, r, microsub.InvalidRequestError("missing parameter channel"))
+				return
+			}
+			following, err := backend.FollowGetList(channel)
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				respondError(w, r, err)
 				return
 			}
-			respondJSON(w, map[string][]microsub.Feed{
+			respondJSON(w, r, map[string][]microsub.Feed{
 				"items": following,
 			})
 		} else if action == "events" {
-			events, err := h.backend.Events()
+			var events chan sse.Message
+			// Browsers send the Last-Event-ID header when they reconnect
+			lastEventID := r.Header.Get("Last-Event-ID")
+			if lastEventID == "" {
+				lastEventID = values.Get("last_event_id")
+			}
+			filter, err := eventsFilter(values)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+			if replay, ok := backend.(ReplayBackend); ok {
+				events, err = replay.EventsAfter(lastEventID, filter)
+			} else {
+				events, err = backend.Events()
+			}
 			if err != nil {
-				http.Error(w, "could not start sse connection", 500)
+				respondError(w, r, err)
+				return
+			}
+
+			// Clients behind proxies that buffer event streams can use a WebSocket
+			if isWebSocket(r) {
+				h.serveWebSocket(w, r, backend, events)
+				return
 			}
 
 			// Remove this client from the map of connected clients
@@ -121,11 +232,11 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			err = sse.WriteMessages(w, events)
 			if err != nil {
-				log.Println(err)
+				logger.Errorf("could not write events: %v", err)
 				http.Error(w, "internal server error", 500)
 			}
 		} else {
-			http.Error(w, fmt.Sprintf("unknown action %s\n", action), 400)
+			respondError(w, r, microsub.InvalidRequestError("unknown action %q", action))
 			return
 		}
 		return
@@ -139,97 +250,171 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			method := values.Get("method")
 			uid := values.Get("channel")
 			if method == "delete" {
-				err := h.backend.ChannelsDelete(uid)
+				err := backend.ChannelsDelete(uid)
 				if err != nil {
-					http.Error(w, err.Error(), 500)
+					respondError(w, r, err)
 					return
 				}
-				respondJSON(w, []string{})
+				respondJSON(w, r, []string{})
+				return
+			}
+			if method == "order" {
+				uids := listParam(values, "channels")
+				if len(uids) == 0 {
+					respondError(w, r, microsub.InvalidRequestError("missing parameter channels"))
+					return
+				}
+				err := backend.ChannelsOrder(uids)
+				if err != nil {
+					respondError(w, r, err)
+					return
+				}
+				respondJSON(w, r, []string{})
+				return
+			}
+
+			if name == "" {
+				respondError(w, r, microsub.InvalidRequestError("missing parameter name"))
 				return
 			}
 
 			if uid == "" {
-				channel, err := h.backend.ChannelsCreate(name)
+				channel, err := backend.ChannelsCreate(name)
 				if err != nil {
-					http.Error(w, err.Error(), 500)
+					respondError(w, r, err)
 					return
 				}
-				respondJSON(w, channel)
-			} else if name != "" {
-				channel, err := h.backend.ChannelsUpdate(uid, name)
+				respondJSON(w, r, channel)
+			} else {
+				channel, err := backend.ChannelsUpdate(uid, name)
 				if err != nil {
-					http.Error(w, err.Error(), 500)
+					respondError(w, r, err)
 					return
 				}
-				respondJSON(w, channel)
+				respondJSON(w, r, channel)
 			}
 		} else if action == "follow" {
 			uid := values.Get("channel")
 			url := values.Get("url")
+			if uid == "" || url == "" {
+				respondError(w, r, microsub.InvalidRequestError("missing parameter channel or url"))
+				return
+			}
 			// h.HubIncomingBackend.CreateFeed(url, uid)
-			feed, err := h.backend.FollowURL(uid, url)
+			feed, err := backend.FollowURL(uid, url)
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				respondError(w, r, err)
 				return
 			}
-			respondJSON(w, feed)
+			respondJSON(w, r, feed)
 		} else if action == "unfollow" {
 			uid := values.Get("channel")
 			url := values.Get("url")
-			err := h.backend.UnfollowURL(uid, url)
+			if uid == "" || url == "" {
+				respondError(w, r, microsub.InvalidRequestError("missing parameter channel or url"))
+				return
+			}
+			err := backend.UnfollowURL(uid, url)
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				respondError(w, r, err)
 				return
 			}
-			respondJSON(w, []string{})
+			respondJSON(w, r, []string{})
 		} else if action == "search" {
 			query := values.Get("query")
-			feeds, err := h.backend.Search(query)
+			if query == "" {
+				respondError(w, r, microsub.InvalidRequestError("missing parameter query"))
+				return
+			}
+			feeds, err := backend.Search(query)
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				respondError(w, r, err)
 				return
 			}
-			respondJSON(w, map[string][]microsub.Feed{
+			respondJSON(w, r, map[string][]microsub.Feed{
 				"results": feeds,
 			})
 		} else if action == "timeline" || r.PostForm.Get("action") == "timeline" {
 			method := values.Get("method")
+			channel := values.Get("channel")
+			uids := entries(values)
 
-			if method == "mark_read" || r.PostForm.Get("method") == "mark_read" {
-				values = r.Form
-				channel := values.Get("channel")
-				var markAsRead []string
-				if uids, e := values["entry"]; e {
-					markAsRead = uids
-				} else if uids, e := values["entry[]"]; e {
-					markAsRead = uids
-				} else {
-					uids := []string{}
-					for k, v := range values {
-						if entryRegex.MatchString(k) {
-							uids = append(uids, v...)
-						}
-					}
-					markAsRead = uids
+			var err error
+			switch method {
+			case "mark_read":
+				if len(uids) > 0 {
+					err = backend.MarkRead(channel, uids)
 				}
-
-				if len(markAsRead) > 0 {
-					err := h.backend.MarkRead(channel, markAsRead)
-					if err != nil {
-						http.Error(w, err.Error(), 500)
-						return
-					}
+			case "mark_unread":
+				if len(uids) > 0 {
+					err = backend.MarkUnread(channel, uids)
 				}
-			} else {
-				http.Error(w, fmt.Sprintf("unknown method in timeline %s\n", method), 500)
+			case "remove":
+				if len(uids) > 0 {
+					err = backend.RemoveItems(channel, uids)
+				}
+			default:
+				err = microsub.InvalidRequestError("unknown method in timeline %q", method)
+			}
+			if err != nil {
+				respondError(w, r, err)
 				return
 			}
 
-			respondJSON(w, []string{})
+			respondJSON(w, r, []string{})
 		} else {
-			http.Error(w, fmt.Sprintf("unknown action %s\n", action), 400)
+			respondError(w, r, microsub.InvalidRequestError("unknown action %q", action))
 		}
 		return
 	}
 	return
 }
+
+// entries returns the ids of the items in the entry parameter, as entry,
+// entry[] or entry[N]
+func entries(values url.Values) []string {
+	if uids, e := values["entry"]; e {
+		return uids
+	}
+	if uids, e := values["entry[]"]; e {
+		return uids
+	}
+	uids := []string{}
+	for k, v := range values {
+		if entryRegex.MatchString(k) {
+			uids = append(uids, v...)
+		}
+	}
+	return uids
+}
+
+// eventsFilter returns the filter of the events request, from the channel,
+// event and ids_only parameters
+func eventsFilter(values url.Values) (sse.Filter, error) {
+	filter := sse.Filter{
+		Channels: listParam(values, "channel"),
+		Events:   listParam(values, "event"),
+	}
+	if v := values.Get("ids_only"); v != "" {
+		idsOnly, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, microsub.InvalidRequestError("ids_only should be true or false")
+		}
+		filter.IDsOnly = idsOnly
+	}
+	return filter, nil
+}
+
+// listParam returns the values of the parameter name, it can be repeated,
+// with or without [], or contain a comma separated list
+func listParam(values url.Values, name string) []string {
+	var list []string
+	for _, v := range append(values[name], values[name+"[]"]...) {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
@@ -1,16 +1,23 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
 	"p83.nl/go/ekster/pkg/client"
 	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/sse"
 )
 
 func init() {
@@ -147,6 +154,27 @@ func TestServer_MarkRead(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestServer_MarkUnread(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.MarkUnread("0001", []string{"test"})
+	assert.NoError(t, err)
+}
+
+func TestServer_RemoveItems(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.RemoveItems("0001", []string{"test"})
+	assert.NoError(t, err)
+}
+
+func TestServer_ChannelsOrder(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.ChannelsOrder([]string{"0001", "0000"})
+	assert.NoError(t, err)
+}
+
 func TestServer_GetUnknownAction(t *testing.T) {
 	server, c := createServerClient()
 	defer server.Close()
@@ -175,3 +203,274 @@ func TestServer_PostUnknownAction(t *testing.T) {
 		assert.Equal(t, 400, resp.StatusCode)
 	}
 }
+
+func TestServer_TimelineGetNotFound(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+
+	_, err := c.TimelineGet("", "", "9999")
+
+	var merr *microsub.Error
+	if assert.True(t, errors.As(err, &merr)) {
+		assert.Equal(t, microsub.ErrorNotFound, merr.Code)
+		assert.Equal(t, "channel 9999 does not exist", merr.Description)
+	}
+}
+
+func TestServer_ErrorResponse(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+
+	u := c.MicrosubEndpoint
+	q := u.Query()
+	q.Add("action", "channels")
+	q.Add("channel", "9999")
+	q.Add("name", "test")
+	u.RawQuery = q.Encode()
+
+	resp, err := http.Post(u.String(), "application/x-www-form-urlencoded", nil)
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, 404, resp.StatusCode)
+		assert.Equal(t, OutputContentType, resp.Header.Get("Content-Type"))
+
+		var res map[string]string
+		if assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res)) {
+			assert.Equal(t, "not_found", res["error"])
+			assert.Equal(t, "channel 9999 does not exist", res["error_description"])
+		}
+	}
+}
+
+func TestServer_MissingParameter(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+
+	_, err := c.FollowURL("0001", "")
+	assert.Equal(t, microsub.ErrorInvalidRequest, microsub.ErrorCode(err))
+}
+
+func TestClient_PlainTextError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Can't validate token", 403)
+	}))
+	defer server.Close()
+
+	c := client.Client{Token: "1234"}
+	c.MicrosubEndpoint, _ = url.Parse(server.URL + "/microsub")
+
+	_, err := c.ChannelsGetList()
+
+	var merr *microsub.Error
+	if assert.True(t, errors.As(err, &merr)) {
+		assert.Equal(t, microsub.ErrorForbidden, merr.Code)
+		assert.Equal(t, "Can't validate token", merr.Description)
+	}
+}
+
+type contextBackend struct {
+	NullBackend
+	ctx context.Context
+}
+
+func (b *contextBackend) WithContext(ctx context.Context) microsub.Microsub {
+	return &contextBackend{ctx: ctx}
+}
+
+func (b *contextBackend) PreviewURL(url string) (microsub.Timeline, error) {
+	if b.ctx == nil {
+		return microsub.Timeline{}, errors.New("backend without context")
+	}
+	return microsub.Timeline{}, nil
+}
+
+func TestServer_ContextBackend(t *testing.T) {
+	handler, _ := NewMicrosubHandler(&contextBackend{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/microsub?action=preview&url=https://example.com/")
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+}
+
+type replayBackend struct {
+	NullBackend
+	lastEventID string
+	filter      sse.Filter
+}
+
+func (b *replayBackend) EventsAfter(lastEventID string, filter sse.Filter) (chan sse.Message, error) {
+	b.lastEventID = lastEventID
+	b.filter = filter
+	ch := make(chan sse.Message, 1)
+	ch <- sse.Message{ID: 5, Event: "new item", Object: map[string]string{}}
+	close(ch)
+	return ch, nil
+}
+
+func TestServer_ReplayBackend(t *testing.T) {
+	backend := &replayBackend{}
+	handler, _ := NewMicrosubHandler(backend)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/microsub?action=events", nil)
+	req.Header.Set("Last-Event-ID", "4")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "4", backend.lastEventID)
+		assert.Equal(t, "event: new item\r\nid: 5\r\ndata: {}\r\n\r\n", string(body))
+	}
+
+	resp, err = http.Get(server.URL + "/microsub?action=events&last_event_id=7&channel[]=home&channel[]=notifications&event=new+item,ping&ids_only=true")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "7", backend.lastEventID)
+		assert.Equal(t, sse.Filter{
+			Channels: []string{"home", "notifications"},
+			Events:   []string{"new item", "ping"},
+			IDsOnly:  true,
+		}, backend.filter)
+	}
+
+	resp, err = http.Get(server.URL + "/microsub?action=events&ids_only=maybe")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 400, resp.StatusCode)
+	}
+}
+
+type itemsBackend struct {
+	NullBackend
+	calls []string
+}
+
+func (b *itemsBackend) MarkRead(channel string, uids []string) error {
+	b.calls = append(b.calls, fmt.Sprint("mark_read ", channel, uids))
+	return nil
+}
+
+func (b *itemsBackend) MarkUnread(channel string, uids []string) error {
+	b.calls = append(b.calls, fmt.Sprint("mark_unread ", channel, uids))
+	return nil
+}
+
+func (b *itemsBackend) RemoveItems(channel string, uids []string) error {
+	b.calls = append(b.calls, fmt.Sprint("remove ", channel, uids))
+	return nil
+}
+
+func (b *itemsBackend) ChannelsOrder(uids []string) error {
+	b.calls = append(b.calls, fmt.Sprint("order ", uids))
+	return nil
+}
+
+func TestServer_TimelineMethods(t *testing.T) {
+	backend := &itemsBackend{}
+	handler, _ := NewMicrosubHandler(backend)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	post := func(form string) int {
+		resp, err := http.Post(server.URL+"/microsub", "application/x-www-form-urlencoded", strings.NewReader(form))
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, 200, post("action=timeline&method=mark_read&channel=home&entry=1"))
+	assert.Equal(t, 200, post("action=timeline&method=mark_unread&channel=home&entry[]=1&entry[]=2"))
+	assert.Equal(t, 200, post("action=timeline&method=remove&channel=home&entry[0]=3"))
+	assert.Equal(t, 200, post("action=channels&method=order&channels[]=b&channels[]=a"))
+	assert.Equal(t, 400, post("action=channels&method=order"))
+	assert.Equal(t, 400, post("action=timeline&method=missing&channel=home&entry=1"))
+
+	assert.Equal(t, []string{
+		"mark_read home[1]",
+		"mark_unread home[1 2]",
+		"remove home[3]",
+		"order [b a]",
+	}, backend.calls)
+}
+
+type websocketBackend struct {
+	NullBackend
+	broker *sse.Broker
+	marked chan []string
+}
+
+func (b *websocketBackend) EventsAfter(lastEventID string, filter sse.Filter) (chan sse.Message, error) {
+	return sse.StartFilteredConnection(b.broker, lastEventID, filter)
+}
+
+func (b *websocketBackend) MarkRead(channel string, uids []string) error {
+	b.marked <- uids
+	return nil
+}
+
+func TestServer_WebSocket(t *testing.T) {
+	backend := &websocketBackend{marked: make(chan []string, 1)}
+	handler, broker := NewMicrosubHandler(backend)
+	defer broker.Close(sse.Message{Event: "shutdown"})
+	backend.broker = broker
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/microsub?action=events&channel=home", "", server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+
+	var msg map[string]interface{}
+	if assert.NoError(t, websocket.JSON.Receive(ws, &msg)) {
+		assert.Equal(t, "started", msg["event"])
+	}
+
+	broker.Send(sse.Message{Event: "new item", Channel: "notifications", Object: map[string]string{"channel": "notifications"}})
+	broker.Send(sse.Message{Event: "new item", Channel: "home", Object: map[string]string{"channel": "home"}})
+	if assert.NoError(t, websocket.JSON.Receive(ws, &msg)) {
+		assert.Equal(t, "new item", msg["event"])
+		assert.Equal(t, map[string]interface{}{"channel": "home"}, msg["data"])
+	}
+
+	assert.NoError(t, websocket.JSON.Send(ws, websocketCommand{ID: "1", Action: "timeline", Method: "mark_read", Channel: "home", Entry: []string{"a", "b"}}))
+	assert.Equal(t, []string{"a", "b"}, <-backend.marked)
+	if assert.NoError(t, websocket.JSON.Receive(ws, &msg)) {
+		assert.Equal(t, "result", msg["event"])
+		assert.Equal(t, map[string]interface{}{"id": "1", "ok": true}, msg["data"])
+	}
+
+	assert.NoError(t, websocket.JSON.Send(ws, websocketCommand{ID: "2", Action: "follow"}))
+	if assert.NoError(t, websocket.JSON.Receive(ws, &msg)) {
+		assert.Equal(t, "result", msg["event"])
+		assert.Equal(t, map[string]interface{}{
+			"id":                "2",
+			"ok":                false,
+			"error":             "invalid_request",
+			"error_description": `unknown action "follow"`,
+		}, msg["data"])
+	}
+}
+
+func TestWriteError_Internal(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "abc123")
+	WriteError(w, fmt.Errorf("dial tcp 10.0.0.5:6379: connection refused"))
+
+	assert.Equal(t, 500, w.Code)
+	assert.NotContains(t, w.Body.String(), "10.0.0.5")
+
+	var merr microsub.Error
+	if assert.NoError(t, json.NewDecoder(w.Body).Decode(&merr)) {
+		assert.Equal(t, microsub.ErrorInternal, merr.Code)
+		assert.Equal(t, "internal server error, reference abc123", merr.Description)
+	}
+}
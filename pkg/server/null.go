@@ -17,6 +17,10 @@ func (b *NullBackend) ChannelsGetList() ([]microsub.Channel, error) {
 	}, nil
 }
 
+func nullChannelExists(uid string) bool {
+	return uid == "0000" || uid == "0001"
+}
+
 // ChannelsCreate creates no channels
 func (b *NullBackend) ChannelsCreate(name string) (microsub.Channel, error) {
 	return microsub.Channel{
@@ -27,6 +31,9 @@ func (b *NullBackend) ChannelsCreate(name string) (microsub.Channel, error) {
 
 // ChannelsUpdate updates no channels
 func (b *NullBackend) ChannelsUpdate(uid, name string) (microsub.Channel, error) {
+	if !nullChannelExists(uid) {
+		return microsub.Channel{}, microsub.NotFoundError("channel %s does not exist", uid)
+	}
 	return microsub.Channel{
 		UID:  uid,
 		Name: name,
@@ -40,6 +47,9 @@ func (b *NullBackend) ChannelsDelete(uid string) error {
 
 // TimelineGet gets no timeline
 func (b *NullBackend) TimelineGet(before, after, channel string) (microsub.Timeline, error) {
+	if !nullChannelExists(channel) {
+		return microsub.Timeline{}, microsub.NotFoundError("channel %s does not exist", channel)
+	}
 	return microsub.Timeline{
 		Paging: microsub.Pagination{},
 		Items:  []microsub.Item{},
@@ -83,6 +93,21 @@ func (b *NullBackend) MarkRead(channel string, uids []string) error {
 	return nil
 }
 
+// ChannelsOrder changes nothing
+func (b *NullBackend) ChannelsOrder(uids []string) error {
+	return nil
+}
+
+// MarkUnread marks no items as unread
+func (b *NullBackend) MarkUnread(channel string, uids []string) error {
+	return nil
+}
+
+// RemoveItems removes no items
+func (b *NullBackend) RemoveItems(channel string, uids []string) error {
+	return nil
+}
+
 // Events returns a closed channel.
 func (b *NullBackend) Events() (chan sse.Message, error) {
 	ch := make(chan sse.Message)
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+	"p83.nl/go/ekster/pkg/logging"
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/sse"
+)
+
+// websocketMessage is an event that is sent over a WebSocket. It contains the
+// same event names and payloads as the event stream.
+type websocketMessage struct {
+	ID    int64       `json:"id,omitempty"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// websocketCommand is a command that a client sends over a WebSocket, it uses
+// the parameters of the POST request with the same action and method
+type websocketCommand struct {
+	// ID is sent back in the result of the command
+	ID      string   `json:"id"`
+	Action  string   `json:"action"`
+	Method  string   `json:"method"`
+	Channel string   `json:"channel"`
+	Entry   []string `json:"entry"`
+}
+
+// websocketResult is the payload of the "result" event, that is sent after a
+// command
+type websocketResult struct {
+	ID               string `json:"id"`
+	OK               bool   `json:"ok"`
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// isWebSocket returns true when the client wants to upgrade the request to a
+// WebSocket
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWebSocket sends the events to the client over a WebSocket, and runs the
+// commands it receives with backend
+func (h *microsubHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, backend microsub.Microsub, events chan sse.Message) {
+	logger := logging.FromContext(r.Context())
+
+	s := websocket.Server{
+		// Clients authenticate with a token, so all origins are allowed,
+		// like with Access-Control-Allow-Origin for the other requests
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			defer h.Broker.CloseClient(events)
+
+			// The commands are read until the client closes the connection
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				for {
+					var cmd websocketCommand
+					err := websocket.JSON.Receive(ws, &cmd)
+					if err != nil {
+						return
+					}
+					result := runWebSocketCommand(logger.With("action", cmd.Action, "method", cmd.Method), backend, cmd)
+					err = websocket.JSON.Send(ws, websocketMessage{Event: "result", Data: result})
+					if err != nil {
+						return
+					}
+				}
+			}()
+
+			for {
+				select {
+				case msg, ok := <-events:
+					if !ok {
+						return
+					}
+					err := websocket.JSON.Send(ws, websocketMessage{ID: msg.ID, Event: msg.Event, Data: msg.Object})
+					if err != nil {
+						logger.Warnf("could not write websocket message: %v", err)
+						return
+					}
+				case <-closed:
+					return
+				}
+			}
+		},
+	}
+	s.ServeHTTP(w, r)
+}
+
+// runWebSocketCommand runs the command with backend. Only the timeline
+// methods are supported, they need the same scope as the events. Unexpected
+// errors are logged with logger.
+func runWebSocketCommand(logger *logging.Logger, backend microsub.Microsub, cmd websocketCommand) websocketResult {
+	var run func(channel string, entry []string) error
+	var err error
+	if cmd.Action != "timeline" {
+		err = microsub.InvalidRequestError("unknown action %q", cmd.Action)
+	} else {
+		switch cmd.Method {
+		case "mark_read":
+			run = backend.MarkRead
+		case "mark_unread":
+			run = backend.MarkUnread
+		case "remove":
+			run = backend.RemoveItems
+		default:
+			err = microsub.InvalidRequestError("unknown method in timeline %q", cmd.Method)
+		}
+	}
+	if run != nil && len(cmd.Entry) > 0 {
+		err = run(cmd.Channel, cmd.Entry)
+	}
+
+	result := websocketResult{ID: cmd.ID, OK: err == nil}
+	if err != nil {
+		merr := publicError(logger, err, "")
+		result.Error = merr.Code
+		result.ErrorDescription = merr.Description
+	}
+	return result
+}
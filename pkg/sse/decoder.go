@@ -0,0 +1,130 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLineSize is the maximum length of a line in an event stream
+const maxLineSize = 16 * 1024 * 1024
+
+// Decoder reads events from an event stream, as described in
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+type Decoder struct {
+	scanner *bufio.Scanner
+	first   bool
+
+	lastEventID string
+	retry       time.Duration
+}
+
+// NewDecoder returns a Decoder that reads from r. The events without an id
+// get lastEventID, like the events after it.
+func NewDecoder(r io.Reader, lastEventID string) *Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineSize)
+	scanner.Split(scanLines)
+	return &Decoder{scanner: scanner, first: true, lastEventID: lastEventID}
+}
+
+// Decode returns the next event. The Event of messages without an event name
+// is "message", and ID is the last event id when it's a number. At the end of
+// the stream it returns io.EOF, an incomplete last event is ignored.
+func (d *Decoder) Decode() (Message, error) {
+	var event string
+	var data strings.Builder
+	hasData := false
+
+	for d.scanner.Scan() {
+		line := d.scanner.Text()
+		if d.first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			d.first = false
+		}
+
+		if line == "" {
+			if !hasData {
+				event = ""
+				continue
+			}
+			if event == "" {
+				event = "message"
+			}
+			id, _ := strconv.ParseInt(d.lastEventID, 10, 64)
+			return Message{ID: id, Event: event, Data: strings.TrimSuffix(data.String(), "\n")}, nil
+		}
+
+		// Lines that start with a colon are comments
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastEventID = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 32); err == nil {
+				d.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+
+	if err := d.scanner.Err(); err != nil {
+		return Message{}, err
+	}
+	return Message{}, io.EOF
+}
+
+// LastEventID returns the id of the last event that was read
+func (d *Decoder) LastEventID() string {
+	return d.lastEventID
+}
+
+// Retry returns the reconnection time that was sent by the server, or 0
+func (d *Decoder) Retry() time.Duration {
+	return d.retry
+}
+
+// scanLines splits the stream into lines that end in CRLF, LF or CR
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		// Wait for the next byte, it could be the LF of CRLF
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,54 @@
+package sse
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeAll(t *testing.T, d *Decoder) []Message {
+	var messages []Message
+	for {
+		msg, err := d.Decode()
+		if err == io.EOF {
+			return messages
+		}
+		if !assert.NoError(t, err) {
+			return messages
+		}
+		messages = append(messages, msg)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	stream := "\ufeff: comment\n" +
+		"event: new item\r\nid: 1\r\ndata: {\"a\":\r\ndata:1}\r\n\r\n" +
+		"data: no event name\rretry: 2500\r\r" +
+		"event: ignored\nid\n\n" +
+		"id: 7\ndata\ndata\n\n" +
+		"data: no id\n\n" +
+		"data: incomplete"
+
+	d := NewDecoder(strings.NewReader(stream), "")
+	assert.Equal(t, []Message{
+		{ID: 1, Event: "new item", Data: "{\"a\":\n1}"},
+		{ID: 1, Event: "message", Data: "no event name"},
+		{ID: 7, Event: "message", Data: "\n"},
+		{ID: 7, Event: "message", Data: "no id"},
+	}, decodeAll(t, d))
+	assert.Equal(t, "7", d.LastEventID())
+	assert.Equal(t, 2500*time.Millisecond, d.Retry())
+}
+
+func TestDecoder_LastEventID(t *testing.T) {
+	d := NewDecoder(strings.NewReader("data: a\n\nid: abc\ndata: b\n\n"), "12")
+	assert.Equal(t, []Message{
+		{ID: 12, Event: "message", Data: "a"},
+		{ID: 0, Event: "message", Data: "b"},
+	}, decodeAll(t, d))
+	assert.Equal(t, "abc", d.LastEventID())
+	assert.Equal(t, time.Duration(0), d.Retry())
+}
@@ -1,16 +1,24 @@
 package sse
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"p83.nl/go/ekster/pkg/metrics"
+)
+
+var (
+	metricClients = metrics.NewGauge("ekster_sse_clients", "Number of connected event stream clients.")
+	metricDropped = metrics.NewCounter("ekster_sse_dropped_events_total", "Number of events that were not sent to a client.")
+	metricEvicted = metrics.NewCounter("ekster_sse_evicted_clients_total", "Number of clients that were disconnected because they were too slow.")
+	metricPending = metrics.NewGauge("ekster_sse_pending_events", "Number of events that wait to be sent by the brokers.")
 )
 
 // A MessageChan is a channel of channels
@@ -21,11 +29,70 @@ type MessageChan chan Message
 
 // Message is a message.
 type Message struct {
+	// ID is given by the broker, messages without an id can't be replayed
+	ID     int64
 	Event  string
 	Data   string
 	Object interface{}
+
+	// Channel is the uid of the channel that the event is about
+	Channel string
+	// Short is sent instead of Object to clients that only want ids
+	Short interface{}
+}
+
+// notifierSize is the number of events that can be sent to a broker before
+// Send blocks
+const notifierSize = 256
+
+// Policy decides what happens with an event when the queue of a client is full
+type Policy int
+
+// The policies for slow clients
+const (
+	// Evict disconnects the client. It can reconnect with the id of the last
+	// event it received, and receive the events it missed from the log.
+	Evict Policy = iota
+	// DropNewest drops the new event for the client
+	DropNewest
+	// DropOldest drops the oldest event in the queue of the client
+	DropOldest
+)
+
+var policyNames = map[Policy]string{
+	Evict:      "evict",
+	DropNewest: "drop-newest",
+	DropOldest: "drop-oldest",
+}
+
+func (p Policy) String() string {
+	return policyNames[p]
 }
 
+// ParsePolicy returns the policy with name, "evict", "drop-newest" or "drop-oldest"
+func ParsePolicy(name string) (Policy, error) {
+	for p, n := range policyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return Evict, fmt.Errorf("unknown policy %q", name)
+}
+
+// Options contains the options of a broker
+type Options struct {
+	// QueueSize is the number of events that are queued for a client
+	QueueSize int
+	// Policy is used when the queue of a client is full
+	Policy Policy
+	// Log keeps the last events for clients that reconnect, when it's nil
+	// the last DefaultLogSize events are kept in memory
+	Log EventLog
+}
+
+// DefaultOptions are the options of NewBroker
+var DefaultOptions = Options{QueueSize: 64, Policy: Evict}
+
 type pingMessage struct {
 	PingCount int `json:"ping"`
 }
@@ -38,13 +105,23 @@ type Broker struct {
 	Notifier chan Message
 
 	// New client connections
-	newClients chan MessageChan
+	newClients chan clientRequest
 
 	// Closed client connections
 	closingClients chan MessageChan
 
-	// Client connections registry
-	clients map[MessageChan]bool
+	// Client connections registry, with the filter of the client
+	clients map[MessageChan]Filter
+
+	// log keeps the last events for clients that reconnect
+	log     EventLog
+	options Options
+
+	// closing receives the last message before the broker stops
+	closing chan Message
+	// done is closed when the broker has stopped
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // Listen on different channels and act accordingly
@@ -54,40 +131,183 @@ func (broker *Broker) listen() {
 	for {
 		select {
 		case <-ticker.C:
-			broker.Notifier <- Message{
+			broker.broadcast(Message{
 				Event:  "ping",
 				Object: pingMessage{PingCount: pingCount},
-			}
+			})
 			pingCount++
-		case s := <-broker.newClients:
+		case req := <-broker.newClients:
 			// A new client has connected.
 			// Register their message channel
-			broker.clients[s] = true
+			s := broker.startClient(req.lastEventID, req.filter)
+			broker.clients[s] = req.filter
+			metricClients.With().Inc()
 			log.Printf("Client added. %d registered clients", len(broker.clients))
+			req.reply <- s
 		case s := <-broker.closingClients:
 			// A client has detached and we want to
 			// stop sending them messages.
-			delete(broker.clients, s)
+			if _, ok := broker.clients[s]; ok {
+				delete(broker.clients, s)
+				metricClients.With().Dec()
+			}
 			log.Printf("Removed client. %d registered clients", len(broker.clients))
 		case event := <-broker.Notifier:
 			// We got a new event from the outside!
 			// Send event to all connected clients
+			metricPending.With().Dec()
+			broker.broadcast(broker.appendLog(event))
+		case event := <-broker.closing:
+			ticker.Stop()
+			// The pending events are not sent anymore
+			metricPending.With().Add(-float64(len(broker.Notifier)))
 			for clientMessageChan := range broker.clients {
-				clientMessageChan <- event
+				// Make room for the last message
+				select {
+				case clientMessageChan <- event:
+				default:
+					select {
+					case <-clientMessageChan:
+						metricDropped.With().Inc()
+					default:
+					}
+					clientMessageChan <- event
+				}
+				close(clientMessageChan)
+				delete(broker.clients, clientMessageChan)
+				metricClients.With().Dec()
+			}
+			close(broker.done)
+			return
+		}
+	}
+
+}
+
+// broadcast sends event to all clients that want it, without waiting for them
+func (broker *Broker) broadcast(event Message) {
+	for clientMessageChan, filter := range broker.clients {
+		if !filter.Match(event) {
+			continue
+		}
+		event := filter.apply(event)
+
+		select {
+		case clientMessageChan <- event:
+			continue
+		default:
+		}
+
+		// The queue of the client is full
+		metricDropped.With().Inc()
+		switch broker.options.Policy {
+		case DropNewest:
+		case DropOldest:
+			select {
+			case <-clientMessageChan:
+			default:
+			}
+			select {
+			case clientMessageChan <- event:
+			default:
+			}
+		default:
+			close(clientMessageChan)
+			delete(broker.clients, clientMessageChan)
+			metricClients.With().Dec()
+			metricEvicted.With().Inc()
+			log.Printf("Evicted slow client. %d registered clients", len(broker.clients))
+		}
+	}
+}
+
+// appendLog adds event to the log, it returns the event with its id
+func (broker *Broker) appendLog(event Message) Message {
+	logged, err := broker.log.Append(event)
+	if err != nil {
+		log.Printf("could not add event to the event log: %v", err)
+		return event
+	}
+	return logged
+}
+
+// startClient creates the channel of a new client, with the first messages
+// already in it. The first message is "started". When the client sent the
+// id of the last event it received, the events after it are replayed, or
+// a "reset" event is sent when they are not in the log anymore.
+func (broker *Broker) startClient(lastEventID string, filter Filter) MessageChan {
+	started := Message{Event: "started", Object: welcomeMessage{Version: "1.0.0"}}
+
+	lastID, err := broker.log.LastID()
+	if err != nil {
+		log.Printf("could not get the last event id: %v", err)
+	}
+
+	var messages []Message
+	if lastEventID == "" {
+		// Clients that reconnect start from here
+		started.ID = lastID
+	} else if after, ok := broker.replay(lastEventID); ok {
+		for _, msg := range after {
+			if filter.Match(msg) {
+				messages = append(messages, filter.apply(msg))
 			}
 		}
+	} else {
+		messages = []Message{{
+			Event:  "reset",
+			ID:     lastID,
+			Object: resetMessage{Reason: "events since last event id are not available"},
+		}}
+	}
+
+	ch := make(MessageChan, 1+len(messages)+broker.options.QueueSize)
+	ch <- started
+	for _, msg := range messages {
+		ch <- msg
 	}
+	return ch
+}
 
+// replay returns the events after lastEventID, it returns false when they
+// can't be replayed
+func (broker *Broker) replay(lastEventID string) ([]Message, bool) {
+	id, err := strconv.ParseInt(lastEventID, 10, 64)
+	if err != nil || id < 0 {
+		return nil, false
+	}
+	messages, ok, err := broker.log.After(id)
+	if err != nil {
+		log.Printf("could not get events after %d: %v", id, err)
+		return nil, false
+	}
+	return messages, ok
 }
 
-// NewBroker creates a Broker.
+// NewBroker creates a Broker with the DefaultOptions.
 func NewBroker() (broker *Broker) {
+	return NewBrokerWithOptions(DefaultOptions)
+}
+
+// NewBrokerWithOptions creates a Broker with options.
+func NewBrokerWithOptions(options Options) (broker *Broker) {
+	if options.Log == nil {
+		options.Log = NewMemoryLog(DefaultLogSize)
+	}
+	if options.QueueSize < 1 {
+		options.QueueSize = DefaultOptions.QueueSize
+	}
+
 	// Instantiate a broker
 	broker = &Broker{
-		Notifier:       make(chan Message, 1),
-		newClients:     make(chan MessageChan),
+		Notifier:       make(chan Message, notifierSize),
+		newClients:     make(chan clientRequest),
 		closingClients: make(chan MessageChan),
-		clients:        make(map[MessageChan]bool),
+		clients:        make(map[MessageChan]Filter),
+		log:            options.Log,
+		options:        options,
+		closing:        make(chan Message),
+		done:           make(chan struct{}),
 	}
 
 	// Set it running - listening and broadcasting events
@@ -98,24 +318,82 @@ func NewBroker() (broker *Broker) {
 
 // CloseClient closes the client channel
 func (broker *Broker) CloseClient(ch MessageChan) {
-	broker.closingClients <- ch
+	select {
+	case broker.closingClients <- ch:
+	case <-broker.done:
+	}
+}
+
+// Send sends the message to all clients. Slow clients don't block Send,
+// what happens with their messages depends on the Policy. Messages sent after
+// Close are dropped.
+func (broker *Broker) Send(msg Message) {
+	metricPending.With().Inc()
+	select {
+	case broker.Notifier <- msg:
+	case <-broker.done:
+		metricPending.With().Dec()
+		metricDropped.With().Inc()
+	}
+}
+
+// Close sends msg to all clients as the last message, closes the client
+// channels and stops the broker.
+func (broker *Broker) Close(msg Message) {
+	broker.closeOnce.Do(func() {
+		select {
+		case broker.closing <- msg:
+		case <-broker.done:
+		}
+		<-broker.done
+	})
+}
+
+// clientRequest registers a new client with the broker
+type clientRequest struct {
+	lastEventID string
+	filter      Filter
+	reply       chan MessageChan
 }
 
 // StartConnection starts a SSE connection, based on an existing HTTP connection.
 func StartConnection(broker *Broker) (MessageChan, error) {
+	return StartConnectionAfter(broker, "")
+}
+
+// StartConnectionAfter starts a SSE connection for a client that reconnects,
+// the events after lastEventID are sent first.
+func StartConnectionAfter(broker *Broker, lastEventID string) (MessageChan, error) {
+	return StartFilteredConnection(broker, lastEventID, Filter{})
+}
+
+// StartFilteredConnection starts a SSE connection that only receives the
+// events selected by filter. When lastEventID is not empty, the events after
+// it are sent first.
+func StartFilteredConnection(broker *Broker, lastEventID string, filter Filter) (MessageChan, error) {
 	// Each connection registers its own message channel with the Broker's connections registry
-	messageChan := make(MessageChan)
+	req := clientRequest{lastEventID: lastEventID, filter: filter, reply: make(chan MessageChan, 1)}
 
 	// Signal the broker that we have a new connection
-	broker.newClients <- messageChan
+	select {
+	case broker.newClients <- req:
+	case <-broker.done:
+		return nil, fmt.Errorf("broker is closed")
+	}
 
-	return messageChan, nil
+	return <-req.reply, nil
 }
 
 type welcomeMessage struct {
 	Version string `json:"version"`
 }
 
+// resetMessage tells the client that it missed events, it should load the
+// channels and timelines again
+type resetMessage struct {
+	Reason string `json:"reason"`
+}
+
 // WriteMessages writes SSE formatted messages to the writer
 func WriteMessages(w http.ResponseWriter, messageChan chan Message) error {
 	// Make sure that the writer supports flushing.
@@ -129,22 +407,6 @@ func WriteMessages(w http.ResponseWriter, messageChan chan Message) error {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	var welcomeMsg welcomeMessage
-	welcomeMsg.Version = "1.0.0"
-	encoded, err := json.Marshal(&welcomeMsg)
-	if err != nil {
-		return errors.Wrap(err, "could not encode welcome message")
-	}
-
-	messageID := 1
-
-	_, err = fmt.Fprintf(w, "event: started\r\nid: %d\r\ndata: %s\r\n\r\n", messageID, encoded)
-	if err != nil {
-		return err
-	}
-
-	messageID++
 	flusher.Flush()
 
 	// block waiting or messages broadcast on this connection's messageChan
@@ -155,42 +417,34 @@ func WriteMessages(w http.ResponseWriter, messageChan chan Message) error {
 			return errors.Wrap(err, "could not marshal message data")
 		}
 
-		_, err = fmt.Fprintf(w, "event: %s\r\nid: %d\r\ndata: %s\r\n\r\n", message.Event, messageID, output)
+		// Messages without an id don't change the last event id of the client
+		id := ""
+		if message.ID != 0 {
+			id = fmt.Sprintf("id: %d\r\n", message.ID)
+		}
+
+		_, err = fmt.Fprintf(w, "event: %s\r\n%sdata: %s\r\n\r\n", message.Event, id, output)
 		if err != nil {
 			return errors.Wrap(err, "could not write message")
 		}
 
-		messageID++
-
 		flusher.Flush()
 	}
 
 	return nil
 }
 
-// Reader returns a channel that contains parsed SSE messages.
+// Reader sends the messages from body to ch, until the end of body.
 func Reader(body io.ReadCloser, ch MessageChan) error {
-	r := bufio.NewScanner(body)
-	var msg Message
-
-	for r.Scan() {
-		line := r.Text()
-		if line == "" {
-			ch <- msg
-			msg = Message{}
-			continue
-		}
-		if strings.HasPrefix(line, "event: ") {
-			line = line[len("event: "):]
-			msg.Event = line
+	d := NewDecoder(body, "")
+	for {
+		msg, err := d.Decode()
+		if err == io.EOF {
+			return nil
 		}
-		if strings.HasPrefix(line, "data: ") {
-			line = line[len("data: "):]
-			msg.Data = line
+		if err != nil {
+			return errors.Wrap(err, "could not read sse events")
 		}
+		ch <- msg
 	}
-	if err := r.Err(); err != nil {
-		return errors.Wrap(err, "could not scan lines from sse events")
-	}
-	return nil
 }
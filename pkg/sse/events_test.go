@@ -0,0 +1,237 @@
+package sse
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_Close(t *testing.T) {
+	broker := NewBroker()
+
+	client, err := StartConnection(broker)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	received := make(chan []Message)
+	go func() {
+		var messages []Message
+		for msg := range client {
+			messages = append(messages, msg)
+		}
+		received <- messages
+	}()
+
+	broker.Send(Message{Event: "new item"})
+	broker.Close(Message{Event: "shutdown"})
+
+	select {
+	case messages := <-received:
+		if assert.Len(t, messages, 3) {
+			assert.Equal(t, "started", messages[0].Event)
+			assert.Equal(t, "new item", messages[1].Event)
+			assert.Equal(t, "shutdown", messages[2].Event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client channel was not closed")
+	}
+
+	// After Close nothing blocks
+	done := make(chan struct{})
+	go func() {
+		broker.Send(Message{Event: "new item"})
+		broker.CloseClient(client)
+		broker.Close(Message{Event: "shutdown"})
+		_, err := StartConnection(broker)
+		assert.Error(t, err)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broker blocks after Close")
+	}
+}
+
+// receive returns the next n messages of client
+func receive(t *testing.T, client MessageChan, n int) []Message {
+	var messages []Message
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-client:
+			messages = append(messages, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d messages", i, n)
+		}
+	}
+	return messages
+}
+
+func TestBroker_Replay(t *testing.T) {
+	broker := NewBrokerWithOptions(Options{Log: NewMemoryLog(3)})
+	defer broker.Close(Message{Event: "shutdown"})
+
+	client, err := StartConnection(broker)
+	if !assert.NoError(t, err) {
+		return
+	}
+	started := receive(t, client, 1)[0]
+	assert.Equal(t, "started", started.Event)
+	assert.Equal(t, int64(0), started.ID)
+
+	for i := 0; i < 4; i++ {
+		broker.Send(Message{Event: "new item"})
+	}
+	messages := receive(t, client, 4)
+	for i, msg := range messages {
+		assert.Equal(t, int64(i+1), msg.ID)
+	}
+
+	// A new client starts at the last event
+	client, err = StartConnection(broker)
+	if assert.NoError(t, err) {
+		messages := receive(t, client, 1)
+		assert.Equal(t, int64(4), messages[0].ID)
+	}
+
+	// The events after 2 are still in the log
+	client, err = StartConnectionAfter(broker, "2")
+	if assert.NoError(t, err) {
+		messages := receive(t, client, 3)
+		assert.Equal(t, "started", messages[0].Event)
+		assert.Equal(t, int64(0), messages[0].ID)
+		assert.Equal(t, int64(3), messages[1].ID)
+		assert.Equal(t, int64(4), messages[2].ID)
+	}
+
+	// Nothing was missed
+	client, err = StartConnectionAfter(broker, "4")
+	if assert.NoError(t, err) {
+		receive(t, client, 1)
+		assert.Len(t, client, 0)
+	}
+
+	// Event 1 is not in the log anymore, and the other ids are unknown
+	for _, id := range []string{"0", "5", "abc"} {
+		client, err = StartConnectionAfter(broker, id)
+		if assert.NoError(t, err) {
+			messages := receive(t, client, 2)
+			assert.Equal(t, "reset", messages[1].Event, id)
+			assert.Equal(t, int64(4), messages[1].ID, id)
+		}
+	}
+}
+
+func TestWriteMessages(t *testing.T) {
+	ch := make(chan Message, 2)
+	ch <- Message{Event: "started", Object: welcomeMessage{Version: "1.0.0"}}
+	ch <- Message{ID: 12, Event: "new item", Object: map[string]int{"a": 1}}
+	close(ch)
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, WriteMessages(w, ch))
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "event: started\r\ndata: {\"version\":\"1.0.0\"}\r\n\r\nevent: new item\r\nid: 12\r\ndata: {\"a\":1}\r\n\r\n", w.Body.String())
+
+	// Reader reads the messages back
+	read := make(MessageChan, 2)
+	assert.NoError(t, Reader(ioutil.NopCloser(w.Body), read))
+	if assert.Len(t, read, 2) {
+		<-read
+		msg := <-read
+		assert.Equal(t, int64(12), msg.ID)
+		assert.Equal(t, "new item", msg.Event)
+		assert.Equal(t, `{"a":1}`, msg.Data)
+	}
+}
+
+// send sends msg and fails when that blocks
+func send(t *testing.T, broker *Broker, msg Message) {
+	done := make(chan struct{})
+	go func() {
+		broker.Send(msg)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Send blocks")
+	}
+}
+
+// drain returns the messages in client until it's closed or empty
+func drain(client MessageChan) (messages []Message, closed bool) {
+	for {
+		select {
+		case msg, ok := <-client:
+			if !ok {
+				return messages, true
+			}
+			messages = append(messages, msg)
+		case <-time.After(100 * time.Millisecond):
+			return messages, false
+		}
+	}
+}
+
+func TestBroker_SlowClient(t *testing.T) {
+	tests := []struct {
+		policy    Policy
+		received  []int
+		isEvicted bool
+	}{
+		{Evict, []int{0, 1, 2}, true},
+		{DropNewest, []int{0, 1, 2}, false},
+		{DropOldest, []int{6, 7, 8, 9}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			broker := NewBrokerWithOptions(Options{QueueSize: 3, Policy: test.policy})
+			defer broker.Close(Message{Event: "shutdown"})
+
+			// The slow client doesn't read, the started event and 3 events fit in its queue
+			slow, err := StartConnection(broker)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			fast, err := StartConnection(broker)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, "started", receive(t, fast, 1)[0].Event)
+
+			// Send doesn't block, and the fast client receives everything
+			for i := 0; i < 10; i++ {
+				send(t, broker, Message{Event: "new item", Object: i})
+				assert.Equal(t, i, receive(t, fast, 1)[0].Object)
+			}
+
+			messages, closed := drain(slow)
+			assert.Equal(t, test.isEvicted, closed)
+			var objects []int
+			for _, msg := range messages {
+				if msg.Event == "new item" {
+					objects = append(objects, msg.Object.(int))
+				}
+			}
+			assert.Equal(t, test.received, objects)
+		})
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Evict, DropNewest, DropOldest} {
+		parsed, err := ParsePolicy(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParsePolicy("block")
+	assert.Error(t, err)
+}
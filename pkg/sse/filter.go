@@ -0,0 +1,43 @@
+package sse
+
+// Filter selects the events that a client receives. Empty lists select all
+// channels and events.
+type Filter struct {
+	// Channels are the uids of the channels. Events that are not about a
+	// channel, like "ping", are always sent.
+	Channels []string
+	// Events are the names of the events, e.g. "new item in channel"
+	Events []string
+	// IDsOnly sends the short form of the events that have one, e.g. new
+	// items without their content
+	IDsOnly bool
+}
+
+// Match returns true when the client wants msg
+func (f Filter) Match(msg Message) bool {
+	if len(f.Events) > 0 && !contains(f.Events, msg.Event) {
+		return false
+	}
+	if len(f.Channels) > 0 && msg.Channel != "" && !contains(f.Channels, msg.Channel) {
+		return false
+	}
+	return true
+}
+
+// apply returns msg in the form the client wants it
+func (f Filter) apply(msg Message) Message {
+	if f.IDsOnly && msg.Short != nil {
+		msg.Object = msg.Short
+	}
+	msg.Short = nil
+	return msg
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
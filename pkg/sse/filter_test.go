@@ -0,0 +1,70 @@
+package sse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter_Match(t *testing.T) {
+	ping := Message{Event: "ping"}
+	home := Message{Event: "new item", Channel: "home"}
+	unread := Message{Event: "new item in channel", Channel: "notifications"}
+
+	all := Filter{}
+	assert.True(t, all.Match(ping))
+	assert.True(t, all.Match(home))
+	assert.True(t, all.Match(unread))
+
+	channels := Filter{Channels: []string{"home"}}
+	assert.True(t, channels.Match(ping), "events without a channel are sent")
+	assert.True(t, channels.Match(home))
+	assert.False(t, channels.Match(unread))
+
+	events := Filter{Events: []string{"new item in channel"}}
+	assert.False(t, events.Match(ping))
+	assert.False(t, events.Match(home))
+	assert.True(t, events.Match(unread))
+}
+
+func TestFilter_Apply(t *testing.T) {
+	msg := Message{Event: "new item", Object: "full", Short: "id"}
+	assert.Equal(t, Message{Event: "new item", Object: "full"}, Filter{}.apply(msg))
+	assert.Equal(t, Message{Event: "new item", Object: "id"}, Filter{IDsOnly: true}.apply(msg))
+
+	msg = Message{Event: "new item in channel", Object: "count"}
+	assert.Equal(t, msg, Filter{IDsOnly: true}.apply(msg))
+}
+
+func TestBroker_Filter(t *testing.T) {
+	broker := NewBroker()
+	defer broker.Close(Message{Event: "shutdown"})
+
+	client, err := StartFilteredConnection(broker, "", Filter{
+		Channels: []string{"home"},
+		Events:   []string{"new item"},
+		IDsOnly:  true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "started", receive(t, client, 1)[0].Event)
+
+	broker.Send(Message{Event: "new item", Channel: "notifications", Object: "full 1", Short: "id 1"})
+	broker.Send(Message{Event: "new item in channel", Channel: "home", Object: "count"})
+	broker.Send(Message{Event: "new item", Channel: "home", Object: "full 3", Short: "id 3"})
+
+	msg := receive(t, client, 1)[0]
+	assert.Equal(t, int64(3), msg.ID)
+	assert.Equal(t, "id 3", msg.Object)
+	assert.Nil(t, msg.Short)
+
+	// Replayed events are filtered too
+	client, err = StartFilteredConnection(broker, "0", Filter{Events: []string{"new item in channel"}})
+	if assert.NoError(t, err) {
+		messages := receive(t, client, 2)
+		assert.Equal(t, "started", messages[0].Event)
+		assert.Equal(t, int64(2), messages[1].ID)
+		assert.Len(t, client, 0)
+	}
+}
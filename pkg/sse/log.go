@@ -0,0 +1,82 @@
+package sse
+
+import (
+	"sync"
+)
+
+// DefaultLogSize is the number of events a broker keeps for clients that reconnect
+const DefaultLogSize = 1000
+
+// EventLog keeps the last events of a broker, so they can be sent again to
+// clients that reconnect. The ids of the events increase by one for every event.
+type EventLog interface {
+	// Append gives msg the next id and adds it to the log
+	Append(msg Message) (Message, error)
+
+	// LastID returns the id of the last event, or 0 when there are no events
+	LastID() (int64, error)
+
+	// After returns the events after id. It returns false when some of these
+	// events are not in the log anymore, or when id is not known.
+	After(id int64) ([]Message, bool, error)
+}
+
+// MemoryLog is an EventLog in memory, the ids start at 1 again when the
+// process restarts.
+type MemoryLog struct {
+	lock   sync.Mutex
+	size   int
+	lastID int64
+	events []Message
+}
+
+// NewMemoryLog returns a MemoryLog that keeps the last size events
+func NewMemoryLog(size int) *MemoryLog {
+	return &MemoryLog{size: size}
+}
+
+// Append gives msg the next id and adds it to the log
+func (l *MemoryLog) Append(msg Message) (Message, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lastID++
+	msg.ID = l.lastID
+	l.events = append(l.events, msg)
+	if len(l.events) > l.size {
+		l.events = append([]Message(nil), l.events[len(l.events)-l.size:]...)
+	}
+	return msg, nil
+}
+
+// LastID returns the id of the last event
+func (l *MemoryLog) LastID() (int64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lastID, nil
+}
+
+// After returns the events after id
+func (l *MemoryLog) After(id int64) ([]Message, bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var after []Message
+	for _, msg := range l.events {
+		if msg.ID > id {
+			after = append(after, msg)
+		}
+	}
+	return after, CanReplay(id, l.lastID, after), nil
+}
+
+// CanReplay returns true when events are all events after id, up to lastID
+func CanReplay(id, lastID int64, events []Message) bool {
+	if id > lastID {
+		return false
+	}
+	if id == lastID {
+		return true
+	}
+	return len(events) > 0 && events[0].ID == id+1
+}
@@ -0,0 +1,37 @@
+package sse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLog(t *testing.T) {
+	l := NewMemoryLog(2)
+
+	id, _ := l.LastID()
+	assert.Equal(t, int64(0), id)
+	events, ok, _ := l.After(0)
+	assert.True(t, ok)
+	assert.Empty(t, events)
+
+	for i := 0; i < 3; i++ {
+		msg, err := l.Append(Message{Event: "new item"})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i+1), msg.ID)
+	}
+
+	events, ok, _ = l.After(1)
+	assert.True(t, ok)
+	assert.Len(t, events, 2)
+
+	events, ok, _ = l.After(3)
+	assert.True(t, ok)
+	assert.Empty(t, events)
+
+	_, ok, _ = l.After(0)
+	assert.False(t, ok, "event 1 is not in the log")
+
+	_, ok, _ = l.After(4)
+	assert.False(t, ok, "event 4 does not exist")
+}
@@ -25,3 +25,15 @@ func (timeline *nullTimeline) Count() (int, error) {
 func (timeline *nullTimeline) MarkRead(uids []string) error {
 	return nil
 }
+
+func (timeline *nullTimeline) MarkUnread(uids []string) error {
+	return nil
+}
+
+func (timeline *nullTimeline) RemoveItem(uid string) error {
+	return nil
+}
+
+func (timeline *nullTimeline) HasItem(uid string) (bool, error) {
+	return false, nil
+}
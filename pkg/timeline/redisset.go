@@ -11,6 +11,7 @@ import (
 )
 
 type redisSortedSetTimeline struct {
+	prefix  string
 	channel string
 	pool    *redis.Pool
 }
@@ -30,7 +31,7 @@ func (timeline *redisSortedSetTimeline) Items(before, after string) (microsub.Ti
 
 	channel := timeline.channel
 
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	zchannelKey := fmt.Sprintf("%szchannel:%s:posts", timeline.prefix, channel)
 
 	afterScore := "-inf"
 	if len(after) != 0 {
@@ -51,7 +52,7 @@ func (timeline *redisSortedSetTimeline) Items(before, after string) (microsub.Ti
 			beforeScore,
 			"LIMIT",
 			0,
-			20,
+			currentOptions().PageSize,
 			"WITHSCORES",
 		),
 	)
@@ -108,7 +109,7 @@ func (timeline *redisSortedSetTimeline) AddItem(item microsub.Item) (bool, error
 	defer conn.Close()
 
 	channel := timeline.channel
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	zchannelKey := fmt.Sprintf("%szchannel:%s:posts", timeline.prefix, channel)
 
 	if item.Published == "" {
 		item.Published = time.Now().Format(time.RFC3339)
@@ -126,13 +127,13 @@ func (timeline *redisSortedSetTimeline) AddItem(item microsub.Item) (bool, error
 		Data:      data,
 	}
 
-	itemKey := fmt.Sprintf("item:%s", item.ID)
+	itemKey := fmt.Sprintf("%sitem:%s", timeline.prefix, item.ID)
 	_, err = redis.String(conn.Do("HMSET", redis.Args{}.Add(itemKey).AddFlat(&forRedis)...))
 	if err != nil {
 		return false, fmt.Errorf("writing failed for item to redis: %v", err)
 	}
 
-	readChannelKey := fmt.Sprintf("channel:%s:read", channel)
+	readChannelKey := fmt.Sprintf("%schannel:%s:read", timeline.prefix, channel)
 	isRead, err := redis.Bool(conn.Do("SISMEMBER", readChannelKey, itemKey))
 	if err != nil {
 		return false, err
@@ -160,7 +161,7 @@ func (timeline *redisSortedSetTimeline) Count() (int, error) {
 	defer conn.Close()
 
 	channel := timeline.channel
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	zchannelKey := fmt.Sprintf("%szchannel:%s:posts", timeline.prefix, channel)
 	unread, err := redis.Int(conn.Do("ZCARD", zchannelKey))
 	if err != nil {
 		return -1, fmt.Errorf("while updating channel unread count for %s: %s", channel, err)
@@ -176,17 +177,17 @@ func (timeline *redisSortedSetTimeline) MarkRead(uids []string) error {
 
 	itemUIDs := []string{}
 	for _, uid := range uids {
-		itemUIDs = append(itemUIDs, "item:"+uid)
+		itemUIDs = append(itemUIDs, timeline.prefix+"item:"+uid)
 	}
 
-	channelKey := fmt.Sprintf("channel:%s:read", channel)
+	channelKey := fmt.Sprintf("%schannel:%s:read", timeline.prefix, channel)
 	args := redis.Args{}.Add(channelKey).AddFlat(itemUIDs)
 
 	if _, err := conn.Do("SADD", args...); err != nil {
 		return fmt.Errorf("marking read for channel %s has failed: %s", channel, err)
 	}
 
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	zchannelKey := fmt.Sprintf("%szchannel:%s:posts", timeline.prefix, channel)
 	args = redis.Args{}.Add(zchannelKey).AddFlat(itemUIDs)
 
 	if _, err := conn.Do("ZREM", args...); err != nil {
@@ -196,6 +197,89 @@ func (timeline *redisSortedSetTimeline) MarkRead(uids []string) error {
 	return nil
 }
 
+// MarkUnread adds the items back to the timeline, in the order of their publish date.
+// Only items that were read in this channel are added, other items are skipped.
 func (timeline *redisSortedSetTimeline) MarkUnread(uids []string) error {
-	panic("implement me")
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	channel := timeline.channel
+	readChannelKey := fmt.Sprintf("%schannel:%s:read", timeline.prefix, channel)
+	zchannelKey := fmt.Sprintf("%szchannel:%s:posts", timeline.prefix, channel)
+
+	for _, uid := range uids {
+		itemKey := timeline.prefix + "item:" + uid
+
+		isRead, err := redis.Bool(conn.Do("SISMEMBER", readChannelKey, itemKey))
+		if err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+		if !isRead {
+			// The item is unread already, or it's not in this channel
+			continue
+		}
+
+		published, err := redis.String(conn.Do("HGET", itemKey, "Published"))
+		if err == redis.ErrNil {
+			// The item is not in Redis anymore
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+		score, err := time.Parse(time.RFC3339, published)
+		if err != nil {
+			return fmt.Errorf("can't parse %s as time", published)
+		}
+
+		if _, err := conn.Do("SREM", readChannelKey, itemKey); err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+		if _, err := conn.Do("ZADD", zchannelKey, score.Unix(), itemKey); err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+	}
+
+	return nil
+}
+
+func (timeline *redisSortedSetTimeline) RemoveItem(uid string) error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	channel := timeline.channel
+	itemKey := timeline.prefix + "item:" + uid
+
+	zchannelKey := fmt.Sprintf("%szchannel:%s:posts", timeline.prefix, channel)
+	if _, err := conn.Do("ZREM", zchannelKey, itemKey); err != nil {
+		return fmt.Errorf("removing item %s from channel %s has failed: %s", uid, channel, err)
+	}
+
+	readChannelKey := fmt.Sprintf("%schannel:%s:read", timeline.prefix, channel)
+	if _, err := conn.Do("SREM", readChannelKey, itemKey); err != nil {
+		return fmt.Errorf("removing item %s from channel %s has failed: %s", uid, channel, err)
+	}
+
+	return nil
+}
+
+// HasItem checks if the item is in the unread items or the read items of the channel
+func (timeline *redisSortedSetTimeline) HasItem(uid string) (bool, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	channel := timeline.channel
+	itemKey := timeline.prefix + "item:" + uid
+
+	zchannelKey := fmt.Sprintf("%szchannel:%s:posts", timeline.prefix, channel)
+	_, err := redis.Float64(conn.Do("ZSCORE", zchannelKey, itemKey))
+	if err == nil {
+		return true, nil
+	}
+	if err != redis.ErrNil {
+		return false, err
+	}
+
+	readChannelKey := fmt.Sprintf("%schannel:%s:read", timeline.prefix, channel)
+	return redis.Bool(conn.Do("SISMEMBER", readChannelKey, itemKey))
 }
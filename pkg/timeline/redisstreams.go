@@ -11,6 +11,7 @@ import (
 )
 
 type redisStreamTimeline struct {
+	prefix              string
 	channel, channelKey string
 
 	pool *redis.Pool
@@ -20,7 +21,7 @@ type redisStreamTimeline struct {
  * REDIS STREAMS TIMELINE
  */
 func (timeline *redisStreamTimeline) Init() error {
-	timeline.channelKey = fmt.Sprintf("stream:%s", timeline.channel)
+	timeline.channelKey = fmt.Sprintf("%sstream:%s", timeline.prefix, timeline.channel)
 	return nil
 }
 
@@ -36,7 +37,7 @@ func (timeline *redisStreamTimeline) Items(before, after string) (microsub.Timel
 		after = "+"
 	}
 
-	results, err := redis.Values(conn.Do("XREVRANGE", redis.Args{}.Add(timeline.channelKey, after, before, "COUNT", "20")...))
+	results, err := redis.Values(conn.Do("XREVRANGE", redis.Args{}.Add(timeline.channelKey, after, before, "COUNT", currentOptions().PageSize)...))
 	if err != nil {
 		return microsub.Timeline{}, err
 	}
@@ -62,6 +63,10 @@ func (timeline *redisStreamTimeline) Items(before, after string) (microsub.Timel
 		}
 	}
 
+	if len(items) == 0 {
+		return microsub.Timeline{Items: []microsub.Item{}}, nil
+	}
+
 	return microsub.Timeline{
 		Items: items,
 		Paging: microsub.Pagination{
@@ -88,7 +93,7 @@ func (timeline *redisStreamTimeline) AddItem(item microsub.Item) (bool, error) {
 
 	_, err = redis.String(conn.Do("XADD", args...))
 
-	_, _ = conn.Do("XTRIM", timeline.channelKey, "MAXLEN", "~", "250")
+	_, _ = conn.Do("XTRIM", timeline.channelKey, "MAXLEN", "~", currentOptions().StreamMaxLength)
 
 	return err == nil, err
 }
@@ -105,7 +110,69 @@ func (timeline *redisStreamTimeline) MarkRead(uids []string) error {
 	return nil
 }
 
+// MarkUnread is not supported, the entries of a stream can't be changed
 func (timeline *redisStreamTimeline) MarkUnread(uids []string) error {
-	// panic("implement me")
-	return nil
+	return ErrNotSupported
+}
+
+// RemoveItem removes the entries with uid as stream id or item id
+func (timeline *redisStreamTimeline) RemoveItem(uid string) error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	ids, err := timeline.findEntries(conn, uid)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err = conn.Do("XDEL", redis.Args{}.Add(timeline.channelKey).AddFlat(ids)...)
+	return err
+}
+
+// HasItem checks if the item wasn't trimmed from the stream yet
+func (timeline *redisStreamTimeline) HasItem(uid string) (bool, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	ids, err := timeline.findEntries(conn, uid)
+	return len(ids) > 0, err
+}
+
+// findEntries returns the stream ids of the entries with uid as stream id or
+// item id. Streams are trimmed to a few hundred entries, so scanning the
+// stream is cheap enough.
+func (timeline *redisStreamTimeline) findEntries(conn redis.Conn, uid string) ([]string, error) {
+	results, err := redis.Values(conn.Do("XRANGE", timeline.channelKey, "-", "+"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+
+	for _, result := range results {
+		value, ok := result.([]interface{})
+		if !ok || len(value) != 2 {
+			continue
+		}
+		id, err := redis.String(value[0], nil)
+		if err != nil {
+			continue
+		}
+		if id == uid {
+			ids = append(ids, id)
+			continue
+		}
+		var forRedis redisItem
+		if fields, ok := value[1].([]interface{}); ok {
+			if err = redis.ScanStruct(fields, &forRedis); err == nil && forRedis.ID == uid {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, nil
 }
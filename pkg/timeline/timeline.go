@@ -7,6 +7,8 @@ package timeline
 
 import (
 	"encoding/json"
+	"errors"
+	"sync/atomic"
 
 	"p83.nl/go/ekster/pkg/microsub"
 
@@ -21,16 +23,56 @@ type Backend interface {
 
 	AddItem(item microsub.Item) (bool, error)
 	MarkRead(uids []string) error
+	MarkUnread(uids []string) error
 
-	// Not used at the moment
-	// MarkUnread(uids []string) error
+	// RemoveItem removes the item with the id from the timeline
+	RemoveItem(uid string) error
+	// HasItem returns true when the item with the id is still in the
+	// timeline, read or unread
+	HasItem(uid string) (bool, error)
+}
+
+// ErrNotSupported is returned by a timeline that doesn't support an operation
+var ErrNotSupported = errors.New("not supported by this type of timeline")
+
+// Options contains the options that are used by all timelines
+type Options struct {
+	// PageSize is the number of items returned by Items
+	PageSize int
+	// StreamMaxLength is the number of items that are kept in a "stream" timeline
+	StreamMaxLength int
+}
+
+// DefaultOptions are the options that are used when SetOptions isn't called
+var DefaultOptions = Options{PageSize: 20, StreamMaxLength: 250}
+
+var options atomic.Value
+
+// SetOptions changes the options of all timelines. It's safe to call while
+// the timelines are used.
+func SetOptions(o Options) {
+	options.Store(o)
+}
+
+func currentOptions() Options {
+	if o, ok := options.Load().(Options); ok {
+		return o
+	}
+	return DefaultOptions
 }
 
 // Create creates a channel of the specfied type. Return nil when the type
 // is not known.
 func Create(channel, timelineType string, pool *redis.Pool) Backend {
+	return CreateWithPrefix("", channel, timelineType, pool)
+}
+
+// CreateWithPrefix creates a channel of the specified type, of which all
+// Redis keys start with prefix. It's used to keep the timelines of different
+// users apart.
+func CreateWithPrefix(prefix, channel, timelineType string, pool *redis.Pool) Backend {
 	if timelineType == "sorted-set" {
-		timeline := &redisSortedSetTimeline{channel: channel, pool: pool}
+		timeline := &redisSortedSetTimeline{prefix: prefix, channel: channel, pool: pool}
 		err := timeline.Init()
 		if err != nil {
 			return nil
@@ -39,7 +81,7 @@ func Create(channel, timelineType string, pool *redis.Pool) Backend {
 	}
 
 	if timelineType == "stream" {
-		timeline := &redisStreamTimeline{channel: channel, pool: pool}
+		timeline := &redisStreamTimeline{prefix: prefix, channel: channel, pool: pool}
 		err := timeline.Init()
 		if err != nil {
 			return nil
@@ -0,0 +1,160 @@
+// Package webpush sends Web Push messages. The payload is encrypted for the
+// browser (RFC 8291) and the request is signed with a VAPID key (RFC 8292).
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"p83.nl/go/ekster/pkg/netguard"
+)
+
+// recordSize is the record size of the aes128gcm content coding. The
+// payload is sent in one record.
+const recordSize = 4096
+
+// MaxPayloadSize is the largest payload that can be sent. Push services
+// accept 4096 bytes, that includes the header of 86 bytes, the padding
+// delimiter and the 16 bytes of the authentication tag.
+const MaxPayloadSize = 4096 - 86 - 1 - 16
+
+// Keys are the keys of a subscription, base64url encoded
+type Keys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// Subscription is a push subscription of a browser, as returned by
+// PushSubscription.toJSON()
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     Keys   `json:"keys"`
+}
+
+// Validate checks the endpoint and the keys of the subscription. An endpoint
+// with an address that is not public is rejected, names are not resolved.
+func (sub Subscription) Validate() error {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("endpoint %q should be a https url", sub.Endpoint)
+	}
+	if !netguard.IsPublicHost(u.Hostname()) {
+		return fmt.Errorf("endpoint %q is not a public address", sub.Endpoint)
+	}
+	uaPublic, err := decodeBase64(sub.Keys.P256dh)
+	if err != nil {
+		return fmt.Errorf("invalid p256dh key: %v", err)
+	}
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), uaPublic); x == nil {
+		return fmt.Errorf("p256dh is not a P-256 public key")
+	}
+	authSecret, err := decodeBase64(sub.Keys.Auth)
+	if err != nil {
+		return fmt.Errorf("invalid auth secret: %v", err)
+	}
+	if len(authSecret) != 16 {
+		return fmt.Errorf("auth secret should be 16 bytes, not %d", len(authSecret))
+	}
+	return nil
+}
+
+// decodeBase64 decodes base64url, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// Encrypt encrypts payload for the browser of sub, with the aes128gcm content
+// coding
+func Encrypt(sub Subscription, payload []byte) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return encrypt(sub, payload, key, salt)
+}
+
+// encrypt encrypts payload with the key of the application server and salt,
+// as described in RFC 8291
+func encrypt(sub Subscription, payload []byte, asKey *ecdsa.PrivateKey, salt []byte) ([]byte, error) {
+	if len(payload) > MaxPayloadSize {
+		return nil, fmt.Errorf("payload of %d bytes is larger than %d bytes", len(payload), MaxPayloadSize)
+	}
+
+	uaPublic, err := decodeBase64(sub.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %v", err)
+	}
+	authSecret, err := decodeBase64(sub.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth secret: %v", err)
+	}
+	if len(authSecret) != 16 {
+		return nil, fmt.Errorf("auth secret should be 16 bytes, not %d", len(authSecret))
+	}
+
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, uaPublic)
+	if x == nil {
+		return nil, fmt.Errorf("p256dh is not a P-256 public key")
+	}
+
+	sx, _ := curve.ScalarMult(x, y, asKey.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	b := sx.Bytes()
+	copy(ecdhSecret[32-len(b):], b)
+
+	asPublic := elliptic.Marshal(curve, asKey.X, asKey.Y)
+
+	// The key of the browser and the application server are mixed with the auth secret
+	prkKey := hmacSHA256(authSecret, ecdhSecret)
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hmacSHA256(prkKey, keyInfo, []byte{1})
+
+	prk := hmacSHA256(salt, ikm)
+	cek := hmacSHA256(prk, []byte("Content-Encoding: aes128gcm\x00"), []byte{1})[:16]
+	nonce := hmacSHA256(prk, []byte("Content-Encoding: nonce\x00"), []byte{1})[:12]
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The delimiter 2 marks the last record
+	plaintext := append(append([]byte(nil), payload...), 2)
+
+	var body bytes.Buffer
+	body.Write(salt)
+	_ = binary.Write(&body, binary.BigEndian, uint32(recordSize))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
@@ -0,0 +1,89 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrGone is returned by Send when the push service doesn't know the
+// subscription anymore. It should be removed.
+var ErrGone = errors.New("push subscription is gone")
+
+// Options contains the settings for a push message
+type Options struct {
+	// Key is the VAPID key of the application server
+	Key *ecdsa.PrivateKey
+	// Subject is a mailto: or https: url, which the push service can use to
+	// contact the operator of the application server
+	Subject string
+	// TTL is the time the push service keeps the message when the browser
+	// isn't connected
+	TTL time.Duration
+	// Urgency is very-low, low, normal or high
+	Urgency string
+	// Topic replaces an earlier message with the same topic that wasn't
+	// delivered yet
+	Topic string
+}
+
+// NewRequest returns the request that sends payload to sub
+func NewRequest(sub Subscription, payload []byte, opts Options) (*http.Request, error) {
+	body, err := Encrypt(sub, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := vapidAuthorization(sub.Endpoint, opts.Subject, opts.Key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(opts.TTL/time.Second)))
+	if opts.Urgency != "" {
+		req.Header.Set("Urgency", opts.Urgency)
+	}
+	if opts.Topic != "" {
+		req.Header.Set("Topic", opts.Topic)
+	}
+	return req, nil
+}
+
+// Send sends payload to sub, and returns the status of the push service. It
+// returns ErrGone when the subscription has expired or was removed.
+func Send(ctx context.Context, client *http.Client, sub Subscription, payload []byte, opts Options) (int, error) {
+	req, err := NewRequest(sub, payload, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return res.StatusCode, ErrGone
+	case res.StatusCode < 200 || res.StatusCode >= 300:
+		return res.StatusCode, fmt.Errorf("unexpected status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,89 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// GenerateKey creates a new VAPID key
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// EncodeKey returns the private key as base64url, like other Web Push
+// libraries
+func EncodeKey(key *ecdsa.PrivateKey) string {
+	d := make([]byte, 32)
+	b := key.D.Bytes()
+	copy(d[32-len(b):], b)
+	return base64.RawURLEncoding.EncodeToString(d)
+}
+
+// ParseKey parses a private key that was encoded with EncodeKey
+func ParseKey(s string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeBase64(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID key: %v", err)
+	}
+	if len(d) != 32 {
+		return nil, fmt.Errorf("VAPID key should be 32 bytes, not %d", len(d))
+	}
+
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	if key.D.Sign() == 0 || key.D.Cmp(curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("invalid VAPID key")
+	}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d)
+	return key, nil
+}
+
+// PublicKey returns the public key as base64url. Browsers need it as the
+// applicationServerKey when they subscribe.
+func PublicKey(key *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+}
+
+// vapidAuthorization returns the Authorization header for a request to
+// endpoint. The token is valid for 12 hours.
+func vapidAuthorization(endpoint, subject string, key *ecdsa.PrivateKey, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(token))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	// ES256 signatures are r and s, both 32 bytes
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	token += "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	return fmt.Sprintf("vapid t=%s, k=%s", token, PublicKey(key)), nil
+}
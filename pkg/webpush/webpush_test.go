@@ -0,0 +1,205 @@
+package webpush
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustDecode(s string) []byte {
+	b, err := decodeBase64(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// The example of RFC 8291, Appendix A
+func TestEncrypt_RFC8291(t *testing.T) {
+	asKey, err := ParseKey("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8", PublicKey(asKey))
+
+	sub := Subscription{
+		Endpoint: "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV",
+		Keys: Keys{
+			P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+			Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+		},
+	}
+
+	body, err := encrypt(sub, []byte("When I grow up, I want to be a watermelon"), asKey, mustDecode("DGv6ra1nlYgDCS1FRnbzlw"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN",
+			base64.RawURLEncoding.EncodeToString(body))
+	}
+}
+
+// decrypt decrypts body like the browser with private key uaKey
+func decrypt(uaKey *ecdsa.PrivateKey, authSecret, body []byte) ([]byte, error) {
+	salt := body[:16]
+	idLen := int(body[20])
+	asPublic := body[21 : 21+idLen]
+	ciphertext := body[21+idLen:]
+
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, asPublic)
+	sx, _ := curve.ScalarMult(x, y, uaKey.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	b := sx.Bytes()
+	copy(ecdhSecret[32-len(b):], b)
+
+	uaPublic := elliptic.Marshal(curve, uaKey.X, uaKey.Y)
+	prkKey := hmacSHA256(authSecret, ecdhSecret)
+	ikm := hmacSHA256(prkKey, []byte("WebPush: info\x00"), uaPublic, asPublic, []byte{1})
+	prk := hmacSHA256(salt, ikm)
+	cek := hmacSHA256(prk, []byte("Content-Encoding: aes128gcm\x00"), []byte{1})[:16]
+	nonce := hmacSHA256(prk, []byte("Content-Encoding: nonce\x00"), []byte{1})[:12]
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	return plaintext[:len(plaintext)-1], nil
+}
+
+func TestSend(t *testing.T) {
+	uaKey, _ := GenerateKey()
+	authSecret := []byte("0123456789abcdef")
+	vapidKey, _ := GenerateKey()
+
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/full":
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	sub := Subscription{
+		Endpoint: server.URL + "/push/abc",
+		Keys: Keys{
+			P256dh: base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y)),
+			Auth:   base64.URLEncoding.EncodeToString(authSecret),
+		},
+	}
+	opts := Options{Key: vapidKey, Subject: "mailto:admin@example.com", TTL: time.Hour, Urgency: "low", Topic: "home"}
+
+	status, err := Send(context.Background(), server.Client(), sub, []byte(`{"title":"Hello"}`), opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 201, status)
+	assert.Equal(t, "aes128gcm", received.Header.Get("Content-Encoding"))
+	assert.Equal(t, "3600", received.Header.Get("TTL"))
+	assert.Equal(t, "low", received.Header.Get("Urgency"))
+	assert.Equal(t, "home", received.Header.Get("Topic"))
+	assert.Equal(t, uint32(recordSize), binary.BigEndian.Uint32(body[16:20]))
+
+	plaintext, err := decrypt(uaKey, authSecret, body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `{"title":"Hello"}`, string(plaintext))
+	}
+
+	// Check the VAPID token with the public key from the header
+	auth := received.Header.Get("Authorization")
+	if assert.True(t, strings.HasPrefix(auth, "vapid t=")) {
+		parts := strings.SplitN(strings.TrimPrefix(auth, "vapid t="), ", k=", 2)
+		assert.Equal(t, PublicKey(vapidKey), parts[1])
+
+		token := strings.Split(parts[0], ".")
+		var claims map[string]interface{}
+		assert.NoError(t, json.Unmarshal(mustDecode(token[1]), &claims))
+		assert.Equal(t, server.URL, claims["aud"])
+		assert.Equal(t, "mailto:admin@example.com", claims["sub"])
+
+		hash := sha256.Sum256([]byte(token[0] + "." + token[1]))
+		sig := mustDecode(token[2])
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		assert.True(t, ecdsa.Verify(&vapidKey.PublicKey, hash[:], r, s))
+	}
+
+	sub.Endpoint = server.URL + "/gone"
+	_, err = Send(context.Background(), server.Client(), sub, []byte("{}"), opts)
+	assert.Equal(t, ErrGone, err)
+
+	sub.Endpoint = server.URL + "/full"
+	status, err = Send(context.Background(), server.Client(), sub, []byte("{}"), opts)
+	assert.Error(t, err)
+	assert.Equal(t, 429, status)
+
+	_, err = Send(context.Background(), server.Client(), sub, make([]byte, MaxPayloadSize+1), opts)
+	assert.Error(t, err)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := GenerateKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+	parsed, err := ParseKey(EncodeKey(key))
+	if assert.NoError(t, err) {
+		assert.Equal(t, PublicKey(key), PublicKey(parsed))
+	}
+
+	_, err = ParseKey("abc")
+	assert.Error(t, err)
+	_, err = ParseKey(base64.RawURLEncoding.EncodeToString(make([]byte, 32)))
+	assert.Error(t, err)
+}
+
+func TestSubscription_Validate(t *testing.T) {
+	sub := Subscription{
+		Endpoint: "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV",
+		Keys: Keys{
+			P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+			Auth:   "BTBZMqHH6r4Tts7J_aSIgg==",
+		},
+	}
+	assert.NoError(t, sub.Validate())
+
+	invalid := sub
+	invalid.Endpoint = "http://push.example.net/push"
+	assert.Error(t, invalid.Validate())
+
+	for _, endpoint := range []string{"https://localhost/push", "https://127.0.0.1:8443/push", "https://192.168.1.1/push", "https://[fe80::1]/push"} {
+		invalid = sub
+		invalid.Endpoint = endpoint
+		assert.Error(t, invalid.Validate(), endpoint)
+	}
+
+	invalid = sub
+	invalid.Keys.P256dh = "BTBZMqHH6r4Tts7J_aSIgg"
+	assert.Error(t, invalid.Validate())
+
+	invalid = sub
+	invalid.Keys.Auth = "BTBZ"
+	assert.Error(t, invalid.Validate())
+}
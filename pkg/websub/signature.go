@@ -10,6 +10,14 @@ import (
 	"github.com/pkg/errors"
 )
 
+// HubSignature returns the sha1 signature of content, in the format of the
+// X-Hub-Signature header
+func HubSignature(content, secret []byte) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(content)
+	return fmt.Sprintf("sha1=%x", mac.Sum(nil))
+}
+
 // ValidateHubSignature validate a sha1 signature that could be send with the
 // hub as an extra header
 func ValidateHubSignature(sig string, feedContent, secret []byte) error {
@@ -20,3 +20,12 @@ func TestValidateHubSignature(t *testing.T) {
 	err := ValidateHubSignature(fmt.Sprintf("sha1=%x", signature), feedContent, secret)
 	assert.NoError(t, err, "error should be nil")
 }
+
+func TestHubSignature(t *testing.T) {
+	secret := []byte("this is a test secret")
+	content := []byte("hello world")
+
+	sig := HubSignature(content, secret)
+	assert.NoError(t, ValidateHubSignature(sig, content, secret))
+	assert.Error(t, ValidateHubSignature(sig, []byte("hello there"), secret))
+}
@@ -0,0 +1,24 @@
+// Service worker that shows the Web Push notifications of eksterd
+
+self.addEventListener('push', function (event) {
+    var msg = {};
+    if (event.data) {
+        try {
+            msg = event.data.json();
+        } catch (e) {
+            msg = {title: event.data.text()};
+        }
+    }
+
+    event.waitUntil(self.registration.showNotification(msg.title || 'Ekster', {
+        body: msg.body || '',
+        // A new notification for a channel replaces the last one
+        tag: msg.channel || 'ekster',
+        data: {url: msg.url || '/'}
+    }));
+});
+
+self.addEventListener('notificationclick', function (event) {
+    event.notification.close();
+    event.waitUntil(self.clients.openWindow(event.notification.data.url));
+});
@@ -0,0 +1,10 @@
+// Package templates contains the default templates and static files of the
+// eksterd frontend, they are compiled into the binary.
+package templates
+
+import "embed"
+
+// FS contains the templates, push-sw.js and the files in static/
+//
+//go:embed *.html *.js static
+var FS embed.FS